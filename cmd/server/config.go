@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/api"
+	"github.com/rakib/proxmox-auto-restart/internal/config"
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/notify"
+	"github.com/rakib/proxmox-auto-restart/internal/scheduler"
+)
+
+// loadConfig reads the file named by CONFIG_FILE, if any, with environment
+// overrides applied
+func loadConfig() (*config.Config, error) {
+	return config.Load(os.Getenv("CONFIG_FILE"))
+}
+
+// applyConfig hands the settings that can change at runtime to the packages
+// that use them
+func (srv *server) applyConfig(cfg *config.Config) {
+	db.SetDefaultRestartInterval(cfg.Scheduler.DefaultIntervalHours)
+	notify.SetWebhookURL(cfg.Notifications.WebhookURL)
+
+	s := cfg.Scheduler
+	scheduler.SetVerifyConfig(scheduler.VerifyConfig{
+		Timeout: time.Duration(s.Verify.Timeout),
+		Probe:   s.Verify.Probe,
+	})
+	srv.sched.SetQueueConfig(scheduler.QueueConfig{
+		MaxConcurrent: s.Queue.MaxConcurrent,
+		MaxPerNode:    s.Queue.MaxPerNode,
+		Stagger:       time.Duration(s.Queue.Stagger),
+		Jitter:        time.Duration(s.Queue.Jitter),
+	})
+	scheduler.SetCrashLoopConfig(scheduler.CrashLoopConfig{
+		MaxFailures: s.CrashLoop.MaxFailures,
+		Window:      time.Duration(s.CrashLoop.Window),
+		Backoff:     time.Duration(s.CrashLoop.Backoff),
+		MaxBackoff:  time.Duration(s.CrashLoop.MaxBackoff),
+	})
+
+	scheduler.SetRetentionConfig(retentionConfig(cfg))
+	scheduler.SetBackupConfig(scheduler.BackupConfig{Dir: cfg.Backup.Dir, Keep: cfg.Backup.Keep})
+	api.SetTerminalConfig(api.TerminalConfig{
+		TicketTTL:      time.Duration(cfg.Terminal.TicketTTL),
+		IdleTimeout:    time.Duration(cfg.Terminal.IdleTimeout),
+		AllowedOrigins: cfg.Terminal.AllowedOrigins,
+		RecordingDir:   cfg.Terminal.RecordingDir,
+	})
+}
+
+func retentionConfig(cfg *config.Config) scheduler.RetentionConfig {
+	r := scheduler.RetentionConfig{
+		MaxAge:     time.Duration(cfg.Retention.MaxAge),
+		MaxPerVMID: cfg.Retention.MaxPerVMID,
+		ArchiveDir: cfg.Retention.ArchiveDir,
+	}
+	if len(cfg.Retention.StatusMaxAge) > 0 {
+		r.StatusMaxAge = make(map[string]time.Duration)
+		for status, age := range cfg.Retention.StatusMaxAge {
+			r.StatusMaxAge[status] = time.Duration(age)
+		}
+	}
+	return r
+}
+
+// Background jobs, each started and stopped on its own so a reload only
+// touches the ones whose schedule changed
+
+func (srv *server) startRestartScheduler(cfg *config.Config) error {
+	if !cfg.Scheduler.Enabled {
+		return nil
+	}
+	interval := fmt.Sprintf("@every %s", time.Duration(cfg.Scheduler.CheckInterval))
+	if err := srv.sched.StartRestartScheduler(interval); err != nil {
+		return fmt.Errorf("failed to start restart scheduler: %w", err)
+	}
+	return nil
+}
+
+func (srv *server) startWatchdog(cfg *config.Config) error {
+	if !cfg.Scheduler.Enabled {
+		return nil
+	}
+	if err := srv.sched.StartWatchdog(time.Duration(cfg.Scheduler.WatchdogInterval)); err != nil {
+		return fmt.Errorf("failed to start watchdog: %w", err)
+	}
+	return nil
+}
+
+func (srv *server) startLogPruner(cfg *config.Config) error {
+	// The pruner only runs when a retention rule is set
+	if !cfg.Scheduler.Enabled || !retentionConfig(cfg).Enabled() {
+		return nil
+	}
+	if err := srv.sched.StartLogPruner(time.Duration(cfg.Retention.PruneInterval)); err != nil {
+		return fmt.Errorf("failed to start log pruner: %w", err)
+	}
+	return nil
+}
+
+func (srv *server) startBackups(cfg *config.Config, dialect db.Dialect) error {
+	// PostgreSQL databases are backed up with their own tooling
+	if cfg.Backup.Interval <= 0 || dialect != db.SQLite {
+		return nil
+	}
+	if err := srv.sched.StartBackups(time.Duration(cfg.Backup.Interval)); err != nil {
+		return fmt.Errorf("failed to start database backups: %w", err)
+	}
+	return nil
+}
+
+// startJobs starts the background jobs cfg enables
+func (srv *server) startJobs(cfg *config.Config, dialect db.Dialect) error {
+	if !cfg.Scheduler.Enabled {
+		log.Println("Scheduler and watchdog disabled (scheduler.enabled is false)")
+	}
+	for _, start := range []func() error{
+		func() error { return srv.startRestartScheduler(cfg) },
+		func() error { return srv.startWatchdog(cfg) },
+		func() error { return srv.startLogPruner(cfg) },
+		func() error { return srv.startBackups(cfg, dialect) },
+	} {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopJobs stops every background job. Restarts already queued or running
+// are left to finish.
+func (srv *server) stopJobs() {
+	srv.sched.StopRestartScheduler()
+	srv.sched.StopWatchdog()
+	srv.sched.StopLogPruner()
+	srv.sched.StopBackups()
+}
+
+// reloadConfig loads the configuration again and applies it. An invalid
+// configuration is logged and the current one kept. Settings that need a
+// restart keep their running values.
+func (srv *server) reloadConfig(current *config.Config, dialect db.Dialect) *config.Config {
+	next, err := loadConfig()
+	if err != nil {
+		log.Printf("ERROR: Failed to reload configuration, keeping the current one: %v", err)
+		return current
+	}
+
+	for _, section := range current.RestartRequired(next) {
+		log.Printf("WARNING: %s changed; restart the service to apply it", section)
+	}
+	next.Server = current.Server
+	next.Database = current.Database
+	next.Backend = current.Backend
+	next.Scheduler.Enabled = current.Scheduler.Enabled
+
+	srv.applyConfig(next)
+
+	if next.Scheduler.CheckInterval != current.Scheduler.CheckInterval {
+		srv.sched.StopRestartScheduler()
+		logJobError(srv.startRestartScheduler(next))
+	}
+	if next.Scheduler.WatchdogInterval != current.Scheduler.WatchdogInterval {
+		srv.sched.StopWatchdog()
+		logJobError(srv.startWatchdog(next))
+	}
+	if next.Retention.PruneInterval != current.Retention.PruneInterval ||
+		retentionConfig(next).Enabled() != retentionConfig(current).Enabled() {
+		srv.sched.StopLogPruner()
+		logJobError(srv.startLogPruner(next))
+	}
+	if next.Backup.Interval != current.Backup.Interval {
+		srv.sched.StopBackups()
+		logJobError(srv.startBackups(next, dialect))
+	}
+
+	log.Println("Configuration reloaded")
+	return next
+}
+
+func logJobError(err error) {
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
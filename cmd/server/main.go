@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,68 +10,164 @@ import (
 	"syscall"
 
 	"github.com/rakib/proxmox-auto-restart/internal/api"
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
 	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
 	"github.com/rakib/proxmox-auto-restart/internal/scheduler"
 )
 
+// server wires the storage backend into the HTTP handlers and the scheduler
+type server struct {
+	store  db.Store
+	sched  *scheduler.Scheduler
+	router http.Handler
+}
+
+// newServer builds the scheduler and the API router on store. sso and
+// passwords are nil unless OIDC or LDAP sign-in is configured.
+func newServer(store db.Store, sso *auth.OIDCProvider, passwords auth.PasswordProvider) *server {
+	sched := scheduler.New(store)
+	h := api.NewHandler(store, sched)
+	if sso != nil {
+		h.SetOIDC(sso)
+	}
+	if passwords != nil {
+		h.SetPasswordProvider(passwords)
+	}
+	return &server{
+		store:  store,
+		sched:  sched,
+		router: api.SetupRoutes(h),
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "user":
+			os.Exit(runUser(os.Args[2:]))
+		}
+	}
+
 	log.Println("Starting Proxmox Auto-Restart Service...")
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Load the config file named by CONFIG_FILE, with env overrides
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		log.Printf("Using config file: %s", path)
 	}
 
 	// Initialize database
-	dbPath := db.GetDBPath()
-	log.Printf("Using database: %s", dbPath)
+	dsn := cfg.DSN()
+	log.Printf("Using database: %s", db.RedactDSN(dsn))
 
-	if err := db.InitDB(dbPath); err != nil {
+	conn, err := db.Open(dsn)
+	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer db.CloseDB()
 
-	// Get database handle
-	database := db.GetDB()
-
-	// Run migrations (only whitelist and restart_logs tables)
-	if err := db.RunMigrations(database); err != nil {
+	// Apply pending schema migrations
+	if err := db.RunMigrations(conn); err != nil {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
-	// Start auto-restart scheduler (NO sync scheduler - data fetched real-time)
-	log.Println("Starting auto-restart scheduler...")
-	if err := scheduler.StartRestartScheduler(""); err != nil {
-		log.Fatalf("Failed to start restart scheduler: %v", err)
+	// Instances sharing a PostgreSQL database would each restart every due
+	// guest, so only one of them may run the scheduler
+	if cfg.Scheduler.Enabled {
+		release, ok, err := conn.TryAdvisoryLock(db.SchedulerLockKey)
+		if err != nil {
+			log.Fatalf("Failed to lock the scheduler: %v", err)
+		}
+		if !ok {
+			log.Fatalf("Refusing to start: another instance runs the scheduler on this database; set scheduler.enabled to false here")
+		}
+		defer release()
+	}
+
+	// Discover the identity provider for single sign-on, if configured
+	var sso *auth.OIDCProvider
+	if cfg.OIDC.Enabled() {
+		if sso, err = auth.NewOIDCProvider(context.Background(), cfg.OIDC); err != nil {
+			log.Fatalf("Failed to configure OIDC sign-in: %v", err)
+		}
+		log.Printf("OIDC sign-in enabled with issuer %s", cfg.OIDC.Issuer)
+	}
+
+	// Check the passwords of directory users against LDAP, if configured
+	var passwords auth.PasswordProvider
+	if cfg.LDAP.Enabled() {
+		directory, err := auth.NewLDAPProvider(cfg.LDAP)
+		if err != nil {
+			log.Fatalf("Failed to configure LDAP sign-in: %v", err)
+		}
+		passwords = directory
+		log.Printf("LDAP sign-in enabled with %s", cfg.LDAP.URL)
+	}
+
+	srv := newServer(db.NewStore(conn), sso, passwords)
+	defer srv.store.Close()
+
+	// Create the first account on a fresh database
+	if err := auth.Bootstrap(srv.store, cfg.Auth.Username, cfg.Auth.Password); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+
+	// Select how we talk to Proxmox (local pvesh/pct or the HTTPS API)
+	backend, err := proxmox.NewBackend(proxmox.BackendConfig{
+		Type:        cfg.Backend.Type,
+		APIURL:      cfg.Backend.APIURL,
+		TokenID:     cfg.Backend.TokenID,
+		TokenSecret: cfg.Backend.TokenSecret,
+		Insecure:    cfg.Backend.Insecure,
+	})
+	if err != nil {
+		log.Fatalf("Failed to configure Proxmox backend: %v", err)
 	}
+	proxmox.SetBackend(backend)
+	log.Printf("Using Proxmox backend: %s", backend.Name())
 
-	// Setup HTTP server
-	router := api.SetupRoutes()
+	// Configure verification, the restart queue, crash-loop detection,
+	// alerts, log retention and backups
+	srv.applyConfig(cfg)
+
+	// Start the scheduler, watchdog, log pruner and backups
+	if err := srv.startJobs(cfg, conn.Dialect); err != nil {
+		log.Fatal(err)
+	}
 
 	// Start HTTP server
-	addr := fmt.Sprintf(":%s", port)
+	addr := fmt.Sprintf(":%d", cfg.Server.Port)
 	log.Printf("HTTP server starting on %s", addr)
 
 	// Setup graceful shutdown
 	go func() {
-		if err := http.ListenAndServe(addr, router); err != nil {
+		if err := http.ListenAndServe(addr, srv.router); err != nil {
 			log.Fatalf("Failed to start HTTP server: %v", err)
 		}
 	}()
 
 	log.Println("✓ Proxmox VM/Container Auto-Restart Service is running")
 	log.Println("✓ VM/Container data: fetched real-time from Proxmox")
-	log.Println("✓ Auto-restart: every 6 hours")
-	log.Printf("✓ API available at http://localhost:%s", port)
+	log.Printf("✓ Auto-restart: every %d hours by default", cfg.Scheduler.DefaultIntervalHours)
+	log.Printf("✓ API available at http://localhost:%d", cfg.Server.Port)
 
-	// Wait for interrupt signal
+	// Reload the configuration on SIGHUP until asked to stop
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigChan; sig == syscall.SIGHUP; sig = <-sigChan {
+		log.Println("Received SIGHUP, reloading configuration...")
+		cfg = srv.reloadConfig(cfg, conn.Dialect)
+	}
 
 	// Cleanup
 	log.Println("Shutting down server...")
-	scheduler.StopRestartScheduler()
+	srv.stopJobs()
 	log.Println("Service stopped")
 }
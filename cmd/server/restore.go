@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+)
+
+const restoreUsage = `usage: proxmox-auto-restart restore <backup-file>
+
+Replaces the SQLite database (database.path or DB_PATH) with a backup after checking its
+integrity and schema version. Stop the service before restoring.`
+
+// runRestore handles the "restore" subcommand and returns the exit code
+func runRestore(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, restoreUsage)
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	dsn := cfg.DSN()
+	if db.DialectFor(dsn) != db.SQLite {
+		fmt.Fprintln(os.Stderr, "Restore is only supported for SQLite; use pg_restore for PostgreSQL")
+		return 1
+	}
+
+	version, err := db.ValidateBackup(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid backup: %v\n", err)
+		return 1
+	}
+
+	previous, err := db.RestoreBackup(args[0], dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Restored %s to %s (schema version %d)\n", args[0], dsn, version)
+	if previous != "" {
+		fmt.Printf("Previous database kept at %s\n", previous)
+	}
+	if version < db.LatestVersion() {
+		fmt.Println("Pending migrations will be applied when the service starts")
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+)
+
+const userUsage = `usage: proxmox-auto-restart user <command>
+
+commands:
+  list                   list user accounts
+  add <username> [role]  create an account; role is viewer, operator or admin (default)
+  passwd <username>      set an account's password and enable it
+
+add and passwd read the password from the first line of standard input.`
+
+// runUser handles the "user" subcommand and returns the exit code
+func runUser(args []string) int {
+	if len(args) == 0 || (args[0] != "list" && len(args) < 2) || len(args) > 3 {
+		fmt.Fprintln(os.Stderr, userUsage)
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	conn, err := db.Open(cfg.DSN())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize database: %v\n", err)
+		return 1
+	}
+	if err := db.RunMigrations(conn); err != nil {
+		conn.Close()
+		fmt.Fprintf(os.Stderr, "Failed to run migrations: %v\n", err)
+		return 1
+	}
+	store := db.NewStore(conn)
+	defer store.Close()
+
+	switch args[0] {
+	case "list":
+		users, err := store.GetAllUsers()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get users: %v\n", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tROLE\tPROVIDER\tENABLED\tCREATED AT")
+		for _, u := range users {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%s\n", u.ID, u.Username, u.Role, u.Provider, u.Enabled, u.CreatedAt.Format("2006-01-02 15:04:05"))
+		}
+		w.Flush()
+
+	case "add":
+		role := auth.RoleAdmin
+		if len(args) == 3 {
+			role = args[2]
+		}
+		if err := auth.ValidateRole(role); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if _, err := auth.CreateUser(store, args[1], password, role); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add user: %v\n", err)
+			return 1
+		}
+		fmt.Printf("User %s created with role %s\n", args[1], role)
+
+	case "passwd":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, userUsage)
+			return 2
+		}
+		user, err := store.GetUserByUsername(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get user: %v\n", err)
+			return 1
+		}
+		if user == nil {
+			fmt.Fprintf(os.Stderr, "User %s not found\n", args[1])
+			return 1
+		}
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		user.Enabled = true
+		if err := auth.SetPassword(store, user, password); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set password: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Password of %s updated\n", args[1])
+
+	default:
+		fmt.Fprintln(os.Stderr, userUsage)
+		return 2
+	}
+
+	return 0
+}
+
+// readPassword reads a password from the first line of standard input
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("no password given: %v", err)
+	}
+	return line, nil
+}
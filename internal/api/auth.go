@@ -1,40 +1,392 @@
 package api
 
 import (
-	"crypto/subtle"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
 )
 
-// BasicAuth middleware for API authentication
-func BasicAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get credentials from environment or use defaults
-		username := os.Getenv("AUTH_USERNAME")
-		password := os.Getenv("AUTH_PASSWORD")
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	tokenContextKey
+)
+
+// bcrypt is deliberately slow, so a successful check is remembered for a
+// while. The key covers the stored hash, so a password change invalidates it.
+const (
+	loginCacheTTL  = 5 * time.Minute
+	loginCacheSize = 1024
+)
+
+// tokenTouchInterval limits how often a token's last use is written
+const tokenTouchInterval = time.Minute
+
+// sessionCookie carries the session of a user signed in through OIDC
+const sessionCookie = "par_session"
+
+var (
+	loginCacheMu sync.Mutex
+	loginCache   = make(map[[32]byte]time.Time)
+)
 
-		// Default credentials if not set
-		if username == "" {
-			username = "admin"
+func loginCacheKey(user *models.User, password string) [32]byte {
+	return sha256.Sum256([]byte(user.Username + "\x00" + user.PasswordHash + "\x00" + password))
+}
+
+// checkLogin verifies a password against an account, using the cache of
+// recent successful checks
+func checkLogin(user *models.User, password string) bool {
+	key := loginCacheKey(user, password)
+	now := time.Now()
+
+	loginCacheMu.Lock()
+	expires, ok := loginCache[key]
+	loginCacheMu.Unlock()
+	if ok && now.Before(expires) {
+		return true
+	}
+
+	if !auth.CheckPassword(user.PasswordHash, password) {
+		return false
+	}
+
+	loginCacheMu.Lock()
+	if len(loginCache) >= loginCacheSize {
+		clear(loginCache)
+	}
+	loginCache[key] = now.Add(loginCacheTTL)
+	loginCacheMu.Unlock()
+	return true
+}
+
+// authenticate returns the enabled account matching the credentials, or nil.
+// Local accounts are checked here; other usernames go to the password
+// provider, if any. The grants of non-admin accounts are loaded with it.
+func (h *Handler) authenticate(username, password string) (*models.User, error) {
+	user, err := h.store.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case user != nil && user.Provider == auth.ProviderLocal:
+		// The password is checked first so disabled accounts take as long
+		if !checkLogin(user, password) || !user.Enabled {
+			return nil, nil
 		}
-		if password == "" {
-			password = "proxmox2024"
+	case h.passwords != nil && (user == nil || user.Provider == h.passwords.Name()):
+		if user, err = h.authenticateExternal(username, password); user == nil || err != nil {
+			return nil, err
 		}
+	default:
+		// Take as long as a wrong password, so response times do not tell
+		// which usernames exist
+		auth.CheckPassword("", password)
+		return nil, nil
+	}
 
-		// Get credentials from request
-		reqUsername, reqPassword, ok := r.BasicAuth()
+	if err := h.loadGrants(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// authenticateExternal checks credentials with the password provider and
+// returns the provider's account for the user, creating it on first sign-in
+func (h *Handler) authenticateExternal(username, password string) (*models.User, error) {
+	identity, err := h.passwords.Authenticate(username, password)
+	var user *models.User
+	if err == nil {
+		user, err = auth.LoginExternal(h.store, h.passwords.Name(), identity.Username, identity.Role)
+	}
+	if errors.Is(err, auth.ErrLoginDenied) {
+		log.Printf("Sign-in of %q refused by %s: %v", username, h.passwords.Name(), err)
+		return nil, nil
+	}
+	return user, err
+}
 
-		// Check if credentials are provided and valid
-		if !ok ||
-			subtle.ConstantTimeCompare([]byte(reqUsername), []byte(username)) != 1 ||
-			subtle.ConstantTimeCompare([]byte(reqPassword), []byte(password)) != 1 {
+// authenticateToken returns the account an unexpired API token acts for, or
+// nil. The account carries the token's role, lowered to the owner's.
+func (h *Handler) authenticateToken(secret string) (*models.User, *models.APIToken, error) {
+	if !strings.HasPrefix(secret, auth.TokenPrefix) {
+		return nil, nil, nil
+	}
+	token, err := h.store.GetAPITokenByHash(auth.HashToken(secret))
+	if err != nil || token == nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if token.ExpiresAt != nil && !now.Before(*token.ExpiresAt) {
+		return nil, nil, nil
+	}
 
-			w.Header().Set("WWW-Authenticate", `Basic realm="Proxmox Auto-Restart API"`)
+	user, err := h.store.GetUserByID(token.UserID)
+	if err != nil || user == nil || !user.Enabled {
+		return nil, nil, err
+	}
+	if err := h.loadGrants(user); err != nil {
+		return nil, nil, err
+	}
+	user.Role = auth.TokenRole(user, token)
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= tokenTouchInterval {
+		if err := h.store.TouchAPIToken(token.ID, now); err != nil {
+			log.Printf("ERROR: Failed to record use of token %d: %v", token.ID, err)
+		}
+	}
+	return user, token, nil
+}
+
+// authenticateSession returns the enabled account of an unexpired session, or
+// nil
+func (h *Handler) authenticateSession(secret string) (*models.User, error) {
+	if !strings.HasPrefix(secret, auth.SessionPrefix) {
+		return nil, nil
+	}
+	session, err := h.store.GetSessionByHash(auth.HashToken(secret))
+	if err != nil || session == nil || !time.Now().Before(session.ExpiresAt) {
+		return nil, err
+	}
+
+	user, err := h.store.GetUserByID(session.UserID)
+	if err != nil || user == nil || !user.Enabled {
+		return nil, err
+	}
+	if err := h.loadGrants(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// sameOrigin reports whether a browser request comes from a page served by
+// this host. Requests without an Origin header are not cross-origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// loadGrants loads the grants of a non-admin account
+func (h *Handler) loadGrants(user *models.User) error {
+	if user.Role == auth.RoleAdmin {
+		return nil
+	}
+	grants, err := h.store.GetUserGrants(user.ID)
+	user.Grants = grants
+	return err
+}
+
+// UserFromContext returns the account that made the request, nil outside
+// authenticated routes
+func UserFromContext(ctx context.Context) *models.User {
+	user, _ := ctx.Value(userContextKey).(*models.User)
+	return user
+}
+
+// TokenFromContext returns the API token the request was authenticated with,
+// nil for password logins
+func TokenFromContext(ctx context.Context) *models.APIToken {
+	token, _ := ctx.Value(tokenContextKey).(*models.APIToken)
+	return token
+}
+
+// actor names the authenticated user for triggered_by and created_by
+func actor(r *http.Request) string {
+	user := UserFromContext(r.Context())
+	if user == nil {
+		return "api"
+	}
+	if token := TokenFromContext(r.Context()); token != nil {
+		return user.Username + " (token " + token.Name + ")"
+	}
+	return user.Username
+}
+
+// AuthMiddleware authenticates the request with an account's password sent as
+// Basic auth, an API token sent as "Authorization: Bearer", or the session
+// cookie of an OIDC sign-in, and adds the account to the request context
+func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *models.User
+		var token *models.APIToken
+		var err error
+		if secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			user, token, err = h.authenticateToken(strings.TrimSpace(secret))
+		} else if username, password, ok := r.BasicAuth(); ok {
+			user, err = h.authenticate(username, password)
+		} else if cookie, cerr := r.Cookie(sessionCookie); cerr == nil {
+			// Browsers send the cookie with requests from other sites too
+			if !sameOrigin(r) {
+				respondError(w, http.StatusForbidden, "Forbidden: cross-origin request")
+				return
+			}
+			user, err = h.authenticateSession(cookie.Value)
+		}
+		if err != nil {
+			log.Printf("ERROR: Failed to authenticate request: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to authenticate")
+			return
+		}
+		if user == nil {
+			w.Header().Add("WWW-Authenticate", `Basic realm="Proxmox Auto-Restart API"`)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="Proxmox Auto-Restart API"`)
 			respondError(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
 
-		// Credentials are valid, proceed
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		if token != nil {
+			ctx = context.WithValue(ctx, tokenContextKey, token)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RejectTokens refuses requests authenticated with an API token, so tokens
+// cannot mint or revoke other tokens. It must run after AuthMiddleware.
+func RejectTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if TokenFromContext(r.Context()) != nil {
+			respondError(w, http.StatusForbidden, "Forbidden: sign in with a password to manage tokens")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireUnrestricted rejects callers limited by grants or token scopes, for
+// routes that reach beyond single guests. It must run after AuthMiddleware.
+func RequireUnrestricted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requireUnrestricted(w, r) {
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireRole rejects requests from users whose role is below role. It must
+// run after AuthMiddleware.
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !auth.HasRole(UserFromContext(r.Context()), role) {
+				respondError(w, http.StatusForbidden, "Forbidden: requires the "+role+" role")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// scopeOf returns the guests the caller may see and act on: the account's
+// grants, narrowed by the scopes of the token the request used
+func scopeOf(r *http.Request) auth.Scope {
+	scope := auth.ScopeFor(UserFromContext(r.Context()))
+	if token := TokenFromContext(r.Context()); token != nil {
+		scope = scope.Narrow(auth.TokenGrants(token))
+	}
+	return scope
+}
+
+type guestKey struct {
+	vmid int
+	node string
+}
+
+// guestFilter returns a check for whether the caller may see a guest known
+// only by VMID and node. When the caller has pool or tag grants the guests'
+// details are fetched from Proxmox first.
+func (h *Handler) guestFilter(r *http.Request) (func(vmid int, node string) bool, error) {
+	scope := scopeOf(r)
+	if scope.Unrestricted() {
+		return func(int, string) bool { return true }, nil
+	}
+
+	details := make(map[guestKey]models.Resource)
+	if scope.NeedsDetails() {
+		resources, err := h.resources.GetAllResources()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get resources from Proxmox: %w", err)
+		}
+		for _, res := range resources {
+			details[guestKey{res.VMID, res.Node}] = res
+		}
+	}
+
+	return func(vmid int, node string) bool {
+		res, ok := details[guestKey{vmid, node}]
+		if !ok {
+			res = models.Resource{VMID: vmid, Node: node}
+		}
+		return scope.Allows(res)
+	}, nil
+}
+
+// requireGuests writes an error response unless the caller's grants cover
+// every one of the guests
+func (h *Handler) requireGuests(w http.ResponseWriter, r *http.Request, guests ...guestKey) bool {
+	allowed, err := h.guestFilter(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to check grants: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return false
+	}
+	for _, g := range guests {
+		if !allowed(g.vmid, g.node) {
+			respondError(w, http.StatusForbidden, fmt.Sprintf("Forbidden: guest %d on node %s is outside your grants", g.vmid, g.node))
+			return false
+		}
+	}
+	return true
+}
+
+// requireGuest writes an error response unless the caller may act on the guest
+func (h *Handler) requireGuest(w http.ResponseWriter, r *http.Request, vmid int, node string) bool {
+	return h.requireGuests(w, r, guestKey{vmid, node})
+}
+
+// logScopes returns the filters limiting stored records, such as restart
+// logs, to the caller's guests; nil for callers without grants. It writes an
+// error response and returns false if the grants cannot be checked.
+func (h *Handler) logScopes(w http.ResponseWriter, r *http.Request) ([]models.LogScope, bool) {
+	scope := scopeOf(r)
+	if scope.Unrestricted() {
+		return nil, true
+	}
+	var resources []models.Resource
+	if scope.NeedsDetails() {
+		var err error
+		if resources, err = h.resources.GetAllResources(); err != nil {
+			log.Printf("ERROR: Failed to check grants: %v", err)
+			respondError(w, http.StatusInternalServerError, "Failed to check permissions")
+			return nil, false
+		}
+	}
+	return scope.LogScopes(resources), true
+}
+
+// requireUnrestricted rejects callers limited by grants or token scopes, for
+// operations that span every guest
+func requireUnrestricted(w http.ResponseWriter, r *http.Request) bool {
+	if !scopeOf(r).Unrestricted() {
+		respondError(w, http.StatusForbidden, "Forbidden: requires an account without grants and a token without scopes")
+		return false
+	}
+	return true
+}
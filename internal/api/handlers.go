@@ -2,19 +2,69 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
 	"github.com/rakib/proxmox-auto-restart/internal/db"
 	"github.com/rakib/proxmox-auto-restart/internal/models"
 	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
 	"github.com/rakib/proxmox-auto-restart/internal/scheduler"
 )
 
+// Handler serves the HTTP API on top of a storage backend
+type Handler struct {
+	store     db.Store
+	sched     *scheduler.Scheduler
+	resources ResourceLister
+	oidc      *auth.OIDCProvider
+	passwords auth.PasswordProvider
+	tickets   *auth.TicketStore
+}
+
+// ResourceLister lists the guests of the cluster, with the pools and tags
+// grants are checked against
+type ResourceLister interface {
+	GetAllResources() ([]models.Resource, error)
+}
+
+// backendResources lists guests through the current Proxmox backend
+type backendResources struct{}
+
+func (backendResources) GetAllResources() ([]models.Resource, error) {
+	return proxmox.GetAllResources()
+}
+
+// NewHandler returns API handlers that read and write through store and run
+// restarts, pruning and backups through sched. Guests are listed through the
+// Proxmox backend unless SetResourceLister replaces it.
+func NewHandler(store db.Store, sched *scheduler.Scheduler) *Handler {
+	return &Handler{store: store, sched: sched, resources: backendResources{}, tickets: auth.NewTicketStore()}
+}
+
+// SetResourceLister lists guests, and checks grants, through lister
+func (h *Handler) SetResourceLister(lister ResourceLister) {
+	h.resources = lister
+}
+
+// SetOIDC enables sign-in through an OpenID Connect provider
+func (h *Handler) SetOIDC(provider *auth.OIDCProvider) {
+	h.oidc = provider
+}
+
+// SetPasswordProvider checks the passwords of users without a local account,
+// and of accounts it created, against an external directory such as LDAP
+func (h *Handler) SetPasswordProvider(provider auth.PasswordProvider) {
+	h.passwords = provider
+}
+
 // Response helpers
 
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
@@ -40,15 +90,26 @@ func contains(s, substr string) bool {
 
 // Resource handlers (VMs and Containers) - Real-time data from Proxmox
 
-func GetResources(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetResources(w http.ResponseWriter, r *http.Request) {
 	// Fetch real-time from Proxmox
-	resources, err := proxmox.GetAllResources()
+	resources, err := h.resources.GetAllResources()
 	if err != nil {
 		log.Printf("ERROR: Failed to get resources from Proxmox: %v", err)
 		respondError(w, http.StatusInternalServerError, "Failed to get resources from Proxmox")
 		return
 	}
 
+	// Only the guests covered by the caller's grants
+	if scope := scopeOf(r); !scope.Unrestricted() {
+		visible := make([]models.Resource, 0, len(resources))
+		for _, res := range resources {
+			if scope.Allows(res) {
+				visible = append(visible, res)
+			}
+		}
+		resources = visible
+	}
+
 	// Pagination
 	limit := 10 // Default limit
 	offset := 0
@@ -83,7 +144,7 @@ func GetResources(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func GetResource(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetResource(w http.ResponseWriter, r *http.Request) {
 	vmidStr := chi.URLParam(r, "vmid")
 	vmid, err := strconv.Atoi(vmidStr)
 	if err != nil {
@@ -107,11 +168,15 @@ func GetResource(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusNotFound, "Resource not found")
 		return
 	}
+	if !scopeOf(r).Allows(*resource) {
+		respondError(w, http.StatusForbidden, fmt.Sprintf("Forbidden: guest %d on node %s is outside your grants", vmid, node))
+		return
+	}
 
 	respondJSON(w, http.StatusOK, resource)
 }
 
-func RestartResource(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) RestartResource(w http.ResponseWriter, r *http.Request) {
 	vmidStr := chi.URLParam(r, "vmid")
 	vmid, err := strconv.Atoi(vmidStr)
 	if err != nil {
@@ -125,23 +190,18 @@ func RestartResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req models.ResourceActionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		req.TriggeredBy = "unknown"
-	}
-
-	if req.TriggeredBy == "" {
-		req.TriggeredBy = "api"
-	}
-
 	// Check if Proxmox is installed
 	if !proxmox.IsProxmoxInstalled() {
 		respondError(w, http.StatusServiceUnavailable, "Proxmox not available on this server")
 		return
 	}
 
+	if !h.requireGuest(w, r, vmid, node) {
+		return
+	}
+
 	// Trigger restart asynchronously
-	err = scheduler.ManualRestartResource(vmid, node, req.TriggeredBy)
+	err = h.sched.ManualRestartResource(vmid, node, actor(r))
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -154,7 +214,7 @@ func RestartResource(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func StopResource(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) StopResource(w http.ResponseWriter, r *http.Request) {
 	vmidStr := chi.URLParam(r, "vmid")
 	vmid, err := strconv.Atoi(vmidStr)
 	if err != nil {
@@ -168,22 +228,17 @@ func StopResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req models.ResourceActionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		req.TriggeredBy = "unknown"
-	}
-
-	if req.TriggeredBy == "" {
-		req.TriggeredBy = "api"
-	}
-
 	// Check if Proxmox is installed
 	if !proxmox.IsProxmoxInstalled() {
 		respondError(w, http.StatusServiceUnavailable, "Proxmox not available on this server")
 		return
 	}
 
-	err = scheduler.ManualStopResource(vmid, node, req.TriggeredBy)
+	if !h.requireGuest(w, r, vmid, node) {
+		return
+	}
+
+	err = h.sched.ManualStopResource(vmid, node, actor(r))
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -196,7 +251,7 @@ func StopResource(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func StartResource(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) StartResource(w http.ResponseWriter, r *http.Request) {
 	vmidStr := chi.URLParam(r, "vmid")
 	vmid, err := strconv.Atoi(vmidStr)
 	if err != nil {
@@ -210,22 +265,17 @@ func StartResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req models.ResourceActionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		req.TriggeredBy = "unknown"
-	}
-
-	if req.TriggeredBy == "" {
-		req.TriggeredBy = "api"
-	}
-
 	// Check if Proxmox is installed
 	if !proxmox.IsProxmoxInstalled() {
 		respondError(w, http.StatusServiceUnavailable, "Proxmox not available on this server")
 		return
 	}
 
-	err = scheduler.ManualStartResource(vmid, node, req.TriggeredBy)
+	if !h.requireGuest(w, r, vmid, node) {
+		return
+	}
+
+	err = h.sched.ManualStartResource(vmid, node, actor(r))
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -240,16 +290,29 @@ func StartResource(w http.ResponseWriter, r *http.Request) {
 
 // Whitelist handlers
 
-func GetWhitelist(w http.ResponseWriter, r *http.Request) {
-	whitelist, err := db.GetAllWhitelist()
+func (h *Handler) GetWhitelist(w http.ResponseWriter, r *http.Request) {
+	whitelist, err := h.store.GetAllWhitelist()
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to get whitelist")
 		return
 	}
-	respondJSON(w, http.StatusOK, whitelist)
+
+	allowed, err := h.guestFilter(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to check grants: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return
+	}
+	visible := make([]models.Whitelist, 0, len(whitelist))
+	for _, wl := range whitelist {
+		if allowed(wl.VMID, wl.Node) {
+			visible = append(visible, wl)
+		}
+	}
+	respondJSON(w, http.StatusOK, visible)
 }
 
-func AddToWhitelist(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) AddToWhitelist(w http.ResponseWriter, r *http.Request) {
 	var req models.CreateWhitelistRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
@@ -268,12 +331,27 @@ func AddToWhitelist(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "node is required")
 		return
 	}
+	if !h.requireGuest(w, r, req.VMID, req.Node) {
+		return
+	}
+
+	if err := scheduler.ValidateSchedule(req.CronExpression, req.WindowStart, req.WindowEnd, req.Timezone); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if req.CreatedBy == "" {
-		req.CreatedBy = "api"
+	if err := scheduler.ValidateRestartMode(req.RestartMode); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !h.joinableGroup(w, r, req.GroupID) {
+		return
 	}
 
-	err := db.AddToWhitelist(req.VMID, req.ResourceName, req.Node, req.CreatedBy, req.Notes)
+	req.CreatedBy = actor(r)
+
+	err := h.store.CreateWhitelist(&req)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to add to whitelist")
 		return
@@ -287,7 +365,7 @@ func AddToWhitelist(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func UpdateWhitelist(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) UpdateWhitelist(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
@@ -295,13 +373,34 @@ func UpdateWhitelist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	wl, ok := h.whitelistInScope(w, r, id)
+	if !ok {
+		return
+	}
+
 	var req models.UpdateWhitelistRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	err = db.UpdateWhitelist(int(id), &req)
+	// Validate the entry as it will be stored, with omitted fields unchanged
+	updated := applyWhitelistUpdate(*wl, &req)
+	if err := scheduler.ValidateSchedule(updated.CronExpression, updated.WindowStart, updated.WindowEnd, updated.Timezone); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := scheduler.ValidateRestartMode(updated.RestartMode); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if updated.GroupID != wl.GroupID && !h.joinableGroup(w, r, updated.GroupID) {
+		return
+	}
+
+	err = h.store.UpdateWhitelist(id, &req)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to update whitelist")
 		return
@@ -310,7 +409,30 @@ func UpdateWhitelist(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]string{"message": "Updated successfully"})
 }
 
-func DeleteFromWhitelist(w http.ResponseWriter, r *http.Request) {
+// applyWhitelistUpdate returns the entry with the fields set in req applied
+func applyWhitelistUpdate(wl models.Whitelist, req *models.UpdateWhitelistRequest) models.Whitelist {
+	if req.CronExpression != nil {
+		wl.CronExpression = *req.CronExpression
+	}
+	if req.WindowStart != nil {
+		wl.WindowStart = *req.WindowStart
+	}
+	if req.WindowEnd != nil {
+		wl.WindowEnd = *req.WindowEnd
+	}
+	if req.Timezone != nil {
+		wl.Timezone = *req.Timezone
+	}
+	if req.GroupID != nil {
+		wl.GroupID = *req.GroupID
+	}
+	if req.RestartMode != nil {
+		wl.RestartMode = *req.RestartMode
+	}
+	return wl
+}
+
+func (h *Handler) DeleteFromWhitelist(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
@@ -318,7 +440,11 @@ func DeleteFromWhitelist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = db.DeleteFromWhitelist(id)
+	if _, ok := h.whitelistInScope(w, r, id); !ok {
+		return
+	}
+
+	err = h.store.DeleteFromWhitelist(id)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to delete from whitelist")
 		return
@@ -327,197 +453,1199 @@ func DeleteFromWhitelist(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]string{"message": "Deleted successfully"})
 }
 
-// Logs handlers
-
-func GetLogs(w http.ResponseWriter, r *http.Request) {
-	filter := models.LogsFilter{
-		Action:      r.URL.Query().Get("action"),
-		TriggerType: r.URL.Query().Get("trigger_type"),
-		Status:      r.URL.Query().Get("status"),
-		Limit:       100, // Default limit
-		Offset:      0,
+func (h *Handler) UnquarantineWhitelist(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
 	}
 
-	// Parse VMID
-	if vmidStr := r.URL.Query().Get("vmid"); vmidStr != "" {
-		if vmid, err := strconv.Atoi(vmidStr); err == nil {
-			filter.VMID = vmid
-		}
+	wl, ok := h.whitelistInScope(w, r, id)
+	if !ok {
+		return
 	}
 
-	// Parse resource_name
-	if resourceName := r.URL.Query().Get("resource_name"); resourceName != "" {
-		filter.ResourceName = resourceName
+	if err := h.sched.UnquarantineWhitelist(id, actor(r)); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	// Parse node
-	if node := r.URL.Query().Get("node"); node != "" {
-		filter.Node = node
-	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Quarantine lifted",
+		"vmid":    wl.VMID,
+	})
+}
 
-	// Parse limit and offset
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if limit, err := strconv.Atoi(limitStr); err == nil {
-			filter.Limit = limit
-		}
+// whitelistInScope loads a whitelist entry the caller may act on and writes
+// an error response if there is none
+func (h *Handler) whitelistInScope(w http.ResponseWriter, r *http.Request, id int64) (*models.Whitelist, bool) {
+	wl, err := h.store.GetWhitelistByID(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get whitelist entry")
+		return nil, false
 	}
-
-	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
-		if offset, err := strconv.Atoi(offsetStr); err == nil {
-			filter.Offset = offset
-		}
+	if wl == nil {
+		respondError(w, http.StatusNotFound, "Whitelist entry not found")
+		return nil, false
 	}
-
-	// Parse date filters
-	if startDateStr := r.URL.Query().Get("start_date"); startDateStr != "" {
-		if startDate, err := time.Parse(time.RFC3339, startDateStr); err == nil {
-			filter.StartDate = &startDate
-		}
+	if !h.requireGuest(w, r, wl.VMID, wl.Node) {
+		return nil, false
 	}
+	return wl, true
+}
 
-	if endDateStr := r.URL.Query().Get("end_date"); endDateStr != "" {
-		if endDate, err := time.Parse(time.RFC3339, endDateStr); err == nil {
-			filter.EndDate = &endDate
-		}
+// joinableGroup checks that a whitelist entry can join a restart group (0
+// means ungrouped): the group must exist and all its members must be within
+// the caller's grants. It writes an error response if not.
+func (h *Handler) joinableGroup(w http.ResponseWriter, r *http.Request, groupID int64) bool {
+	if groupID == 0 {
+		return true
 	}
-
-	logs, err := db.GetLogs(filter)
+	group, err := h.store.GetRestartGroupByID(groupID)
 	if err != nil {
-		log.Printf("ERROR: Failed to get logs: %v", err)
-		respondError(w, http.StatusInternalServerError, "Failed to get logs")
-		return
+		respondError(w, http.StatusInternalServerError, "Failed to get restart group")
+		return false
 	}
-
-	respondJSON(w, http.StatusOK, logs)
+	if group == nil {
+		respondError(w, http.StatusBadRequest, "restart group not found")
+		return false
+	}
+	return h.groupInScope(w, r, groupID)
 }
 
-// System handlers
-
-func GetStatus(w http.ResponseWriter, r *http.Request) {
-	status, err := db.GetSystemStatus()
+// groupInScope checks that every member of a restart group is within the
+// caller's grants and writes an error response if not
+func (h *Handler) groupInScope(w http.ResponseWriter, r *http.Request, groupID int64) bool {
+	members, err := h.store.GetWhitelistByGroup(groupID)
 	if err != nil {
-		log.Printf("ERROR: Failed to get system status: %v", err)
-		respondError(w, http.StatusInternalServerError, "Failed to get system status")
-		return
+		respondError(w, http.StatusInternalServerError, "Failed to get restart group")
+		return false
 	}
-
-	// Get real-time resource counts from Proxmox
-	resources, err := proxmox.GetAllResources()
-	if err == nil {
-		status.TotalResources = len(resources)
-		runningCount := 0
-		for _, r := range resources {
-			if r.Status == "running" {
-				runningCount++
-			}
-		}
-		status.RunningResources = runningCount
+	guests := make([]guestKey, len(members))
+	for i, wl := range members {
+		guests[i] = guestKey{wl.VMID, wl.Node}
 	}
-
-	respondJSON(w, http.StatusOK, status)
+	return h.requireGuests(w, r, guests...)
 }
 
-// Container Management Handlers
+// maxManifestSize bounds the body of a whitelist manifest upload
+const maxManifestSize = 1 << 20
 
-func CloneContainerHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		SourceVMID int    `json:"source_vmid"`
-		NewVMID    int    `json:"new_vmid"`
-		TargetNode string `json:"target_node"`
-		Hostname   string `json:"hostname"`
+// ApplyWhitelistManifest reconciles the whitelist with the YAML or JSON
+// manifest in the request body. With ?dry_run=true only the plan is returned;
+// a manifest that removes every entry also needs ?allow_empty=true.
+func (h *Handler) ApplyWhitelistManifest(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestSize))
+	if err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	if req.SourceVMID == 0 || req.NewVMID == 0 || req.TargetNode == "" {
-		respondError(w, http.StatusBadRequest, "source_vmid, new_vmid, and target_node are required")
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	allowEmpty := r.URL.Query().Get("allow_empty") == "true"
+	plan, err := h.sched.ApplyWhitelistManifest(content, actor(r), dryRun, allowEmpty)
+	if errors.Is(err, scheduler.ErrInvalidManifest) || errors.Is(err, scheduler.ErrEmptyManifest) {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Clone the container
-	if err := proxmox.CloneContainer(req.SourceVMID, req.NewVMID, req.TargetNode, req.Hostname); err != nil {
-		log.Printf("ERROR: Failed to clone container: %v", err)
-		respondError(w, http.StatusInternalServerError, err.Error())
+	if err != nil {
+		log.Printf("ERROR: Failed to apply whitelist manifest: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to apply whitelist manifest")
 		return
 	}
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"message":     "Container cloned successfully",
-		"source_vmid": req.SourceVMID,
-		"new_vmid":    req.NewVMID,
-		"target_node": req.TargetNode,
+		"dry_run": dryRun,
+		"plan":    plan,
 	})
 }
 
-func DeleteContainerHandler(w http.ResponseWriter, r *http.Request) {
-	vmidStr := chi.URLParam(r, "vmid")
-	vmid, err := strconv.Atoi(vmidStr)
+// GetWhitelistDrift reports how the whitelist differs from the last applied
+// manifest
+func (h *Handler) GetWhitelistDrift(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+
+	drift, err := h.sched.GetWhitelistDrift()
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid VMID")
+		log.Printf("ERROR: Failed to check whitelist drift: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to check whitelist drift")
 		return
 	}
+	if drift == nil {
+		respondError(w, http.StatusNotFound, "No manifest has been applied")
+		return
+	}
+	respondJSON(w, http.StatusOK, drift)
+}
 
-	node := r.URL.Query().Get("node")
-	if node == "" {
-		respondError(w, http.StatusBadRequest, "node query parameter is required")
+// Restart group handlers
+
+func (h *Handler) GetRestartGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := h.store.GetAllRestartGroups()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get restart groups")
 		return
 	}
+	if groups == nil {
+		groups = []models.RestartGroup{}
+	}
+	if !h.hideOtherMembers(w, r, groups) {
+		return
+	}
+	respondJSON(w, http.StatusOK, groups)
+}
 
-	// Delete the container
-	if err := proxmox.DeleteContainer(vmid, node); err != nil {
-		log.Printf("ERROR: Failed to delete container: %v", err)
-		respondError(w, http.StatusInternalServerError, err.Error())
+func (h *Handler) GetRestartGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
 		return
 	}
 
-	// Remove from whitelist if exists
-	_ = db.DeleteWhitelistByVMID(vmid)
+	group, err := h.store.GetRestartGroupByID(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get restart group")
+		return
+	}
+	if group == nil {
+		respondError(w, http.StatusNotFound, "Restart group not found")
+		return
+	}
+	if !h.hideOtherMembers(w, r, []models.RestartGroup{*group}) {
+		return
+	}
+	respondJSON(w, http.StatusOK, group)
+}
 
-	// Remove service records
-	_ = db.DeleteServicesByVMID(vmid, node)
+func (h *Handler) CreateRestartGroup(w http.ResponseWriter, r *http.Request) {
+	var req models.RestartGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Name == "" {
+		respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"message": "Container deleted successfully",
-		"vmid":    vmid,
-		"node":    node,
+	id, err := h.store.CreateRestartGroup(req.Name, req.Description, boolOrDefault(req.WaitHealthy, true), boolOrDefault(req.StopOnFailure, true))
+	if err != nil {
+		if db.IsUniqueViolation(err) {
+			respondError(w, http.StatusConflict, "A restart group with this name already exists")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "Failed to create restart group")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Restart group created successfully",
+		"id":      id,
+		"name":    req.Name,
 	})
 }
 
-func DeployBlockchainNodeHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		SourceVMID int      `json:"source_vmid"`
-		NewVMID    int      `json:"new_vmid"`
-		TargetNode string   `json:"target_node"`
-		Hostname   string   `json:"hostname"`
-		Commands   []string `json:"commands"`
+func (h *Handler) UpdateRestartGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
 	}
 
+	var req models.RestartGroupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
+	if req.Name == "" {
+		respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if !h.groupInScope(w, r, id) {
+		return
+	}
 
-	if req.SourceVMID == 0 || req.NewVMID == 0 || req.TargetNode == "" {
-		respondError(w, http.StatusBadRequest, "source_vmid, new_vmid, and target_node are required")
+	err = h.store.UpdateRestartGroup(id, req.Name, req.Description, boolOrDefault(req.WaitHealthy, true), boolOrDefault(req.StopOnFailure, true))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update restart group")
 		return
 	}
 
-	if len(req.Commands) == 0 {
-		respondError(w, http.StatusBadRequest, "commands array is required")
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Updated successfully"})
+}
+
+func (h *Handler) DeleteRestartGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
 		return
 	}
 
-	// Deploy blockchain node
-	if err := proxmox.DeployBlockchainNode(req.SourceVMID, req.NewVMID, req.TargetNode, req.Hostname, req.Commands); err != nil {
-		log.Printf("ERROR: Failed to deploy blockchain node: %v", err)
-		respondError(w, http.StatusInternalServerError, err.Error())
+	if !h.groupInScope(w, r, id) {
 		return
 	}
 
-	// Record service installation in database
+	if err := h.store.DeleteRestartGroup(id); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete restart group")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Deleted successfully"})
+}
+
+func (h *Handler) RestartGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if !proxmox.IsProxmoxInstalled() {
+		respondError(w, http.StatusServiceUnavailable, "Proxmox not available on this server")
+		return
+	}
+
+	// Every member must be within the caller's grants
+	if !h.groupInScope(w, r, id) {
+		return
+	}
+
+	err = h.sched.ManualRestartGroup(id, actor(r))
+	switch {
+	case errors.Is(err, scheduler.ErrGroupNotFound):
+		respondError(w, http.StatusNotFound, "Restart group not found")
+		return
+	case errors.Is(err, scheduler.ErrGroupBusy):
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message": "Rolling restart queued",
+		"id":      id,
+	})
+}
+
+// hideOtherMembers removes the members outside the caller's grants from
+// groups, writing an error response if the grants cannot be checked
+func (h *Handler) hideOtherMembers(w http.ResponseWriter, r *http.Request, groups []models.RestartGroup) bool {
+	allowed, err := h.guestFilter(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to check grants: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return false
+	}
+	for i := range groups {
+		var members []models.Whitelist
+		for _, wl := range groups[i].Members {
+			if allowed(wl.VMID, wl.Node) {
+				members = append(members, wl)
+			}
+		}
+		groups[i].Members = members
+	}
+	return true
+}
+
+// Health check handlers
+
+func (h *Handler) GetHealthChecks(w http.ResponseWriter, r *http.Request) {
+	var whitelistID int64
+	if idStr := r.URL.Query().Get("whitelist_id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid whitelist_id")
+			return
+		}
+		whitelistID = id
+	}
+
+	checks, err := h.store.GetHealthChecks(whitelistID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get health checks")
+		return
+	}
+
+	allowed, err := h.guestFilter(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to check grants: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return
+	}
+	visible := make([]models.HealthCheck, 0, len(checks))
+	for _, hc := range checks {
+		if allowed(hc.VMID, hc.Node) {
+			visible = append(visible, hc)
+		}
+	}
+	respondJSON(w, http.StatusOK, visible)
+}
+
+func (h *Handler) CreateHealthCheck(w http.ResponseWriter, r *http.Request) {
+	var req models.HealthCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.WhitelistID == 0 {
+		respondError(w, http.StatusBadRequest, "whitelist_id is required")
+		return
+	}
+	if err := scheduler.ValidateHealthCheck(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireExecRole(w, r, &req) {
+		return
+	}
+
+	wl, err := h.store.GetWhitelistByID(req.WhitelistID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get whitelist entry")
+		return
+	}
+	if wl == nil {
+		respondError(w, http.StatusBadRequest, "whitelist entry not found")
+		return
+	}
+	if !h.requireGuest(w, r, wl.VMID, wl.Node) {
+		return
+	}
+
+	id, err := h.store.CreateHealthCheck(&req)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create health check")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Health check created successfully",
+		"id":      id,
+		"vmid":    wl.VMID,
+	})
+}
+
+func (h *Handler) UpdateHealthCheck(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if !h.healthCheckInScope(w, r, id) {
+		return
+	}
+
+	var req models.HealthCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := scheduler.ValidateHealthCheck(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireExecRole(w, r, &req) {
+		return
+	}
+
+	if err := h.store.UpdateHealthCheck(id, &req); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update health check")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Updated successfully"})
+}
+
+// requireExecRole rejects exec checks from callers below admin: they run a
+// command as root inside the container, like a terminal
+func requireExecRole(w http.ResponseWriter, r *http.Request, req *models.HealthCheckRequest) bool {
+	if req.Type == scheduler.ProbeExec && !auth.HasRole(UserFromContext(r.Context()), auth.RoleAdmin) {
+		respondError(w, http.StatusForbidden, "Forbidden: exec health checks require the admin role")
+		return false
+	}
+	return true
+}
+
+func (h *Handler) DeleteHealthCheck(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if !h.healthCheckInScope(w, r, id) {
+		return
+	}
+
+	if err := h.store.DeleteHealthCheck(id); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete health check")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Deleted successfully"})
+}
+
+// healthCheckInScope checks that a health check exists and watches a guest the
+// caller may act on, writing an error response if not
+func (h *Handler) healthCheckInScope(w http.ResponseWriter, r *http.Request, id int64) bool {
+	hc, err := h.store.GetHealthCheckByID(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get health check")
+		return false
+	}
+	if hc == nil {
+		respondError(w, http.StatusNotFound, "Health check not found")
+		return false
+	}
+	return h.requireGuest(w, r, hc.VMID, hc.Node)
+}
+
+// boolOrDefault returns *b, or def when the field was omitted
+func boolOrDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+// Logs handlers
+
+func (h *Handler) GetLogs(w http.ResponseWriter, r *http.Request) {
+	filter := models.LogsFilter{
+		Action:      r.URL.Query().Get("action"),
+		TriggerType: r.URL.Query().Get("trigger_type"),
+		Status:      r.URL.Query().Get("status"),
+		Limit:       100, // Default limit
+		Offset:      0,
+	}
+
+	// Parse VMID
+	if vmidStr := r.URL.Query().Get("vmid"); vmidStr != "" {
+		if vmid, err := strconv.Atoi(vmidStr); err == nil {
+			filter.VMID = vmid
+		}
+	}
+
+	// Parse resource_name
+	if resourceName := r.URL.Query().Get("resource_name"); resourceName != "" {
+		filter.ResourceName = resourceName
+	}
+
+	// Parse node
+	if node := r.URL.Query().Get("node"); node != "" {
+		filter.Node = node
+	}
+
+	// Parse limit and offset
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if limit, err := strconv.Atoi(limitStr); err == nil {
+			filter.Limit = limit
+		}
+	}
+
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		if offset, err := strconv.Atoi(offsetStr); err == nil {
+			filter.Offset = offset
+		}
+	}
+
+	// Parse date filters
+	if startDateStr := r.URL.Query().Get("start_date"); startDateStr != "" {
+		if startDate, err := time.Parse(time.RFC3339, startDateStr); err == nil {
+			filter.StartDate = &startDate
+		}
+	}
+
+	if endDateStr := r.URL.Query().Get("end_date"); endDateStr != "" {
+		if endDate, err := time.Parse(time.RFC3339, endDateStr); err == nil {
+			filter.EndDate = &endDate
+		}
+	}
+
+	// Only the guests covered by the caller's grants
+	var ok bool
+	if filter.Scopes, ok = h.logScopes(w, r); !ok {
+		return
+	}
+
+	logs, err := h.store.GetLogs(filter)
+	if err != nil {
+		log.Printf("ERROR: Failed to get logs: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get logs")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, logs)
+}
+
+// System handlers
+
+func (h *Handler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	// Callers with grants only see counts of their own guests
+	scopes, ok := h.logScopes(w, r)
+	if !ok {
+		return
+	}
+	status, err := h.store.GetSystemStatus(scopes)
+	if err != nil {
+		log.Printf("ERROR: Failed to get system status: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get system status")
+		return
+	}
+
+	// Get real-time resource counts from Proxmox
+	resources, err := h.resources.GetAllResources()
+	if err == nil {
+		scope := scopeOf(r)
+		for _, res := range resources {
+			if !scope.Allows(res) {
+				continue
+			}
+			status.TotalResources++
+			if res.Status == "running" {
+				status.RunningResources++
+			}
+		}
+	}
+
+	queueStats := h.sched.GetQueueStats()
+	status.QueuedRestarts = queueStats.Queued
+	status.RunningRestarts = queueStats.Running
+
+	respondJSON(w, http.StatusOK, status)
+}
+
+// Admin handlers
+
+// GetLogStats reports the size of the restart log table, the retention
+// settings and what the pruner has done
+func (h *Handler) GetLogStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.store.GetLogTableStats()
+	if err != nil {
+		log.Printf("ERROR: Failed to get log table stats: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get log table stats")
+		return
+	}
+
+	cfg := scheduler.GetRetentionConfig()
+	statusMaxAge := make(map[string]string)
+	for status, age := range cfg.StatusMaxAge {
+		statusMaxAge[status] = age.String()
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"table": stats,
+		"retention": map[string]interface{}{
+			"enabled":        cfg.Enabled(),
+			"max_age":        cfg.MaxAge.String(),
+			"status_max_age": statusMaxAge,
+			"max_per_vmid":   cfg.MaxPerVMID,
+			"archive_dir":    cfg.ArchiveDir,
+		},
+		"prune": h.sched.GetPruneStats(),
+	})
+}
+
+// PruneLogs runs the log pruner now
+func (h *Handler) PruneLogs(w http.ResponseWriter, r *http.Request) {
+	result, err := h.sched.PruneLogs()
+	if err != nil {
+		log.Printf("ERROR: Failed to prune restart logs: %v", err)
+		respondJSON(w, http.StatusInternalServerError, result)
+		return
+	}
+	respondJSON(w, http.StatusOK, result)
+}
+
+// CreateBackup takes a consistent snapshot of the database
+func (h *Handler) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	backup, err := h.sched.CreateBackup()
+	if errors.Is(err, db.ErrBackupUnsupported) {
+		respondError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to back up database: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to back up database")
+		return
+	}
+	respondJSON(w, http.StatusCreated, backup)
+}
+
+// GetBackups lists the backups in the backup directory, newest first
+func (h *Handler) GetBackups(w http.ResponseWriter, r *http.Request) {
+	backups, err := scheduler.ListBackups()
+	if err != nil {
+		log.Printf("ERROR: Failed to list backups: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list backups")
+		return
+	}
+	if backups == nil {
+		backups = []scheduler.BackupInfo{}
+	}
+	respondJSON(w, http.StatusOK, backups)
+}
+
+// User handlers
+
+// GetUsers lists the user accounts
+func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.store.GetAllUsers()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get users")
+		return
+	}
+	if users == nil {
+		users = []models.User{}
+	}
+	respondJSON(w, http.StatusOK, users)
+}
+
+// GetCurrentUser returns the account that made the request
+func (h *Handler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, UserFromContext(r.Context()))
+}
+
+func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	grants, err := h.store.GetUserGrants(user.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get grants")
+		return
+	}
+	user.Grants = grants
+	respondJSON(w, http.StatusOK, user)
+}
+
+func (h *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = auth.RoleViewer
+	}
+
+	user, err := auth.CreateUser(h.store, req.Username, req.Password, req.Role)
+	switch {
+	case errors.Is(err, auth.ErrInvalidUser):
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, auth.ErrUserExists):
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to create user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+
+	log.Printf("User %s created by %s", user.Username, actor(r))
+	respondJSON(w, http.StatusCreated, user)
+}
+
+// UpdateUser changes a user's password, role and/or enabled flag
+func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	current, ok := h.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user := *current
+	if req.Role != "" {
+		if err := auth.ValidateRole(req.Role); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		user.Role = req.Role
+	}
+	if req.Enabled != nil {
+		user.Enabled = *req.Enabled
+	}
+	if !h.canChangeUser(w, r, current, &user) {
+		return
+	}
+
+	if req.Password != "" {
+		err := auth.SetPassword(h.store, &user, req.Password)
+		if errors.Is(err, auth.ErrInvalidUser) {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: Failed to update user %s: %v", user.Username, err)
+			respondError(w, http.StatusInternalServerError, "Failed to update user")
+			return
+		}
+	} else if err := h.store.UpdateUser(&user); err != nil {
+		log.Printf("ERROR: Failed to update user %s: %v", user.Username, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+
+	log.Printf("User %s updated by %s (role %s, enabled %t)", user.Username, actor(r), user.Role, user.Enabled)
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Updated successfully"})
+}
+
+func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromURL(w, r)
+	if !ok || !h.canChangeUser(w, r, user, nil) {
+		return
+	}
+
+	if err := h.store.DeleteUser(user.ID); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete user")
+		return
+	}
+
+	log.Printf("User %s deleted by %s", user.Username, actor(r))
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Deleted successfully"})
+}
+
+// GetUserGrants lists the grants limiting a user
+func (h *Handler) GetUserGrants(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	grants, err := h.store.GetUserGrants(user.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get grants")
+		return
+	}
+	if grants == nil {
+		grants = []models.UserGrant{}
+	}
+	respondJSON(w, http.StatusOK, grants)
+}
+
+// CreateUserGrant limits a user to the guests of a node, VMID range, pool or tag
+func (h *Handler) CreateUserGrant(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UserGrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	grant, err := auth.AddGrant(h.store, user, req.Scope, req.Value)
+	switch {
+	case errors.Is(err, auth.ErrInvalidGrant):
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, auth.ErrGrantExists):
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to add grant to user %s: %v", user.Username, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create grant")
+		return
+	}
+
+	log.Printf("Grant %s %s added to user %s by %s", grant.Scope, grant.Value, user.Username, actor(r))
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Grant created successfully",
+		"id":      grant.ID,
+		"scope":   grant.Scope,
+		"value":   grant.Value,
+	})
+}
+
+// DeleteUserGrant removes one of a user's grants
+func (h *Handler) DeleteUserGrant(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	grantID, err := strconv.ParseInt(chi.URLParam(r, "grantID"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid grant ID")
+		return
+	}
+
+	grants, err := h.store.GetUserGrants(user.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get grants")
+		return
+	}
+	for _, g := range grants {
+		if g.ID != grantID {
+			continue
+		}
+		if err := h.store.DeleteUserGrant(g.ID); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to delete grant")
+			return
+		}
+		log.Printf("Grant %s %s removed from user %s by %s", g.Scope, g.Value, user.Username, actor(r))
+		respondJSON(w, http.StatusOK, map[string]string{"message": "Deleted successfully"})
+		return
+	}
+	respondError(w, http.StatusNotFound, "Grant not found")
+}
+
+// API token handlers
+
+// GetAPITokens lists the caller's tokens; admins see everyone's with ?all=true
+func (h *Handler) GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(r.Context())
+	userID := user.ID
+	if r.URL.Query().Get("all") == "true" && auth.HasRole(user, auth.RoleAdmin) {
+		userID = 0
+	}
+
+	tokens, err := h.store.GetAPITokens(userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get tokens")
+		return
+	}
+	if tokens == nil {
+		tokens = []models.APIToken{}
+	}
+	respondJSON(w, http.StatusOK, tokens)
+}
+
+// CreateAPIToken issues a token for the caller. The secret is only returned
+// in this response.
+func (h *Handler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	token, secret, err := auth.CreateToken(h.store, UserFromContext(r.Context()), &req)
+	switch {
+	case errors.Is(err, auth.ErrInvalidToken):
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, auth.ErrTokenExists):
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to create token: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to create token")
+		return
+	}
+
+	log.Printf("Token %s (%s) created by %s", token.Name, token.Role, actor(r))
+	respondJSON(w, http.StatusCreated, struct {
+		*models.APIToken
+		Token string `json:"token"`
+	}{token, secret})
+}
+
+// DeleteAPIToken revokes one of the caller's tokens; admins can revoke any
+func (h *Handler) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	user := UserFromContext(r.Context())
+	token, err := h.store.GetAPITokenByID(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get token")
+		return
+	}
+	if token == nil || (token.UserID != user.ID && !auth.HasRole(user, auth.RoleAdmin)) {
+		respondError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+
+	if err := h.store.DeleteAPIToken(id); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete token")
+		return
+	}
+
+	log.Printf("Token %s of %s revoked by %s", token.Name, token.Username, actor(r))
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Deleted successfully"})
+}
+
+// Sign-in handlers
+
+// OIDCLogin sends the browser to the identity provider. ?redirect= names the
+// local page to return to once signed in.
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		respondError(w, http.StatusNotFound, "OIDC sign-in is not configured")
+		return
+	}
+
+	redirect := r.URL.Query().Get("redirect")
+	if !localRedirect(redirect) {
+		redirect = "/"
+	}
+	target, err := h.oidc.AuthCodeURL(redirect)
+	if errors.Is(err, auth.ErrLoginDenied) {
+		respondError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to start OIDC sign-in: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to start sign-in")
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallback completes a sign-in, sets the session cookie and sends the
+// browser back to the page the sign-in started from
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		respondError(w, http.StatusNotFound, "OIDC sign-in is not configured")
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.Printf("ERROR: OIDC sign-in failed at the identity provider: %s %s", e, query.Get("error_description"))
+		respondError(w, http.StatusForbidden, "Sign-in failed: "+e)
+		return
+	}
+
+	identity, err := h.oidc.Exchange(r.Context(), query.Get("state"), query.Get("code"))
+	if err != nil {
+		signInFailed(w, err)
+		return
+	}
+	user, err := auth.LoginExternal(h.store, auth.ProviderOIDC, identity.Username, identity.Role)
+	if err != nil {
+		signInFailed(w, err)
+		return
+	}
+	session, secret, err := auth.CreateSession(h.store, user, h.oidc.SessionTTL())
+	if err != nil {
+		signInFailed(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("User %s signed in with OIDC (role %s)", user.Username, user.Role)
+	http.Redirect(w, r, identity.Redirect, http.StatusFound)
+}
+
+// signInFailed reports why a sign-in did not complete
+func signInFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrLoginDenied) {
+		log.Printf("ERROR: Sign-in refused: %v", err)
+		respondError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	log.Printf("ERROR: Failed to complete sign-in: %v", err)
+	respondError(w, http.StatusInternalServerError, "Failed to complete sign-in")
+}
+
+// Logout ends the session of the session cookie and clears it
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		session, err := h.store.GetSessionByHash(auth.HashToken(cookie.Value))
+		if err == nil && session != nil {
+			err = h.store.DeleteSession(session.ID)
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to end session")
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Signed out"})
+}
+
+// localRedirect reports whether redirect is a path on this host, so sign-in
+// cannot be used to send browsers to other sites
+func localRedirect(redirect string) bool {
+	return strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\")
+}
+
+// userFromURL loads the user named by the {id} URL parameter and writes an
+// error response if there is none
+func (h *Handler) userFromURL(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return nil, false
+	}
+	user, err := h.store.GetUserByID(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get user")
+		return nil, false
+	}
+	if user == nil {
+		respondError(w, http.StatusNotFound, "User not found")
+		return nil, false
+	}
+	return user, true
+}
+
+// canChangeUser checks that updating current to next (nil to delete it) does
+// not lock anyone out: callers cannot delete, disable or demote themselves,
+// and the last enabled admin must remain
+func (h *Handler) canChangeUser(w http.ResponseWriter, r *http.Request, current, next *models.User) bool {
+	removesAccess := next == nil || !next.Enabled || next.Role != current.Role
+	if caller := UserFromContext(r.Context()); removesAccess && caller != nil && caller.ID == current.ID {
+		respondError(w, http.StatusBadRequest, "You cannot delete, disable or change the role of your own account")
+		return false
+	}
+
+	removesAdmin := next == nil || !next.Enabled || next.Role != auth.RoleAdmin
+	if !current.Enabled || current.Role != auth.RoleAdmin || !removesAdmin {
+		return true
+	}
+	users, err := h.store.GetAllUsers()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get users")
+		return false
+	}
+	admins := 0
+	for _, u := range users {
+		if u.Enabled && u.Role == auth.RoleAdmin {
+			admins++
+		}
+	}
+	if admins <= 1 {
+		respondError(w, http.StatusBadRequest, "At least one enabled admin must remain")
+		return false
+	}
+	return true
+}
+
+// Container Management Handlers
+
+func (h *Handler) CloneContainerHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SourceVMID int    `json:"source_vmid"`
+		NewVMID    int    `json:"new_vmid"`
+		TargetNode string `json:"target_node"`
+		Hostname   string `json:"hostname"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.SourceVMID == 0 || req.NewVMID == 0 || req.TargetNode == "" {
+		respondError(w, http.StatusBadRequest, "source_vmid, new_vmid, and target_node are required")
+		return
+	}
+
+	// Clone the container
+	if err := proxmox.CloneContainer(req.SourceVMID, req.NewVMID, req.TargetNode, req.Hostname); err != nil {
+		log.Printf("ERROR: Failed to clone container: %v", err)
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":     "Container cloned successfully",
+		"source_vmid": req.SourceVMID,
+		"new_vmid":    req.NewVMID,
+		"target_node": req.TargetNode,
+	})
+}
+
+func (h *Handler) DeleteContainerHandler(w http.ResponseWriter, r *http.Request) {
+	vmidStr := chi.URLParam(r, "vmid")
+	vmid, err := strconv.Atoi(vmidStr)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid VMID")
+		return
+	}
+
+	node := r.URL.Query().Get("node")
+	if node == "" {
+		respondError(w, http.StatusBadRequest, "node query parameter is required")
+		return
+	}
+
+	// Delete the container
+	if err := proxmox.DeleteContainer(vmid, node); err != nil {
+		log.Printf("ERROR: Failed to delete container: %v", err)
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Remove from whitelist if exists
+	_ = h.store.DeleteWhitelistByVMID(vmid, node)
+
+	// Remove service records
+	_ = h.store.DeleteServicesByVMID(vmid, node)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Container deleted successfully",
+		"vmid":    vmid,
+		"node":    node,
+	})
+}
+
+func (h *Handler) DeployBlockchainNodeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SourceVMID int      `json:"source_vmid"`
+		NewVMID    int      `json:"new_vmid"`
+		TargetNode string   `json:"target_node"`
+		Hostname   string   `json:"hostname"`
+		Commands   []string `json:"commands"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.SourceVMID == 0 || req.NewVMID == 0 || req.TargetNode == "" {
+		respondError(w, http.StatusBadRequest, "source_vmid, new_vmid, and target_node are required")
+		return
+	}
+
+	if len(req.Commands) == 0 {
+		respondError(w, http.StatusBadRequest, "commands array is required")
+		return
+	}
+
+	// Deploy blockchain node
+	if err := proxmox.DeployBlockchainNode(req.SourceVMID, req.NewVMID, req.TargetNode, req.Hostname, req.Commands); err != nil {
+		log.Printf("ERROR: Failed to deploy blockchain node: %v", err)
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Record service installation in database
 	serviceName := req.Hostname
 	if serviceName == "" {
 		serviceName = fmt.Sprintf("blockchain-node-%d", req.NewVMID)
@@ -545,17 +1673,17 @@ func DeployBlockchainNodeHandler(w http.ResponseWriter, r *http.Request) {
 		allCommands += cmd
 	}
 
-	_ = db.CreateContainerService(req.NewVMID, req.TargetNode, serviceName, serviceType, allCommands)
+	_ = h.store.CreateContainerService(req.NewVMID, req.TargetNode, serviceName, serviceType, allCommands)
 
 	// Log the deployment
 	now := time.Now()
-	_, _ = db.CreateRestartLog(&models.RestartLog{
+	_, _ = h.store.CreateRestartLog(&models.RestartLog{
 		VMID:         req.NewVMID,
 		ResourceName: req.Hostname,
 		Node:         req.TargetNode,
 		Action:       "deploy",
 		TriggerType:  "manual",
-		TriggeredBy:  "api",
+		TriggeredBy:  actor(r),
 		Status:       "success",
 		StartedAt:    now,
 		CompletedAt:  &now,
@@ -569,17 +1697,19 @@ func DeployBlockchainNodeHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func GetNextAvailableVMID(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetNextAvailableVMID(w http.ResponseWriter, r *http.Request) {
 	// Fetch all resources to find max VMID
-	resources, err := proxmox.GetAllResources()
+	resources, err := h.resources.GetAllResources()
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch resources")
 		return
 	}
 
+	// Callers with grants only learn about their own guests
+	scope := scopeOf(r)
 	maxVMID := 100 // Start from 100 if no resources exist
 	for _, resource := range resources {
-		if resource.VMID > maxVMID {
+		if resource.VMID > maxVMID && scope.Allows(resource) {
 			maxVMID = resource.VMID
 		}
 	}
@@ -592,7 +1722,7 @@ func GetNextAvailableVMID(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func GetContainerServicesHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetContainerServicesHandler(w http.ResponseWriter, r *http.Request) {
 	vmidStr := chi.URLParam(r, "vmid")
 	vmid, err := strconv.Atoi(vmidStr)
 	if err != nil {
@@ -606,7 +1736,11 @@ func GetContainerServicesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	services, err := db.GetServicesByVMID(vmid, node)
+	if !h.requireGuest(w, r, vmid, node) {
+		return
+	}
+
+	services, err := h.store.GetServicesByVMID(vmid, node)
 	if err != nil {
 		log.Printf("ERROR: Failed to get services: %v", err)
 		respondError(w, http.StatusInternalServerError, "Failed to get services")
@@ -616,10 +1750,11 @@ func GetContainerServicesHandler(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, services)
 }
 
-func HealthCheck(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	health := map[string]interface{}{
 		"status":            "ok",
 		"proxmox_available": proxmox.IsProxmoxInstalled(),
+		"proxmox_backend":   proxmox.GetBackend().Name(),
 		"timestamp":         time.Now(),
 	}
 	respondJSON(w, http.StatusOK, health)
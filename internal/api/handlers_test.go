@@ -0,0 +1,1530 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rakib/proxmox-auto-restart/internal/asciicast"
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
+	"github.com/rakib/proxmox-auto-restart/internal/auth/authtest"
+	"github.com/rakib/proxmox-auto-restart/internal/config"
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+	"github.com/rakib/proxmox-auto-restart/internal/scheduler"
+)
+
+const (
+	testUser     = "tester"
+	testPassword = "tester-secret"
+)
+
+var (
+	// testStore is the store behind the router returned by setupTest
+	testStore db.Store
+	// testScheduler runs the restarts of that router
+	testScheduler *scheduler.Scheduler
+)
+
+// newTestStore returns a store on a fresh in-memory database
+func newTestStore(t *testing.T) db.Store {
+	t.Helper()
+	conn, err := db.Open(":memory:")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	store := db.NewStore(conn)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// setupTest returns a router backed by an in-memory database and a fake cluster
+func setupTest(t *testing.T) (http.Handler, *proxmox.FakeBackend) {
+	t.Helper()
+	testStore = newTestStore(t)
+	testScheduler = scheduler.New(testStore)
+	if _, err := auth.CreateUser(testStore, testUser, testPassword, auth.RoleAdmin); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	fake := proxmox.NewFakeBackend("pve1", "pve2")
+	fake.AddGuest(models.Resource{VMID: 100, Name: "template", Type: "lxc", Node: "pve1", Status: "stopped"})
+	fake.AddGuest(models.Resource{VMID: 101, Name: "db", Type: "lxc", Node: "pve1", Status: "running"})
+	fake.AddGuest(models.Resource{VMID: 102, Name: "app", Type: "qemu", Node: "pve2", Status: "running"})
+
+	previous := proxmox.GetBackend()
+	proxmox.SetBackend(fake)
+	proxmox.TaskPollInterval = time.Millisecond
+	scheduler.SetVerifyConfig(scheduler.VerifyConfig{Timeout: time.Second, PollInterval: time.Millisecond})
+	testScheduler.SetQueueConfig(scheduler.QueueConfig{})
+	SetTerminalConfig(TerminalConfig{TicketTTL: 30 * time.Second, IdleTimeout: 30 * time.Minute, RecordingDir: t.TempDir()})
+	t.Cleanup(func() { proxmox.SetBackend(previous) })
+
+	return SetupRoutes(NewHandler(testStore, testScheduler)), fake
+}
+
+// changeTerminalConfig changes some of the terminal settings
+func changeTerminalConfig(change func(*TerminalConfig)) {
+	cfg := getTerminalConfig()
+	change(&cfg)
+	SetTerminalConfig(cfg)
+}
+
+// doRequest performs an authenticated request and decodes the JSON response into out
+func doRequest(t *testing.T, h http.Handler, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	return doRequestAs(t, h, testUser, testPassword, method, path, body, out)
+}
+
+// doRequestAs performs a request with the given credentials
+func doRequestAs(t *testing.T, h http.Handler, username, password, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	return send(t, h, func(req *http.Request) { req.SetBasicAuth(username, password) }, method, path, body, out)
+}
+
+// doRequestWithToken performs a request authenticated with an API token
+func doRequestWithToken(t *testing.T, h http.Handler, token, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	return send(t, h, func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }, method, path, body, out)
+}
+
+// send performs a request after authenticate has added its credentials
+func send(t *testing.T, h http.Handler, authenticate func(*http.Request), method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	authenticate(req)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("decode %s %s response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAuthRequired(t *testing.T) {
+	h, _ := setupTest(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/resources", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", rec.Code)
+	}
+	if code := doRequestAs(t, h, testUser, "wrong-password", http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong password, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("health check should not require auth, got %d", rec.Code)
+	}
+}
+
+func TestUnknownUserTakesAsLong(t *testing.T) {
+	h, _ := setupTest(t)
+
+	// fastest returns the quickest of a few refused sign-ins as username
+	fastest := func(username string) time.Duration {
+		best := time.Hour
+		for range 3 {
+			start := time.Now()
+			if code := doRequestAs(t, h, username, "wrong-password", http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+				t.Fatalf("expected 401 for %s, got %d", username, code)
+			}
+			best = min(best, time.Since(start))
+		}
+		return best
+	}
+	known, unknown := fastest(testUser), fastest("nobody")
+	if unknown < known/2 {
+		t.Errorf("unknown usernames are refused in %s, known ones in %s", unknown, known)
+	}
+}
+
+func TestGetResourcesPagination(t *testing.T) {
+	h, _ := setupTest(t)
+
+	var resp struct {
+		Data  []models.Resource `json:"data"`
+		Total int               `json:"total"`
+	}
+	if code := doRequest(t, h, http.MethodGet, "/api/resources?limit=2&offset=1", nil, &resp); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if resp.Total != 3 || len(resp.Data) != 2 || resp.Data[0].VMID != 101 {
+		t.Errorf("unexpected page: %+v", resp)
+	}
+}
+
+func TestGetResourcesBackendFailure(t *testing.T) {
+	h, fake := setupTest(t)
+	fake.InjectFailure(proxmox.OpGetAllResources, 0, errors.New("cluster unreachable"))
+
+	if code := doRequest(t, h, http.MethodGet, "/api/resources", nil, nil); code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", code)
+	}
+}
+
+func TestRestartResourceEndToEnd(t *testing.T) {
+	h, fake := setupTest(t)
+
+	// triggered_by comes from the authenticated user, not the request body
+	body := map[string]string{"triggered_by": "bob"}
+	if code := doRequest(t, h, http.MethodPost, "/api/resources/102/restart?node=pve2", body, nil); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+
+	// The restart runs asynchronously; wait for its log entry to complete
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var logs []models.RestartLog
+		doRequest(t, h, http.MethodGet, "/api/logs?vmid=102", nil, &logs)
+		if len(logs) == 1 && logs[0].Status != "pending" {
+			if logs[0].Status != "success" || logs[0].TriggeredBy != testUser {
+				t.Errorf("unexpected log %+v", logs[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for restart log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 1 {
+		t.Errorf("expected 1 restart call, got %d", got)
+	}
+}
+
+func TestRestartResourceUnavailable(t *testing.T) {
+	h, fake := setupTest(t)
+	fake.SetAvailable(false)
+
+	if code := doRequest(t, h, http.MethodPost, "/api/resources/101/restart?node=pve1", nil, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", code)
+	}
+}
+
+func TestWhitelistCRUD(t *testing.T) {
+	h, _ := setupTest(t)
+
+	create := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", create, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", models.CreateWhitelistRequest{VMID: 101}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing fields, got %d", code)
+	}
+
+	var list []models.Whitelist
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if len(list) != 1 || list[0].VMID != 101 || !list[0].Enabled || list[0].CreatedBy != testUser {
+		t.Fatalf("unexpected whitelist %+v", list)
+	}
+
+	// The path holds the entry ID, not the VMID
+	path := "/api/whitelist/" + strconv.FormatInt(list[0].ID, 10)
+	update := models.UpdateWhitelistRequest{Enabled: true, Notes: "primary"}
+	if code := doRequest(t, h, http.MethodPut, path, update, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on update, got %d", code)
+	}
+	list = nil
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if len(list) != 1 || list[0].Notes != "primary" {
+		t.Errorf("update by entry ID not applied: %+v", list)
+	}
+
+	if code := doRequest(t, h, http.MethodDelete, path, nil, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", code)
+	}
+	list = nil
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if len(list) != 0 {
+		t.Errorf("whitelist should be empty, got %+v", list)
+	}
+}
+
+func TestHandlersUseTheirOwnStore(t *testing.T) {
+	h, _ := setupTest(t)
+	otherStore := newTestStore(t)
+	auth.CreateUser(otherStore, testUser, testPassword, auth.RoleAdmin)
+	other := SetupRoutes(NewHandler(otherStore, scheduler.New(otherStore)))
+
+	create := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", create, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+
+	var list []models.Whitelist
+	doRequest(t, other, http.MethodGet, "/api/whitelist", nil, &list)
+	if len(list) != 0 {
+		t.Errorf("second store should be empty, got %+v", list)
+	}
+}
+
+func TestWhitelistSchedule(t *testing.T) {
+	h, _ := setupTest(t)
+
+	bad := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", CronExpression: "sometimes"}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", bad, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid cron expression, got %d", code)
+	}
+
+	create := models.CreateWhitelistRequest{
+		VMID: 101, ResourceName: "db", Node: "pve1", RestartIntervalHours: 12,
+		CronExpression: "30 3 * * 1-5", WindowStart: "02:00", WindowEnd: "05:00", Timezone: "Asia/Dhaka",
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", create, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+
+	var list []models.Whitelist
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if len(list) != 1 {
+		t.Fatalf("expected one entry, got %d", len(list))
+	}
+	wl := list[0]
+	if wl.RestartIntervalHours != 12 || wl.CronExpression != "30 3 * * 1-5" || wl.WindowStart != "02:00" ||
+		wl.WindowEnd != "05:00" || wl.Timezone != "Asia/Dhaka" {
+		t.Errorf("schedule not stored: %+v", wl)
+	}
+
+	update := map[string]interface{}{
+		"enabled": true, "cron_expression": "", "window_start": "01:00", "window_end": "04:00", "timezone": "UTC",
+	}
+	path := "/api/whitelist/" + strconv.FormatInt(wl.ID, 10)
+	if code := doRequest(t, h, http.MethodPut, path, update, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on update, got %d", code)
+	}
+	list = nil
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if list[0].CronExpression != "" || list[0].WindowStart != "01:00" || list[0].Timezone != "UTC" {
+		t.Errorf("update not applied: %+v", list[0])
+	}
+
+	update["window_end"] = ""
+	if code := doRequest(t, h, http.MethodPut, path, update, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for half-open window, got %d", code)
+	}
+}
+
+func TestWhitelistPartialUpdate(t *testing.T) {
+	h, _ := setupTest(t)
+
+	var group struct {
+		ID int64 `json:"id"`
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/groups", models.RestartGroupRequest{Name: "db"}, &group); code != http.StatusCreated {
+		t.Fatalf("expected 201 creating a group, got %d", code)
+	}
+	create := models.CreateWhitelistRequest{
+		VMID: 101, ResourceName: "db", Node: "pve1", WindowStart: "02:00", WindowEnd: "05:00", Timezone: "UTC",
+		GroupID: group.ID, GroupOrder: 2, RestartMode: scheduler.RestartModeWatchdog,
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", create, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	wl, _ := testStore.GetWhitelistByVMID(101)
+	path := "/api/whitelist/" + strconv.FormatInt(wl.ID, 10)
+
+	// Omitted mode, window and group fields keep their stored values
+	if code := doRequest(t, h, http.MethodPut, path, map[string]interface{}{"restart_interval_hours": 12}, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on update, got %d", code)
+	}
+	wl, _ = testStore.GetWhitelistByVMID(101)
+	if wl.RestartIntervalHours != 12 || wl.RestartMode != scheduler.RestartModeWatchdog || wl.WindowStart != "02:00" ||
+		wl.WindowEnd != "05:00" || wl.Timezone != "UTC" || wl.GroupID != group.ID || wl.GroupOrder != 2 {
+		t.Errorf("partial update changed omitted fields: %+v", wl)
+	}
+
+	// A change is validated together with the stored fields
+	if code := doRequest(t, h, http.MethodPut, path, map[string]interface{}{"window_end": ""}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a half-open window, got %d", code)
+	}
+}
+
+func TestRestartGroups(t *testing.T) {
+	h, fake := setupTest(t)
+
+	if code := doRequest(t, h, http.MethodPost, "/api/groups", models.RestartGroupRequest{}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing name, got %d", code)
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/groups", models.RestartGroupRequest{Name: "stack"}, &created); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/groups", models.RestartGroupRequest{Name: "stack"}, nil); code != http.StatusConflict {
+		t.Errorf("expected 409 for duplicate name, got %d", code)
+	}
+
+	orphan := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", GroupID: created.ID + 1}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", orphan, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown group, got %d", code)
+	}
+	member := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", GroupID: created.ID, GroupOrder: 1}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", member, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+
+	path := "/api/groups/" + strconv.FormatInt(created.ID, 10)
+	var group models.RestartGroup
+	doRequest(t, h, http.MethodGet, path, nil, &group)
+	if !group.WaitHealthy || !group.StopOnFailure || len(group.Members) != 1 || group.Members[0].VMID != 101 {
+		t.Fatalf("unexpected group %+v", group)
+	}
+
+	if code := doRequest(t, h, http.MethodPost, path+"/restart", nil, nil); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+
+	// The group runs through the restart queue; wait for the member to be verified
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var logs []models.RestartLog
+		doRequest(t, h, http.MethodGet, "/api/logs?vmid=101", nil, &logs)
+		if len(logs) == 1 && logs[0].Verification == scheduler.VerificationVerified {
+			if logs[0].TriggerType != "manual" || logs[0].TriggeredBy != testUser {
+				t.Errorf("unexpected log %+v", logs[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for group restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 1 {
+		t.Errorf("expected 1 restart call, got %d", got)
+	}
+
+	if code := doRequest(t, h, http.MethodPost, "/api/groups/999/restart", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown group, got %d", code)
+	}
+
+	if code := doRequest(t, h, http.MethodDelete, path, nil, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", code)
+	}
+	var list []models.Whitelist
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if len(list) != 1 || list[0].GroupID != 0 {
+		t.Errorf("deleting a group should ungroup its members, got %+v", list)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	h, _ := setupTest(t)
+
+	bad := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", RestartMode: "sometimes"}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", bad, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid restart_mode, got %d", code)
+	}
+	create := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", RestartMode: "watchdog"}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", create, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	var list []models.Whitelist
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if list[0].RestartMode != "watchdog" {
+		t.Fatalf("restart_mode not stored: %+v", list[0])
+	}
+	wlID := list[0].ID
+
+	check := models.HealthCheckRequest{WhitelistID: wlID, Type: "tcp", Target: "10.0.0.5"}
+	if code := doRequest(t, h, http.MethodPost, "/api/health-checks", check, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for target without port, got %d", code)
+	}
+	check.Target = "10.0.0.5:5432"
+	if code := doRequest(t, h, http.MethodPost, "/api/health-checks", check, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+
+	// exec checks run commands as root in the container, so only admins may set them
+	auth.CreateUser(testStore, "op", "op-secret-password", auth.RoleOperator)
+	asOperator := func(method, path string, body interface{}) int {
+		return doRequestAs(t, h, "op", "op-secret-password", method, path, body, nil)
+	}
+	exec := models.HealthCheckRequest{WhitelistID: wlID, Type: "exec", Target: "systemctl is-active postgresql"}
+	if code := asOperator(http.MethodPost, "/api/health-checks", exec); code != http.StatusForbidden {
+		t.Errorf("expected 403 for an operator's exec check, got %d", code)
+	}
+	if code := asOperator(http.MethodPut, "/api/health-checks/1", exec); code != http.StatusForbidden {
+		t.Errorf("expected 403 for an operator turning a check into exec, got %d", code)
+	}
+	if code := asOperator(http.MethodPut, "/api/health-checks/1", check); code != http.StatusOK {
+		t.Errorf("expected 200 for an operator's tcp check, got %d", code)
+	}
+
+	var checks []models.HealthCheck
+	doRequest(t, h, http.MethodGet, "/api/health-checks?whitelist_id="+strconv.FormatInt(wlID, 10), nil, &checks)
+	if len(checks) != 1 || checks[0].VMID != 101 || checks[0].FailureThreshold != 3 || !checks[0].Enabled {
+		t.Fatalf("unexpected health checks %+v", checks)
+	}
+
+	if code := doRequest(t, h, http.MethodDelete, "/api/whitelist/"+strconv.FormatInt(wlID, 10), nil, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", code)
+	}
+	checks = nil
+	doRequest(t, h, http.MethodGet, "/api/health-checks", nil, &checks)
+	if len(checks) != 0 {
+		t.Errorf("health checks should be removed with their whitelist entry, got %+v", checks)
+	}
+}
+
+func TestUnquarantineWhitelist(t *testing.T) {
+	h, _ := setupTest(t)
+
+	create := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist", create, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	var list []models.Whitelist
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if err := testStore.SetQuarantine(list[0].ID, 1, time.Now().Add(time.Hour), "3 failed restarts within 6h0m0s"); err != nil {
+		t.Fatalf("SetQuarantine: %v", err)
+	}
+
+	list = nil
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if !list[0].Quarantined || list[0].QuarantineReason == "" || list[0].QuarantinedUntil == nil {
+		t.Fatalf("quarantine not visible: %+v", list[0])
+	}
+
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist/999/unquarantine", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown entry, got %d", code)
+	}
+	path := "/api/whitelist/" + strconv.FormatInt(list[0].ID, 10) + "/unquarantine"
+	if code := doRequest(t, h, http.MethodPost, path, nil, nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	list = nil
+	doRequest(t, h, http.MethodGet, "/api/whitelist", nil, &list)
+	if list[0].Quarantined || list[0].QuarantinedUntil != nil {
+		t.Errorf("quarantine not lifted: %+v", list[0])
+	}
+}
+
+func TestWhitelistManifest(t *testing.T) {
+	h, _ := setupTest(t)
+	testStore.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", CreatedBy: "ui"})
+
+	// JSON is valid YAML, so the manifest can be sent either way
+	manifest := map[string]interface{}{
+		"whitelist": []map[string]interface{}{
+			{"vmid": 101, "resource_name": "db", "node": "pve1", "restart_interval_hours": 12},
+			{"vmid": 102, "resource_name": "app", "node": "pve2"},
+		},
+	}
+
+	if code := doRequest(t, h, http.MethodGet, "/api/whitelist/drift", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 before any apply, got %d", code)
+	}
+
+	var result struct {
+		DryRun bool                    `json:"dry_run"`
+		Plan   scheduler.WhitelistPlan `json:"plan"`
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist/apply?dry_run=true", manifest, &result); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if !result.DryRun || result.Plan.Add != 1 || result.Plan.Update != 1 {
+		t.Errorf("unexpected dry run %+v", result)
+	}
+	if all, _ := testStore.GetAllWhitelist(); len(all) != 1 {
+		t.Fatalf("dry run should not change the whitelist, got %+v", all)
+	}
+
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist/apply", manifest, &result); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if all, _ := testStore.GetAllWhitelist(); len(all) != 2 || all[0].RestartIntervalHours != 12 {
+		t.Errorf("unexpected whitelist after apply %+v", all)
+	}
+
+	testStore.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 100, ResourceName: "template", Node: "pve1", CreatedBy: "ui"})
+	var drift scheduler.WhitelistDrift
+	if code := doRequest(t, h, http.MethodGet, "/api/whitelist/drift", nil, &drift); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if drift.InSync || drift.Manifest.AppliedBy != testUser || drift.Plan.Remove != 1 {
+		t.Errorf("unexpected drift %+v", drift)
+	}
+
+	bad := map[string]interface{}{"whitelist": []map[string]interface{}{{"vmid": 103, "node": "pve1"}}}
+	if code := doRequest(t, h, http.MethodPost, "/api/whitelist/apply", bad, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid manifest, got %d", code)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	h, _ := setupTest(t)
+
+	var me models.User
+	if code := doRequest(t, h, http.MethodGet, "/api/users/me", nil, &me); code != http.StatusOK || me.Username != testUser {
+		t.Fatalf("unexpected current user %+v (%d)", me, code)
+	}
+
+	var alice models.User
+	create := models.CreateUserRequest{Username: "alice", Password: "alice-secret", Role: auth.RoleOperator}
+	if code := doRequest(t, h, http.MethodPost, "/api/users", create, &alice); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if alice.Role != auth.RoleOperator {
+		t.Errorf("unexpected role %q", alice.Role)
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/users", create, nil); code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate username, got %d", code)
+	}
+	weak := models.CreateUserRequest{Username: "bob", Password: "proxmox2024"}
+	if code := doRequest(t, h, http.MethodPost, "/api/users", weak, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for the former default password, got %d", code)
+	}
+
+	// The new account can sign in and is recorded as the actor
+	whitelist := models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}
+	if code := doRequestAs(t, h, "alice", "alice-secret", http.MethodPost, "/api/whitelist", whitelist, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if wl, _ := testStore.GetWhitelistByVMID(101); wl.CreatedBy != "alice" {
+		t.Errorf("created_by should be the authenticated user, got %q", wl.CreatedBy)
+	}
+
+	path := "/api/users/" + strconv.FormatInt(alice.ID, 10)
+	update := map[string]interface{}{"password": "alice-new-secret"}
+	if code := doRequest(t, h, http.MethodPut, path, update, nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := doRequestAs(t, h, "alice", "alice-secret", http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("old password should stop working, got %d", code)
+	}
+	if code := doRequestAs(t, h, "alice", "alice-new-secret", http.MethodGet, "/api/status", nil, nil); code != http.StatusOK {
+		t.Errorf("new password should work, got %d", code)
+	}
+
+	// Nobody can lock themselves out, and an admin must remain
+	mePath := "/api/users/" + strconv.FormatInt(me.ID, 10)
+	if code := doRequest(t, h, http.MethodDelete, mePath, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 when deleting yourself, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodPut, mePath, map[string]interface{}{"role": auth.RoleViewer}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 when demoting yourself, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodPut, path, map[string]interface{}{"role": "root"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown role, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodPut, path, map[string]interface{}{"enabled": false}, nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := doRequestAs(t, h, "alice", "alice-new-secret", http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("disabled user should be rejected, got %d", code)
+	}
+
+	if code := doRequest(t, h, http.MethodDelete, path, nil, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", code)
+	}
+	var users []models.User
+	doRequest(t, h, http.MethodGet, "/api/users", nil, &users)
+	if len(users) != 1 || users[0].Username != testUser {
+		t.Errorf("unexpected users %+v", users)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	h, _ := setupTest(t)
+	auth.CreateUser(testStore, "viewer", "viewer-secret", auth.RoleViewer)
+	auth.CreateUser(testStore, "operator", "operator-secret", auth.RoleOperator)
+
+	tests := []struct {
+		method, path string
+		body         interface{}
+		viewer       int
+		operator     int
+	}{
+		{http.MethodGet, "/api/resources", nil, http.StatusOK, http.StatusOK},
+		{http.MethodGet, "/api/logs", nil, http.StatusOK, http.StatusOK},
+		{http.MethodGet, "/api/users/me", nil, http.StatusOK, http.StatusOK},
+		{http.MethodPost, "/api/groups", models.RestartGroupRequest{Name: "web"}, http.StatusForbidden, http.StatusCreated},
+		{http.MethodPost, "/api/whitelist", models.CreateWhitelistRequest{VMID: 102, ResourceName: "app", Node: "pve2"},
+			http.StatusForbidden, http.StatusCreated},
+		{http.MethodDelete, "/api/containers/101?node=pve1", nil, http.StatusForbidden, http.StatusForbidden},
+		{http.MethodPost, "/api/containers/clone", nil, http.StatusForbidden, http.StatusForbidden},
+		{http.MethodGet, "/api/users", nil, http.StatusForbidden, http.StatusForbidden},
+		{http.MethodGet, "/api/admin/backups", nil, http.StatusForbidden, http.StatusForbidden},
+		// Terminals are root shells and need the admin role
+		{http.MethodPost, "/api/terminal/tickets", models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1"},
+			http.StatusForbidden, http.StatusForbidden},
+		{http.MethodGet, "/api/terminal/sessions", nil, http.StatusForbidden, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if code := doRequestAs(t, h, "viewer", "viewer-secret", tt.method, tt.path, tt.body, nil); code != tt.viewer {
+			t.Errorf("viewer %s %s: expected %d, got %d", tt.method, tt.path, tt.viewer, code)
+		}
+		if code := doRequestAs(t, h, "operator", "operator-secret", tt.method, tt.path, tt.body, nil); code != tt.operator {
+			t.Errorf("operator %s %s: expected %d, got %d", tt.method, tt.path, tt.operator, code)
+		}
+	}
+}
+
+func TestGrants(t *testing.T) {
+	h, fake := setupTest(t)
+	fake.AddGuest(models.Resource{VMID: 103, Name: "api", Type: "lxc", Node: "pve1", Status: "running", Pool: "team-a"})
+	user, _ := auth.CreateUser(testStore, "team-a", "team-a-secret", auth.RoleOperator)
+	grantsPath := "/api/users/" + strconv.FormatInt(user.ID, 10) + "/grants"
+	asTeam := func(method, path string, body, out interface{}) int {
+		return doRequestAs(t, h, "team-a", "team-a-secret", method, path, body, out)
+	}
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if code := doRequest(t, h, http.MethodPost, grantsPath, models.UserGrantRequest{Scope: "node", Value: "pve2"}, &created); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodPost, grantsPath, models.UserGrantRequest{Scope: "node", Value: "pve2"}, nil); code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate grant, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodPost, grantsPath, models.UserGrantRequest{Scope: "vmid", Value: "200-100"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an empty VMID range, got %d", code)
+	}
+	doRequest(t, h, http.MethodPost, grantsPath, models.UserGrantRequest{Scope: "pool", Value: "team-a"}, nil)
+
+	var resources struct {
+		Data  []models.Resource `json:"data"`
+		Total int               `json:"total"`
+	}
+	asTeam(http.MethodGet, "/api/resources", nil, &resources)
+	if resources.Total != 2 || resources.Data[0].VMID != 102 || resources.Data[1].VMID != 103 {
+		t.Fatalf("expected guests 102 and 103, got %+v", resources)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		body         interface{}
+		want         int
+	}{
+		{http.MethodGet, "/api/resources/101?node=pve1", nil, http.StatusForbidden},
+		{http.MethodGet, "/api/resources/103?node=pve1", nil, http.StatusOK},
+		{http.MethodPost, "/api/resources/101/restart?node=pve1", nil, http.StatusForbidden},
+		{http.MethodPost, "/api/resources/101/stop?node=pve1", nil, http.StatusForbidden},
+		{http.MethodPost, "/api/whitelist", models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}, http.StatusForbidden},
+		{http.MethodPost, "/api/whitelist", models.CreateWhitelistRequest{VMID: 102, ResourceName: "app", Node: "pve2"}, http.StatusCreated},
+		{http.MethodPost, "/api/whitelist/apply", nil, http.StatusForbidden},
+	} {
+		if code := asTeam(tt.method, tt.path, tt.body, nil); code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, code)
+		}
+	}
+
+	// Team B's whitelist entries and logs are hidden
+	doRequest(t, h, http.MethodPost, "/api/whitelist", models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}, nil)
+	var whitelist []models.Whitelist
+	asTeam(http.MethodGet, "/api/whitelist", nil, &whitelist)
+	if len(whitelist) != 1 || whitelist[0].VMID != 102 {
+		t.Errorf("expected only guest 102 in the whitelist, got %+v", whitelist)
+	}
+	other, _ := testStore.GetWhitelistByVMID(101)
+	if code := asTeam(http.MethodDelete, "/api/whitelist/"+strconv.FormatInt(other.ID, 10), nil, nil); code != http.StatusForbidden {
+		t.Errorf("expected 403 deleting another team's entry, got %d", code)
+	}
+
+	// Groups with another team's members can be neither changed nor joined
+	var shared, own struct {
+		ID int64 `json:"id"`
+	}
+	doRequest(t, h, http.MethodPost, "/api/groups", models.RestartGroupRequest{Name: "shared"}, &shared)
+	testStore.UpdateWhitelist(other.ID, &models.UpdateWhitelistRequest{Enabled: true, GroupID: &shared.ID})
+	mine, _ := testStore.GetWhitelistByVMID(102)
+	sharedPath := "/api/groups/" + strconv.FormatInt(shared.ID, 10)
+	minePath := "/api/whitelist/" + strconv.FormatInt(mine.ID, 10)
+	if code := asTeam(http.MethodPost, "/api/groups", models.RestartGroupRequest{Name: "team-a"}, &own); code != http.StatusCreated {
+		t.Fatalf("expected 201 creating a group, got %d", code)
+	}
+	for _, tt := range []struct {
+		method, path string
+		body         interface{}
+		want         int
+	}{
+		{http.MethodPut, sharedPath, models.RestartGroupRequest{Name: "renamed"}, http.StatusForbidden},
+		{http.MethodDelete, sharedPath, nil, http.StatusForbidden},
+		{http.MethodPost, sharedPath + "/restart", nil, http.StatusForbidden},
+		{http.MethodPut, minePath, models.UpdateWhitelistRequest{Enabled: true, GroupID: &shared.ID}, http.StatusForbidden},
+		{http.MethodPost, "/api/whitelist", models.CreateWhitelistRequest{VMID: 103, ResourceName: "api", Node: "pve1", GroupID: shared.ID}, http.StatusForbidden},
+		{http.MethodPut, minePath, models.UpdateWhitelistRequest{Enabled: true, GroupID: &own.ID}, http.StatusOK},
+		{http.MethodPut, "/api/groups/" + strconv.FormatInt(own.ID, 10), models.RestartGroupRequest{Name: "team-a-web"}, http.StatusOK},
+	} {
+		if code := asTeam(tt.method, tt.path, tt.body, nil); code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, code)
+		}
+	}
+	if group, _ := testStore.GetRestartGroupByID(shared.ID); group == nil || group.Name != "shared" || len(group.Members) != 1 {
+		t.Errorf("shared group changed: %+v", group)
+	}
+
+	for _, g := range []struct {
+		vmid int
+		node string
+	}{{101, "pve1"}, {102, "pve2"}, {103, "pve1"}} {
+		testStore.CreateRestartLog(&models.RestartLog{
+			VMID: g.vmid, Node: g.node, Action: "restart", TriggerType: "manual",
+			TriggeredBy: "test", Status: "success", StartedAt: time.Now(),
+		})
+	}
+	var logs []models.RestartLog
+	asTeam(http.MethodGet, "/api/logs", nil, &logs)
+	if len(logs) != 2 {
+		t.Errorf("expected the logs of guests 102 and 103, got %+v", logs)
+	}
+	for _, l := range logs {
+		if l.VMID == 101 {
+			t.Errorf("log of guest 101 visible: %+v", l)
+		}
+	}
+
+	var withGrants models.User
+	doRequest(t, h, http.MethodGet, "/api/users/"+strconv.FormatInt(user.ID, 10), nil, &withGrants)
+	if len(withGrants.Grants) != 2 {
+		t.Errorf("expected 2 grants on the user, got %+v", withGrants.Grants)
+	}
+
+	// Without grants the account is unrestricted again
+	for _, g := range withGrants.Grants {
+		if code := doRequest(t, h, http.MethodDelete, grantsPath+"/"+strconv.FormatInt(g.ID, 10), nil, nil); code != http.StatusOK {
+			t.Fatalf("expected 200 deleting a grant, got %d", code)
+		}
+	}
+	if code := doRequest(t, h, http.MethodDelete, grantsPath+"/"+strconv.FormatInt(created.ID, 10), nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted grant, got %d", code)
+	}
+	asTeam(http.MethodGet, "/api/resources", nil, &resources)
+	if resources.Total != 4 {
+		t.Errorf("expected every guest without grants, got %d", resources.Total)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	h, _ := setupTest(t)
+	owner, _ := auth.CreateUser(testStore, "ci", "ci-secret-password", auth.RoleOperator)
+	asOwner := func(method, path string, body, out interface{}) int {
+		return doRequestAs(t, h, "ci", "ci-secret-password", method, path, body, out)
+	}
+
+	var created struct {
+		models.APIToken
+		Token string `json:"token"`
+	}
+	code := asOwner(http.MethodPost, "/api/tokens", models.CreateAPITokenRequest{
+		Name: "deploy", Scopes: []string{"node:pve2"},
+	}, &created)
+	if code != http.StatusCreated || created.Token == "" || created.Role != auth.RoleOperator {
+		t.Fatalf("expected 201 with a token, got %d %+v", code, created)
+	}
+	if code := asOwner(http.MethodPost, "/api/tokens", models.CreateAPITokenRequest{Name: "root", Role: auth.RoleAdmin}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a token above the owner's role, got %d", code)
+	}
+
+	// The token acts for its owner within its scopes
+	var resources struct {
+		Total int `json:"total"`
+	}
+	if code := doRequestWithToken(t, h, created.Token, http.MethodGet, "/api/resources", nil, &resources); code != http.StatusOK || resources.Total != 1 {
+		t.Errorf("expected the one guest on pve2, got %d with %d guests", code, resources.Total)
+	}
+	if code := doRequestWithToken(t, h, created.Token, http.MethodPost, "/api/whitelist",
+		models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}, nil); code != http.StatusForbidden {
+		t.Errorf("expected 403 outside the token's scopes, got %d", code)
+	}
+	if code := doRequestWithToken(t, h, created.Token, http.MethodPost, "/api/whitelist",
+		models.CreateWhitelistRequest{VMID: 102, ResourceName: "app", Node: "pve2"}, nil); code != http.StatusCreated {
+		t.Errorf("expected 201 within the token's scopes, got %d", code)
+	}
+	wl, _ := testStore.GetWhitelistByVMID(102)
+	if wl == nil || wl.CreatedBy != "ci (token deploy)" {
+		t.Errorf("expected the token recorded as the author, got %+v", wl)
+	}
+	if code := doRequestWithToken(t, h, created.Token, http.MethodGet, "/api/users", nil, nil); code != http.StatusForbidden {
+		t.Errorf("expected 403 above the token's role, got %d", code)
+	}
+	if code := doRequestWithToken(t, h, created.Token, http.MethodGet, "/api/tokens", nil, nil); code != http.StatusForbidden {
+		t.Errorf("expected tokens to be refused on /api/tokens, got %d", code)
+	}
+
+	var tokens []models.APIToken
+	asOwner(http.MethodGet, "/api/tokens", nil, &tokens)
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil || tokens[0].Prefix == "" {
+		t.Errorf("expected one used token, got %+v", tokens)
+	}
+
+	// Unknown, expired and revoked tokens are rejected
+	if code := doRequestWithToken(t, h, "par_unknown", http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", code)
+	}
+	expired := time.Now().Add(-time.Hour)
+	testStore.CreateAPIToken(&models.APIToken{
+		UserID: owner.ID, Name: "old", Prefix: "par_old", TokenHash: auth.HashToken("par_old-secret"),
+		Role: auth.RoleViewer, ExpiresAt: &expired,
+	})
+	if code := doRequestWithToken(t, h, "par_old-secret", http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an expired token, got %d", code)
+	}
+	if code := doRequest(t, h, http.MethodDelete, "/api/tokens/"+strconv.FormatInt(created.ID, 10), nil, nil); code != http.StatusOK {
+		t.Fatalf("expected an admin to revoke the token, got %d", code)
+	}
+	if code := doRequestWithToken(t, h, created.Token, http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a revoked token, got %d", code)
+	}
+}
+
+// stubResources is a ResourceLister with a fixed guest list
+type stubResources struct {
+	guests []models.Resource
+	err    error
+}
+
+func (s stubResources) GetAllResources() ([]models.Resource, error) {
+	return s.guests, s.err
+}
+
+func TestGrantsUseResourceLister(t *testing.T) {
+	setupTest(t)
+	user, _ := auth.CreateUser(testStore, "team-c", "team-c-secret", auth.RoleViewer)
+	testStore.CreateUserGrant(user.ID, "pool", "team-c")
+	for _, vmid := range []int{101, 102} {
+		testStore.CreateWhitelist(&models.CreateWhitelistRequest{VMID: vmid, ResourceName: "guest", Node: "pve1", CreatedBy: "test"})
+	}
+
+	// Pools come from the handler's lister, not the Proxmox backend
+	handler := NewHandler(testStore, testScheduler)
+	handler.SetResourceLister(stubResources{guests: []models.Resource{
+		{VMID: 101, Node: "pve1", Status: "running", Pool: "team-c"},
+		{VMID: 102, Node: "pve1", Status: "running"},
+	}})
+	h := SetupRoutes(handler)
+	var whitelist []models.Whitelist
+	doRequestAs(t, h, "team-c", "team-c-secret", http.MethodGet, "/api/whitelist", nil, &whitelist)
+	if len(whitelist) != 1 || whitelist[0].VMID != 101 {
+		t.Errorf("expected only guest 101 in the whitelist, got %+v", whitelist)
+	}
+
+	handler.SetResourceLister(stubResources{err: errors.New("cluster unreachable")})
+	if code := doRequestAs(t, h, "team-c", "team-c-secret", http.MethodGet, "/api/whitelist", nil, nil); code != http.StatusInternalServerError {
+		t.Errorf("expected 500 when grants cannot be checked, got %d", code)
+	}
+	if code := doRequestAs(t, h, "team-c", "team-c-secret", http.MethodGet, "/api/logs", nil, nil); code != http.StatusInternalServerError {
+		t.Errorf("expected 500 for logs when grants cannot be checked, got %d", code)
+	}
+}
+
+func TestScopedAdminToken(t *testing.T) {
+	h, _ := setupTest(t)
+	admin, _ := testStore.GetUserByUsername(testUser)
+
+	var scoped, unscoped struct {
+		Token string `json:"token"`
+	}
+	doRequest(t, h, http.MethodPost, "/api/tokens", models.CreateAPITokenRequest{Name: "team-a", Scopes: []string{"node:pve2"}}, &scoped)
+	doRequest(t, h, http.MethodPost, "/api/tokens", models.CreateAPITokenRequest{Name: "ops"}, &unscoped)
+	if scoped.Token == "" || unscoped.Token == "" {
+		t.Fatal("expected two tokens")
+	}
+
+	// A scoped admin token reaches its guests, but not accounts or administration
+	if code := doRequestWithToken(t, h, scoped.Token, http.MethodGet, "/api/resources", nil, nil); code != http.StatusOK {
+		t.Errorf("expected 200 for resources, got %d", code)
+	}
+	grants := "/api/users/" + strconv.FormatInt(admin.ID, 10) + "/grants"
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodGet, "/api/users", nil},
+		{http.MethodPost, "/api/users", models.CreateUserRequest{Username: "mallory", Password: "mallory-secret", Role: auth.RoleAdmin}},
+		{http.MethodPost, grants, models.UserGrantRequest{Scope: "node", Value: "pve1"}},
+		{http.MethodGet, "/api/admin/logs", nil},
+		{http.MethodPost, "/api/admin/backup", nil},
+		{http.MethodPost, "/api/containers/clone", map[string]interface{}{"source_vmid": 102, "new_vmid": 200, "node": "pve2"}},
+		{http.MethodPost, "/api/containers/deploy-node", map[string]interface{}{"source_vmid": 102, "new_vmid": 201, "target_node": "pve1"}},
+		{http.MethodDelete, "/api/containers/101?node=pve1", nil},
+	} {
+		if code := doRequestWithToken(t, h, scoped.Token, req.method, req.path, req.body, nil); code != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403 for a scoped token, got %d", req.method, req.path, code)
+		}
+	}
+	if code := doRequestWithToken(t, h, unscoped.Token, http.MethodGet, "/api/users", nil, nil); code != http.StatusOK {
+		t.Errorf("expected 200 for an unscoped admin token, got %d", code)
+	}
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	setupTest(t)
+	issuer, err := authtest.NewIssuer("par", "client-secret")
+	if err != nil {
+		t.Fatalf("NewIssuer: %v", err)
+	}
+	defer issuer.Close()
+	provider, err := auth.NewOIDCProvider(context.Background(), config.OIDCConfig{
+		Issuer:        issuer.URL,
+		ClientID:      "par",
+		ClientSecret:  "client-secret",
+		RedirectURL:   "http://par.test/api/auth/oidc/callback",
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		RoleMapping:   map[string]string{"ops": auth.RoleOperator},
+		SessionTTL:    config.Duration(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	handler := NewHandler(testStore, testScheduler)
+	handler.SetOIDC(provider)
+	h := SetupRoutes(handler)
+	issuer.SetUser("alice", "ops")
+
+	// Sign in: the API sends the browser to the issuer, which sends it back
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login?redirect=/whitelist", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the issuer, got %d", rec.Code)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil))
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/whitelist" || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected the session cookie and a redirect back, got %d %q %+v", rec.Code, rec.Header().Get("Location"), cookies)
+	}
+	withCookie := func(req *http.Request) { req.AddCookie(cookies[0]) }
+
+	var me models.User
+	if code := send(t, h, withCookie, http.MethodGet, "/api/users/me", nil, &me); code != http.StatusOK || me.Username != "alice" ||
+		me.Role != auth.RoleOperator || me.Provider != auth.ProviderOIDC {
+		t.Fatalf("expected alice as an operator, got %d %+v", code, me)
+	}
+	crossSite := func(req *http.Request) {
+		withCookie(req)
+		req.Header.Set("Origin", "http://evil.test")
+	}
+	if code := send(t, h, crossSite, http.MethodPost, "/api/whitelist",
+		models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1"}, nil); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a cross-origin request with the cookie, got %d", code)
+	}
+	if code := doRequestAs(t, h, "alice", "", http.MethodGet, "/api/status", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected no password login for an OIDC account, got %d", code)
+	}
+
+	if code := send(t, h, withCookie, http.MethodPost, "/api/terminal/tickets",
+		models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1"}, nil); code != http.StatusForbidden {
+		t.Errorf("expected the operator to be refused a terminal ticket, got %d", code)
+	}
+
+	if code := send(t, h, withCookie, http.MethodPost, "/api/auth/logout", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected logout to succeed, got %d", code)
+	}
+	if code := send(t, h, withCookie, http.MethodGet, "/api/users/me", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after logout, got %d", code)
+	}
+}
+
+func TestLDAPSignIn(t *testing.T) {
+	setupTest(t)
+	directory, err := authtest.NewLDAP()
+	if err != nil {
+		t.Fatalf("NewLDAP: %v", err)
+	}
+	defer directory.Close()
+	directory.Add(authtest.LDAPEntry{DN: "ou=people,dc=example,dc=com"})
+	for _, uid := range []string{"alice", testUser} {
+		directory.Add(authtest.LDAPEntry{
+			DN: "uid=" + uid + ",ou=people,dc=example,dc=com", Password: uid + "-ldap-secret",
+			Attributes: map[string][]string{"objectClass": {"person"}, "uid": {uid}, "memberOf": {"cn=ops,ou=groups,dc=example,dc=com"}},
+		})
+	}
+
+	cfg := config.Default().LDAP
+	cfg.URL = directory.URL
+	cfg.UserBaseDN = "ou=people,dc=example,dc=com"
+	cfg.RoleMapping = map[string]string{"ops": auth.RoleOperator}
+	provider, err := auth.NewLDAPProvider(cfg)
+	if err != nil {
+		t.Fatalf("NewLDAPProvider: %v", err)
+	}
+	handler := NewHandler(testStore, testScheduler)
+	handler.SetPasswordProvider(provider)
+	h := SetupRoutes(handler)
+
+	var me models.User
+	if code := doRequestAs(t, h, "alice", "alice-ldap-secret", http.MethodGet, "/api/users/me", nil, &me); code != http.StatusOK ||
+		me.Provider != auth.ProviderLDAP || me.Role != auth.RoleOperator {
+		t.Fatalf("expected alice as an LDAP operator, got %d %+v", code, me)
+	}
+	if code := doRequestAs(t, h, "alice", "wrong", http.MethodGet, "/api/users/me", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong LDAP password, got %d", code)
+	}
+
+	// Local accounts keep their own passwords and are never checked against LDAP
+	if code := doRequest(t, h, http.MethodGet, "/api/users/me", nil, nil); code != http.StatusOK {
+		t.Errorf("expected the local account to sign in, got %d", code)
+	}
+	if code := doRequestAs(t, h, testUser, testUser+"-ldap-secret", http.MethodGet, "/api/users/me", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected the directory password of a local account to be refused, got %d", code)
+	}
+}
+
+func TestTerminalTickets(t *testing.T) {
+	h, _ := setupTest(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	issue := func(req models.CreateTerminalTicketRequest) string {
+		t.Helper()
+		var resp struct {
+			Ticket    string    `json:"ticket"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		if code := doRequest(t, h, http.MethodPost, "/api/terminal/tickets", req, &resp); code != http.StatusCreated ||
+			!strings.HasPrefix(resp.Ticket, auth.TicketPrefix) || resp.ExpiresAt.IsZero() {
+			t.Fatalf("expected a ticket, got %d %+v", code, resp)
+		}
+		return resp.Ticket
+	}
+	connect := func(query, origin string) int {
+		t.Helper()
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws/terminal?"+query, header)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, req := range []models.CreateTerminalTicketRequest{
+		{Node: "pve1"},
+		{VMID: 101},
+		{VMID: 101, Node: "pve1", Type: "docker"},
+	} {
+		if code := doRequest(t, h, http.MethodPost, "/api/terminal/tickets", req, nil); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %+v, got %d", req, code)
+		}
+	}
+
+	// Tickets open one connection
+	ticket := issue(models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1", Type: "lxc"})
+	if code := connect("ticket="+ticket+"&vmid=101&node=pve1", ""); code != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the ticket to open a terminal, got %d", code)
+	}
+	if code := connect("ticket="+ticket, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected a used ticket to be refused, got %d", code)
+	}
+	if code := connect("vmid=101&node=pve1&username="+testUser+"&password="+testPassword, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected credentials without a ticket to be refused, got %d", code)
+	}
+
+	// Tickets are bound to their guest
+	ticket = issue(models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1", Type: "lxc"})
+	if code := connect("ticket="+ticket+"&vmid=102", ""); code != http.StatusForbidden {
+		t.Errorf("expected a ticket for another guest to be refused, got %d", code)
+	}
+
+	// Other sites need to be allowed
+	ticket = issue(models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1"})
+	if code := connect("ticket="+ticket, "http://evil.test"); code != http.StatusForbidden {
+		t.Errorf("expected a cross-origin terminal to be refused, got %d", code)
+	}
+	changeTerminalConfig(func(cfg *TerminalConfig) { cfg.AllowedOrigins = []string{"https://dash.example.com"} })
+	if code := connect("ticket="+ticket, "https://dash.example.com"); code != http.StatusSwitchingProtocols {
+		t.Errorf("expected an allowed origin to open a terminal, got %d", code)
+	}
+
+	changeTerminalConfig(func(cfg *TerminalConfig) { cfg.TicketTTL = time.Nanosecond })
+	ticket = issue(models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1"})
+	if code := connect("ticket="+ticket, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected an expired ticket to be refused, got %d", code)
+	}
+}
+
+func TestTerminalProtocol(t *testing.T) {
+	h, _ := setupTest(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+	previous := terminalCommand
+	t.Cleanup(func() { terminalCommand = previous })
+	// A shell that prints the terminal size after each line of input
+	terminalCommand = func(string, int) *exec.Cmd {
+		return exec.Command("sh", "-c", "while read line; do stty size; done")
+	}
+
+	open := func() *websocket.Conn {
+		t.Helper()
+		var resp struct{ Ticket string }
+		if code := doRequest(t, h, http.MethodPost, "/api/terminal/tickets",
+			models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1", Type: "lxc"}, &resp); code != http.StatusCreated {
+			t.Fatalf("expected a ticket, got %d", code)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws/terminal?ticket="+resp.Ticket, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	// expect reads until output containing want, or a control message of type want
+	expect := func(conn *websocket.Conn, want string) {
+		t.Helper()
+		var output string
+		for {
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("expected %q, got %q and %v", want, output, err)
+			}
+			var msg terminalMessage
+			if kind == websocket.TextMessage && json.Unmarshal(data, &msg) == nil && msg.Type == want {
+				return
+			}
+			if output += string(data); strings.Contains(output, want) {
+				return
+			}
+		}
+	}
+	// closed reads until the server closes the connection
+	closed := func(conn *websocket.Conn) error {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return err
+			}
+		}
+	}
+	control := func(conn *websocket.Conn, msg terminalMessage) {
+		t.Helper()
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatalf("write control message: %v", err)
+		}
+	}
+
+	conn := open()
+	control(conn, terminalMessage{Type: terminalResize, Rows: 40, Cols: 120})
+	conn.WriteMessage(websocket.BinaryMessage, []byte("\n"))
+	expect(conn, "40 120")
+
+	control(conn, terminalMessage{Type: terminalPing})
+	expect(conn, terminalPong)
+	control(conn, terminalMessage{Type: terminalResize})
+	expect(conn, terminalError)
+	conn.WriteMessage(websocket.TextMessage, []byte("ls\n"))
+	expect(conn, terminalError)
+	control(conn, terminalMessage{Type: terminalSignal, Signal: "SIGWINCH"})
+	expect(conn, terminalError)
+
+	// SIGTERM ends the shell and with it the session
+	control(conn, terminalMessage{Type: terminalSignal, Signal: "term"})
+	if err := closed(conn); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected the session to close when the shell exits, got %v", err)
+	}
+	conn.Close()
+
+	// Sessions without input are closed
+	changeTerminalConfig(func(cfg *TerminalConfig) { cfg.IdleTimeout = 200 * time.Millisecond })
+	conn = open()
+	defer conn.Close()
+	control(conn, terminalMessage{Type: terminalPing})
+	expect(conn, terminalPong)
+	if err := closed(conn); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected an idle session to be closed, got %v", err)
+	}
+}
+
+func TestTerminalRecording(t *testing.T) {
+	h, _ := setupTest(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+	previous := terminalCommand
+	t.Cleanup(func() { terminalCommand = previous })
+	terminalCommand = func(string, int) *exec.Cmd {
+		return exec.Command("sh", "-c", "read line; echo \"got $line\"")
+	}
+
+	connect := func() (*websocket.Conn, int) {
+		t.Helper()
+		var resp struct{ Ticket string }
+		doRequest(t, h, http.MethodPost, "/api/terminal/tickets", models.CreateTerminalTicketRequest{VMID: 101, Node: "pve1", Type: "lxc"}, &resp)
+		conn, httpResp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws/terminal?ticket="+resp.Ticket, nil)
+		if httpResp == nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return conn, httpResp.StatusCode
+	}
+
+	conn, _ := connect()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteJSON(terminalMessage{Type: terminalResize, Rows: 30, Cols: 100})
+	conn.WriteMessage(websocket.BinaryMessage, []byte("top-secret\n"))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	conn.Close()
+
+	// The session is stored once the handler has finished it
+	var sessions []models.TerminalSession
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if code := doRequest(t, h, http.MethodGet, "/api/terminal/sessions?vmid=101", nil, &sessions); code != http.StatusOK {
+			t.Fatalf("expected the sessions, got %d", code)
+		}
+		if len(sessions) == 1 && sessions[0].EndedAt != nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(sessions) != 1 || sessions[0].Username != testUser || sessions[0].EndedAt == nil ||
+		sessions[0].InputBytes != int64(len("top-secret\n")) || sessions[0].OutputBytes == 0 {
+		t.Fatalf("expected one finished session, got %+v", sessions)
+	}
+	var others []models.TerminalSession
+	if code := doRequest(t, h, http.MethodGet, "/api/terminal/sessions?vmid=102", nil, &others); code != http.StatusOK || len(others) != 0 {
+		t.Errorf("expected no sessions on 102, got %d %+v", code, others)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/terminal/sessions/%d/recording", sessions[0].ID), nil)
+	req.SetBasicAuth(testUser, testPassword)
+	h.ServeHTTP(rec, req)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != asciicast.ContentType || len(lines) < 3 {
+		t.Fatalf("expected the recording, got %d %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	for _, want := range []string{`"version":2`, `"r","100x30"]`, `"i","top-secret\n"]`, `got top-secret`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected %s in the recording:\n%s", want, rec.Body.String())
+		}
+	}
+	if code := doRequest(t, h, http.MethodGet, "/api/terminal/sessions/999/recording", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown session, got %d", code)
+	}
+
+	// Without a recording there is no terminal
+	blocked := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(blocked, nil, 0o600)
+	changeTerminalConfig(func(cfg *TerminalConfig) { cfg.RecordingDir = blocked })
+	if _, code := connect(); code != http.StatusInternalServerError {
+		t.Errorf("expected 500 when the recording cannot be written, got %d", code)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	for redirect, want := range map[string]bool{
+		"/":                   true,
+		"/whitelist?vmid=100": true,
+		"":                    false,
+		"//evil.test/":        false,
+		"/\\evil.test/":       false,
+		"https://evil.test/":  false,
+	} {
+		if got := localRedirect(redirect); got != want {
+			t.Errorf("localRedirect(%q) = %t, want %t", redirect, got, want)
+		}
+	}
+}
+
+func TestLogRetentionAdmin(t *testing.T) {
+	h, _ := setupTest(t)
+	scheduler.SetRetentionConfig(scheduler.RetentionConfig{MaxAge: 24 * time.Hour})
+	t.Cleanup(func() { scheduler.SetRetentionConfig(scheduler.RetentionConfig{}) })
+
+	for _, age := range []time.Duration{48 * time.Hour, time.Hour} {
+		_, err := testStore.CreateRestartLog(&models.RestartLog{
+			VMID: 101, ResourceName: "db", Node: "pve1", Action: "restart", TriggerType: "auto",
+			TriggeredBy: "scheduler", Status: "success", StartedAt: time.Now().Add(-age),
+		})
+		if err != nil {
+			t.Fatalf("CreateRestartLog: %v", err)
+		}
+	}
+
+	var stats struct {
+		Table     models.LogTableStats `json:"table"`
+		Retention struct {
+			Enabled bool   `json:"enabled"`
+			MaxAge  string `json:"max_age"`
+		} `json:"retention"`
+	}
+	doRequest(t, h, http.MethodGet, "/api/admin/logs", nil, &stats)
+	if stats.Table.Rows != 2 || stats.Table.ByStatus["success"] != 2 || !stats.Retention.Enabled || stats.Retention.MaxAge != "24h0m0s" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	var result scheduler.PruneResult
+	if code := doRequest(t, h, http.MethodPost, "/api/admin/logs/prune", nil, &result); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if result.Deleted != 1 {
+		t.Errorf("expected 1 pruned log, got %+v", result)
+	}
+}
+
+func TestBackupEndpoints(t *testing.T) {
+	h, _ := setupTest(t)
+	scheduler.SetBackupConfig(scheduler.BackupConfig{Dir: t.TempDir(), Keep: 3})
+	t.Cleanup(func() { scheduler.SetBackupConfig(scheduler.BackupConfig{Dir: "./backups", Keep: 7}) })
+
+	var backup scheduler.BackupInfo
+	if code := doRequest(t, h, http.MethodPost, "/api/admin/backup", nil, &backup); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if backup.SizeBytes == 0 {
+		t.Errorf("empty backup %+v", backup)
+	}
+
+	var backups []scheduler.BackupInfo
+	doRequest(t, h, http.MethodGet, "/api/admin/backups", nil, &backups)
+	if len(backups) != 1 || backups[0].Name != backup.Name {
+		t.Errorf("unexpected backups %+v", backups)
+	}
+}
+
+func TestDeployAndDeleteContainer(t *testing.T) {
+	h, fake := setupTest(t)
+
+	deploy := map[string]interface{}{
+		"source_vmid": 100,
+		"new_vmid":    110,
+		"target_node": "pve2",
+		"hostname":    "grow-1",
+		"commands":    []string{"bash install-growblockchain.sh"},
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/containers/deploy-node", deploy, nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if g, ok := fake.Guest(110); !ok || g.Status != "running" {
+		t.Fatalf("expected running guest 110, got %+v", g)
+	}
+
+	var services []models.ContainerService
+	doRequest(t, h, http.MethodGet, "/api/containers/110/services?node=pve2", nil, &services)
+	if len(services) != 1 || services[0].ServiceType != "grow" {
+		t.Errorf("unexpected services %+v", services)
+	}
+
+	// A whitelist entry for the same VMID on another node is left alone
+	for _, node := range []string{"pve1", "pve2"} {
+		testStore.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 110, ResourceName: "grow-1", Node: node, CreatedBy: "test"})
+	}
+	if code := doRequest(t, h, http.MethodDelete, "/api/containers/110?node=pve2", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", code)
+	}
+	if _, ok := fake.Guest(110); ok {
+		t.Error("guest 110 should be destroyed")
+	}
+	if whitelist, _ := testStore.GetAllWhitelist(); len(whitelist) != 1 || whitelist[0].Node != "pve1" {
+		t.Errorf("expected only the whitelist entry on pve1 left, got %+v", whitelist)
+	}
+	services = nil
+	doRequest(t, h, http.MethodGet, "/api/containers/110/services?node=pve2", nil, &services)
+	if len(services) != 0 {
+		t.Errorf("service records should be removed, got %+v", services)
+	}
+}
+
+func TestDeployFailureReported(t *testing.T) {
+	h, fake := setupTest(t)
+	fake.InjectFailure(proxmox.OpCloneContainer, 0, errors.New("storage full"))
+
+	deploy := map[string]interface{}{
+		"source_vmid": 100, "new_vmid": 111, "target_node": "pve1", "commands": []string{"true"},
+	}
+	if code := doRequest(t, h, http.MethodPost, "/api/containers/deploy-node", deploy, nil); code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", code)
+	}
+}
+
+func TestGetNextAvailableVMID(t *testing.T) {
+	h, _ := setupTest(t)
+
+	var resp map[string]int
+	doRequest(t, h, http.MethodGet, "/api/containers/next-vmid", nil, &resp)
+	if resp["suggested_vmid"] != 103 {
+		t.Errorf("expected suggested_vmid 103, got %v", resp)
+	}
+}
+
+func TestStatusAndNextVMIDInScope(t *testing.T) {
+	h, fake := setupTest(t)
+	fake.AddGuest(models.Resource{VMID: 150, Name: "other", Type: "lxc", Node: "pve1", Status: "stopped"})
+	user, _ := auth.CreateUser(testStore, "team-b", "team-b-secret", auth.RoleViewer)
+	grantsPath := "/api/users/" + strconv.FormatInt(user.ID, 10) + "/grants"
+	doRequest(t, h, http.MethodPost, grantsPath, models.UserGrantRequest{Scope: "node", Value: "pve2"}, nil)
+	for _, req := range []models.CreateWhitelistRequest{
+		{VMID: 101, ResourceName: "db", Node: "pve1"},
+		{VMID: 102, ResourceName: "app", Node: "pve2"},
+	} {
+		doRequest(t, h, http.MethodPost, "/api/whitelist", req, nil)
+	}
+
+	// Counts only cover the caller's guests
+	var status models.SystemStatus
+	doRequestAs(t, h, "team-b", "team-b-secret", http.MethodGet, "/api/status", nil, &status)
+	if status.TotalResources != 1 || status.RunningResources != 1 || status.WhitelistedCount != 1 {
+		t.Errorf("expected counts of guest 102 only, got %+v", status)
+	}
+	status = models.SystemStatus{}
+	doRequest(t, h, http.MethodGet, "/api/status", nil, &status)
+	if status.TotalResources != 4 || status.WhitelistedCount != 2 {
+		t.Errorf("expected cluster-wide counts for an admin, got %+v", status)
+	}
+
+	// The highest VMID outside the caller's scope is not revealed
+	var resp map[string]int
+	doRequestAs(t, h, "team-b", "team-b-secret", http.MethodGet, "/api/containers/next-vmid", nil, &resp)
+	if resp["max_vmid"] != 102 {
+		t.Errorf("expected max_vmid 102 in scope, got %v", resp)
+	}
+	doRequest(t, h, http.MethodGet, "/api/containers/next-vmid", nil, &resp)
+	if resp["max_vmid"] != 150 {
+		t.Errorf("expected max_vmid 150, got %v", resp)
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rakib/proxmox-auto-restart/internal/asciicast"
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// startRecording creates the recording of a terminal session and indexes it
+// in the terminal_sessions table
+func (h *Handler) startRecording(user *models.User, ticket *auth.TerminalTicket) (*models.TerminalSession, *asciicast.Writer, error) {
+	dir := getTerminalConfig().RecordingDir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	started := time.Now()
+	session := &models.TerminalSession{
+		UserID:    user.ID,
+		Username:  user.Username,
+		VMID:      ticket.VMID,
+		Node:      ticket.Node,
+		Type:      ticket.Type,
+		Recording: filepath.Join(dir, fmt.Sprintf("%d-%s.cast", ticket.VMID, started.UTC().Format("20060102T150405.000000000Z"))),
+		StartedAt: started,
+	}
+	recording, err := asciicast.Create(session.Recording, asciicast.Header{
+		Width:  80,
+		Height: 24,
+		Title:  fmt.Sprintf("%s on %s %d (%s)", user.Username, ticket.Type, ticket.VMID, ticket.Node),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.ID, err = h.store.CreateTerminalSession(session); err != nil {
+		recording.Close()
+		os.Remove(session.Recording)
+		return nil, nil, fmt.Errorf("failed to store terminal session: %w", err)
+	}
+	return session, recording, nil
+}
+
+// finishRecording closes the recording and stores the end of the session
+func (h *Handler) finishRecording(session *models.TerminalSession, recording *asciicast.Writer) {
+	if err := recording.Close(); err != nil {
+		log.Printf("ERROR: Recording of terminal session %d is incomplete: %v", session.ID, err)
+	}
+	ended := time.Now()
+	session.EndedAt = &ended
+	session.InputBytes, session.OutputBytes = recording.Bytes()
+	if err := h.store.FinishTerminalSession(session); err != nil {
+		log.Printf("ERROR: Failed to store the end of terminal session %d: %v", session.ID, err)
+	}
+}
+
+// GetTerminalSessions lists recorded terminal sessions, newest first
+func (h *Handler) GetTerminalSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.TerminalSessionFilter{
+		Username: query.Get("username"),
+		Node:     query.Get("node"),
+		Limit:    100,
+	}
+	if vmid, err := strconv.Atoi(query.Get("vmid")); err == nil {
+		filter.VMID = vmid
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil {
+		filter.Limit = limit
+	}
+	if offset, err := strconv.Atoi(query.Get("offset")); err == nil {
+		filter.Offset = offset
+	}
+	if startDate, err := time.Parse(time.RFC3339, query.Get("start_date")); err == nil {
+		filter.StartDate = &startDate
+	}
+	if endDate, err := time.Parse(time.RFC3339, query.Get("end_date")); err == nil {
+		filter.EndDate = &endDate
+	}
+
+	// Only the guests covered by the caller's grants
+	var ok bool
+	if filter.Scopes, ok = h.logScopes(w, r); !ok {
+		return
+	}
+
+	sessions, err := h.store.GetTerminalSessions(filter)
+	if err != nil {
+		log.Printf("ERROR: Failed to get terminal sessions: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get terminal sessions")
+		return
+	}
+	if sessions == nil {
+		sessions = []models.TerminalSession{}
+	}
+	respondJSON(w, http.StatusOK, sessions)
+}
+
+// GetTerminalSession returns one terminal session
+func (h *Handler) GetTerminalSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.terminalSession(w, r)
+	if !ok {
+		return
+	}
+	respondJSON(w, http.StatusOK, session)
+}
+
+// GetTerminalRecording sends the asciicast recording of a terminal session,
+// which asciinema can play. Recordings of open sessions are sent as far as
+// they have been written.
+func (h *Handler) GetTerminalRecording(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.terminalSession(w, r)
+	if !ok {
+		return
+	}
+
+	file, err := os.Open(session.Recording)
+	if os.IsNotExist(err) {
+		respondError(w, http.StatusNotFound, "Recording not found")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to open recording of terminal session %d: %v", session.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to open recording")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to open recording")
+		return
+	}
+
+	log.Printf("Recording of terminal session %d downloaded by %s", session.ID, actor(r))
+	w.Header().Set("Content-Type", asciicast.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(session.Recording)))
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// terminalSession loads the session named by the URL, writing an error
+// response unless it exists and its guest is within the caller's grants
+func (h *Handler) terminalSession(w http.ResponseWriter, r *http.Request) (*models.TerminalSession, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return nil, false
+	}
+	session, err := h.store.GetTerminalSessionByID(id)
+	if err != nil {
+		log.Printf("ERROR: Failed to get terminal session %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get terminal session")
+		return nil, false
+	}
+	if session == nil {
+		respondError(w, http.StatusNotFound, "Terminal session not found")
+		return nil, false
+	}
+	if !h.requireGuest(w, r, session.VMID, session.Node) {
+		return nil, false
+	}
+	return session, true
+}
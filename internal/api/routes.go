@@ -6,10 +6,11 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
 )
 
 // SetupRoutes configures all HTTP routes with middleware
-func SetupRoutes() http.Handler {
+func SetupRoutes(h *Handler) http.Handler {
 	r := chi.NewRouter()
 
 	// Middleware
@@ -28,51 +29,128 @@ func SetupRoutes() http.Handler {
 	}))
 
 	// Health check (no auth required)
-	r.Get("/health", HealthCheck)
+	r.Get("/health", h.HealthCheck)
 
-	// WebSocket routes (custom auth via query parameters)
+	// WebSocket routes (authenticated by a ticket from POST /api/terminal/tickets)
 	r.Route("/api/ws", func(r chi.Router) {
-		r.Get("/terminal", TerminalHandler) // WS /api/ws/terminal?vmid=100&node=pve&type=lxc&username=admin&password=xxx
+		r.Get("/terminal", h.TerminalHandler) // WS /api/ws/terminal?ticket=pat_...
 	})
 
-	// API routes (with authentication)
+	// Browser sign-in (no auth required)
+	r.Route("/api/auth", func(r chi.Router) {
+		r.Get("/oidc/login", h.OIDCLogin)       // GET /api/auth/oidc/login?redirect=/
+		r.Get("/oidc/callback", h.OIDCCallback) // GET /api/auth/oidc/callback?state=...&code=...
+		r.Post("/logout", h.Logout)             // POST /api/auth/logout
+	})
+
+	// API routes (with authentication). Every role can read; changes need the
+	// operator role, and containers, users and administration the admin role.
+	operator := RequireRole(auth.RoleOperator)
+	admin := RequireRole(auth.RoleAdmin)
+
 	r.Route("/api", func(r chi.Router) {
-		// Apply basic auth to all API routes
-		r.Use(BasicAuthMiddleware)
+		// Password or API token authentication on all API routes
+		r.Use(h.AuthMiddleware)
+		r.Use(RequireRole(auth.RoleViewer))
 
 		// Resources (VMs and Containers)
 		r.Route("/resources", func(r chi.Router) {
-			r.Get("/", GetResources)                   // GET /api/resources
-			r.Get("/{vmid}", GetResource)              // GET /api/resources/103?node=www
-			r.Post("/{vmid}/restart", RestartResource) // POST /api/resources/103/restart?node=www
-			r.Post("/{vmid}/stop", StopResource)       // POST /api/resources/103/stop?node=www
-			r.Post("/{vmid}/start", StartResource)     // POST /api/resources/103/start?node=www
+			r.Get("/", h.GetResources)                                  // GET /api/resources
+			r.Get("/{vmid}", h.GetResource)                             // GET /api/resources/103?node=www
+			r.With(operator).Post("/{vmid}/restart", h.RestartResource) // POST /api/resources/103/restart?node=www
+			r.With(operator).Post("/{vmid}/stop", h.StopResource)       // POST /api/resources/103/stop?node=www
+			r.With(operator).Post("/{vmid}/start", h.StartResource)     // POST /api/resources/103/start?node=www
 		})
 
 		// Whitelist
 		r.Route("/whitelist", func(r chi.Router) {
-			r.Get("/", GetWhitelist)               // GET /api/whitelist
-			r.Post("/", AddToWhitelist)            // POST /api/whitelist
-			r.Put("/{id}", UpdateWhitelist)        // PUT /api/whitelist/1
-			r.Delete("/{id}", DeleteFromWhitelist) // DELETE /api/whitelist/1
+			r.Get("/", h.GetWhitelist)                                           // GET /api/whitelist
+			r.With(operator).Post("/", h.AddToWhitelist)                         // POST /api/whitelist
+			r.With(operator).Post("/apply", h.ApplyWhitelistManifest)            // POST /api/whitelist/apply?dry_run=true
+			r.Get("/drift", h.GetWhitelistDrift)                                 // GET /api/whitelist/drift
+			r.With(operator).Put("/{id}", h.UpdateWhitelist)                     // PUT /api/whitelist/1
+			r.With(operator).Delete("/{id}", h.DeleteFromWhitelist)              // DELETE /api/whitelist/1
+			r.With(operator).Post("/{id}/unquarantine", h.UnquarantineWhitelist) // POST /api/whitelist/1/unquarantine
+		})
+
+		// Restart groups
+		r.Route("/groups", func(r chi.Router) {
+			r.Get("/", h.GetRestartGroups)                                // GET /api/groups
+			r.With(operator).Post("/", h.CreateRestartGroup)              // POST /api/groups
+			r.Get("/{id}", h.GetRestartGroup)                             // GET /api/groups/1
+			r.With(operator).Put("/{id}", h.UpdateRestartGroup)           // PUT /api/groups/1
+			r.With(operator).Delete("/{id}", h.DeleteRestartGroup)        // DELETE /api/groups/1
+			r.With(operator).Post("/{id}/restart", h.RestartGroupHandler) // POST /api/groups/1/restart
+		})
+
+		// Watchdog health checks
+		r.Route("/health-checks", func(r chi.Router) {
+			r.Get("/", h.GetHealthChecks)                         // GET /api/health-checks?whitelist_id=1
+			r.With(operator).Post("/", h.CreateHealthCheck)       // POST /api/health-checks
+			r.With(operator).Put("/{id}", h.UpdateHealthCheck)    // PUT /api/health-checks/1
+			r.With(operator).Delete("/{id}", h.DeleteHealthCheck) // DELETE /api/health-checks/1
 		})
 
 		// Logs
 		r.Route("/logs", func(r chi.Router) {
-			r.Get("/", GetLogs) // GET /api/logs?vmid=103&status=success
+			r.Get("/", h.GetLogs) // GET /api/logs?vmid=103&status=success
 		})
 
 		// Container Management
 		r.Route("/containers", func(r chi.Router) {
-			r.Post("/clone", CloneContainerHandler)                // POST /api/containers/clone
-			r.Delete("/{vmid}", DeleteContainerHandler)            // DELETE /api/containers/103?node=www
-			r.Post("/deploy-node", DeployBlockchainNodeHandler)    // POST /api/containers/deploy-node
-			r.Get("/next-vmid", GetNextAvailableVMID)              // GET /api/containers/next-vmid
-			r.Get("/{vmid}/services", GetContainerServicesHandler) // GET /api/containers/103/services?node=www
+			// Clones and deployments may target any node, so changes need a
+			// caller without grants or token scopes
+			manage := r.With(admin, RequireUnrestricted)
+			manage.Post("/clone", h.CloneContainerHandler)             // POST /api/containers/clone
+			manage.Delete("/{vmid}", h.DeleteContainerHandler)         // DELETE /api/containers/103?node=www
+			manage.Post("/deploy-node", h.DeployBlockchainNodeHandler) // POST /api/containers/deploy-node
+			r.Get("/next-vmid", h.GetNextAvailableVMID)                // GET /api/containers/next-vmid
+			r.Get("/{vmid}/services", h.GetContainerServicesHandler)   // GET /api/containers/103/services?node=www
+		})
+
+		// Web terminals and their recordings
+		r.Route("/terminal", func(r chi.Router) {
+			r.Use(admin)
+			r.Post("/tickets", h.CreateTerminalTicket)                // POST /api/terminal/tickets
+			r.Get("/sessions", h.GetTerminalSessions)                 // GET /api/terminal/sessions?vmid=103&username=alice
+			r.Get("/sessions/{id}", h.GetTerminalSession)             // GET /api/terminal/sessions/1
+			r.Get("/sessions/{id}/recording", h.GetTerminalRecording) // GET /api/terminal/sessions/1/recording
+		})
+
+		// User accounts
+		r.Get("/users/me", h.GetCurrentUser) // GET /api/users/me
+		r.Route("/users", func(r chi.Router) {
+			r.Use(admin, RequireUnrestricted)
+			r.Get("/", h.GetUsers)          // GET /api/users
+			r.Post("/", h.CreateUser)       // POST /api/users
+			r.Get("/{id}", h.GetUser)       // GET /api/users/1
+			r.Put("/{id}", h.UpdateUser)    // PUT /api/users/1
+			r.Delete("/{id}", h.DeleteUser) // DELETE /api/users/1
+
+			r.Get("/{id}/grants", h.GetUserGrants)                // GET /api/users/1/grants
+			r.Post("/{id}/grants", h.CreateUserGrant)             // POST /api/users/1/grants
+			r.Delete("/{id}/grants/{grantID}", h.DeleteUserGrant) // DELETE /api/users/1/grants/2
+		})
+
+		// API tokens, managed by their owners
+		r.Route("/tokens", func(r chi.Router) {
+			r.Use(RejectTokens)
+			r.Get("/", h.GetAPITokens)          // GET /api/tokens?all=true
+			r.Post("/", h.CreateAPIToken)       // POST /api/tokens
+			r.Delete("/{id}", h.DeleteAPIToken) // DELETE /api/tokens/1
+		})
+
+		// Administration
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(admin, RequireUnrestricted)
+			r.Get("/logs", h.GetLogStats)      // GET /api/admin/logs
+			r.Post("/logs/prune", h.PruneLogs) // POST /api/admin/logs/prune
+			r.Get("/backups", h.GetBackups)    // GET /api/admin/backups
+			r.Post("/backup", h.CreateBackup)  // POST /api/admin/backup
 		})
 
 		// System
-		r.Get("/status", GetStatus) // GET /api/status
+		r.Get("/status", h.GetStatus) // GET /api/status
 	})
 
 	return r
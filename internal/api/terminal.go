@@ -0,0 +1,261 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+	"github.com/rakib/proxmox-auto-restart/internal/asciicast"
+)
+
+// Terminal protocol: binary WebSocket frames carry terminal data in both
+// directions, and text frames carry JSON control messages.
+
+const (
+	// terminalPingInterval is how often the server pings the client
+	terminalPingInterval = 30 * time.Second
+	// terminalPongWait closes sessions whose client stopped answering
+	terminalPongWait = 2 * terminalPingInterval
+	// terminalWriteWait bounds each write to the client
+	terminalWriteWait = 10 * time.Second
+)
+
+// Control message types
+const (
+	terminalResize = "resize" // client: set the PTY size to rows and cols
+	terminalPing   = "ping"   // client: answered with a pong
+	terminalPong   = "pong"   // server: answer to a ping
+	terminalSignal = "signal" // client: send signal to the terminal
+	terminalError  = "error"  // server: a control message was refused
+)
+
+// terminalMessage is a control message
+type terminalMessage struct {
+	Type    string `json:"type"`
+	Rows    uint16 `json:"rows,omitempty"`
+	Cols    uint16 `json:"cols,omitempty"`
+	Signal  string `json:"signal,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// terminalKeys are the signals typed as control characters, so the PTY
+// delivers them to the program in the foreground on the guest
+var terminalKeys = map[string]string{
+	"SIGINT":  "\x03", // Ctrl-C
+	"SIGQUIT": "\x1c", // Ctrl-\
+	"SIGTSTP": "\x1a", // Ctrl-Z
+}
+
+// terminalSignals are sent to the terminal process itself and end the session
+var terminalSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// terminalSession connects a WebSocket to a process running in a PTY
+type terminalSession struct {
+	conn *websocket.Conn
+	pty  *os.File
+	cmd  *exec.Cmd
+	vmid int
+	// recording receives everything typed and shown
+	recording *asciicast.Writer
+
+	writeMu     sync.Mutex
+	idle        *time.Timer
+	idleTimeout time.Duration
+}
+
+// run copies data between the WebSocket and the PTY and answers control
+// messages until either side closes, the client stops answering pings, or
+// no input arrives for idleTimeout
+func (s *terminalSession) run(idleTimeout time.Duration) {
+	done := make(chan struct{})
+	defer close(done)
+
+	s.conn.SetReadDeadline(time.Now().Add(terminalPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(terminalPongWait))
+	})
+	if idleTimeout > 0 {
+		s.idleTimeout = idleTimeout
+		s.idle = time.AfterFunc(idleTimeout, func() {
+			log.Printf("Terminal for VMID %d idle for %s, closing", s.vmid, idleTimeout)
+			s.close(websocket.CloseGoingAway, "idle timeout")
+		})
+		defer s.idle.Stop()
+	}
+
+	go s.keepalive(done)
+	go s.output()
+
+	for {
+		kind, message, err := s.conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case errors.As(err, &netErr) && netErr.Timeout():
+				log.Printf("Terminal for VMID %d stopped answering pings, closing", s.vmid)
+			case errors.Is(err, net.ErrClosed):
+			case websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure):
+				log.Printf("ERROR: WebSocket read error: %v", err)
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(terminalPongWait))
+
+		switch kind {
+		case websocket.BinaryMessage:
+			s.touch()
+			if !s.recorded(s.recording.Input(message)) {
+				return
+			}
+			if _, err := s.pty.Write(message); err != nil {
+				log.Printf("ERROR: PTY write error: %v", err)
+				return
+			}
+		case websocket.TextMessage:
+			if err := s.control(message); err != nil {
+				s.send(terminalMessage{Type: terminalError, Message: err.Error()})
+			}
+		}
+	}
+}
+
+// control handles one control message
+func (s *terminalSession) control(message []byte) error {
+	var msg terminalMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return fmt.Errorf("invalid control message: %v", err)
+	}
+
+	switch msg.Type {
+	case terminalResize:
+		if msg.Rows == 0 || msg.Cols == 0 {
+			return fmt.Errorf("resize needs rows and cols")
+		}
+		if err := pty.Setsize(s.pty, &pty.Winsize{Rows: msg.Rows, Cols: msg.Cols}); err != nil {
+			return fmt.Errorf("failed to resize terminal: %v", err)
+		}
+		s.recorded(s.recording.Resize(int(msg.Cols), int(msg.Rows)))
+		return nil
+
+	case terminalPing:
+		return s.send(terminalMessage{Type: terminalPong})
+
+	case terminalSignal:
+		s.touch()
+		name := strings.ToUpper(msg.Signal)
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		if key, ok := terminalKeys[name]; ok {
+			if !s.recorded(s.recording.Input([]byte(key))) {
+				return nil
+			}
+			_, err := s.pty.Write([]byte(key))
+			return err
+		}
+		if sig, ok := terminalSignals[name]; ok {
+			log.Printf("Sending %s to terminal for VMID %d", name, s.vmid)
+			return s.cmd.Process.Signal(sig)
+		}
+		return fmt.Errorf("unsupported signal %q", msg.Signal)
+	}
+	return fmt.Errorf("unknown control message type %q", msg.Type)
+}
+
+// output copies PTY output to the WebSocket and closes the session when the
+// terminal process exits
+func (s *terminalSession) output() {
+	buf := make([]byte, 1024)
+	for {
+		n, err := s.pty.Read(buf)
+		if err != nil {
+			// Linux reports EIO once the process has exited
+			if err != io.EOF && !errors.Is(err, syscall.EIO) && !errors.Is(err, os.ErrClosed) {
+				log.Printf("ERROR: PTY read error: %v", err)
+			}
+			s.close(websocket.CloseNormalClosure, "terminal exited")
+			return
+		}
+		if !s.recorded(s.recording.Output(buf[:n])) {
+			return
+		}
+		if err := s.write(websocket.BinaryMessage, buf[:n]); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("ERROR: WebSocket write error: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// keepalive pings the client until done is closed
+func (s *terminalSession) keepalive(done <-chan struct{}) {
+	ticker := time.NewTicker(terminalPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(terminalWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// recorded checks the result of recording an event. Sessions that cannot be
+// recorded are closed.
+func (s *terminalSession) recorded(err error) bool {
+	if err == nil {
+		return true
+	}
+	log.Printf("ERROR: Closing terminal for VMID %d: %v", s.vmid, err)
+	s.close(websocket.CloseInternalServerErr, "recording failed")
+	return false
+}
+
+// touch restarts the idle timeout
+func (s *terminalSession) touch() {
+	if s.idle != nil {
+		s.idle.Reset(s.idleTimeout)
+	}
+}
+
+// send writes a control message
+func (s *terminalSession) send(msg terminalMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.write(websocket.TextMessage, data)
+}
+
+func (s *terminalSession) write(kind int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(terminalWriteWait))
+	return s.conn.WriteMessage(kind, data)
+}
+
+// close tells the client why the session ends and closes the connection,
+// which ends run
+func (s *terminalSession) close(code int, reason string) {
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(terminalWriteWait))
+	s.conn.Close()
+}
@@ -1,73 +1,174 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
+	"github.com/rakib/proxmox-auto-restart/internal/auth"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
 )
 
+// TerminalConfig holds the settings of web terminal connections
+type TerminalConfig struct {
+	// TicketTTL is how long a ticket can wait to be used
+	TicketTTL time.Duration
+	// IdleTimeout closes sessions without input for this long; 0 disables it
+	IdleTimeout time.Duration
+	// AllowedOrigins may open terminals besides this host's own pages; "*"
+	// allows any
+	AllowedOrigins []string
+	// RecordingDir holds the recordings of terminal sessions
+	RecordingDir string
+}
+
+var (
+	terminalMu     sync.Mutex
+	terminalConfig = TerminalConfig{TicketTTL: 30 * time.Second, IdleTimeout: 30 * time.Minute, RecordingDir: "./recordings"}
+)
+
+// SetTerminalConfig replaces the terminal settings
+func SetTerminalConfig(cfg TerminalConfig) {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+	terminalConfig = cfg
+}
+
+func getTerminalConfig() TerminalConfig {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+	return terminalConfig
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for development
-		// TODO: Restrict this in production
-		return true
-	},
+	CheckOrigin:     allowedOrigin,
 }
 
-// TerminalHandler handles WebSocket connections for terminal access
-func TerminalHandler(w http.ResponseWriter, r *http.Request) {
-	// WebSocket connections can't send Basic Auth headers during upgrade
-	// Check credentials from query parameters instead
-	username := r.URL.Query().Get("username")
-	password := r.URL.Query().Get("password")
+// allowedOrigin accepts WebSocket requests from this host's own pages, from
+// the configured origins and from clients that send no Origin, which are not
+// browsers
+func allowedOrigin(r *http.Request) bool {
+	if sameOrigin(r) {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, allowed := range getTerminalConfig().AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Get expected credentials
-	expectedUsername := os.Getenv("AUTH_USERNAME")
-	expectedPassword := os.Getenv("AUTH_PASSWORD")
-	if expectedUsername == "" {
-		expectedUsername = "admin"
+// CreateTerminalTicket issues a ticket for one terminal connection to a guest.
+// The ticket is bound to the caller and the guest and expires after the
+// configured TTL.
+func (h *Handler) CreateTerminalTicket(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateTerminalTicketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Type == "" {
+		req.Type = "qemu"
+	}
+	if req.VMID <= 0 || req.Node == "" {
+		respondError(w, http.StatusBadRequest, "vmid and node are required")
+		return
+	}
+	if req.Type != "lxc" && req.Type != "qemu" {
+		respondError(w, http.StatusBadRequest, "type must be lxc or qemu")
+		return
 	}
-	if expectedPassword == "" {
-		expectedPassword = "proxmox2024"
+	if !h.requireGuest(w, r, req.VMID, req.Node) {
+		return
 	}
 
-	log.Printf("INFO: expectedUsername: %s expectedPassword: %s username: %s password: %s", expectedUsername, expectedPassword, username, password)
+	user := UserFromContext(r.Context())
+	secret, ticket, err := h.tickets.Issue(auth.TerminalTicket{
+		UserID: user.ID,
+		VMID:   req.VMID,
+		Node:   req.Node,
+		Type:   req.Type,
+	}, getTerminalConfig().TicketTTL)
+	if err != nil {
+		log.Printf("ERROR: Failed to issue terminal ticket: %v", err)
+		respondError(w, http.StatusServiceUnavailable, "Failed to issue terminal ticket")
+		return
+	}
 
-	// Validate credentials
-	if username != expectedUsername || password != expectedPassword {
-		log.Printf("ERROR: WebSocket authentication failed for user: %s", username)
+	log.Printf("Terminal ticket for VMID %d on %s issued to %s", req.VMID, req.Node, actor(r))
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"ticket":     secret,
+		"expires_at": ticket.ExpiresAt,
+	})
+}
+
+// TerminalHandler handles WebSocket connections for terminal access
+func (h *Handler) TerminalHandler(w http.ResponseWriter, r *http.Request) {
+	// Browsers can't send headers with a WebSocket upgrade, so the connection
+	// is authenticated by a single-use ticket from POST /api/terminal/tickets
+	if !allowedOrigin(r) {
+		log.Printf("ERROR: Terminal refused for origin %s", r.Header.Get("Origin"))
+		http.Error(w, "Forbidden: origin not allowed", http.StatusForbidden)
+		return
+	}
+	ticket, err := h.tickets.Redeem(r.URL.Query().Get("ticket"))
+	if err != nil {
+		log.Printf("ERROR: Terminal refused: %v", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Get parameters
-	vmidStr := r.URL.Query().Get("vmid")
-	node := r.URL.Query().Get("node")
-	resourceType := r.URL.Query().Get("type") // "lxc" or "qemu"
-
-	if vmidStr == "" || node == "" {
-		log.Printf("ERROR: Missing required parameters: vmid=%s, node=%s", vmidStr, node)
-		http.Error(w, "vmid and node are required", http.StatusBadRequest)
+	// Clients may repeat the guest, which must be the one the ticket is for
+	query := r.URL.Query()
+	if (query.Has("vmid") && query.Get("vmid") != strconv.Itoa(ticket.VMID)) ||
+		(query.Has("node") && query.Get("node") != ticket.Node) ||
+		(query.Has("type") && query.Get("type") != ticket.Type) {
+		log.Printf("ERROR: Terminal refused: ticket for VMID %d on %s used for another guest", ticket.VMID, ticket.Node)
+		http.Error(w, "Forbidden: ticket is for another guest", http.StatusForbidden)
 		return
 	}
 
-	vmid, err := strconv.Atoi(vmidStr)
+	// The account may have changed since the ticket was issued
+	user, err := h.store.GetUserByID(ticket.UserID)
 	if err != nil {
-		log.Printf("ERROR: Invalid vmid '%s': %v", vmidStr, err)
-		http.Error(w, "Invalid vmid", http.StatusBadRequest)
+		log.Printf("ERROR: Failed to look up user %d: %v", ticket.UserID, err)
+		http.Error(w, "Failed to authenticate", http.StatusInternalServerError)
+		return
+	}
+	if user == nil || !user.Enabled {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// A terminal is a root shell on the guest
+	if !auth.HasRole(user, auth.RoleAdmin) {
+		log.Printf("ERROR: Terminal refused for %s (role %s)", user.Username, user.Role)
+		http.Error(w, "Forbidden: requires the admin role", http.StatusForbidden)
 		return
 	}
 
-	log.Printf("Terminal connection request: vmid=%d, node=%s, type=%s", vmid, node, resourceType)
+	vmid, node, resourceType := ticket.VMID, ticket.Node, ticket.Type
+	log.Printf("Terminal connection request from %s: vmid=%d, node=%s, type=%s", user.Username, vmid, node, resourceType)
+
+	// Every session is recorded; without a recording there is no terminal
+	recorded, recording, err := h.startRecording(user, ticket)
+	if err != nil {
+		log.Printf("ERROR: Failed to start recording of terminal for VMID %d: %v", vmid, err)
+		http.Error(w, "Failed to start recording", http.StatusInternalServerError)
+		return
+	}
+	defer h.finishRecording(recorded, recording)
 
 	// Upgrade to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -79,65 +180,39 @@ func TerminalHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("WebSocket upgraded successfully for VMID %d", vmid)
 
-	// Determine command based on resource type
-	var cmd *exec.Cmd
-	if resourceType == "lxc" {
-		// For LXC containers, use pct enter
-		log.Printf("Starting LXC terminal for VMID %d using 'pct enter'", vmid)
-		cmd = exec.Command("pct", "enter", strconv.Itoa(vmid))
-	} else {
-		// For QEMU VMs, use qm terminal (requires serial console)
-		log.Printf("Starting QEMU terminal for VMID %d using 'qm terminal'", vmid)
-		cmd = exec.Command("qm", "terminal", strconv.Itoa(vmid))
-	}
+	cmd := terminalCommand(resourceType, vmid)
 
 	// Start PTY
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to start terminal: %v\r\n\r\nNote: The backend must run ON the Proxmox server with root privileges.\r\n", err)
 		log.Printf("ERROR: Failed to start PTY for VMID %d: %v", vmid, err)
-		conn.WriteMessage(websocket.TextMessage, []byte(errMsg))
+		recording.Output([]byte(errMsg))
+		conn.WriteMessage(websocket.BinaryMessage, []byte(errMsg))
 		return
 	}
 	defer func() {
 		ptmx.Close()
 		cmd.Process.Kill()
+		cmd.Wait()
 	}()
 
-	log.Printf("Terminal session started for VMID %d (type: %s)", vmid, resourceType)
-
-	// Handle PTY -> WebSocket (output)
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("ERROR: PTY read error: %v", err)
-				}
-				return
-			}
-			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-				log.Printf("ERROR: WebSocket write error: %v", err)
-				return
-			}
-		}
-	}()
+	log.Printf("Terminal session %d started for VMID %d (type: %s)", recorded.ID, vmid, resourceType)
 
-	// Handle WebSocket -> PTY (input)
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("ERROR: WebSocket read error: %v", err)
-			}
-			break
-		}
-		if _, err := ptmx.Write(message); err != nil {
-			log.Printf("ERROR: PTY write error: %v", err)
-			break
-		}
-	}
+	session := &terminalSession{conn: conn, pty: ptmx, cmd: cmd, vmid: vmid, recording: recording}
+	session.run(getTerminalConfig().IdleTimeout)
 
 	log.Printf("Terminal session ended for VMID %d", vmid)
 }
+
+// terminalCommand returns the command opening a shell on a guest
+var terminalCommand = func(resourceType string, vmid int) *exec.Cmd {
+	if resourceType == "lxc" {
+		// For LXC containers, use pct enter
+		log.Printf("Starting LXC terminal for VMID %d using 'pct enter'", vmid)
+		return exec.Command("pct", "enter", strconv.Itoa(vmid))
+	}
+	// For QEMU VMs, use qm terminal (requires serial console)
+	log.Printf("Starting QEMU terminal for VMID %d using 'qm terminal'", vmid)
+	return exec.Command("qm", "terminal", strconv.Itoa(vmid))
+}
@@ -0,0 +1,157 @@
+// Package asciicast records terminal sessions in the asciicast v2 format
+// played by asciinema: a JSON header line followed by one JSON event per line.
+package asciicast
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ContentType is the media type of asciicast files
+const ContentType = "application/x-asciicast"
+
+// Event types
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// Header is the first line of a recording
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Writer appends the events of a session to a recording. It is safe for
+// concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	start   time.Time
+	pending map[string][]byte // incomplete UTF-8 sequences held back per stream
+	input   int64
+	output  int64
+	err     error
+}
+
+// Create starts a new recording at path, which must not exist yet. The
+// header's version and timestamp are filled in.
+func Create(path string, header Header) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	start := time.Now()
+	header.Version = 2
+	header.Timestamp = start.Unix()
+	line, err := json.Marshal(header)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+	return &Writer{file: file, start: start, pending: make(map[string][]byte)}, nil
+}
+
+// Output records data written to the terminal
+func (w *Writer) Output(data []byte) error {
+	return w.record(EventOutput, data)
+}
+
+// Input records data typed into the terminal
+func (w *Writer) Input(data []byte) error {
+	return w.record(EventInput, data)
+}
+
+// Resize records a change of the terminal size
+func (w *Writer) Resize(cols, rows int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write(EventResize, fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Bytes returns the number of input and output bytes recorded
+func (w *Writer) Bytes() (input, output int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.input, w.output
+}
+
+// Close flushes held back bytes and closes the file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, kind := range []string{EventInput, EventOutput} {
+		if rest := w.pending[kind]; len(rest) > 0 {
+			w.write(kind, string(rest))
+		}
+	}
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func (w *Writer) record(kind string, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if kind == EventInput {
+		w.input += int64(len(data))
+	} else {
+		w.output += int64(len(data))
+	}
+
+	// Events are JSON strings, so a character split across reads waits for
+	// the rest of its bytes
+	buf := append(w.pending[kind], data...)
+	n := completeUTF8(buf)
+	w.pending[kind] = append([]byte(nil), buf[n:]...)
+	if n == 0 {
+		return w.err
+	}
+	return w.write(kind, string(buf[:n]))
+}
+
+// write appends one event; the first error is kept and returned from then on
+func (w *Writer) write(kind, data string) error {
+	if w.err != nil {
+		return w.err
+	}
+	elapsed := math.Round(time.Since(w.start).Seconds()*1e6) / 1e6
+	line, err := json.Marshal([]interface{}{elapsed, kind, data})
+	if err == nil {
+		_, err = w.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		w.err = fmt.Errorf("failed to write recording: %w", err)
+	}
+	return w.err
+}
+
+// completeUTF8 returns the length of data without an incomplete UTF-8
+// sequence at its end
+func completeUTF8(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return len(data)
+			}
+			return i
+		}
+	}
+	return len(data)
+}
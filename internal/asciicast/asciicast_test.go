@@ -0,0 +1,78 @@
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	w, err := Create(path, Header{Width: 80, Height: 24, Title: "VMID 101", Env: map[string]string{"TERM": "xterm"}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := Create(path, Header{}); err == nil {
+		t.Error("expected an existing recording not to be overwritten")
+	}
+
+	w.Input([]byte("ls\r"))
+	w.Output([]byte("caf\xc3")) // "café" split inside the é
+	w.Output([]byte("\xa9\r\n"))
+	w.Resize(120, 40)
+	w.Output([]byte("\xe2\x82")) // incomplete at the end
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if input, output := w.Bytes(); input != 3 || output != 9 {
+		t.Errorf("expected 3 input and 9 output bytes, got %d and %d", input, output)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+
+	scanner.Scan()
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 || header.Width != 80 ||
+		header.Timestamp == 0 || header.Env["TERM"] != "xterm" {
+		t.Fatalf("unexpected header %s: %v", scanner.Text(), err)
+	}
+
+	want := [][2]string{
+		{EventInput, "ls\r"},
+		{EventOutput, "caf"},
+		{EventOutput, "é\r\n"},
+		{EventResize, "120x40"},
+		{EventOutput, "��"}, // one replacement per byte
+	}
+	var got [][2]string
+	var last float64
+	for scanner.Scan() {
+		var event [3]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid event %s: %v", scanner.Text(), err)
+		}
+		elapsed, _ := event[0].(float64)
+		if elapsed < last {
+			t.Errorf("event times go backwards: %s", scanner.Text())
+		}
+		last = elapsed
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+		got = append(got, [2]string{kind, data})
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected events %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
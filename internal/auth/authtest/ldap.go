@@ -0,0 +1,346 @@
+package authtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPEntry is a directory entry served by LDAP. Entries with a Password can
+// be bound as.
+type LDAPEntry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// LDAP is an in-process LDAP server for tests. It serves simple binds,
+// searches with and, or, not, equality and presence filters, and StartTLS
+// with a self-signed certificate for 127.0.0.1.
+type LDAP struct {
+	// URL is ldap://127.0.0.1:port
+	URL string
+	// RequireTLS refuses binds until the connection has started TLS
+	RequireTLS bool
+
+	listener net.Listener
+	tls      *tls.Config
+	certPEM  []byte
+
+	mu      sync.Mutex
+	entries []LDAPEntry
+	binds   int
+	conns   sync.WaitGroup
+}
+
+// NewLDAP starts an LDAP server; Close it when done
+func NewLDAP() (*LDAP, error) {
+	cert, certPEM, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	f := &LDAP{
+		URL:      "ldap://" + listener.Addr().String(),
+		listener: listener,
+		tls:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		certPEM:  certPEM,
+	}
+	go f.serve()
+	return f, nil
+}
+
+// Add adds an entry to the directory
+func (f *LDAP) Add(entry LDAPEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, entry)
+}
+
+// SetPassword changes the password of the entry with the given DN
+func (f *LDAP) SetPassword(dn, password string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.entries {
+		if strings.EqualFold(f.entries[i].DN, dn) {
+			f.entries[i].Password = password
+		}
+	}
+}
+
+// Binds returns the number of bind requests received
+func (f *LDAP) Binds() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.binds
+}
+
+// CACert returns the PEM certificate to trust for StartTLS
+func (f *LDAP) CACert() []byte {
+	return f.certPEM
+}
+
+// Close stops the server
+func (f *LDAP) Close() {
+	f.listener.Close()
+	f.conns.Wait()
+}
+
+func (f *LDAP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.conns.Add(1)
+		go func() {
+			defer f.conns.Done()
+			f.handle(conn)
+		}()
+	}
+}
+
+// handle answers the requests of one connection until it is unbound or closed
+func (f *LDAP) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	secure := false
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := f.bind(op, secure)
+			f.send(conn, id, ldapResult(ldap.ApplicationBindResponse, code))
+
+		case ldap.ApplicationSearchRequest:
+			entries, code := f.search(op)
+			for _, entry := range entries {
+				f.send(conn, id, entry)
+			}
+			f.send(conn, id, ldapResult(ldap.ApplicationSearchResultDone, code))
+
+		case ldap.ApplicationExtendedRequest:
+			if secure || len(op.Children) == 0 || string(op.Children[0].Data.Bytes()) != "1.3.6.1.4.1.1466.20037" {
+				f.send(conn, id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError))
+				continue
+			}
+			f.send(conn, id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			tlsConn := tls.Server(conn, f.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		default:
+			f.send(conn, id, ldapResult(op.Tag+1, ldap.LDAPResultUnwillingToPerform))
+		}
+	}
+}
+
+// bind checks a simple bind; an empty name and password bind anonymously
+func (f *LDAP) bind(op *ber.Packet, secure bool) uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.binds++
+
+	if f.RequireTLS && !secure {
+		return ldap.LDAPResultConfidentialityRequired
+	}
+	if len(op.Children) < 3 {
+		return ldap.LDAPResultProtocolError
+	}
+	name := string(op.Children[1].Data.Bytes())
+	password := string(op.Children[2].Data.Bytes())
+	if name == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	for _, entry := range f.entries {
+		if strings.EqualFold(entry.DN, name) && entry.Password != "" && entry.Password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+// search returns the result entries matching a search request
+func (f *LDAP) search(op *ber.Packet) ([]*ber.Packet, uint16) {
+	if len(op.Children) < 8 {
+		return nil, ldap.LDAPResultProtocolError
+	}
+	base := strings.ToLower(string(op.Children[0].Data.Bytes()))
+	scope, _ := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+	var wanted []string
+	for _, attr := range op.Children[7].Children {
+		wanted = append(wanted, string(attr.Data.Bytes()))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	baseFound := false
+	var results []*ber.Packet
+	for _, entry := range f.entries {
+		dn := strings.ToLower(entry.DN)
+		if dn == base {
+			baseFound = true
+		}
+		inScope := dn == base
+		if scope != int64(ldap.ScopeBaseObject) {
+			inScope = inScope || strings.HasSuffix(dn, ","+base)
+		}
+		if inScope && matchFilter(filter, entry) {
+			results = append(results, searchEntry(entry, wanted))
+		}
+	}
+	if !baseFound {
+		return nil, ldap.LDAPResultNoSuchObject
+	}
+	return results, ldap.LDAPResultSuccess
+}
+
+func (f *LDAP) send(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+// matchFilter evaluates a search filter against an entry. Attribute names
+// and values compare case-insensitively.
+func matchFilter(filter *ber.Packet, entry LDAPEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !matchFilter(filter.Children[0], entry)
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		value := string(filter.Children[1].Data.Bytes())
+		for _, v := range entryValues(entry, string(filter.Children[0].Data.Bytes())) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(entryValues(entry, string(filter.Data.Bytes()))) > 0
+	}
+	return false
+}
+
+// entryValues returns the values of an attribute, looked up case-insensitively
+func entryValues(entry LDAPEntry, name string) []string {
+	for attr, values := range entry.Attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// searchEntry encodes an entry with the wanted attributes, all of them when
+// none are named
+func searchEntry(entry LDAPEntry, wanted []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range entry.Attributes {
+		if len(wanted) > 0 && !containsFold(wanted, name) {
+			continue
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(set)
+		attributes.AppendChild(attr)
+	}
+	op.AppendChild(attributes)
+	return op
+}
+
+// ldapResult encodes a response carrying only a result code
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return op
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 and its PEM encoding
+func selfSignedCert() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rakib/proxmox-auto-restart/internal/config"
+)
+
+// ldapCacheSize bounds the cache of recent successful sign-ins
+const ldapCacheSize = 1024
+
+// LDAPProvider checks usernames and passwords against an LDAP directory and
+// maps the user's groups to a role. Successful sign-ins are cached for
+// CacheTTL, so the directory is not asked on every API request.
+type LDAPProvider struct {
+	cfg     config.LDAPConfig
+	tls     *tls.Config
+	mapping map[string]string // lowercased group DN or name to role
+
+	mu    sync.Mutex
+	cache map[[32]byte]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	identity Identity
+	expires  time.Time
+}
+
+// NewLDAPProvider prepares a provider; the directory is first contacted at
+// the first sign-in
+func NewLDAPProvider(cfg config.LDAPConfig) (*LDAPProvider, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: cfg.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LDAP CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in LDAP CA file %s", cfg.CAFile)
+		}
+	}
+
+	mapping := make(map[string]string, len(cfg.RoleMapping))
+	for group, role := range cfg.RoleMapping {
+		mapping[strings.ToLower(group)] = role
+	}
+
+	return &LDAPProvider{
+		cfg:     cfg,
+		tls:     tlsConfig,
+		mapping: mapping,
+		cache:   make(map[[32]byte]ldapCacheEntry),
+	}, nil
+}
+
+// Name returns the provider recorded on the accounts of directory users
+func (p *LDAPProvider) Name() string {
+	return ProviderLDAP
+}
+
+// Authenticate checks a username and password against the directory. Wrong
+// credentials, unknown users and users in no mapped group return
+// ErrLoginDenied; an unreachable directory returns another error.
+func (p *LDAPProvider) Authenticate(username, password string) (*Identity, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("%w: username and password are required", ErrLoginDenied)
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+	p.mu.Lock()
+	cached, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		identity := cached.identity
+		return &identity, nil
+	}
+
+	identity, err := p.authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.cfg.CacheTTL > 0 {
+		p.mu.Lock()
+		if len(p.cache) >= ldapCacheSize {
+			clear(p.cache)
+		}
+		p.cache[key] = ldapCacheEntry{identity: *identity, expires: now.Add(time.Duration(p.cfg.CacheTTL))}
+		p.mu.Unlock()
+	}
+	return identity, nil
+}
+
+// authenticate finds the user with the search account, binds as the user to
+// check the password and reads the user's groups
+func (p *LDAPProvider) authenticate(username, password string) (*Identity, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := p.bindSearcher(conn); err != nil {
+		return nil, err
+	}
+	attributes := []string{p.cfg.UsernameAttribute}
+	if p.cfg.GroupBaseDN == "" {
+		attributes = append(attributes, p.cfg.GroupAttribute)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		p.cfg.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(time.Duration(p.cfg.Timeout).Seconds()), false,
+		strings.Replace(p.cfg.UserFilter, "%s", ldap.EscapeFilter(username), 1), attributes, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for LDAP user %s: %w", username, err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("%w: %d LDAP entries match %s", ErrLoginDenied, len(result.Entries), username)
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("%w: wrong password for %s", ErrLoginDenied, username)
+		}
+		return nil, fmt.Errorf("failed to bind as %s: %w", entry.DN, err)
+	}
+
+	identity := &Identity{Username: entry.GetAttributeValue(p.cfg.UsernameAttribute)}
+	if identity.Username == "" {
+		identity.Username = username
+	}
+	if p.cfg.GroupBaseDN == "" {
+		identity.Groups = entry.GetAttributeValues(p.cfg.GroupAttribute)
+	} else if identity.Groups, err = p.searchGroups(conn, entry.DN); err != nil {
+		return nil, err
+	}
+
+	identity.Role = p.mapGroups(identity.Groups)
+	if identity.Role == "" {
+		return nil, fmt.Errorf("%w: none of the groups of %s maps to a role", ErrLoginDenied, username)
+	}
+	return identity, nil
+}
+
+// dial connects to the directory, upgrading the connection with StartTLS
+// when configured
+func (p *LDAPProvider) dial() (*ldap.Conn, error) {
+	timeout := time.Duration(p.cfg.Timeout)
+	conn, err := ldap.DialURL(p.cfg.URL,
+		ldap.DialWithTLSConfig(p.tls), ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(timeout)
+
+	if p.cfg.StartTLS {
+		if err := conn.StartTLS(p.tls); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS with LDAP server: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// bindSearcher binds as the search account, or anonymously without one
+func (p *LDAPProvider) bindSearcher(conn *ldap.Conn) error {
+	var err error
+	if p.cfg.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(p.cfg.BindDN, p.cfg.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bind to LDAP server as the search account: %w", err)
+	}
+	return nil
+}
+
+// searchGroups returns the DNs of the groups under GroupBaseDN that list
+// userDN as a member
+func (p *LDAPProvider) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	// The user's own bind may not be allowed to search groups
+	if err := p.bindSearcher(conn); err != nil {
+		return nil, err
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		p.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(time.Duration(p.cfg.Timeout).Seconds()), false,
+		strings.Replace(p.cfg.GroupFilter, "%s", ldap.EscapeFilter(userDN), 1), []string{"cn"}, nil,
+	))
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultNoSuchObject {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to search groups of %s: %w", userDN, err)
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// mapGroups returns the highest role mapped from any group, matching group
+// DNs or their common names case-insensitively
+func (p *LDAPProvider) mapGroups(groups []string) string {
+	names := make([]string, 0, 2*len(groups))
+	for _, group := range groups {
+		group = strings.ToLower(group)
+		names = append(names, group)
+		if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			names = append(names, dn.RDNs[0].Attributes[0].Value)
+		}
+	}
+	return MapGroups(p.mapping, names)
+}
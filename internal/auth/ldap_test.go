@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/auth/authtest"
+	"github.com/rakib/proxmox-auto-restart/internal/config"
+)
+
+// newTestLDAP starts a fake directory requiring StartTLS, with a search
+// account, two users and their groups
+func newTestLDAP(t *testing.T) (*authtest.LDAP, config.LDAPConfig) {
+	t.Helper()
+	directory, err := authtest.NewLDAP()
+	if err != nil {
+		t.Fatalf("NewLDAP: %v", err)
+	}
+	t.Cleanup(directory.Close)
+	directory.RequireTLS = true
+
+	for _, entry := range []authtest.LDAPEntry{
+		{DN: "dc=example,dc=com"},
+		{DN: "ou=people,dc=example,dc=com"},
+		{DN: "cn=svc,dc=example,dc=com", Password: "svc-secret"},
+		{DN: "uid=alice,ou=people,dc=example,dc=com", Password: "alice-secret", Attributes: map[string][]string{
+			"objectClass": {"person"}, "uid": {"alice"},
+			"memberOf": {"cn=Staff,ou=groups,dc=example,dc=com", "cn=Proxmox-Ops,ou=groups,dc=example,dc=com"},
+		}},
+		{DN: "uid=bob,ou=people,dc=example,dc=com", Password: "bob-secret", Attributes: map[string][]string{
+			"objectClass": {"person"}, "uid": {"bob"}, "memberOf": {"cn=Staff,ou=groups,dc=example,dc=com"},
+		}},
+		{DN: "ou=groups,dc=example,dc=com"},
+		{DN: "cn=infra,ou=groups,dc=example,dc=com", Attributes: map[string][]string{
+			"objectClass": {"groupOfNames"}, "member": {"uid=bob,ou=people,dc=example,dc=com"},
+		}},
+	} {
+		directory.Add(entry)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, directory.CACert(), 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+	cfg := config.Default().LDAP
+	cfg.URL = directory.URL
+	cfg.StartTLS = true
+	cfg.CAFile = caFile
+	cfg.BindDN = "cn=svc,dc=example,dc=com"
+	cfg.BindPassword = "svc-secret"
+	cfg.UserBaseDN = "ou=people,dc=example,dc=com"
+	cfg.RoleMapping = map[string]string{"proxmox-ops": RoleOperator, "cn=infra,ou=groups,dc=example,dc=com": RoleAdmin}
+	return directory, cfg
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	_, cfg := newTestLDAP(t)
+	provider, err := NewLDAPProvider(cfg)
+	if err != nil {
+		t.Fatalf("NewLDAPProvider: %v", err)
+	}
+
+	identity, err := provider.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.Username != "alice" || identity.Role != RoleOperator || len(identity.Groups) != 2 {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	for _, tt := range []struct{ username, password string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"carol", "carol-secret"},
+		{"bob", "bob-secret"}, // only in unmapped groups
+		{"*", "alice-secret"},
+	} {
+		if _, err := provider.Authenticate(tt.username, tt.password); !errors.Is(err, ErrLoginDenied) {
+			t.Errorf("Authenticate(%q, %q): expected ErrLoginDenied, got %v", tt.username, tt.password, err)
+		}
+	}
+}
+
+func TestLDAPGroupSearch(t *testing.T) {
+	_, cfg := newTestLDAP(t)
+	cfg.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	provider, err := NewLDAPProvider(cfg)
+	if err != nil {
+		t.Fatalf("NewLDAPProvider: %v", err)
+	}
+
+	identity, err := provider.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.Role != RoleAdmin || len(identity.Groups) != 1 {
+		t.Errorf("expected bob to be an admin through infra, got %+v", identity)
+	}
+}
+
+func TestLDAPRequiresStartTLS(t *testing.T) {
+	_, cfg := newTestLDAP(t)
+	cfg.StartTLS = false
+	provider, _ := NewLDAPProvider(cfg)
+	if _, err := provider.Authenticate("alice", "alice-secret"); err == nil || errors.Is(err, ErrLoginDenied) {
+		t.Errorf("expected a bind error without TLS, got %v", err)
+	}
+
+	cfg.StartTLS = true
+	cfg.CAFile = ""
+	provider, _ = NewLDAPProvider(cfg)
+	if _, err := provider.Authenticate("alice", "alice-secret"); err == nil {
+		t.Error("expected an untrusted certificate to be refused")
+	}
+}
+
+func TestLDAPCache(t *testing.T) {
+	directory, cfg := newTestLDAP(t)
+	cfg.CacheTTL = config.Duration(time.Hour)
+	provider, _ := NewLDAPProvider(cfg)
+
+	if _, err := provider.Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	binds := directory.Binds()
+	if _, err := provider.Authenticate("alice", "alice-secret"); err != nil || directory.Binds() != binds {
+		t.Errorf("expected a cached sign-in without binds, got %v after %d binds", err, directory.Binds()-binds)
+	}
+
+	// Other passwords are not answered from the cache
+	directory.SetPassword("uid=alice,ou=people,dc=example,dc=com", "new-secret")
+	if _, err := provider.Authenticate("alice", "new-secret"); err != nil {
+		t.Errorf("expected the new password to work, got %v", err)
+	}
+}
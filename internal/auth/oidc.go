@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/rakib/proxmox-auto-restart/internal/config"
+	"golang.org/x/oauth2"
+)
+
+// A login must come back from the identity provider within loginTimeout.
+// At most maxPendingLogins can be in progress, so unfinished logins cannot
+// grow memory without bound.
+const (
+	loginTimeout     = 10 * time.Minute
+	maxPendingLogins = 1024
+)
+
+// OIDCProvider signs users in with the OpenID Connect authorization code flow
+// and PKCE, and maps their groups to roles
+type OIDCProvider struct {
+	cfg      config.OIDCConfig
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	mu      sync.Mutex
+	pending map[string]pendingLogin // by state
+}
+
+// pendingLogin is a login sent to the identity provider and not yet back
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	redirect string
+	expires  time.Time
+}
+
+// OIDCIdentity is a user signed in through the identity provider
+type OIDCIdentity struct {
+	Username string
+	Groups   []string
+	Role     string
+	// Redirect is the local path the login was started from
+	Redirect string
+}
+
+// NewOIDCProvider discovers the issuer's endpoints and keys. The HTTP client
+// in ctx, if any, is used for every request to the issuer.
+func NewOIDCProvider(ctx context.Context, cfg config.OIDCConfig) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC issuer %s: %w", cfg.Issuer, err)
+	}
+
+	return &OIDCProvider{
+		cfg: cfg,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       cfg.Scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		pending:  make(map[string]pendingLogin),
+	}, nil
+}
+
+// SessionTTL returns how long a sign-in lasts
+func (p *OIDCProvider) SessionTTL() time.Duration {
+	return time.Duration(p.cfg.SessionTTL)
+}
+
+// AuthCodeURL starts a login and returns the identity provider URL to send
+// the browser to. redirect is where the browser goes once signed in.
+func (p *OIDCProvider) AuthCodeURL(redirect string) (string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	now := time.Now()
+	p.mu.Lock()
+	for s, login := range p.pending {
+		if now.After(login.expires) {
+			delete(p.pending, s)
+		}
+	}
+	if len(p.pending) >= maxPendingLogins {
+		p.mu.Unlock()
+		return "", fmt.Errorf("%w: too many sign-ins in progress, try again later", ErrLoginDenied)
+	}
+	p.pending[state] = pendingLogin{verifier: verifier, nonce: nonce, redirect: redirect, expires: now.Add(loginTimeout)}
+	p.mu.Unlock()
+
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange completes the login identified by state: it redeems code with the
+// PKCE verifier, verifies the ID token and maps the user's groups to a role.
+// Users in no mapped group are denied.
+func (p *OIDCProvider) Exchange(ctx context.Context, state, code string) (*OIDCIdentity, error) {
+	p.mu.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return nil, fmt.Errorf("%w: unknown or expired sign-in, start again", ErrLoginDenied)
+	}
+
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem the authorization code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("the token response has no id_token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token: %v", ErrLoginDenied, err)
+	}
+	if idToken.Nonce != login.nonce {
+		return nil, fmt.Errorf("%w: ID token nonce does not match", ErrLoginDenied)
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode ID token claims: %w", err)
+	}
+	username, _ := claims[p.cfg.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("%w: ID token has no %s claim", ErrLoginDenied, p.cfg.UsernameClaim)
+	}
+	groups := claimStrings(claims[p.cfg.GroupsClaim])
+	role := MapGroups(p.cfg.RoleMapping, groups)
+	if role == "" {
+		return nil, fmt.Errorf("%w: none of the groups of %s maps to a role", ErrLoginDenied, username)
+	}
+
+	return &OIDCIdentity{Username: username, Groups: groups, Role: role, Redirect: login.redirect}, nil
+}
+
+// MapGroups returns the highest role that mapping gives any of groups, or ""
+// when none of them is mapped
+func MapGroups(mapping map[string]string, groups []string) string {
+	role := ""
+	for _, group := range groups {
+		if r, ok := mapping[group]; ok && roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	return role
+}
+
+// claimStrings reads a claim holding a string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// randomString returns a random URL-safe string for states and nonces
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
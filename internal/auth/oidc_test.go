@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/auth/authtest"
+	"github.com/rakib/proxmox-auto-restart/internal/config"
+)
+
+// newTestOIDC starts a fake issuer and a provider using it
+func newTestOIDC(t *testing.T) (*authtest.Issuer, *OIDCProvider) {
+	t.Helper()
+	issuer, err := authtest.NewIssuer("par", "client-secret")
+	if err != nil {
+		t.Fatalf("NewIssuer: %v", err)
+	}
+	t.Cleanup(issuer.Close)
+
+	provider, err := NewOIDCProvider(context.Background(), config.OIDCConfig{
+		Issuer:        issuer.URL,
+		ClientID:      "par",
+		ClientSecret:  "client-secret",
+		RedirectURL:   "http://par.test/api/auth/oidc/callback",
+		Scopes:        []string{"openid", "profile"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		RoleMapping:   map[string]string{"ops": RoleOperator, "infra": RoleAdmin},
+		SessionTTL:    config.Duration(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	return issuer, provider
+}
+
+// authorize follows a login URL to the fake issuer and returns the state and
+// code it sends back to the callback
+func authorize(t *testing.T, loginURL string) (string, string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(loginURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil {
+		t.Fatalf("expected a redirect to the callback, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return callback.Query().Get("state"), callback.Query().Get("code")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	issuer, provider := newTestOIDC(t)
+	issuer.SetUser("alice", "staff", "ops")
+
+	loginURL, err := provider.AuthCodeURL("/whitelist")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	if q, _ := url.Parse(loginURL); q.Query().Get("code_challenge_method") != "S256" || q.Query().Get("nonce") == "" {
+		t.Errorf("login URL lacks PKCE or a nonce: %s", loginURL)
+	}
+
+	state, code := authorize(t, loginURL)
+	identity, err := provider.Exchange(context.Background(), state, code)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Username != "alice" || identity.Role != RoleOperator || identity.Redirect != "/whitelist" || len(identity.Groups) != 2 {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	// A state can only be used once
+	if _, err := provider.Exchange(context.Background(), state, code); !errors.Is(err, ErrLoginDenied) {
+		t.Errorf("expected a replayed state to be denied, got %v", err)
+	}
+
+	// Users in no mapped group are denied
+	issuer.SetUser("bob", "staff")
+	loginURL, _ = provider.AuthCodeURL("/")
+	state, code = authorize(t, loginURL)
+	if _, err := provider.Exchange(context.Background(), state, code); !errors.Is(err, ErrLoginDenied) {
+		t.Errorf("expected an unmapped user to be denied, got %v", err)
+	}
+}
+
+func TestMapGroups(t *testing.T) {
+	mapping := map[string]string{"ops": RoleOperator, "infra": RoleAdmin, "audit": RoleViewer}
+	if got := MapGroups(mapping, []string{"audit", "infra", "ops"}); got != RoleAdmin {
+		t.Errorf("expected the highest role, got %q", got)
+	}
+	if got := MapGroups(mapping, []string{"staff"}); got != "" {
+		t.Errorf("expected no role for unmapped groups, got %q", got)
+	}
+}
+
+func TestLoginExternal(t *testing.T) {
+	store := newTestStore(t)
+
+	user, err := LoginExternal(store, ProviderOIDC, "alice", RoleViewer)
+	if err != nil || user.Provider != ProviderOIDC || user.Role != RoleViewer || user.PasswordHash != "" {
+		t.Fatalf("LoginExternal: %+v, %v", user, err)
+	}
+	if user, _ = LoginExternal(store, ProviderOIDC, "alice", RoleAdmin); user.Role != RoleAdmin {
+		t.Errorf("expected the role to follow the groups, got %s", user.Role)
+	}
+	if err := SetPassword(store, user, "correct horse"); !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("expected no password for an OIDC account, got %v", err)
+	}
+
+	if _, err := CreateUser(store, "bob", "correct horse", RoleAdmin); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := LoginExternal(store, ProviderOIDC, "bob", RoleViewer); !errors.Is(err, ErrLoginDenied) {
+		t.Errorf("expected a local account not to be taken over, got %v", err)
+	}
+
+	user.Enabled = false
+	store.UpdateUser(user)
+	if _, err := LoginExternal(store, ProviderOIDC, "alice", RoleAdmin); !errors.Is(err, ErrLoginDenied) {
+		t.Errorf("expected a disabled account to be denied, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// Grant scopes
+const (
+	ScopeNode = "node" // every guest on a node
+	ScopeVMID = "vmid" // one VMID or an inclusive range such as 100-199
+	ScopePool = "pool" // every guest in a Proxmox pool
+	ScopeTag  = "tag"  // every guest carrying a Proxmox tag
+)
+
+var (
+	// ErrInvalidGrant wraps every reason a grant is rejected
+	ErrInvalidGrant = errors.New("invalid grant")
+	// ErrGrantExists is returned when the user already has the grant
+	ErrGrantExists = errors.New("grant already exists")
+)
+
+// parseVMIDRange parses "100" or "100-199"
+func parseVMIDRange(value string) (int, int, error) {
+	from, to, isRange := strings.Cut(value, "-")
+	first, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, err
+	}
+	last := first
+	if isRange {
+		if last, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+			return 0, 0, err
+		}
+	}
+	if first <= 0 || last < first {
+		return 0, 0, fmt.Errorf("range %d-%d is empty", first, last)
+	}
+	return first, last, nil
+}
+
+// ValidateGrant checks a grant and returns its value in canonical form
+func ValidateGrant(scope, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("%w: value is required", ErrInvalidGrant)
+	}
+
+	switch scope {
+	case ScopeNode, ScopePool:
+		return value, nil
+	case ScopeTag:
+		// Proxmox stores tags in lower case
+		return strings.ToLower(value), nil
+	case ScopeVMID:
+		first, last, err := parseVMIDRange(value)
+		if err != nil {
+			return "", fmt.Errorf("%w: vmid must be a VMID or a range like 100-199", ErrInvalidGrant)
+		}
+		if first == last {
+			return strconv.Itoa(first), nil
+		}
+		return fmt.Sprintf("%d-%d", first, last), nil
+	}
+	return "", fmt.Errorf("%w: scope must be %s, %s, %s or %s", ErrInvalidGrant, ScopeNode, ScopeVMID, ScopePool, ScopeTag)
+}
+
+// AddGrant validates and stores a grant for an account
+func AddGrant(users db.UserRepository, user *models.User, scope, value string) (*models.UserGrant, error) {
+	value, err := ValidateGrant(scope, value)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := users.CreateUserGrant(user.ID, scope, value)
+	if db.IsUniqueViolation(err) {
+		return nil, fmt.Errorf("%w: %s %s", ErrGrantExists, scope, value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create grant: %w", err)
+	}
+	return &models.UserGrant{ID: id, UserID: user.ID, Scope: scope, Value: value}, nil
+}
+
+// Scope is the set of guests an account may see and act on. It is made of
+// layers of grants; a guest must match a grant in every layer.
+type Scope struct {
+	layers [][]models.UserGrant
+}
+
+// ScopeFor returns the scope of an account from its loaded grants. Admins and
+// accounts without grants are unrestricted.
+func ScopeFor(user *models.User) Scope {
+	if user == nil || user.Role == RoleAdmin {
+		return Scope{}
+	}
+	return Scope{}.Narrow(user.Grants)
+}
+
+// Narrow returns the part of the scope also covered by grants. No grants
+// leave the scope unchanged.
+func (s Scope) Narrow(grants []models.UserGrant) Scope {
+	if len(grants) == 0 {
+		return s
+	}
+	layers := append(s.layers[:len(s.layers):len(s.layers)], grants)
+	return Scope{layers: layers}
+}
+
+// Unrestricted reports whether the scope covers every guest
+func (s Scope) Unrestricted() bool {
+	return len(s.layers) == 0
+}
+
+// NeedsDetails reports whether the scope has pool or tag grants, which can
+// only be checked against a guest's details from Proxmox
+func (s Scope) NeedsDetails() bool {
+	for _, grants := range s.layers {
+		for _, g := range grants {
+			if g.Scope == ScopePool || g.Scope == ScopeTag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allows reports whether a guest falls within the scope. Pool and tag grants
+// only match when res carries the guest's pool and tags.
+func (s Scope) Allows(res models.Resource) bool {
+	for _, grants := range s.layers {
+		if !anyGrantMatches(grants, res) {
+			return false
+		}
+	}
+	return true
+}
+
+func anyGrantMatches(grants []models.UserGrant, res models.Resource) bool {
+	for _, g := range grants {
+		if grantMatches(g, res) {
+			return true
+		}
+	}
+	return false
+}
+
+func grantMatches(g models.UserGrant, res models.Resource) bool {
+	switch g.Scope {
+	case ScopeNode:
+		return res.Node == g.Value
+	case ScopeVMID:
+		first, last, err := parseVMIDRange(g.Value)
+		return err == nil && res.VMID >= first && res.VMID <= last
+	case ScopePool:
+		return res.Pool != "" && res.Pool == g.Value
+	case ScopeTag:
+		for _, tag := range res.Tags {
+			if strings.EqualFold(tag, g.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LogScopes translates the scope into restart log filters, one per layer.
+// Pool and tag grants match the VMIDs of the given guests.
+func (s Scope) LogScopes(resources []models.Resource) []models.LogScope {
+	var scopes []models.LogScope
+	for _, grants := range s.layers {
+		var scope models.LogScope
+		for _, g := range grants {
+			switch g.Scope {
+			case ScopeNode:
+				scope.Nodes = append(scope.Nodes, g.Value)
+			case ScopeVMID:
+				if first, last, err := parseVMIDRange(g.Value); err == nil {
+					scope.VMIDRanges = append(scope.VMIDRanges, [2]int{first, last})
+				}
+			}
+		}
+		for _, res := range resources {
+			for _, g := range grants {
+				if (g.Scope == ScopePool || g.Scope == ScopeTag) && grantMatches(g, res) {
+					scope.VMIDs = append(scope.VMIDs, res.VMID)
+					break
+				}
+			}
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
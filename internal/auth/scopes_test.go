@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+func TestValidateGrant(t *testing.T) {
+	for _, tt := range []struct{ scope, value, want string }{
+		{ScopeNode, "pve1", "pve1"},
+		{ScopeVMID, "105", "105"},
+		{ScopeVMID, " 100 - 199 ", "100-199"},
+		{ScopeVMID, "200-200", "200"},
+		{ScopePool, "team-a", "team-a"},
+		{ScopeTag, "Prod", "prod"},
+	} {
+		if got, err := ValidateGrant(tt.scope, tt.value); err != nil || got != tt.want {
+			t.Errorf("ValidateGrant(%q, %q) = %q, %v; want %q", tt.scope, tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ scope, value string }{
+		{ScopeNode, ""},
+		{ScopeVMID, "abc"},
+		{ScopeVMID, "199-100"},
+		{ScopeVMID, "0"},
+		{"group", "web"},
+	} {
+		if _, err := ValidateGrant(tt.scope, tt.value); !errors.Is(err, ErrInvalidGrant) {
+			t.Errorf("ValidateGrant(%q, %q): expected ErrInvalidGrant, got %v", tt.scope, tt.value, err)
+		}
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	user := &models.User{Role: RoleOperator, Grants: []models.UserGrant{
+		{Scope: ScopeNode, Value: "pve1"},
+		{Scope: ScopeVMID, Value: "200-299"},
+		{Scope: ScopePool, Value: "team-a"},
+		{Scope: ScopeTag, Value: "prod"},
+	}}
+	scope := ScopeFor(user)
+	if scope.Unrestricted() || !scope.NeedsDetails() {
+		t.Fatal("expected a restricted scope that needs guest details")
+	}
+
+	for _, tt := range []struct {
+		res  models.Resource
+		want bool
+	}{
+		{models.Resource{VMID: 101, Node: "pve1"}, true},
+		{models.Resource{VMID: 250, Node: "pve2"}, true},
+		{models.Resource{VMID: 101, Node: "pve2", Pool: "team-a"}, true},
+		{models.Resource{VMID: 101, Node: "pve2", Tags: []string{"db", "PROD"}}, true},
+		{models.Resource{VMID: 300, Node: "pve2", Pool: "team-b", Tags: []string{"dev"}}, false},
+	} {
+		if got := scope.Allows(tt.res); got != tt.want {
+			t.Errorf("Allows(%+v) = %v, want %v", tt.res, got, tt.want)
+		}
+	}
+
+	if !ScopeFor(&models.User{Role: RoleOperator}).Unrestricted() {
+		t.Error("accounts without grants should be unrestricted")
+	}
+	user.Role = RoleAdmin
+	if !ScopeFor(user).Unrestricted() {
+		t.Error("grants should not restrict admins")
+	}
+}
+
+func TestScopeLogScope(t *testing.T) {
+	scope := ScopeFor(&models.User{Role: RoleViewer, Grants: []models.UserGrant{
+		{Scope: ScopeNode, Value: "pve1"},
+		{Scope: ScopeVMID, Value: "200-299"},
+		{Scope: ScopeTag, Value: "prod"},
+	}})
+
+	scopes := scope.LogScopes([]models.Resource{
+		{VMID: 101, Node: "pve2", Tags: []string{"prod"}},
+		{VMID: 102, Node: "pve2", Tags: []string{"dev"}},
+	})
+	if len(scopes) != 1 {
+		t.Fatalf("expected one log scope, got %+v", scopes)
+	}
+	ls := scopes[0]
+	if len(ls.Nodes) != 1 || ls.Nodes[0] != "pve1" {
+		t.Errorf("unexpected nodes %v", ls.Nodes)
+	}
+	if len(ls.VMIDRanges) != 1 || ls.VMIDRanges[0] != [2]int{200, 299} {
+		t.Errorf("unexpected ranges %v", ls.VMIDRanges)
+	}
+	if len(ls.VMIDs) != 1 || ls.VMIDs[0] != 101 {
+		t.Errorf("unexpected VMIDs %v", ls.VMIDs)
+	}
+
+	if ScopeFor(&models.User{Role: RoleViewer}).LogScopes(nil) != nil {
+		t.Error("an unrestricted scope should not filter logs")
+	}
+}
+
+func TestScopeNarrow(t *testing.T) {
+	user := &models.User{Role: RoleOperator, Grants: []models.UserGrant{{Scope: ScopeNode, Value: "pve1"}}}
+	scope := ScopeFor(user).Narrow([]models.UserGrant{{Scope: ScopeVMID, Value: "100-199"}})
+
+	if !scope.Allows(models.Resource{VMID: 101, Node: "pve1"}) {
+		t.Error("guest within both layers should be allowed")
+	}
+	if scope.Allows(models.Resource{VMID: 201, Node: "pve1"}) || scope.Allows(models.Resource{VMID: 101, Node: "pve2"}) {
+		t.Error("guests outside either layer should be refused")
+	}
+	if len(scope.LogScopes(nil)) != 2 {
+		t.Error("expected a log scope per layer")
+	}
+
+	// Narrowing an unrestricted admin scope restricts it
+	admin := ScopeFor(&models.User{Role: RoleAdmin}).Narrow([]models.UserGrant{{Scope: ScopeNode, Value: "pve2"}})
+	if admin.Unrestricted() || admin.Allows(models.Resource{VMID: 101, Node: "pve1"}) {
+		t.Error("narrowed admin scope should be restricted")
+	}
+	if !ScopeFor(user).Narrow(nil).Allows(models.Resource{VMID: 300, Node: "pve1"}) {
+		t.Error("narrowing with no grants should not change the scope")
+	}
+}
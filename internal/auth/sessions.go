@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// SessionPrefix starts every session secret, so sessions and API tokens
+// cannot be mistaken for each other
+const SessionPrefix = "pas_"
+
+// ErrLoginDenied wraps every reason an identity provider's user may not sign in
+var ErrLoginDenied = errors.New("sign-in denied")
+
+// Identity is a user signed in through an external provider
+type Identity struct {
+	Username string
+	Groups   []string
+	Role     string
+}
+
+// PasswordProvider checks the passwords of users kept outside this service,
+// such as in an LDAP directory. Authenticate returns ErrLoginDenied for wrong
+// credentials and users without a role.
+type PasswordProvider interface {
+	// Name is the provider recorded on the accounts of its users
+	Name() string
+	Authenticate(username, password string) (*Identity, error)
+}
+
+// LoginExternal returns the account of a user signed in through an identity
+// provider, creating it on first sign-in. The role comes from the provider
+// and is updated on every sign-in. Accounts of another provider, including
+// local password accounts, are never taken over.
+func LoginExternal(users db.UserRepository, provider, username, role string) (*models.User, error) {
+	if err := ValidateUsername(username); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLoginDenied, err)
+	}
+	if roleRank[role] == 0 {
+		return nil, fmt.Errorf("%w: unknown role %q", ErrLoginDenied, role)
+	}
+
+	user, err := users.GetUserByUsername(username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user == nil {
+		id, err := users.CreateUser(username, "", role, provider)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create user: %w", err)
+		}
+		log.Printf("Created %s account %q (%s) on first sign-in", provider, username, role)
+		return users.GetUserByID(id)
+	}
+
+	switch {
+	case user.Provider != provider:
+		return nil, fmt.Errorf("%w: %s belongs to a %s account", ErrLoginDenied, username, user.Provider)
+	case !user.Enabled:
+		return nil, fmt.Errorf("%w: %s is disabled", ErrLoginDenied, username)
+	}
+	if user.Role != role {
+		log.Printf("Role of %s account %q changed from %s to %s by its groups", provider, username, user.Role, role)
+		user.Role = role
+		if err := users.UpdateUser(user); err != nil {
+			return nil, fmt.Errorf("failed to update user: %w", err)
+		}
+	}
+	return user, nil
+}
+
+// CreateSession starts a session for user and returns it with its secret,
+// which is only sent to the browser. Expired sessions are removed on the way.
+func CreateSession(sessions db.SessionRepository, user *models.User, ttl time.Duration) (*models.Session, string, error) {
+	secret, err := generateToken(SessionPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &models.Session{UserID: user.ID, TokenHash: HashToken(secret), ExpiresAt: now.Add(ttl), CreatedAt: now}
+	if session.ID, err = sessions.CreateSession(session); err != nil {
+		return nil, "", fmt.Errorf("failed to create session: %w", err)
+	}
+	if _, err := sessions.DeleteExpiredSessions(now); err != nil {
+		log.Printf("ERROR: Failed to remove expired sessions: %v", err)
+	}
+	return session, secret, nil
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TicketPrefix starts every terminal ticket
+const TicketPrefix = "pat_"
+
+// maxTickets bounds the number of unredeemed tickets
+const maxTickets = 1024
+
+// ErrInvalidTicket is returned for unknown, used and expired tickets
+var ErrInvalidTicket = errors.New("invalid or expired ticket")
+
+// TerminalTicket allows one terminal connection to one guest
+type TerminalTicket struct {
+	UserID    int64
+	VMID      int
+	Node      string
+	Type      string
+	ExpiresAt time.Time
+}
+
+// TicketStore keeps terminal tickets in memory until they are redeemed or
+// expire. Only hashes of the tickets are kept.
+type TicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]TerminalTicket // by HashToken of the ticket
+}
+
+// NewTicketStore returns an empty ticket store
+func NewTicketStore() *TicketStore {
+	return &TicketStore{tickets: make(map[string]TerminalTicket)}
+}
+
+// Issue stores a ticket valid for ttl and returns its secret
+func (s *TicketStore) Issue(ticket TerminalTicket, ttl time.Duration) (string, *TerminalTicket, error) {
+	secret, err := generateToken(TicketPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	ticket.ExpiresAt = now.Add(ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, t := range s.tickets {
+		if !now.Before(t.ExpiresAt) {
+			delete(s.tickets, hash)
+		}
+	}
+	if len(s.tickets) >= maxTickets {
+		return "", nil, fmt.Errorf("too many terminal tickets outstanding")
+	}
+	s.tickets[HashToken(secret)] = ticket
+	return secret, &ticket, nil
+}
+
+// Redeem returns the ticket for secret and removes it, so each ticket opens
+// a single connection
+func (s *TicketStore) Redeem(secret string) (*TerminalTicket, error) {
+	hash := HashToken(secret)
+	s.mu.Lock()
+	ticket, ok := s.tickets[hash]
+	delete(s.tickets, hash)
+	s.mu.Unlock()
+
+	if !ok || !time.Now().Before(ticket.ExpiresAt) {
+		return nil, ErrInvalidTicket
+	}
+	return &ticket, nil
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTicketStore(t *testing.T) {
+	store := NewTicketStore()
+
+	secret, ticket, err := store.Issue(TerminalTicket{UserID: 1, VMID: 101, Node: "pve1", Type: "lxc"}, time.Minute)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if !strings.HasPrefix(secret, TicketPrefix) || ticket.ExpiresAt.IsZero() {
+		t.Errorf("unexpected ticket %q %+v", secret, ticket)
+	}
+
+	redeemed, err := store.Redeem(secret)
+	if err != nil || redeemed.UserID != 1 || redeemed.VMID != 101 || redeemed.Node != "pve1" || redeemed.Type != "lxc" {
+		t.Fatalf("Redeem: %+v %v", redeemed, err)
+	}
+	if _, err := store.Redeem(secret); !errors.Is(err, ErrInvalidTicket) {
+		t.Errorf("expected a ticket to be single-use, got %v", err)
+	}
+	if _, err := store.Redeem(""); !errors.Is(err, ErrInvalidTicket) {
+		t.Errorf("expected an empty ticket to be refused, got %v", err)
+	}
+
+	expired, _, _ := store.Issue(TerminalTicket{UserID: 1}, -time.Second)
+	if _, err := store.Redeem(expired); !errors.Is(err, ErrInvalidTicket) {
+		t.Errorf("expected an expired ticket to be refused, got %v", err)
+	}
+}
+
+func TestTicketStoreLimit(t *testing.T) {
+	store := NewTicketStore()
+	for i := 0; i < maxTickets; i++ {
+		if _, _, err := store.Issue(TerminalTicket{UserID: 1}, time.Minute); err != nil {
+			t.Fatalf("Issue %d: %v", i, err)
+		}
+	}
+	if _, _, err := store.Issue(TerminalTicket{UserID: 1}, time.Minute); err == nil {
+		t.Error("expected outstanding tickets to be limited")
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// TokenPrefix starts every API token, so leaked tokens are easy to recognise
+const TokenPrefix = "par_"
+
+var (
+	// ErrInvalidToken wraps every reason a token request is rejected
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExists is returned when the owner already has a token with the name
+	ErrTokenExists = errors.New("token already exists")
+)
+
+// HashToken returns the hash stored for a token. Tokens are long and random,
+// so a fast hash is enough.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateToken returns a new random token starting with prefix
+func generateToken(prefix string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// ParseTokenScope parses a token scope such as pool:team-a into a grant
+func ParseTokenScope(scope string) (models.UserGrant, error) {
+	kind, value, ok := strings.Cut(scope, ":")
+	if !ok {
+		return models.UserGrant{}, fmt.Errorf("%w: scope %q must look like node:pve1", ErrInvalidToken, scope)
+	}
+	value, err := ValidateGrant(kind, value)
+	if err != nil {
+		return models.UserGrant{}, fmt.Errorf("%w: scope %q: %v", ErrInvalidToken, scope, err)
+	}
+	if strings.ContainsFunc(value, unicode.IsSpace) {
+		return models.UserGrant{}, fmt.Errorf("%w: scope %q must not contain spaces", ErrInvalidToken, scope)
+	}
+	return models.UserGrant{Scope: kind, Value: value}, nil
+}
+
+// TokenGrants returns a token's scopes as grants. Scopes were validated when
+// the token was created; any that no longer parse are skipped.
+func TokenGrants(token *models.APIToken) []models.UserGrant {
+	grants := make([]models.UserGrant, 0, len(token.Scopes))
+	for _, scope := range token.Scopes {
+		if g, err := ParseTokenScope(scope); err == nil {
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
+
+// CreateToken validates and stores a new token for owner and returns it with
+// its secret, which is not stored and cannot be shown again
+func CreateToken(tokens db.APITokenRepository, owner *models.User, req *models.CreateAPITokenRequest) (*models.APIToken, string, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 64 {
+		return nil, "", fmt.Errorf("%w: name is required and must be at most 64 characters", ErrInvalidToken)
+	}
+
+	role := req.Role
+	if role == "" {
+		role = owner.Role
+	}
+	if roleRank[role] == 0 {
+		return nil, "", fmt.Errorf("%w: role must be %s, %s or %s", ErrInvalidToken, RoleViewer, RoleOperator, RoleAdmin)
+	}
+	if roleRank[role] > roleRank[owner.Role] {
+		return nil, "", fmt.Errorf("%w: role %s is above your own role %s", ErrInvalidToken, role, owner.Role)
+	}
+
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		g, err := ParseTokenScope(scope)
+		if err != nil {
+			return nil, "", err
+		}
+		scopes = append(scopes, g.Scope+":"+g.Value)
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, "", fmt.Errorf("%w: expires_at must be in the future", ErrInvalidToken)
+	}
+
+	secret, err := generateToken(TokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &models.APIToken{
+		UserID:    owner.ID,
+		Username:  owner.Username,
+		Name:      name,
+		Prefix:    secret[:len(TokenPrefix)+6],
+		TokenHash: HashToken(secret),
+		Role:      role,
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+	id, err := tokens.CreateAPIToken(token)
+	if db.IsUniqueViolation(err) {
+		return nil, "", fmt.Errorf("%w: %s", ErrTokenExists, name)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create token: %w", err)
+	}
+
+	created, err := tokens.GetAPITokenByID(id)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get token: %w", err)
+	}
+	return created, secret, nil
+}
+
+// TokenRole returns the role a token acts with: its own role, lowered to its
+// owner's current role
+func TokenRole(owner *models.User, token *models.APIToken) string {
+	if roleRank[token.Role] > roleRank[owner.Role] {
+		return owner.Role
+	}
+	return token.Role
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+func TestCreateToken(t *testing.T) {
+	store := newTestStore(t)
+	owner, err := CreateUser(store, "ci", "correct horse", RoleOperator)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	expires := time.Now().Add(24 * time.Hour)
+	token, secret, err := CreateToken(store, owner, &models.CreateAPITokenRequest{
+		Name: "deploy", Scopes: []string{"vmid:100 - 199", "tag:Prod"}, ExpiresAt: &expires,
+	})
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if !strings.HasPrefix(secret, TokenPrefix) || !strings.HasPrefix(secret, token.Prefix) || len(secret) < 40 {
+		t.Errorf("unexpected secret %q with prefix %q", secret, token.Prefix)
+	}
+	if token.Role != RoleOperator || token.Username != "ci" || token.TokenHash != HashToken(secret) {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if len(token.Scopes) != 2 || token.Scopes[0] != "vmid:100-199" || token.Scopes[1] != "tag:prod" {
+		t.Errorf("scopes not normalised: %q", token.Scopes)
+	}
+	if grants := TokenGrants(token); len(grants) != 2 || grants[0].Scope != ScopeVMID || grants[1].Value != "prod" {
+		t.Errorf("unexpected grants %+v", grants)
+	}
+
+	if _, _, err := CreateToken(store, owner, &models.CreateAPITokenRequest{Name: "deploy"}); !errors.Is(err, ErrTokenExists) {
+		t.Errorf("expected ErrTokenExists, got %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	for _, req := range []models.CreateAPITokenRequest{
+		{Name: ""},
+		{Name: "admin", Role: RoleAdmin},
+		{Name: "bad-role", Role: "root"},
+		{Name: "bad-scope", Scopes: []string{"pve1"}},
+		{Name: "bad-kind", Scopes: []string{"group:web"}},
+		{Name: "expired", ExpiresAt: &past},
+	} {
+		if _, _, err := CreateToken(store, owner, &req); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("CreateToken(%+v): expected ErrInvalidToken, got %v", req, err)
+		}
+	}
+}
+
+func TestTokenRole(t *testing.T) {
+	token := &models.APIToken{Role: RoleOperator}
+	if got := TokenRole(&models.User{Role: RoleAdmin}, token); got != RoleOperator {
+		t.Errorf("token role should apply below the owner's, got %s", got)
+	}
+	if got := TokenRole(&models.User{Role: RoleViewer}, token); got != RoleViewer {
+		t.Errorf("a demoted owner should demote the token, got %s", got)
+	}
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from least to most privileged. Each role can do everything the
+// previous one can.
+const (
+	RoleViewer   = "viewer"   // read resources, the whitelist and logs
+	RoleOperator = "operator" // also restart, start and stop guests and manage the whitelist
+	RoleAdmin    = "admin"    // also manage containers, terminals, users and the database
+)
+
+// Providers an account can sign in with
+const (
+	ProviderLocal = "local" // a password stored here
+	ProviderOIDC  = "oidc"  // an OpenID Connect identity provider
+	ProviderLDAP  = "ldap"  // a password checked against an LDAP directory
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// defaultPassword was the built-in API password before user accounts existed
+// and is refused everywhere
+const defaultPassword = "proxmox2024"
+
+var (
+	// ErrInvalidUser wraps every reason a username, password or role is rejected
+	ErrInvalidUser = errors.New("invalid user")
+	// ErrUserExists is returned when the username is already taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrNoUsers is returned by Bootstrap when there is no account and none
+	// can be created from the configuration
+	ErrNoUsers = errors.New("no user accounts exist")
+)
+
+// ValidateRole checks that a role is one of the known roles
+func ValidateRole(role string) error {
+	if roleRank[role] == 0 {
+		return fmt.Errorf("%w: role must be %s, %s or %s", ErrInvalidUser, RoleViewer, RoleOperator, RoleAdmin)
+	}
+	return nil
+}
+
+// HasRole reports whether a user's role grants at least the required role
+func HasRole(user *models.User, required string) bool {
+	return user != nil && roleRank[user.Role] >= roleRank[required]
+}
+
+// HashPassword returns the bcrypt hash of a password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// dummyHash is checked against in place of a missing or invalid hash, so a
+// failed sign-in takes as long whether or not the account exists
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("no account has this password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// CheckPassword reports whether password matches a hash from HashPassword.
+// An empty or invalid hash never matches but takes as long to check.
+func CheckPassword(hash, password string) bool {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// ValidateUsername checks that a username can be sent with HTTP Basic auth
+func ValidateUsername(username string) error {
+	switch {
+	case username == "":
+		return fmt.Errorf("%w: username is required", ErrInvalidUser)
+	case len(username) > 64:
+		return fmt.Errorf("%w: username must be at most 64 characters", ErrInvalidUser)
+	case strings.ContainsRune(username, ':') || strings.ContainsFunc(username, unicode.IsSpace):
+		return fmt.Errorf("%w: username must not contain colons or spaces", ErrInvalidUser)
+	}
+	return nil
+}
+
+// ValidatePassword enforces the password policy
+func ValidatePassword(password string) error {
+	switch {
+	case len(password) < 8:
+		return fmt.Errorf("%w: password must be at least 8 characters", ErrInvalidUser)
+	case len(password) > 72:
+		// bcrypt ignores everything after 72 bytes
+		return fmt.Errorf("%w: password must be at most 72 bytes", ErrInvalidUser)
+	case password == defaultPassword:
+		return fmt.Errorf("%w: the former default password is not allowed", ErrInvalidUser)
+	}
+	return nil
+}
+
+// CreateUser validates and stores a new enabled account
+func CreateUser(users db.UserRepository, username, password, role string) (*models.User, error) {
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if err := ValidateRole(role); err != nil {
+		return nil, err
+	}
+	if err := ValidatePassword(password); err != nil {
+		return nil, err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := users.CreateUser(username, hash, role, ProviderLocal)
+	if db.IsUniqueViolation(err) {
+		return nil, fmt.Errorf("%w: %s", ErrUserExists, username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	return users.GetUserByID(id)
+}
+
+// SetPassword validates and stores a new password for a local account
+func SetPassword(users db.UserRepository, user *models.User, password string) error {
+	if user.Provider != ProviderLocal {
+		return fmt.Errorf("%w: %s signs in with %s and has no password", ErrInvalidUser, user.Username, user.Provider)
+	}
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	if err := users.UpdateUser(user); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// Bootstrap makes sure at least one account exists. On first run it creates
+// an admin from the configured username and password, which must be set and
+// must not be the former default. Once accounts exist the configured credentials
+// are no longer used.
+func Bootstrap(users db.UserRepository, username, password string) error {
+	count, err := users.CountUsers()
+	if err != nil {
+		return fmt.Errorf("failed to count users: %w", err)
+	}
+	if count > 0 {
+		if password != "" {
+			log.Printf("WARNING: auth.password (AUTH_PASSWORD) is ignored because user accounts exist; remove it from the configuration")
+		}
+		return nil
+	}
+
+	if password == "" {
+		return fmt.Errorf("%w: set auth.username and auth.password (AUTH_USERNAME, AUTH_PASSWORD) to create the first account, "+
+			"or run \"proxmox-auto-restart user add <username>\"", ErrNoUsers)
+	}
+	user, err := CreateUser(users, username, password, RoleAdmin)
+	if err != nil {
+		return fmt.Errorf("failed to create the first account: %w", err)
+	}
+	log.Printf("Created the first user account %q (admin) from the configuration; AUTH_PASSWORD can now be removed", user.Username)
+	return nil
+}
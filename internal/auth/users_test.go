@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+func newTestStore(t *testing.T) db.Store {
+	t.Helper()
+	conn, err := db.Open(":memory:")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	store := db.NewStore(conn)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if hash == "correct horse" || !CheckPassword(hash, "correct horse") {
+		t.Errorf("hash %q does not verify", hash)
+	}
+	if CheckPassword(hash, "wrong horse") || CheckPassword("not a hash", "correct horse") {
+		t.Error("wrong password or malformed hash accepted")
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	store := newTestStore(t)
+
+	user, err := CreateUser(store, "alice", "correct horse", RoleOperator)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if !user.Enabled || user.Role != RoleOperator || !CheckPassword(user.PasswordHash, "correct horse") {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if _, err := CreateUser(store, "alice", "another one", RoleViewer); !errors.Is(err, ErrUserExists) {
+		t.Errorf("expected ErrUserExists, got %v", err)
+	}
+
+	for _, tt := range []struct{ username, password, role string }{
+		{"", "correct horse", RoleViewer},
+		{"bob:admin", "correct horse", RoleViewer},
+		{"bob smith", "correct horse", RoleViewer},
+		{"bob", "short", RoleViewer},
+		{"bob", defaultPassword, RoleViewer},
+		{"bob", "correct horse", "root"},
+	} {
+		if _, err := CreateUser(store, tt.username, tt.password, tt.role); !errors.Is(err, ErrInvalidUser) {
+			t.Errorf("CreateUser(%q, %q, %q): expected ErrInvalidUser, got %v", tt.username, tt.password, tt.role, err)
+		}
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	operator := &models.User{Role: RoleOperator}
+	if !HasRole(operator, RoleViewer) || !HasRole(operator, RoleOperator) || HasRole(operator, RoleAdmin) {
+		t.Error("operator should include viewer and exclude admin")
+	}
+	if HasRole(&models.User{Role: "unknown"}, RoleViewer) || HasRole(nil, RoleViewer) {
+		t.Error("unknown roles and missing users grant nothing")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	store := newTestStore(t)
+
+	if err := Bootstrap(store, "admin", ""); !errors.Is(err, ErrNoUsers) {
+		t.Errorf("expected ErrNoUsers without a password, got %v", err)
+	}
+	if err := Bootstrap(store, "admin", defaultPassword); !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("the former default password must be refused, got %v", err)
+	}
+	if n, _ := store.CountUsers(); n != 0 {
+		t.Fatalf("expected no users, got %d", n)
+	}
+
+	if err := Bootstrap(store, "admin", "first-run-secret"); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	admin, _ := store.GetUserByUsername("admin")
+	if admin == nil || admin.Role != RoleAdmin || !CheckPassword(admin.PasswordHash, "first-run-secret") {
+		t.Fatalf("first account not created: %+v", admin)
+	}
+
+	// Later runs leave the accounts alone
+	if err := Bootstrap(store, "admin", "changed-in-config"); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if admin, _ = store.GetUserByUsername("admin"); !CheckPassword(admin.PasswordHash, "first-run-secret") {
+		t.Error("Bootstrap changed an existing account")
+	}
+}
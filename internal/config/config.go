@@ -0,0 +1,448 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the service configuration. It is read from a YAML file, then
+// environment variables override individual settings.
+type Config struct {
+	Server        ServerConfig        `yaml:"server"`
+	Database      DatabaseConfig      `yaml:"database"`
+	Auth          AuthConfig          `yaml:"auth"`
+	OIDC          OIDCConfig          `yaml:"oidc"`
+	LDAP          LDAPConfig          `yaml:"ldap"`
+	Scheduler     SchedulerConfig     `yaml:"scheduler"`
+	Backend       BackendConfig       `yaml:"backend"`
+	Notifications NotificationsConfig `yaml:"notifications"`
+	Retention     RetentionConfig     `yaml:"retention"`
+	Backup        BackupConfig        `yaml:"backup"`
+	Terminal      TerminalConfig      `yaml:"terminal"`
+}
+
+// ServerConfig configures the HTTP API
+type ServerConfig struct {
+	Port int `yaml:"port"`
+}
+
+// DatabaseConfig selects the database; URL takes precedence over Path
+type DatabaseConfig struct {
+	// Path is the SQLite database file
+	Path string `yaml:"path"`
+	// URL is a postgres:// connection URL
+	URL string `yaml:"url"`
+}
+
+// AuthConfig holds the credentials of the first user account, created on
+// startup while the users table is empty
+type AuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// OIDCConfig configures single sign-on through an OpenID Connect provider.
+// It is enabled when Issuer is set.
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is this service's /api/auth/oidc/callback as the browser sees it
+	RedirectURL   string   `yaml:"redirect_url"`
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"username_claim"`
+	GroupsClaim   string   `yaml:"groups_claim"`
+	// RoleMapping maps groups from GroupsClaim to roles; users in none of
+	// them cannot sign in
+	RoleMapping map[string]string `yaml:"role_mapping"`
+	SessionTTL  Duration          `yaml:"session_ttl"`
+}
+
+// Enabled reports whether OIDC sign-in is configured
+func (o OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// LDAPConfig configures password sign-in against an LDAP directory or Active
+// Directory. It is enabled when URL is set.
+type LDAPConfig struct {
+	// URL is ldap://host:389 or ldaps://host:636
+	URL                string `yaml:"url"`
+	StartTLS           bool   `yaml:"start_tls"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// BindDN and BindPassword are the account that searches for users;
+	// empty searches anonymously
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	UserBaseDN   string `yaml:"user_base_dn"`
+	// UserFilter finds the user; %s is replaced with the escaped username
+	UserFilter        string `yaml:"user_filter"`
+	UsernameAttribute string `yaml:"username_attribute"`
+	// GroupAttribute lists the user's groups on the user entry (memberOf).
+	// With GroupBaseDN set, groups are searched with GroupFilter instead, %s
+	// being the user's DN.
+	GroupAttribute string `yaml:"group_attribute"`
+	GroupBaseDN    string `yaml:"group_base_dn"`
+	GroupFilter    string `yaml:"group_filter"`
+	// RoleMapping maps group DNs or common names to roles; users in none of
+	// them cannot sign in
+	RoleMapping map[string]string `yaml:"role_mapping"`
+	CacheTTL    Duration          `yaml:"cache_ttl"`
+	Timeout     Duration          `yaml:"timeout"`
+}
+
+// Enabled reports whether LDAP sign-in is configured
+func (l LDAPConfig) Enabled() bool {
+	return l.URL != ""
+}
+
+// SchedulerConfig configures automatic restarts and the watchdog
+type SchedulerConfig struct {
+	// Enabled runs the restart scheduler, watchdog and log pruner
+	Enabled bool `yaml:"enabled"`
+	// CheckInterval is how often whitelist entries are checked for due restarts
+	CheckInterval Duration `yaml:"check_interval"`
+	// DefaultIntervalHours applies to entries without their own interval
+	DefaultIntervalHours int             `yaml:"default_interval_hours"`
+	WatchdogInterval     Duration        `yaml:"watchdog_interval"`
+	Verify               VerifyConfig    `yaml:"verify"`
+	Queue                QueueConfig     `yaml:"queue"`
+	CrashLoop            CrashLoopConfig `yaml:"crash_loop"`
+}
+
+// VerifyConfig configures the check that a restarted guest came back
+type VerifyConfig struct {
+	Timeout Duration `yaml:"timeout"`
+	Probe   bool     `yaml:"probe"`
+}
+
+// QueueConfig limits how many scheduled restarts run at once
+type QueueConfig struct {
+	MaxConcurrent int      `yaml:"max_concurrent"`
+	MaxPerNode    int      `yaml:"max_per_node"`
+	Stagger       Duration `yaml:"stagger"`
+	Jitter        Duration `yaml:"jitter"`
+}
+
+// CrashLoopConfig configures the quarantine of guests that keep failing
+type CrashLoopConfig struct {
+	MaxFailures int      `yaml:"max_failures"`
+	Window      Duration `yaml:"window"`
+	Backoff     Duration `yaml:"backoff"`
+	MaxBackoff  Duration `yaml:"max_backoff"`
+}
+
+// BackendConfig selects how the service talks to Proxmox
+type BackendConfig struct {
+	// Type is "shell" or "api"
+	Type        string `yaml:"type"`
+	APIURL      string `yaml:"api_url"`
+	TokenID     string `yaml:"token_id"`
+	TokenSecret string `yaml:"token_secret"`
+	Insecure    bool   `yaml:"insecure"`
+}
+
+// NotificationsConfig configures where alerts are sent
+type NotificationsConfig struct {
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// RetentionConfig configures restart log pruning
+type RetentionConfig struct {
+	MaxAge        Duration            `yaml:"max_age"`
+	StatusMaxAge  map[string]Duration `yaml:"status_max_age"`
+	MaxPerVMID    int                 `yaml:"max_per_vmid"`
+	ArchiveDir    string              `yaml:"archive_dir"`
+	PruneInterval Duration            `yaml:"prune_interval"`
+}
+
+// BackupConfig configures database backups
+type BackupConfig struct {
+	// Dir defaults to a backups directory beside the SQLite database
+	Dir      string   `yaml:"dir"`
+	Keep     int      `yaml:"keep"`
+	Interval Duration `yaml:"interval"`
+}
+
+// TerminalConfig configures web terminal connections
+type TerminalConfig struct {
+	// TicketTTL is how long a terminal ticket can wait to be used
+	TicketTTL Duration `yaml:"ticket_ttl"`
+	// IdleTimeout closes terminals that received no input for this long; 0
+	// keeps them open
+	IdleTimeout Duration `yaml:"idle_timeout"`
+	// AllowedOrigins are the pages, such as https://dash.example.com, that may
+	// open terminals besides this host's own; "*" allows any
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// RecordingDir holds the session recordings; it defaults to a recordings
+	// directory beside the SQLite database
+	RecordingDir string `yaml:"recording_dir"`
+}
+
+// Duration is a time.Duration written as a string such as "90s" or "6h"
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalYAML writes the duration as a string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Default returns the settings used when neither the config file nor the
+// environment sets them
+func Default() *Config {
+	return &Config{
+		Server:   ServerConfig{Port: 8080},
+		Database: DatabaseConfig{Path: "./proxmox.db"},
+		Auth:     AuthConfig{Username: "admin"},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+			SessionTTL:    Duration(8 * time.Hour),
+		},
+		LDAP: LDAPConfig{
+			UserFilter:        "(&(objectClass=person)(uid=%s))",
+			UsernameAttribute: "uid",
+			GroupAttribute:    "memberOf",
+			GroupFilter:       "(member=%s)",
+			CacheTTL:          Duration(time.Minute),
+			Timeout:           Duration(10 * time.Second),
+		},
+		Scheduler: SchedulerConfig{
+			Enabled:              true,
+			CheckInterval:        Duration(time.Hour),
+			DefaultIntervalHours: 6,
+			WatchdogInterval:     Duration(15 * time.Second),
+			Verify:               VerifyConfig{Timeout: Duration(5 * time.Minute)},
+			Queue: QueueConfig{
+				MaxConcurrent: 2,
+				MaxPerNode:    1,
+				Stagger:       Duration(30 * time.Second),
+				Jitter:        Duration(30 * time.Second),
+			},
+			CrashLoop: CrashLoopConfig{
+				MaxFailures: 3,
+				Window:      Duration(6 * time.Hour),
+				Backoff:     Duration(time.Hour),
+				MaxBackoff:  Duration(24 * time.Hour),
+			},
+		},
+		Backend:   BackendConfig{Type: "shell"},
+		Retention: RetentionConfig{PruneInterval: Duration(24 * time.Hour)},
+		Backup:    BackupConfig{Keep: 7, Interval: Duration(24 * time.Hour)},
+		Terminal:  TerminalConfig{TicketTTL: Duration(30 * time.Second), IdleTimeout: Duration(30 * time.Minute)},
+	}
+}
+
+// Load reads the config file at path, if any, applies environment overrides
+// and validates the result
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Backup.Dir == "" {
+		cfg.Backup.Dir = filepath.Join(filepath.Dir(cfg.Database.Path), "backups")
+	}
+	if cfg.Terminal.RecordingDir == "" {
+		cfg.Terminal.RecordingDir = filepath.Join(filepath.Dir(cfg.Database.Path), "recordings")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// DSN returns the database to open: the PostgreSQL URL if set, else the
+// SQLite path
+func (c *Config) DSN() string {
+	if c.Database.URL != "" {
+		return c.Database.URL
+	}
+	return c.Database.Path
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port must be between 1 and 65535")
+	check(c.Database.Path != "" || c.Database.URL != "", "database.path or database.url is required")
+	if c.Database.URL != "" {
+		check(strings.HasPrefix(c.Database.URL, "postgres://") || strings.HasPrefix(c.Database.URL, "postgresql://"),
+			"database.url must be a postgres:// URL")
+	}
+	check(c.Auth.Username != "", "auth.username is required")
+
+	if o := c.OIDC; o.Enabled() {
+		u, err := url.Parse(o.Issuer)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "oidc.issuer must be an http(s) URL")
+		u, err = url.Parse(o.RedirectURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "oidc.redirect_url must be an http(s) URL")
+		check(o.ClientID != "", "oidc.client_id is required")
+		check(o.UsernameClaim != "" && o.GroupsClaim != "", "oidc.username_claim and oidc.groups_claim are required")
+		check(len(o.RoleMapping) > 0, "oidc.role_mapping must map at least one group to a role")
+		for group, role := range o.RoleMapping {
+			check(role == "viewer" || role == "operator" || role == "admin",
+				"oidc.role_mapping.%s must be viewer, operator or admin", group)
+		}
+		check(o.SessionTTL > 0, "oidc.session_ttl must be positive")
+	}
+
+	if l := c.LDAP; l.Enabled() {
+		u, err := url.Parse(l.URL)
+		check(err == nil && (u.Scheme == "ldap" || u.Scheme == "ldaps") && u.Host != "", "ldap.url must be an ldap:// or ldaps:// URL")
+		check(!l.StartTLS || err != nil || u.Scheme == "ldap", "ldap.start_tls cannot be used with ldaps://")
+		check(l.UserBaseDN != "", "ldap.user_base_dn is required")
+		check(strings.Count(l.UserFilter, "%s") == 1, "ldap.user_filter must contain %%s once")
+		check(l.UsernameAttribute != "", "ldap.username_attribute is required")
+		check(l.GroupBaseDN == "" || strings.Count(l.GroupFilter, "%s") == 1, "ldap.group_filter must contain %%s once")
+		check(l.GroupBaseDN != "" || l.GroupAttribute != "", "ldap.group_attribute or ldap.group_base_dn is required")
+		check(len(l.RoleMapping) > 0, "ldap.role_mapping must map at least one group to a role")
+		for group, role := range l.RoleMapping {
+			check(role == "viewer" || role == "operator" || role == "admin",
+				"ldap.role_mapping.%s must be viewer, operator or admin", group)
+		}
+		check(l.CacheTTL >= 0, "ldap.cache_ttl must not be negative")
+		check(l.Timeout > 0, "ldap.timeout must be positive")
+	}
+
+	s := c.Scheduler
+	check(s.CheckInterval > 0, "scheduler.check_interval must be positive")
+	check(s.DefaultIntervalHours >= 1, "scheduler.default_interval_hours must be at least 1")
+	check(s.WatchdogInterval > 0, "scheduler.watchdog_interval must be positive")
+	check(s.Verify.Timeout >= 0, "scheduler.verify.timeout must not be negative")
+	check(s.Queue.MaxConcurrent >= 0, "scheduler.queue.max_concurrent must not be negative")
+	check(s.Queue.MaxPerNode >= 0, "scheduler.queue.max_per_node must not be negative")
+	check(s.Queue.Stagger >= 0 && s.Queue.Jitter >= 0, "scheduler.queue.stagger and jitter must not be negative")
+	check(s.CrashLoop.MaxFailures >= 0, "scheduler.crash_loop.max_failures must not be negative")
+	check(s.CrashLoop.Window >= 0 && s.CrashLoop.Backoff >= 0 && s.CrashLoop.MaxBackoff >= 0,
+		"scheduler.crash_loop durations must not be negative")
+
+	switch c.Backend.Type {
+	case "shell":
+	case "api":
+		check(c.Backend.APIURL != "" && c.Backend.TokenID != "" && c.Backend.TokenSecret != "",
+			"backend.api_url, backend.token_id and backend.token_secret are required for the api backend")
+	default:
+		errs = append(errs, fmt.Errorf("backend.type must be shell or api, got %q", c.Backend.Type))
+	}
+
+	if c.Notifications.WebhookURL != "" {
+		u, err := url.Parse(c.Notifications.WebhookURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"notifications.webhook_url must be an http(s) URL")
+	}
+
+	r := c.Retention
+	check(r.MaxAge >= 0, "retention.max_age must not be negative")
+	for status, age := range r.StatusMaxAge {
+		check(age >= 0, "retention.status_max_age.%s must not be negative", status)
+	}
+	check(r.MaxPerVMID >= 0, "retention.max_per_vmid must not be negative")
+	check(r.PruneInterval > 0, "retention.prune_interval must be positive")
+
+	check(c.Backup.Keep >= 0, "backup.keep must not be negative")
+	check(c.Backup.Interval >= 0, "backup.interval must not be negative")
+
+	check(c.Terminal.TicketTTL > 0, "terminal.ticket_ttl must be positive")
+	check(c.Terminal.IdleTimeout >= 0, "terminal.idle_timeout must not be negative")
+	for _, origin := range c.Terminal.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check(origin == "*" || (err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == ""),
+			"terminal.allowed_origins must be origins such as https://dash.example.com, got %q", origin)
+	}
+
+	return errors.Join(errs...)
+}
+
+// RestartRequired lists the sections that differ between c and next but
+// only take effect when the service restarts
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	if c.Server != next.Server {
+		changed = append(changed, "server")
+	}
+	if c.Database != next.Database {
+		changed = append(changed, "database")
+	}
+	if c.Backend != next.Backend {
+		changed = append(changed, "backend")
+	}
+	if !reflect.DeepEqual(c.OIDC, next.OIDC) {
+		changed = append(changed, "oidc")
+	}
+	if !reflect.DeepEqual(c.LDAP, next.LDAP) {
+		changed = append(changed, "ldap")
+	}
+	if c.Scheduler.Enabled != next.Scheduler.Enabled {
+		changed = append(changed, "scheduler.enabled")
+	}
+	return changed
+}
+
+// ParseStatusMaxAge parses per-status ages written as "success=720h,skipped=168h"
+func ParseStatusMaxAge(value string) (map[string]Duration, error) {
+	ages := make(map[string]Duration)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		status, age, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(status) == "" {
+			return nil, fmt.Errorf("expected status=duration, got %q", part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(age))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration for %s: %q", status, age)
+		}
+		ages[strings.TrimSpace(status)] = Duration(d)
+	}
+	return ages, nil
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file into a temporary directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Server.Port != 8080 || cfg.DSN() != "./proxmox.db" || !cfg.Scheduler.Enabled {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+	if time.Duration(cfg.Scheduler.CheckInterval) != time.Hour || cfg.Scheduler.DefaultIntervalHours != 6 {
+		t.Errorf("unexpected scheduler defaults %+v", cfg.Scheduler)
+	}
+	if cfg.Backup.Dir != "backups" || cfg.Terminal.RecordingDir != "recordings" {
+		t.Errorf("backups and recordings should default beside the database, got %q and %q",
+			cfg.Backup.Dir, cfg.Terminal.RecordingDir)
+	}
+}
+
+func TestLoadFileWithEnvOverrides(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  port: 9090
+database:
+  path: /var/lib/par/proxmox.db
+auth:
+  username: ops
+  password: from-file
+scheduler:
+  check_interval: 15m
+  default_interval_hours: 12
+  queue:
+    max_concurrent: 4
+retention:
+  max_age: 2160h
+  status_max_age:
+    failed: 8760h
+`)
+	t.Setenv("AUTH_PASSWORD", "from-env")
+	t.Setenv("RESTART_MAX_PER_NODE", "3")
+	t.Setenv("TERMINAL_ALLOWED_ORIGINS", "https://dash.example.com, http://localhost:3000")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Server.Port != 9090 || cfg.Auth.Username != "ops" {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	if cfg.Auth.Password != "from-env" || cfg.Scheduler.Queue.MaxPerNode != 3 {
+		t.Errorf("env should override the file: %+v", cfg)
+	}
+	if time.Duration(cfg.Scheduler.CheckInterval) != 15*time.Minute || cfg.Scheduler.DefaultIntervalHours != 12 {
+		t.Errorf("unexpected scheduler %+v", cfg.Scheduler)
+	}
+	if cfg.Scheduler.Queue.MaxConcurrent != 4 || time.Duration(cfg.Scheduler.Queue.Stagger) != 30*time.Second {
+		t.Errorf("unset keys should keep their defaults: %+v", cfg.Scheduler.Queue)
+	}
+	if time.Duration(cfg.Retention.StatusMaxAge["failed"]) != 8760*time.Hour {
+		t.Errorf("unexpected retention %+v", cfg.Retention)
+	}
+	if cfg.Backup.Dir != "/var/lib/par/backups" {
+		t.Errorf("unexpected backup dir %q", cfg.Backup.Dir)
+	}
+	if o := cfg.Terminal.AllowedOrigins; len(o) != 2 || o[0] != "https://dash.example.com" || o[1] != "http://localhost:3000" {
+		t.Errorf("unexpected terminal origins %q", o)
+	}
+}
+
+func TestLoadRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{
+			name:    "unknown key",
+			content: "scheduler:\n  interval: 1h\n",
+			want:    []string{"field interval not found"},
+		},
+		{
+			name:    "bad duration",
+			content: "scheduler:\n  check_interval: soon\n",
+			want:    []string{`invalid duration "soon"`},
+		},
+		{
+			name:    "every problem reported",
+			content: "server:\n  port: 0\nbackend:\n  type: api\nbackup:\n  keep: -1\n",
+			want:    []string{"server.port", "backend.api_url", "backup.keep"},
+		},
+		{
+			name:    "incomplete oidc",
+			content: "oidc:\n  issuer: https://id.example.com\n  role_mapping:\n    ops: root\n",
+			want:    []string{"oidc.redirect_url", "oidc.client_id", "oidc.role_mapping.ops"},
+		},
+		{
+			name:    "incomplete ldap",
+			content: "ldap:\n  url: ldaps://dc.example.com\n  start_tls: true\n  user_filter: (uid=bob)\n",
+			want:    []string{"ldap.start_tls", "ldap.user_base_dn", "ldap.user_filter", "ldap.role_mapping"},
+		},
+		{
+			name:    "bad terminal settings",
+			content: "terminal:\n  ticket_ttl: 0s\n  idle_timeout: -1m\n  allowed_origins: [dash.example.com]\n",
+			want:    []string{"terminal.ticket_ttl", "terminal.idle_timeout", "terminal.allowed_origins"},
+		},
+		{
+			name: "bad env",
+			env:  map[string]string{"RESTART_MAX_CONCURRENT": "two", "SCHEDULER_ENABLED": "maybe"},
+			want: []string{"RESTART_MAX_CONCURRENT", "SCHEDULER_ENABLED"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.content != "" {
+				path = writeConfig(t, tt.content)
+			}
+			_, err := Load(path)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q should mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.Scheduler.CheckInterval = Duration(time.Minute)
+	if changed := current.RestartRequired(next); len(changed) != 0 {
+		t.Errorf("scheduler interval reloads live, got %v", changed)
+	}
+
+	next.Server.Port = 9090
+	next.Backend.Type = "api"
+	changed := current.RestartRequired(next)
+	if len(changed) != 2 || changed[0] != "server" || changed[1] != "backend" {
+		t.Errorf("unexpected sections %v", changed)
+	}
+
+	next = Default()
+	next.OIDC.RoleMapping = map[string]string{"ops": "operator"}
+	if changed := current.RestartRequired(next); len(changed) != 1 || changed[0] != "oidc" {
+		t.Errorf("expected oidc to need a restart, got %v", changed)
+	}
+}
+
+func TestParseStatusMaxAge(t *testing.T) {
+	ages, err := ParseStatusMaxAge("success=720h, skipped=168h,failed=0s")
+	if err != nil {
+		t.Fatalf("ParseStatusMaxAge: %v", err)
+	}
+	if ages["success"] != Duration(720*time.Hour) || ages["skipped"] != Duration(168*time.Hour) || len(ages) != 3 {
+		t.Errorf("unexpected ages %v", ages)
+	}
+
+	for _, bad := range []string{"success", "success=soon", "=1h", "failed=-1h"} {
+		if _, err := ParseStatusMaxAge(bad); err == nil {
+			t.Errorf("ParseStatusMaxAge(%q) should fail", bad)
+		}
+	}
+}
+
+func TestExampleConfigMatchesDefaults(t *testing.T) {
+	cfg, err := Load("../../config.example.yaml")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want, err := Load("")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Server != want.Server || cfg.Database != want.Database || cfg.Auth != want.Auth ||
+		cfg.Scheduler != want.Scheduler || cfg.Backend != want.Backend || cfg.Backup != want.Backup ||
+		!reflect.DeepEqual(cfg.OIDC, want.OIDC) || !reflect.DeepEqual(cfg.LDAP, want.LDAP) ||
+		time.Duration(cfg.Terminal.TicketTTL) != time.Duration(want.Terminal.TicketTTL) ||
+		time.Duration(cfg.Terminal.IdleTimeout) != time.Duration(want.Terminal.IdleTimeout) || len(cfg.Terminal.AllowedOrigins) != 0 {
+		t.Errorf("config.example.yaml drifted from the defaults:\n got %+v\nwant %+v", cfg, want)
+	}
+}
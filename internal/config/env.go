@@ -0,0 +1,132 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envReader copies set environment variables into config fields and
+// collects the ones that fail to parse
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) string(name string, dst *string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+func (e *envReader) int(name string, dst *int) {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s: %q", name, v))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) bool(name string, dst *bool) {
+	if v := os.Getenv(name); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s: %q", name, v))
+			return
+		}
+		*dst = b
+	}
+}
+
+func (e *envReader) duration(name string, dst *Duration) {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s: %q", name, v))
+			return
+		}
+		*dst = Duration(d)
+	}
+}
+
+// applyEnv overrides settings with the environment variables that are set
+func (c *Config) applyEnv() error {
+	var e envReader
+
+	e.int("PORT", &c.Server.Port)
+
+	e.string("DB_PATH", &c.Database.Path)
+	e.string("DATABASE_URL", &c.Database.URL)
+
+	e.string("AUTH_USERNAME", &c.Auth.Username)
+	e.string("AUTH_PASSWORD", &c.Auth.Password)
+
+	e.string("OIDC_ISSUER", &c.OIDC.Issuer)
+	e.string("OIDC_CLIENT_ID", &c.OIDC.ClientID)
+	e.string("OIDC_CLIENT_SECRET", &c.OIDC.ClientSecret)
+	e.string("OIDC_REDIRECT_URL", &c.OIDC.RedirectURL)
+
+	e.string("LDAP_URL", &c.LDAP.URL)
+	e.string("LDAP_BIND_DN", &c.LDAP.BindDN)
+	e.string("LDAP_BIND_PASSWORD", &c.LDAP.BindPassword)
+
+	s := &c.Scheduler
+	e.bool("SCHEDULER_ENABLED", &s.Enabled)
+	e.duration("SCHEDULER_CHECK_INTERVAL", &s.CheckInterval)
+	e.int("DEFAULT_RESTART_INTERVAL_HOURS", &s.DefaultIntervalHours)
+	e.duration("WATCHDOG_INTERVAL", &s.WatchdogInterval)
+	e.duration("RESTART_VERIFY_TIMEOUT", &s.Verify.Timeout)
+	e.bool("RESTART_VERIFY_PROBE", &s.Verify.Probe)
+	e.int("RESTART_MAX_CONCURRENT", &s.Queue.MaxConcurrent)
+	e.int("RESTART_MAX_PER_NODE", &s.Queue.MaxPerNode)
+	e.duration("RESTART_STAGGER", &s.Queue.Stagger)
+	e.duration("RESTART_JITTER", &s.Queue.Jitter)
+	e.int("CRASHLOOP_MAX_FAILURES", &s.CrashLoop.MaxFailures)
+	e.duration("CRASHLOOP_WINDOW", &s.CrashLoop.Window)
+	e.duration("CRASHLOOP_BACKOFF", &s.CrashLoop.Backoff)
+	e.duration("CRASHLOOP_MAX_BACKOFF", &s.CrashLoop.MaxBackoff)
+
+	e.string("PROXMOX_BACKEND", &c.Backend.Type)
+	e.string("PROXMOX_API_URL", &c.Backend.APIURL)
+	e.string("PROXMOX_API_TOKEN_ID", &c.Backend.TokenID)
+	e.string("PROXMOX_API_TOKEN_SECRET", &c.Backend.TokenSecret)
+	e.bool("PROXMOX_API_INSECURE", &c.Backend.Insecure)
+
+	e.string("ALERT_WEBHOOK_URL", &c.Notifications.WebhookURL)
+
+	e.duration("LOG_RETENTION_MAX_AGE", &c.Retention.MaxAge)
+	if v := os.Getenv("LOG_RETENTION_STATUS_MAX_AGE"); v != "" {
+		ages, err := ParseStatusMaxAge(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid LOG_RETENTION_STATUS_MAX_AGE: %w", err))
+		} else {
+			c.Retention.StatusMaxAge = ages
+		}
+	}
+	e.int("LOG_RETENTION_MAX_PER_VMID", &c.Retention.MaxPerVMID)
+	e.string("LOG_ARCHIVE_DIR", &c.Retention.ArchiveDir)
+	e.duration("LOG_PRUNE_INTERVAL", &c.Retention.PruneInterval)
+
+	e.string("BACKUP_DIR", &c.Backup.Dir)
+	e.int("BACKUP_KEEP", &c.Backup.Keep)
+	e.duration("BACKUP_INTERVAL", &c.Backup.Interval)
+
+	e.duration("TERMINAL_TICKET_TTL", &c.Terminal.TicketTTL)
+	e.duration("TERMINAL_IDLE_TIMEOUT", &c.Terminal.IdleTimeout)
+	e.string("TERMINAL_RECORDING_DIR", &c.Terminal.RecordingDir)
+	if v := os.Getenv("TERMINAL_ALLOWED_ORIGINS"); v != "" {
+		c.Terminal.AllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.Terminal.AllowedOrigins = append(c.Terminal.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	return errors.Join(e.errs...)
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrBackupUnsupported is returned when the database cannot snapshot itself;
+// PostgreSQL databases are backed up with pg_dump instead
+var ErrBackupUnsupported = errors.New("online backups are only supported for SQLite; use pg_dump for PostgreSQL")
+
+// Backup writes a consistent snapshot of the database to path, which must
+// not exist yet
+func (s *SQLStore) Backup(path string) error {
+	if s.db.Dialect != SQLite {
+		return ErrBackupUnsupported
+	}
+
+	// VACUUM INTO copies a transaction-consistent view while the service runs
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if _, err := s.db.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move backup into place: %w", err)
+	}
+	return nil
+}
+
+// ValidateBackup checks that path is an intact SQLite database created by
+// this service and returns its schema version
+func ValidateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, fmt.Errorf("backup not found: %w", err)
+	}
+
+	conn, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer conn.Close()
+
+	var integrity string
+	if err := conn.QueryRow(`PRAGMA integrity_check`).Scan(&integrity); err != nil {
+		return 0, fmt.Errorf("backup is not a readable SQLite database: %w", err)
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("backup failed the integrity check: %s", integrity)
+	}
+
+	var version sql.NullInt64
+	if err := conn.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("backup has no schema version: %w", err)
+	}
+	if !version.Valid || version.Int64 < 1 {
+		return 0, errors.New("backup has no applied migrations")
+	}
+	if int(version.Int64) > LatestVersion() {
+		return 0, fmt.Errorf("backup has schema version %d, newer than this release supports (%d)",
+			version.Int64, LatestVersion())
+	}
+	return int(version.Int64), nil
+}
+
+// RestoreBackup validates backupPath and swaps it in as the database at
+// dbPath. The current database is kept next to it and its path returned.
+// The service must not be running.
+func RestoreBackup(backupPath, dbPath string) (string, error) {
+	if _, err := ValidateBackup(backupPath); err != nil {
+		return "", err
+	}
+
+	// Stage the copy beside the database so the final rename is atomic
+	staged := dbPath + ".restore-tmp"
+	if err := copyFile(backupPath, staged); err != nil {
+		os.Remove(staged)
+		return "", fmt.Errorf("failed to stage backup: %w", err)
+	}
+
+	var previous string
+	if _, err := os.Stat(dbPath); err == nil {
+		previous = fmt.Sprintf("%s.pre-restore-%s", dbPath, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(dbPath, previous); err != nil {
+			os.Remove(staged)
+			return "", fmt.Errorf("failed to set aside current database: %w", err)
+		}
+	}
+
+	if err := os.Rename(staged, dbPath); err != nil {
+		if previous != "" {
+			os.Rename(previous, dbPath)
+		}
+		os.Remove(staged)
+		return "", fmt.Errorf("failed to swap in backup: %w", err)
+	}
+	return previous, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// migratedFileDB creates a migrated SQLite database file with one whitelist entry
+func migratedFileDB(t *testing.T, path string, vmid int) {
+	t.Helper()
+	conn, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer conn.Close()
+	if err := RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	err = NewStore(conn).CreateWhitelist(&models.CreateWhitelistRequest{VMID: vmid, ResourceName: "db", Node: "pve1", CreatedBy: "test"})
+	if err != nil {
+		t.Fatalf("CreateWhitelist: %v", err)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "proxmox.db")
+	migratedFileDB(t, dbPath, 101)
+
+	conn, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	backup := filepath.Join(dir, "backup.db")
+	if err := NewStore(conn).Backup(backup); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if version, err := ValidateBackup(backup); err != nil || version != LatestVersion() {
+		t.Fatalf("ValidateBackup = %d, %v", version, err)
+	}
+
+	// Change the live database, then roll it back
+	if err := NewStore(conn).DeleteWhitelistByVMID(101, "pve1"); err != nil {
+		t.Fatalf("DeleteWhitelistByVMID: %v", err)
+	}
+	conn.Close()
+
+	previous, err := RestoreBackup(backup, dbPath)
+	if err != nil {
+		t.Fatalf("RestoreBackup: %v", err)
+	}
+	if _, err := os.Stat(previous); err != nil {
+		t.Errorf("previous database not kept: %v", err)
+	}
+
+	conn, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer conn.Close()
+	if wl, err := NewStore(conn).GetWhitelistByVMID(101); err != nil || wl == nil {
+		t.Errorf("restored database lost the whitelist entry: %v", err)
+	}
+}
+
+func TestValidateBackupRejects(t *testing.T) {
+	dir := t.TempDir()
+
+	garbage := filepath.Join(dir, "garbage.db")
+	os.WriteFile(garbage, []byte(strings.Repeat("not a database ", 100)), 0o600)
+
+	unversioned := filepath.Join(dir, "unversioned.db")
+	conn, _ := Open(unversioned)
+	conn.Exec(`CREATE TABLE whitelist (id INTEGER PRIMARY KEY)`)
+	conn.Close()
+
+	newer := filepath.Join(dir, "newer.db")
+	migratedFileDB(t, newer, 101)
+	conn, _ = Open(newer)
+	conn.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', CURRENT_TIMESTAMP)`, LatestVersion()+1)
+	conn.Close()
+
+	for _, path := range []string{filepath.Join(dir, "missing.db"), garbage, unversioned, newer} {
+		if _, err := ValidateBackup(path); err == nil {
+			t.Errorf("ValidateBackup(%s) should fail", filepath.Base(path))
+		}
+	}
+
+	// A rejected backup leaves the live database alone
+	dbPath := filepath.Join(dir, "proxmox.db")
+	migratedFileDB(t, dbPath, 101)
+	if _, err := RestoreBackup(newer, dbPath); err == nil {
+		t.Fatal("RestoreBackup should refuse a newer schema")
+	}
+	if _, err := ValidateBackup(dbPath); err != nil {
+		t.Errorf("live database damaged by a refused restore: %v", err)
+	}
+}
@@ -1,52 +1,191 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"os"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "modernc.org/sqlite"
 )
 
-var DB *sql.DB
+// Dialect is the SQL flavour spoken by a database
+type Dialect string
 
-// InitDB initializes the SQLite database connection
-func InitDB(dbPath string) error {
-	var err error
-	DB, err = sql.Open("sqlite", dbPath)
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// Conn is an open database together with its dialect. Exec, Query and
+// QueryRow take ? placeholders whatever the dialect.
+type Conn struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+// DialectFor picks the dialect of a DSN: postgres:// and postgresql:// URLs
+// are PostgreSQL, anything else is a SQLite file path
+func DialectFor(dsn string) Dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return Postgres
+	}
+	return SQLite
+}
+
+// Open opens the database named by dsn
+func Open(dsn string) (*Conn, error) {
+	dialect := DialectFor(dsn)
+	if dialect == Postgres {
+		return openPostgres(dsn)
+	}
+
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	// Enable foreign keys
-	if _, err := DB.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		return fmt.Errorf("failed to enable foreign keys: %w", err)
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
 	}
 
 	// Set connection pool settings
-	DB.SetMaxOpenConns(1) // SQLite works best with single connection
-	DB.SetMaxIdleConns(1)
+	db.SetMaxOpenConns(1) // SQLite works best with single connection
+	db.SetMaxIdleConns(1)
+
+	return &Conn{DB: db, Dialect: SQLite}, nil
+}
+
+func openPostgres(dsn string) (*Conn, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+
+	return &Conn{DB: db, Dialect: Postgres}, nil
+}
+
+// Rebind rewrites ? placeholders into the dialect's style
+func (c *Conn) Rebind(query string) string {
+	if c.Dialect != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
 
-	return nil
+// Exec runs a statement with ? placeholders
+func (c *Conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.DB.Exec(c.Rebind(query), args...)
 }
 
-// CloseDB closes the database connection
-func CloseDB() error {
-	if DB != nil {
-		return DB.Close()
+// Query runs a query with ? placeholders
+func (c *Conn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.DB.Query(c.Rebind(query), args...)
+}
+
+// QueryRow runs a single-row query with ? placeholders
+func (c *Conn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.DB.QueryRow(c.Rebind(query), args...)
+}
+
+// PostgreSQL advisory locks taken by instances sharing a database
+const (
+	MigrationLockKey int64 = 0x70617200 + iota // held while migrating
+	SchedulerLockKey                           // held by the instance running the scheduler
+)
+
+// AdvisoryLock waits for the PostgreSQL advisory lock key and returns a
+// function releasing it. The lock belongs to a connection of its own, so
+// statements can run through c while it is held. A SQLite database is never
+// shared, so there it returns straight away.
+func (c *Conn) AdvisoryLock(key int64) (func(), error) {
+	if c.Dialect != Postgres {
+		return func() {}, nil
 	}
-	return nil
+
+	ctx := context.Background()
+	conn, err := c.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return unlocker(conn, key), nil
 }
 
-// GetDB returns the database handle
-func GetDB() *sql.DB {
-	return DB
+// TryAdvisoryLock is AdvisoryLock without waiting; ok is false when another
+// session holds the lock
+func (c *Conn) TryAdvisoryLock(key int64) (release func(), ok bool, err error) {
+	if c.Dialect != Postgres {
+		return func() {}, true, nil
+	}
+
+	ctx := context.Background()
+	conn, err := c.DB.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+	return unlocker(conn, key), true, nil
+}
+
+func unlocker(conn *sql.Conn, key int64) func() {
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			log.Printf("WARNING: Failed to release advisory lock %d: %v", key, err)
+		}
+		conn.Close()
+	}
 }
 
-// GetDBPath returns the database path from env or default
-func GetDBPath() string {
-	if path := os.Getenv("DB_PATH"); path != "" {
-		return path
+// IsUniqueViolation reports whether err was caused by a UNIQUE constraint
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// RedactDSN hides the password in a PostgreSQL URL so it can be logged
+func RedactDSN(dsn string) string {
+	if DialectFor(dsn) != Postgres {
+		return dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "postgres://(invalid URL)"
 	}
-	return "./proxmox.db"
+	return u.Redacted()
 }
@@ -4,146 +4,595 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 )
 
-// RunMigrations creates all necessary database tables and indexes
-// Only whitelist and restart_logs - no resources table (fetched real-time from Proxmox)
-func RunMigrations(db *sql.DB) error {
+// Migration is a numbered schema change. Up and Down may hold several
+// statements separated by semicolons; a migration runs in one transaction.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+
+	// marker is a table or table.column that only exists once this migration
+	// ran, used to adopt databases created before schema_migrations existed
+	marker string
+}
+
+// MigrationState is a migration and whether it has been applied
+type MigrationState struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// migrations lists every schema change in order. Never edit an applied
+// migration; add a new one instead.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		marker:  "whitelist",
+		Up: `
+			CREATE TABLE whitelist (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				vmid INTEGER NOT NULL,
+				resource_name TEXT NOT NULL,
+				node TEXT NOT NULL,
+				enabled BOOLEAN DEFAULT 1,
+				restart_interval_hours INTEGER DEFAULT 6,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				created_by TEXT NOT NULL,
+				notes TEXT,
+				UNIQUE(vmid, node)
+			);
+			CREATE INDEX idx_whitelist_vmid ON whitelist(vmid);
+			CREATE INDEX idx_whitelist_enabled ON whitelist(enabled);
+
+			CREATE TABLE restart_logs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				vmid INTEGER NOT NULL,
+				resource_name TEXT NOT NULL,
+				node TEXT NOT NULL,
+				action TEXT NOT NULL,
+				trigger_type TEXT NOT NULL,
+				triggered_by TEXT NOT NULL,
+				status TEXT NOT NULL,
+				error_message TEXT,
+				output TEXT,
+				started_at DATETIME NOT NULL,
+				completed_at DATETIME,
+				duration_seconds INTEGER
+			);
+			CREATE INDEX idx_restart_logs_vmid ON restart_logs(vmid);
+			CREATE INDEX idx_restart_logs_status ON restart_logs(status);
+			CREATE INDEX idx_restart_logs_started_at ON restart_logs(started_at DESC);
+
+			CREATE TABLE container_services (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				vmid INTEGER NOT NULL,
+				node TEXT NOT NULL,
+				service_name TEXT NOT NULL,
+				service_type TEXT NOT NULL,
+				install_commands TEXT,
+				installed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(vmid, node, service_name)
+			);
+			CREATE INDEX idx_container_services_vmid ON container_services(vmid, node)`,
+		Down: `
+			DROP TABLE container_services;
+			DROP TABLE restart_logs;
+			DROP TABLE whitelist`,
+	},
+	{
+		Version: 2,
+		Name:    "proxmox task tracking on restart_logs",
+		marker:  "restart_logs.upid",
+		Up: `
+			ALTER TABLE restart_logs ADD COLUMN upid TEXT;
+			ALTER TABLE restart_logs ADD COLUMN exit_status TEXT;
+			ALTER TABLE restart_logs ADD COLUMN task_log TEXT`,
+		Down: `
+			ALTER TABLE restart_logs DROP COLUMN task_log;
+			ALTER TABLE restart_logs DROP COLUMN exit_status;
+			ALTER TABLE restart_logs DROP COLUMN upid`,
+	},
+	{
+		Version: 3,
+		Name:    "post-restart verification on restart_logs",
+		marker:  "restart_logs.verification",
+		Up: `
+			ALTER TABLE restart_logs ADD COLUMN verification TEXT;
+			ALTER TABLE restart_logs ADD COLUMN verification_detail TEXT`,
+		Down: `
+			ALTER TABLE restart_logs DROP COLUMN verification_detail;
+			ALTER TABLE restart_logs DROP COLUMN verification`,
+	},
+	{
+		Version: 4,
+		Name:    "cron schedule and maintenance window on whitelist",
+		marker:  "whitelist.cron_expression",
+		Up: `
+			ALTER TABLE whitelist ADD COLUMN cron_expression TEXT NOT NULL DEFAULT '';
+			ALTER TABLE whitelist ADD COLUMN window_start TEXT NOT NULL DEFAULT '';
+			ALTER TABLE whitelist ADD COLUMN window_end TEXT NOT NULL DEFAULT '';
+			ALTER TABLE whitelist ADD COLUMN timezone TEXT NOT NULL DEFAULT ''`,
+		Down: `
+			ALTER TABLE whitelist DROP COLUMN timezone;
+			ALTER TABLE whitelist DROP COLUMN window_end;
+			ALTER TABLE whitelist DROP COLUMN window_start;
+			ALTER TABLE whitelist DROP COLUMN cron_expression`,
+	},
+	{
+		Version: 5,
+		Name:    "restart groups",
+		marker:  "restart_groups",
+		Up: `
+			CREATE TABLE restart_groups (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE,
+				description TEXT NOT NULL DEFAULT '',
+				wait_healthy BOOLEAN NOT NULL DEFAULT 1,
+				stop_on_failure BOOLEAN NOT NULL DEFAULT 1,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+			ALTER TABLE whitelist ADD COLUMN group_id INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE whitelist ADD COLUMN group_order INTEGER NOT NULL DEFAULT 0`,
+		Down: `
+			ALTER TABLE whitelist DROP COLUMN group_order;
+			ALTER TABLE whitelist DROP COLUMN group_id;
+			DROP TABLE restart_groups`,
+	},
+	{
+		Version: 6,
+		Name:    "watchdog health checks",
+		marker:  "health_checks",
+		Up: `
+			CREATE TABLE health_checks (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				whitelist_id INTEGER NOT NULL,
+				type TEXT NOT NULL,
+				target TEXT NOT NULL DEFAULT '',
+				threshold REAL NOT NULL DEFAULT 0,
+				interval_seconds INTEGER NOT NULL DEFAULT 60,
+				timeout_seconds INTEGER NOT NULL DEFAULT 10,
+				failure_threshold INTEGER NOT NULL DEFAULT 3,
+				cooldown_minutes INTEGER NOT NULL DEFAULT 30,
+				enabled BOOLEAN NOT NULL DEFAULT 1,
+				consecutive_failures INTEGER NOT NULL DEFAULT 0,
+				last_status TEXT NOT NULL DEFAULT '',
+				last_result TEXT NOT NULL DEFAULT '',
+				last_checked_at DATETIME,
+				last_triggered_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX idx_health_checks_whitelist ON health_checks(whitelist_id);
+			ALTER TABLE whitelist ADD COLUMN restart_mode TEXT NOT NULL DEFAULT 'schedule';
+			ALTER TABLE restart_logs ADD COLUMN probe_result TEXT`,
+		Down: `
+			ALTER TABLE restart_logs DROP COLUMN probe_result;
+			ALTER TABLE whitelist DROP COLUMN restart_mode;
+			DROP TABLE health_checks`,
+	},
+	{
+		Version: 7,
+		Name:    "crash-loop quarantine on whitelist",
+		marker:  "whitelist.quarantined",
+		Up: `
+			ALTER TABLE whitelist ADD COLUMN quarantined BOOLEAN NOT NULL DEFAULT 0;
+			ALTER TABLE whitelist ADD COLUMN quarantine_level INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE whitelist ADD COLUMN quarantined_until DATETIME;
+			ALTER TABLE whitelist ADD COLUMN quarantine_reason TEXT NOT NULL DEFAULT '';
+			ALTER TABLE whitelist ADD COLUMN failures_reset_at DATETIME`,
+		Down: `
+			ALTER TABLE whitelist DROP COLUMN failures_reset_at;
+			ALTER TABLE whitelist DROP COLUMN quarantine_reason;
+			ALTER TABLE whitelist DROP COLUMN quarantined_until;
+			ALTER TABLE whitelist DROP COLUMN quarantine_level;
+			ALTER TABLE whitelist DROP COLUMN quarantined`,
+	},
+	{
+		Version: 8,
+		Name:    "applied whitelist manifests",
+		marker:  "whitelist_manifests",
+		Up: `
+			CREATE TABLE whitelist_manifests (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				content TEXT NOT NULL,
+				checksum TEXT NOT NULL,
+				applied_by TEXT NOT NULL,
+				applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+		Down: `
+			DROP TABLE whitelist_manifests`,
+	},
+	{
+		Version: 9,
+		Name:    "user accounts",
+		marker:  "users",
+		Up: `
+			CREATE TABLE users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT NOT NULL UNIQUE,
+				password_hash TEXT NOT NULL,
+				enabled BOOLEAN NOT NULL DEFAULT 1,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+		Down: `
+			DROP TABLE users`,
+	},
+	{
+		Version: 10,
+		Name:    "user roles",
+		marker:  "users.role",
+		// Accounts created before roles had full access, so they become admins
+		Up: `
+			ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer';
+			UPDATE users SET role = 'admin'`,
+		Down: `
+			ALTER TABLE users DROP COLUMN role`,
+	},
+	{
+		Version: 11,
+		Name:    "user grants",
+		marker:  "user_grants",
+		Up: `
+			CREATE TABLE user_grants (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				scope TEXT NOT NULL,
+				value TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (user_id, scope, value)
+			)`,
+		Down: `
+			DROP TABLE user_grants`,
+	},
+	{
+		Version: 12,
+		Name:    "api tokens",
+		marker:  "api_tokens",
+		Up: `
+			CREATE TABLE api_tokens (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				prefix TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				role TEXT NOT NULL,
+				scopes TEXT NOT NULL DEFAULT '',
+				expires_at DATETIME,
+				last_used_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (user_id, name)
+			)`,
+		Down: `
+			DROP TABLE api_tokens`,
+	},
+	{
+		Version: 13,
+		Name:    "sign-in sessions",
+		marker:  "sessions",
+		// Accounts signed in through an identity provider have no password
+		Up: `
+			ALTER TABLE users ADD COLUMN provider TEXT NOT NULL DEFAULT 'local';
+			CREATE TABLE sessions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+		Down: `
+			DROP TABLE sessions;
+			ALTER TABLE users DROP COLUMN provider`,
+	},
+	{
+		Version: 14,
+		Name:    "terminal sessions",
+		marker:  "terminal_sessions",
+		// Kept after the user is deleted, so the username is copied
+		Up: `
+			CREATE TABLE terminal_sessions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				username TEXT NOT NULL,
+				vmid INTEGER NOT NULL,
+				node TEXT NOT NULL,
+				type TEXT NOT NULL,
+				recording TEXT NOT NULL,
+				started_at DATETIME NOT NULL,
+				ended_at DATETIME,
+				input_bytes BIGINT NOT NULL DEFAULT 0,
+				output_bytes BIGINT NOT NULL DEFAULT 0
+			);
+			CREATE INDEX idx_terminal_sessions_started_at ON terminal_sessions(started_at)`,
+		Down: `DROP TABLE terminal_sessions`,
+	},
+}
+
+// postgresTypes rewrites the SQLite DDL of migrations for PostgreSQL
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"DATETIME", "TIMESTAMPTZ",
+	"REAL", "DOUBLE PRECISION",
+	"BOOLEAN DEFAULT 1", "BOOLEAN DEFAULT TRUE",
+	"BOOLEAN NOT NULL DEFAULT 1", "BOOLEAN NOT NULL DEFAULT TRUE",
+	"BOOLEAN NOT NULL DEFAULT 0", "BOOLEAN NOT NULL DEFAULT FALSE",
+)
+
+// ddl adapts a migration script, written for SQLite, to the dialect
+func ddl(dialect Dialect, script string) string {
+	if dialect == Postgres {
+		return postgresTypes.Replace(script)
+	}
+	return script
+}
+
+// LatestVersion returns the newest schema version
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// RunMigrations brings the schema up to the latest version
+func RunMigrations(db *Conn) error {
 	log.Println("Running database migrations...")
 
-	// Create whitelist table
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS whitelist (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			vmid INTEGER NOT NULL,
-			resource_name TEXT NOT NULL,
-			node TEXT NOT NULL,
-			enabled BOOLEAN DEFAULT 1,
-			restart_interval_hours INTEGER DEFAULT 6,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			created_by TEXT NOT NULL,
-			notes TEXT,
-			UNIQUE(vmid, node)
-		)
-	`)
+	applied, err := MigrateUp(db, 0)
 	if err != nil {
 		return err
 	}
 
-	// Create index for whitelist
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_whitelist_vmid ON whitelist(vmid)`)
+	log.Printf("Database migrations completed successfully (%d applied, schema version %d)", len(applied), LatestVersion())
+	return nil
+}
+
+// MigrateUp applies pending migrations up to and including target; 0 means
+// all of them. It returns the migrations that were applied. Instances sharing
+// a PostgreSQL database take turns, so each migration is applied once.
+func MigrateUp(db *Conn, target int) ([]Migration, error) {
+	unlock, err := db.AdvisoryLock(MigrationLockKey)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to lock migrations: %w", err)
 	}
+	defer unlock()
 
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_whitelist_enabled ON whitelist(enabled)`)
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	current, err := currentVersion(db)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if target == 0 {
+		target = LatestVersion()
 	}
 
-	// Create restart_logs table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS restart_logs (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			vmid INTEGER NOT NULL,
-			resource_name TEXT NOT NULL,
-			node TEXT NOT NULL,
-			action TEXT NOT NULL,
-			trigger_type TEXT NOT NULL,
-			triggered_by TEXT NOT NULL,
-			status TEXT NOT NULL,
-			error_message TEXT,
-			output TEXT,
-			started_at DATETIME NOT NULL,
-			completed_at DATETIME,
-			duration_seconds INTEGER
-		)
-	`)
+	var applied []Migration
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+		if err := applyMigration(db, m, true); err != nil {
+			return applied, err
+		}
+		log.Printf("Applied migration %d: %s", m.Version, m.Name)
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the newest applied migrations, steps at a time. It
+// returns the migrations that were reverted.
+func MigrateDown(db *Conn, steps int) ([]Migration, error) {
+	unlock, err := db.AdvisoryLock(MigrationLockKey)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer unlock()
+
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
 	}
 
-	// Create indexes for restart_logs
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_restart_logs_vmid ON restart_logs(vmid)`)
+	current, err := currentVersion(db)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		m := migrations[i]
+		if m.Version > current {
+			continue
+		}
+		if err := applyMigration(db, m, false); err != nil {
+			return reverted, err
+		}
+		log.Printf("Reverted migration %d: %s", m.Version, m.Name)
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// MigrationStatus lists every migration and whether it has been applied
+func MigrationStatus(db *Conn) ([]MigrationState, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
 	}
 
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_restart_logs_status ON restart_logs(status)`)
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_restart_logs_started_at ON restart_logs(started_at DESC)`)
+	appliedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, m := range migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if at, ok := appliedAt[m.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = &at
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// applyMigration runs a migration's up or down script and records the
+// change in schema_migrations within one transaction
+func applyMigration(db *Conn, m Migration, up bool) error {
+	script, record := m.Up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`
+	args := []interface{}{m.Version, m.Name, time.Now()}
+	if !up {
+		script, record = m.Down, `DELETE FROM schema_migrations WHERE version = ?`
+		args = []interface{}{m.Version}
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to start migration %d: %w", m.Version, err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitStatements(ddl(db.Dialect, script)) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+	if _, err := tx.Exec(db.Rebind(record), args...); err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
 	}
 
-	// Create container_services table for tracking installed services
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS container_services (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			vmid INTEGER NOT NULL,
-			node TEXT NOT NULL,
-			service_name TEXT NOT NULL,
-			service_type TEXT NOT NULL,
-			install_commands TEXT,
-			installed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(vmid, node, service_name)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", m.Version, err)
+	}
+	return nil
+}
+
+// splitStatements splits a script on semicolons; migrations must not use
+// semicolons inside string literals
+func splitStatements(script string) []string {
+	var stmts []string
+	for _, stmt := range strings.Split(script, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
+
+// ensureMigrationsTable creates schema_migrations and, for databases created
+// before versioned migrations, records the migrations they already have
+func ensureMigrationsTable(db *Conn) error {
+	if tableExists(db, "schema_migrations") {
+		return nil
+	}
+
+	_, err := db.Exec(ddl(db.Dialect, `
+		CREATE TABLE schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME NOT NULL
 		)
-	`)
+	`))
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
 	}
 
-	// Create index for container_services
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_container_services_vmid ON container_services(vmid, node)`)
-	if err != nil {
-		return err
+	// Only SQLite databases predate versioned migrations
+	if db.Dialect == SQLite && tableExists(db, "whitelist") {
+		return adoptLegacySchema(db)
 	}
+	return nil
+}
 
-	// Schema Updates: Add missing columns if they don't exist (for existing databases)
+// adoptLegacySchema marks migrations as applied when their changes are
+// already present. Old releases added columns ad hoc at startup; the two
+// oldest of those are repaired here so the database matches migration 1.
+func adoptLegacySchema(db *Conn) error {
+	log.Println("Adopting existing database into versioned migrations...")
 
-	// 1. Add restart_interval_hours to whitelist
-	_, err = db.Exec(`ALTER TABLE whitelist ADD COLUMN restart_interval_hours INTEGER DEFAULT 6`)
-	if err != nil {
-		// Ignore error if column already exists (SQLite doesn't support IF NOT EXISTS for ADD COLUMN directly in all versions/drivers easily without checking,
-		// but typically returns an error we can ignore if it says "duplicate column name")
-		// For simplicity in this driver, we'll assume it might fail if exists.
-		// A better way is to check pragma_table_info, but for this quick fix, we can just log/ignore or wrap in a separate check.
-		// Let's try a safer approach by checking if column exists first?
-		// Or just let it fail silently? SQLite error for duplicate column is usually safe to ignore in this context if we just want to ensure it's there.
-		// However, Go's sql package returns an error.
-		// Let's use a helper or just try-catch style.
-		// Since we can't easily check error string cross-platform/driver without overhead, let's just run it and ignore specific error?
-		// No, let's do it properly.
-	}
-
-	// Better approach: Check if column exists
 	if !columnExists(db, "whitelist", "restart_interval_hours") {
-		_, err = db.Exec(`ALTER TABLE whitelist ADD COLUMN restart_interval_hours INTEGER DEFAULT 6`)
-		if err != nil {
-			log.Printf("WARNING: Failed to add restart_interval_hours column: %v", err)
-		} else {
-			log.Println("Added restart_interval_hours column to whitelist table")
+		if _, err := db.Exec(`ALTER TABLE whitelist ADD COLUMN restart_interval_hours INTEGER DEFAULT 6`); err != nil {
+			return fmt.Errorf("failed to add restart_interval_hours column: %w", err)
 		}
 	}
-
-	// 2. Add output to restart_logs
 	if !columnExists(db, "restart_logs", "output") {
-		_, err = db.Exec(`ALTER TABLE restart_logs ADD COLUMN output TEXT`)
-		if err != nil {
-			log.Printf("WARNING: Failed to add output column: %v", err)
-		} else {
-			log.Println("Added output column to restart_logs table")
+		if _, err := db.Exec(`ALTER TABLE restart_logs ADD COLUMN output TEXT`); err != nil {
+			return fmt.Errorf("failed to add output column: %w", err)
 		}
 	}
 
-	log.Println("Database migrations completed successfully")
+	for _, m := range migrations {
+		table, column, _ := strings.Cut(m.marker, ".")
+		present := tableExists(db, table)
+		if column != "" {
+			present = present && columnExists(db, table, column)
+		}
+		if !present {
+			// Later migrations are applied normally from here
+			break
+		}
+
+		_, err := db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Name, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+		}
+		log.Printf("Existing schema already has migration %d: %s", m.Version, m.Name)
+	}
 	return nil
 }
 
-func columnExists(db *sql.DB, tableName, columnName string) bool {
+// currentVersion returns the highest applied migration, 0 for an empty database
+func currentVersion(db *Conn) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+func tableExists(db *Conn, tableName string) bool {
+	query := `SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if db.Dialect == Postgres {
+		query = `SELECT table_name FROM information_schema.tables
+		         WHERE table_schema = current_schema() AND table_name = ?`
+	}
+
+	var name string
+	err := db.QueryRow(query, tableName).Scan(&name)
+	return err == nil
+}
+
+func columnExists(db *Conn, tableName, columnName string) bool {
+	if db.Dialect == Postgres {
+		var name string
+		err := db.QueryRow(`SELECT column_name FROM information_schema.columns
+		                    WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?`,
+			tableName, columnName).Scan(&name)
+		return err == nil
+	}
+
 	query := fmt.Sprintf("PRAGMA table_info(%s)", tableName)
 	rows, err := db.Query(query)
 	if err != nil {
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"testing"
+)
+
+func openTestDB(t *testing.T) *Conn {
+	t.Helper()
+	conn, err := Open(":memory:")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func appliedVersions(t *testing.T, conn *Conn) []int {
+	t.Helper()
+	states, err := MigrationStatus(conn)
+	if err != nil {
+		t.Fatalf("MigrationStatus: %v", err)
+	}
+	var versions []int
+	for _, s := range states {
+		if s.Applied {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	conn := openTestDB(t)
+
+	if err := RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	if got := appliedVersions(t, conn); len(got) != LatestVersion() {
+		t.Fatalf("expected all %d migrations applied, got %v", LatestVersion(), got)
+	}
+
+	// Running again is a no-op
+	applied, err := MigrateUp(conn, 0)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("second MigrateUp applied %d migrations, err %v", len(applied), err)
+	}
+
+	reverted, err := MigrateDown(conn, 6)
+	if err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	if len(reverted) != 6 || reverted[0].Version != LatestVersion() {
+		t.Fatalf("unexpected reverted migrations %+v", reverted)
+	}
+	if tableExists(conn, "users") || columnExists(conn, "users", "role") || tableExists(conn, "user_grants") ||
+		tableExists(conn, "api_tokens") || tableExists(conn, "sessions") || tableExists(conn, "terminal_sessions") {
+		t.Error("down migrations did not remove their schema changes")
+	}
+
+	if _, err := MigrateDown(conn, LatestVersion()); err != nil {
+		t.Fatalf("MigrateDown to empty: %v", err)
+	}
+	if tableExists(conn, "whitelist") || len(appliedVersions(t, conn)) != 0 {
+		t.Error("expected an empty schema after reverting everything")
+	}
+
+	if _, err := MigrateUp(conn, 3); err != nil {
+		t.Fatalf("MigrateUp to 3: %v", err)
+	}
+	if got := appliedVersions(t, conn); len(got) != 3 || got[2] != 3 {
+		t.Errorf("expected migrations 1-3, got %v", got)
+	}
+}
+
+func TestExistingUsersBecomeAdmins(t *testing.T) {
+	conn := openTestDB(t)
+
+	if _, err := MigrateUp(conn, 9); err != nil {
+		t.Fatalf("MigrateUp to 9: %v", err)
+	}
+	if _, err := conn.Exec(`INSERT INTO users (username, password_hash) VALUES ('admin', 'hash')`); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	if err := RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+
+	user, err := NewStore(conn).GetUserByUsername("admin")
+	if err != nil || user == nil || user.Role != "admin" {
+		t.Errorf("expected the existing account to become an admin, got %+v, %v", user, err)
+	}
+}
+
+func TestMigrationRollsBackOnFailure(t *testing.T) {
+	conn := openTestDB(t)
+
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	migrations = append(append([]Migration{}, saved...), Migration{
+		Version: LatestVersion() + 1,
+		Name:    "broken",
+		Up:      `CREATE TABLE broken (id INTEGER); ALTER TABLE no_such_table ADD COLUMN x TEXT`,
+	})
+
+	if err := RunMigrations(conn); err == nil {
+		t.Fatal("expected the broken migration to fail")
+	}
+	if tableExists(conn, "broken") {
+		t.Error("failed migration was not rolled back")
+	}
+	if got := appliedVersions(t, conn); len(got) != len(saved) {
+		t.Errorf("expected %d migrations applied, got %v", len(saved), got)
+	}
+}
+
+func TestAdoptLegacySchema(t *testing.T) {
+	conn := openTestDB(t)
+
+	// A database from a release that predates versioned migrations and
+	// lacks the columns old releases added at startup
+	_, err := conn.Exec(`
+		CREATE TABLE whitelist (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			vmid INTEGER NOT NULL,
+			resource_name TEXT NOT NULL,
+			node TEXT NOT NULL,
+			enabled BOOLEAN DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			created_by TEXT NOT NULL,
+			notes TEXT,
+			UNIQUE(vmid, node)
+		);
+		CREATE TABLE restart_logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			vmid INTEGER NOT NULL,
+			resource_name TEXT NOT NULL,
+			node TEXT NOT NULL,
+			action TEXT NOT NULL,
+			trigger_type TEXT NOT NULL,
+			triggered_by TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error_message TEXT,
+			started_at DATETIME NOT NULL,
+			completed_at DATETIME,
+			duration_seconds INTEGER,
+			upid TEXT,
+			exit_status TEXT,
+			task_log TEXT
+		);
+		CREATE TABLE container_services (id INTEGER PRIMARY KEY AUTOINCREMENT);
+		INSERT INTO whitelist (vmid, resource_name, node, created_by, notes) VALUES (101, 'db', 'pve1', 'admin', '');
+	`)
+	if err != nil {
+		t.Fatalf("create legacy schema: %v", err)
+	}
+
+	if err := RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+
+	states, err := MigrationStatus(conn)
+	if err != nil {
+		t.Fatalf("MigrationStatus: %v", err)
+	}
+	for _, s := range states {
+		if !s.Applied {
+			t.Errorf("migration %d not applied", s.Version)
+		}
+	}
+
+	wl, err := NewStore(conn).GetWhitelistByVMID(101)
+	if err != nil || wl == nil {
+		t.Fatalf("existing whitelist entry lost: %v", err)
+	}
+	if wl.RestartIntervalHours != 6 || wl.RestartMode != "schedule" {
+		t.Errorf("legacy entry did not get column defaults: %+v", wl)
+	}
+}
@@ -3,21 +3,102 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rakib/proxmox-auto-restart/internal/models"
 )
 
+// SQLStore implements Store on a SQLite or PostgreSQL database. Queries are
+// written with ? placeholders and TRUE/FALSE literals, which both accept.
+type SQLStore struct {
+	db *Conn
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// defaultIntervalHours is the restart interval of whitelist entries that do
+// not set their own
+var defaultIntervalHours atomic.Int32
+
+func init() {
+	defaultIntervalHours.Store(6)
+}
+
+// SetDefaultRestartInterval changes the restart interval, in hours, used by
+// whitelist entries that do not set their own
+func SetDefaultRestartInterval(hours int) {
+	defaultIntervalHours.Store(int32(hours))
+}
+
+// DefaultRestartInterval returns the restart interval, in hours, used by
+// whitelist entries that do not set their own
+func DefaultRestartInterval() int {
+	return int(defaultIntervalHours.Load())
+}
+
+// NewStore returns a store backed by an open, migrated database
+func NewStore(db *Conn) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close closes the underlying database
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// insert runs an INSERT and returns the new row's id
+func (s *SQLStore) insert(query string, args ...interface{}) (int64, error) {
+	if s.db.Dialect == Postgres {
+		// PostgreSQL drivers do not support LastInsertId
+		var id int64
+		err := s.db.QueryRow(query+` RETURNING id`, args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
 // No resource queries - fetch real-time from Proxmox
 
 // Whitelist functions
 
+// whitelistColumns is the column list matching scanWhitelist
+const whitelistColumns = `id, vmid, resource_name, node, enabled, restart_interval_hours,
+	cron_expression, window_start, window_end, timezone, group_id, group_order, restart_mode,
+	quarantined, quarantine_level, quarantined_until, quarantine_reason, failures_reset_at, created_at, created_by, notes`
+
+// scanWhitelist scans a row selected with whitelistColumns
+func scanWhitelist(row interface{ Scan(...interface{}) error }) (models.Whitelist, error) {
+	var wl models.Whitelist
+	var quarantinedUntil, failuresResetAt sql.NullTime
+	err := row.Scan(&wl.ID, &wl.VMID, &wl.ResourceName, &wl.Node, &wl.Enabled, &wl.RestartIntervalHours,
+		&wl.CronExpression, &wl.WindowStart, &wl.WindowEnd, &wl.Timezone, &wl.GroupID, &wl.GroupOrder, &wl.RestartMode,
+		&wl.Quarantined, &wl.QuarantineLevel, &quarantinedUntil, &wl.QuarantineReason, &failuresResetAt,
+		&wl.CreatedAt, &wl.CreatedBy, &wl.Notes)
+	if quarantinedUntil.Valid {
+		t := quarantinedUntil.Time
+		wl.QuarantinedUntil = &t
+	}
+	if failuresResetAt.Valid {
+		t := failuresResetAt.Time
+		wl.FailuresResetAt = &t
+	}
+	return wl, err
+}
+
 // GetAllWhitelist retrieves all whitelist entries
-func GetAllWhitelist() ([]models.Whitelist, error) {
-	query := `SELECT id, vmid, resource_name, node, enabled, created_at, created_by, notes 
-	          FROM whitelist ORDER BY vmid ASC`
+func (s *SQLStore) GetAllWhitelist() ([]models.Whitelist, error) {
+	query := `SELECT ` + whitelistColumns + ` FROM whitelist ORDER BY vmid ASC`
 
-	rows, err := DB.Query(query)
+	rows, err := s.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -25,9 +106,7 @@ func GetAllWhitelist() ([]models.Whitelist, error) {
 
 	var whitelist []models.Whitelist
 	for rows.Next() {
-		var wl models.Whitelist
-		err := rows.Scan(&wl.ID, &wl.VMID, &wl.ResourceName, &wl.Node,
-			&wl.Enabled, &wl.CreatedAt, &wl.CreatedBy, &wl.Notes)
+		wl, err := scanWhitelist(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -38,14 +117,25 @@ func GetAllWhitelist() ([]models.Whitelist, error) {
 }
 
 // GetWhitelistByID retrieves a whitelist entry by ID
-func GetWhitelistByID(id int64) (*models.Whitelist, error) {
-	query := `SELECT id, vmid, resource_name, node, enabled, created_at, created_by, notes
-	          FROM whitelist WHERE id = ?`
+func (s *SQLStore) GetWhitelistByID(id int64) (*models.Whitelist, error) {
+	query := `SELECT ` + whitelistColumns + ` FROM whitelist WHERE id = ?`
 
-	var wl models.Whitelist
-	err := DB.QueryRow(query, id).Scan(&wl.ID, &wl.VMID, &wl.ResourceName, &wl.Node,
-		&wl.Enabled, &wl.CreatedAt, &wl.CreatedBy, &wl.Notes)
+	wl, err := scanWhitelist(s.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &wl, nil
+}
 
+// GetWhitelistByVMID retrieves the whitelist entry for a VMID
+func (s *SQLStore) GetWhitelistByVMID(vmid int) (*models.Whitelist, error) {
+	query := `SELECT ` + whitelistColumns + ` FROM whitelist WHERE vmid = ? ORDER BY id ASC LIMIT 1`
+
+	wl, err := scanWhitelist(s.db.QueryRow(query, vmid))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -56,27 +146,52 @@ func GetWhitelistByID(id int64) (*models.Whitelist, error) {
 	return &wl, nil
 }
 
+// SetQuarantine marks a whitelist entry as crash looping until the given time
+func (s *SQLStore) SetQuarantine(id int64, level int, until time.Time, reason string) error {
+	query := `UPDATE whitelist SET quarantined = TRUE, quarantine_level = ?, quarantined_until = ?, quarantine_reason = ?
+	          WHERE id = ?`
+	_, err := s.db.Exec(query, level, until, reason, id)
+	return err
+}
+
+// ClearQuarantine lifts a quarantine and forgets earlier failures
+func (s *SQLStore) ClearQuarantine(id int64) error {
+	query := `UPDATE whitelist SET quarantined = FALSE, quarantine_level = 0, quarantined_until = NULL,
+	          quarantine_reason = '', failures_reset_at = ? WHERE id = ?`
+	_, err := s.db.Exec(query, time.Now(), id)
+	return err
+}
+
 // AddToWhitelist adds a VM/Container to the whitelist
-func AddToWhitelist(vmid int, resourceName, node, createdBy, notes string) error {
+func (s *SQLStore) AddToWhitelist(vmid int, resourceName, node, createdBy, notes string) error {
 	query := `INSERT INTO whitelist (vmid, resource_name, node, enabled, created_by, notes)
-	          VALUES (?, ?, ?, 1, ?, ?)`
+	          VALUES (?, ?, ?, TRUE, ?, ?)`
 
-	_, err := DB.Exec(query, vmid, resourceName, node, createdBy, notes)
+	_, err := s.db.Exec(query, vmid, resourceName, node, createdBy, notes)
 	return err
 }
 
 // DeleteFromWhitelist removes an entry from the whitelist
-func DeleteFromWhitelist(id int64) error {
-	query := `DELETE FROM whitelist WHERE id = ?`
-	_, err := DB.Exec(query, id)
-	return err
+func (s *SQLStore) DeleteFromWhitelist(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM health_checks WHERE whitelist_id = ?`), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM whitelist WHERE id = ?`), id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // GetEnabledWhitelist retrieves all enabled whitelist entries
-func GetEnabledWhitelist() ([]models.Whitelist, error) {
-	query := `SELECT id, vmid, resource_name, node, enabled, restart_interval_hours, created_at, created_by, notes 
-	          FROM whitelist WHERE enabled = 1`
-	rows, err := DB.Query(query)
+func (s *SQLStore) GetEnabledWhitelist() ([]models.Whitelist, error) {
+	query := `SELECT ` + whitelistColumns + ` FROM whitelist WHERE enabled = TRUE`
+	rows, err := s.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -84,9 +199,7 @@ func GetEnabledWhitelist() ([]models.Whitelist, error) {
 
 	var whitelist []models.Whitelist
 	for rows.Next() {
-		var w models.Whitelist
-		err := rows.Scan(&w.ID, &w.VMID, &w.ResourceName, &w.Node, &w.Enabled, &w.RestartIntervalHours,
-			&w.CreatedAt, &w.CreatedBy, &w.Notes)
+		w, err := scanWhitelist(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -96,67 +209,466 @@ func GetEnabledWhitelist() ([]models.Whitelist, error) {
 }
 
 // CreateWhitelist adds a new entry to the whitelist
-func CreateWhitelist(req *models.CreateWhitelistRequest) error {
-	query := `INSERT INTO whitelist (vmid, resource_name, node, created_by, notes, restart_interval_hours) 
-	          VALUES (?, ?, ?, ?, ?, ?)`
+func (s *SQLStore) CreateWhitelist(req *models.CreateWhitelistRequest) error {
+	query := `INSERT INTO whitelist (vmid, resource_name, node, created_by, notes, restart_interval_hours,
+	          cron_expression, window_start, window_end, timezone, group_id, group_order, restart_mode) 
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	// Default to 6 hours if not specified
 	interval := req.RestartIntervalHours
 	if interval < 1 {
-		interval = 6
+		interval = DefaultRestartInterval()
 	}
 
-	_, err := DB.Exec(query, req.VMID, req.ResourceName, req.Node, req.CreatedBy, req.Notes, interval)
+	_, err := s.db.Exec(query, req.VMID, req.ResourceName, req.Node, req.CreatedBy, req.Notes, interval,
+		req.CronExpression, req.WindowStart, req.WindowEnd, req.Timezone, req.GroupID, req.GroupOrder,
+		restartModeOrDefault(req.RestartMode))
 	return err
 }
 
-// UpdateWhitelist updates an existing whitelist entry
-func UpdateWhitelist(vmid int, req *models.UpdateWhitelistRequest) error {
-	query := `UPDATE whitelist SET enabled = ?, notes = ?, restart_interval_hours = ? WHERE vmid = ?`
-
-	// Default to 6 hours if not specified
+// UpdateWhitelist updates the whitelist entry with the given ID, which is the
+// id of PUT /api/whitelist/{id}, not the guest's VMID. Schedule, group and mode
+// fields left nil in the request keep their stored values.
+func (s *SQLStore) UpdateWhitelist(id int64, req *models.UpdateWhitelistRequest) error {
 	interval := req.RestartIntervalHours
 	if interval < 1 {
-		interval = 6
+		interval = DefaultRestartInterval()
+	}
+
+	sets := []string{"enabled = ?", "notes = ?", "restart_interval_hours = ?"}
+	args := []interface{}{req.Enabled, req.Notes, interval}
+	set := func(column string, value interface{}) {
+		sets = append(sets, column+" = ?")
+		args = append(args, value)
+	}
+	if req.CronExpression != nil {
+		set("cron_expression", *req.CronExpression)
+	}
+	if req.WindowStart != nil {
+		set("window_start", *req.WindowStart)
+	}
+	if req.WindowEnd != nil {
+		set("window_end", *req.WindowEnd)
+	}
+	if req.Timezone != nil {
+		set("timezone", *req.Timezone)
+	}
+	if req.GroupID != nil {
+		set("group_id", *req.GroupID)
+	}
+	if req.GroupOrder != nil {
+		set("group_order", *req.GroupOrder)
+	}
+	if req.RestartMode != nil {
+		set("restart_mode", restartModeOrDefault(*req.RestartMode))
+	}
+
+	query := `UPDATE whitelist SET ` + strings.Join(sets, ", ") + ` WHERE id = ?`
+	_, err := s.db.Exec(query, append(args, id)...)
+	return err
+}
+
+// DeleteWhitelistByVMID removes the whitelist entry of a guest on a node and
+// its health checks
+func (s *SQLStore) DeleteWhitelistByVMID(vmid int, node string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM health_checks WHERE whitelist_id IN (SELECT id FROM whitelist WHERE vmid = ? AND node = ?)`), vmid, node); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM whitelist WHERE vmid = ? AND node = ?`), vmid, node); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SyncWhitelist deletes, updates and creates whitelist entries and records
+// the manifest they came from, all in one transaction
+func (s *SQLStore) SyncWhitelist(sync *models.WhitelistSync) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range sync.Delete {
+		if _, err := tx.Exec(s.db.Rebind(`DELETE FROM health_checks WHERE whitelist_id = ?`), id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.db.Rebind(`DELETE FROM whitelist WHERE id = ?`), id); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range sync.Update {
+		interval := u.RestartIntervalHours
+		if interval < 1 {
+			interval = DefaultRestartInterval()
+		}
+		_, err := tx.Exec(s.db.Rebind(`UPDATE whitelist SET resource_name = ?, node = ?, enabled = ?, notes = ?,
+		          restart_interval_hours = ?, cron_expression = ?, window_start = ?, window_end = ?, timezone = ?,
+		          group_id = ?, group_order = ?, restart_mode = ? WHERE id = ?`),
+			u.ResourceName, u.Node, u.Enabled, u.Notes, interval, u.CronExpression, u.WindowStart, u.WindowEnd,
+			u.Timezone, u.GroupID, u.GroupOrder, restartModeOrDefault(u.RestartMode), u.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range sync.Create {
+		interval := c.RestartIntervalHours
+		if interval < 1 {
+			interval = DefaultRestartInterval()
+		}
+		_, err := tx.Exec(s.db.Rebind(`INSERT INTO whitelist (vmid, resource_name, node, enabled, created_by, notes,
+		          restart_interval_hours, cron_expression, window_start, window_end, timezone, group_id, group_order,
+		          restart_mode) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			c.VMID, c.ResourceName, c.Node, c.Enabled, c.CreatedBy, c.Notes, interval, c.CronExpression, c.WindowStart,
+			c.WindowEnd, c.Timezone, c.GroupID, c.GroupOrder, restartModeOrDefault(c.RestartMode))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(s.db.Rebind(`INSERT INTO whitelist_manifests (content, checksum, applied_by) VALUES (?, ?, ?)`),
+		sync.Manifest, sync.Checksum, sync.AppliedBy); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetLastAppliedManifest returns the most recently applied whitelist manifest
+func (s *SQLStore) GetLastAppliedManifest() (*models.AppliedManifest, error) {
+	var m models.AppliedManifest
+	err := s.db.QueryRow(`SELECT id, content, checksum, applied_by, applied_at
+	                      FROM whitelist_manifests ORDER BY id DESC LIMIT 1`).
+		Scan(&m.ID, &m.Content, &m.Checksum, &m.AppliedBy, &m.AppliedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// restartModeOrDefault treats an empty restart mode as time-based scheduling
+func restartModeOrDefault(mode string) string {
+	if mode == "" {
+		return "schedule"
+	}
+	return mode
+}
+
+// Restart group functions
+
+// GetAllRestartGroups retrieves all restart groups with their members
+func (s *SQLStore) GetAllRestartGroups() ([]models.RestartGroup, error) {
+	query := `SELECT id, name, description, wait_healthy, stop_on_failure, created_at
+	          FROM restart_groups ORDER BY name ASC`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []models.RestartGroup
+	for rows.Next() {
+		var g models.RestartGroup
+		err := rows.Scan(&g.ID, &g.Name, &g.Description, &g.WaitHealthy, &g.StopOnFailure, &g.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		members, err := s.GetWhitelistByGroup(groups[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		groups[i].Members = members
+	}
+
+	return groups, nil
+}
+
+// GetRestartGroupByID retrieves a restart group and its members
+func (s *SQLStore) GetRestartGroupByID(id int64) (*models.RestartGroup, error) {
+	query := `SELECT id, name, description, wait_healthy, stop_on_failure, created_at
+	          FROM restart_groups WHERE id = ?`
+
+	var g models.RestartGroup
+	err := s.db.QueryRow(query, id).Scan(&g.ID, &g.Name, &g.Description, &g.WaitHealthy, &g.StopOnFailure, &g.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	g.Members, err = s.GetWhitelistByGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// GetWhitelistByGroup retrieves a group's members in restart order
+func (s *SQLStore) GetWhitelistByGroup(groupID int64) ([]models.Whitelist, error) {
+	query := `SELECT ` + whitelistColumns + ` FROM whitelist WHERE group_id = ? ORDER BY group_order ASC, vmid ASC`
+
+	rows, err := s.db.Query(query, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []models.Whitelist
+	for rows.Next() {
+		wl, err := scanWhitelist(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, wl)
+	}
+	return members, nil
+}
+
+// CreateRestartGroup adds a restart group and returns its ID
+func (s *SQLStore) CreateRestartGroup(name, description string, waitHealthy, stopOnFailure bool) (int64, error) {
+	query := `INSERT INTO restart_groups (name, description, wait_healthy, stop_on_failure) VALUES (?, ?, ?, ?)`
+	return s.insert(query, name, description, waitHealthy, stopOnFailure)
+}
+
+// UpdateRestartGroup updates a restart group's settings
+func (s *SQLStore) UpdateRestartGroup(id int64, name, description string, waitHealthy, stopOnFailure bool) error {
+	query := `UPDATE restart_groups SET name = ?, description = ?, wait_healthy = ?, stop_on_failure = ? WHERE id = ?`
+	_, err := s.db.Exec(query, name, description, waitHealthy, stopOnFailure, id)
+	return err
+}
+
+// DeleteRestartGroup removes a group; its members become ungrouped
+func (s *SQLStore) DeleteRestartGroup(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.db.Rebind(`UPDATE whitelist SET group_id = 0, group_order = 0 WHERE group_id = ?`), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM restart_groups WHERE id = ?`), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Health check functions
+
+// healthCheckColumns is the column list matching scanHealthCheck; it joins
+// the whitelist entry the check belongs to
+const healthCheckColumns = `hc.id, hc.whitelist_id, w.vmid, w.resource_name, w.node, hc.type, hc.target, hc.threshold,
+	hc.interval_seconds, hc.timeout_seconds, hc.failure_threshold, hc.cooldown_minutes, hc.enabled,
+	hc.consecutive_failures, hc.last_status, hc.last_result, hc.last_checked_at, hc.last_triggered_at, hc.created_at`
+
+const healthCheckFrom = ` FROM health_checks hc JOIN whitelist w ON w.id = hc.whitelist_id`
+
+// scanHealthCheck scans a row selected with healthCheckColumns
+func scanHealthCheck(row interface{ Scan(...interface{}) error }) (models.HealthCheck, error) {
+	var hc models.HealthCheck
+	var lastChecked, lastTriggered sql.NullTime
+	err := row.Scan(&hc.ID, &hc.WhitelistID, &hc.VMID, &hc.ResourceName, &hc.Node, &hc.Type, &hc.Target, &hc.Threshold,
+		&hc.IntervalSeconds, &hc.TimeoutSeconds, &hc.FailureThreshold, &hc.CooldownMinutes, &hc.Enabled,
+		&hc.ConsecutiveFailures, &hc.LastStatus, &hc.LastResult, &lastChecked, &lastTriggered, &hc.CreatedAt)
+	if lastChecked.Valid {
+		t := lastChecked.Time
+		hc.LastCheckedAt = &t
+	}
+	if lastTriggered.Valid {
+		t := lastTriggered.Time
+		hc.LastTriggeredAt = &t
+	}
+	return hc, err
+}
+
+func (s *SQLStore) queryHealthChecks(query string, args ...interface{}) ([]models.HealthCheck, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checks []models.HealthCheck
+	for rows.Next() {
+		hc, err := scanHealthCheck(rows)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, hc)
+	}
+	return checks, nil
+}
+
+// GetHealthChecks retrieves health checks, optionally only those of one whitelist entry
+func (s *SQLStore) GetHealthChecks(whitelistID int64) ([]models.HealthCheck, error) {
+	query := `SELECT ` + healthCheckColumns + healthCheckFrom
+	if whitelistID != 0 {
+		return s.queryHealthChecks(query+` WHERE hc.whitelist_id = ? ORDER BY hc.id ASC`, whitelistID)
+	}
+	return s.queryHealthChecks(query + ` ORDER BY w.vmid ASC, hc.id ASC`)
+}
+
+// GetActiveHealthChecks retrieves enabled checks of enabled whitelist entries
+func (s *SQLStore) GetActiveHealthChecks() ([]models.HealthCheck, error) {
+	query := `SELECT ` + healthCheckColumns + healthCheckFrom + ` WHERE hc.enabled = TRUE AND w.enabled = TRUE ORDER BY hc.id ASC`
+	return s.queryHealthChecks(query)
+}
+
+// GetHealthCheckByID retrieves a health check by ID
+func (s *SQLStore) GetHealthCheckByID(id int64) (*models.HealthCheck, error) {
+	query := `SELECT ` + healthCheckColumns + healthCheckFrom + ` WHERE hc.id = ?`
+
+	hc, err := scanHealthCheck(s.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	return &hc, nil
+}
+
+// CreateHealthCheck adds a health check and returns its ID
+func (s *SQLStore) CreateHealthCheck(req *models.HealthCheckRequest) (int64, error) {
+	query := `INSERT INTO health_checks (whitelist_id, type, target, threshold, interval_seconds, timeout_seconds,
+	          failure_threshold, cooldown_minutes, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	enabled := req.Enabled == nil || *req.Enabled
+	return s.insert(query, req.WhitelistID, req.Type, req.Target, req.Threshold, req.IntervalSeconds,
+		req.TimeoutSeconds, req.FailureThreshold, req.CooldownMinutes, enabled)
+}
+
+// UpdateHealthCheck replaces a health check's settings and resets its failure count
+func (s *SQLStore) UpdateHealthCheck(id int64, req *models.HealthCheckRequest) error {
+	query := `UPDATE health_checks SET type = ?, target = ?, threshold = ?, interval_seconds = ?, timeout_seconds = ?,
+	          failure_threshold = ?, cooldown_minutes = ?, enabled = ?, consecutive_failures = 0 WHERE id = ?`
+
+	enabled := req.Enabled == nil || *req.Enabled
+	_, err := s.db.Exec(query, req.Type, req.Target, req.Threshold, req.IntervalSeconds, req.TimeoutSeconds,
+		req.FailureThreshold, req.CooldownMinutes, enabled, id)
+	return err
+}
 
-	_, err := DB.Exec(query, req.Enabled, req.Notes, interval, vmid)
+// UpdateHealthCheckState stores the outcome of the latest probe
+func (s *SQLStore) UpdateHealthCheckState(hc *models.HealthCheck) error {
+	query := `UPDATE health_checks SET consecutive_failures = ?, last_status = ?, last_result = ?,
+	          last_checked_at = ?, last_triggered_at = ? WHERE id = ?`
+	_, err := s.db.Exec(query, hc.ConsecutiveFailures, hc.LastStatus, hc.LastResult,
+		hc.LastCheckedAt, hc.LastTriggeredAt, hc.ID)
 	return err
 }
 
-// DeleteWhitelistByVMID removes a whitelist entry by VMID
-func DeleteWhitelistByVMID(vmid int) error {
-	query := `DELETE FROM whitelist WHERE vmid = ?`
-	_, err := DB.Exec(query, vmid)
+// DeleteHealthCheck removes a health check
+func (s *SQLStore) DeleteHealthCheck(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM health_checks WHERE id = ?`, id)
 	return err
 }
 
 // Restart logs functions
 
-// CreateRestartLog creates a new restart log entry
-func CreateRestartLog(log *models.RestartLog) (int64, error) {
-	query := `INSERT INTO restart_logs (vmid, resource_name, node, action, trigger_type, triggered_by, status, started_at) 
-	          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	result, err := DB.Exec(query, log.VMID, log.ResourceName, log.Node, log.Action, log.TriggerType, log.TriggeredBy, log.Status, log.StartedAt)
+// restartLogColumns is the column list matching scanRestartLog
+const restartLogColumns = `id, vmid, resource_name, node, action, trigger_type, triggered_by, status,
+	error_message, output, upid, exit_status, task_log, verification, verification_detail, probe_result,
+	started_at, completed_at, duration_seconds`
+
+// scanRestartLog scans a row selected with restartLogColumns
+func scanRestartLog(row interface{ Scan(...interface{}) error }) (models.RestartLog, error) {
+	var log models.RestartLog
+	var errorMsg sql.NullString
+	var output sql.NullString
+	var upid, exitStatus, taskLog sql.NullString
+	var verification, verificationDetail, probeResult sql.NullString
+	var completedAt sql.NullTime
+	var duration sql.NullInt64
+
+	err := row.Scan(&log.ID, &log.VMID, &log.ResourceName, &log.Node,
+		&log.Action, &log.TriggerType, &log.TriggeredBy, &log.Status,
+		&errorMsg, &output, &upid, &exitStatus, &taskLog,
+		&verification, &verificationDetail, &probeResult, &log.StartedAt, &completedAt, &duration)
 	if err != nil {
-		return 0, err
+		return log, err
 	}
-	return result.LastInsertId()
+
+	if errorMsg.Valid {
+		log.ErrorMessage = errorMsg.String
+	}
+	if output.Valid {
+		log.Output = output.String
+	}
+	log.UPID = upid.String
+	log.ExitStatus = exitStatus.String
+	log.TaskLog = taskLog.String
+	log.Verification = verification.String
+	log.VerificationDetail = verificationDetail.String
+	log.ProbeResult = probeResult.String
+	if completedAt.Valid {
+		t := completedAt.Time
+		log.CompletedAt = &t
+	}
+	if duration.Valid {
+		log.DurationSeconds = duration.Int64
+	}
+	return log, nil
+}
+
+func (s *SQLStore) queryRestartLogs(query string, args ...interface{}) ([]models.RestartLog, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []models.RestartLog
+	for rows.Next() {
+		log, err := scanRestartLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+	return logs, rows.Err()
+}
+
+// CreateRestartLog creates a new restart log entry
+func (s *SQLStore) CreateRestartLog(log *models.RestartLog) (int64, error) {
+	query := `INSERT INTO restart_logs (vmid, resource_name, node, action, trigger_type, triggered_by, status, probe_result, started_at) 
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	return s.insert(query, log.VMID, log.ResourceName, log.Node, log.Action, log.TriggerType, log.TriggeredBy, log.Status,
+		log.ProbeResult, log.StartedAt)
 }
 
 // UpdateRestartLog updates an existing restart log entry with completion details
-func UpdateRestartLog(log *models.RestartLog) error {
+func (s *SQLStore) UpdateRestartLog(log *models.RestartLog) error {
 	query := `UPDATE restart_logs 
-	          SET status = ?, error_message = ?, output = ?, completed_at = ?, duration_seconds = ? 
+	          SET status = ?, error_message = ?, output = ?, upid = ?, exit_status = ?, task_log = ?, verification = ?, verification_detail = ?, completed_at = ?, duration_seconds = ? 
 	          WHERE id = ?`
-	_, err := DB.Exec(query, log.Status, log.ErrorMessage, log.Output, log.CompletedAt, log.DurationSeconds, log.ID)
+	_, err := s.db.Exec(query, log.Status, log.ErrorMessage, log.Output, log.UPID, log.ExitStatus, log.TaskLog,
+		log.Verification, log.VerificationDetail, log.CompletedAt, log.DurationSeconds, log.ID)
 	return err
 }
 
 // GetLogs retrieves logs with filtering and pagination
-func GetLogs(filter models.LogsFilter) ([]models.RestartLog, error) {
-	query := `SELECT id, vmid, resource_name, node, action, trigger_type, triggered_by, status, error_message, output, started_at, completed_at, duration_seconds 
-	          FROM restart_logs WHERE 1=1`
+func (s *SQLStore) GetLogs(filter models.LogsFilter) ([]models.RestartLog, error) {
+	query := `SELECT ` + restartLogColumns + ` FROM restart_logs WHERE 1=1`
 	args := []interface{}{}
 
 	if filter.VMID != 0 {
@@ -191,6 +703,11 @@ func GetLogs(filter models.LogsFilter) ([]models.RestartLog, error) {
 		query += " AND started_at <= ?"
 		args = append(args, filter.EndDate)
 	}
+	for i := range filter.Scopes {
+		clause, scopeArgs := logScopeClause(&filter.Scopes[i])
+		query += " AND " + clause
+		args = append(args, scopeArgs...)
+	}
 
 	query += " ORDER BY started_at DESC"
 
@@ -201,72 +718,217 @@ func GetLogs(filter models.LogsFilter) ([]models.RestartLog, error) {
 		query += fmt.Sprintf(" OFFSET %d", filter.Offset)
 	}
 
-	rows, err := DB.Query(query, args...)
+	return s.queryRestartLogs(query, args...)
+}
+
+// logScopeClause builds the condition matching logs within a scope; an empty
+// scope matches nothing
+func logScopeClause(scope *models.LogScope) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if len(scope.Nodes) > 0 {
+		conds = append(conds, "node IN ("+placeholders(len(scope.Nodes))+")")
+		for _, node := range scope.Nodes {
+			args = append(args, node)
+		}
+	}
+	for _, r := range scope.VMIDRanges {
+		conds = append(conds, "vmid BETWEEN ? AND ?")
+		args = append(args, r[0], r[1])
+	}
+	if len(scope.VMIDs) > 0 {
+		conds = append(conds, "vmid IN ("+placeholders(len(scope.VMIDs))+")")
+		for _, vmid := range scope.VMIDs {
+			args = append(args, vmid)
+		}
+	}
+	if len(conds) == 0 {
+		return "1=0", nil
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// CountRestartFailures counts restarts of a guest since the given time that
+// failed or did not come back. A health-triggered restart that came back only
+// counts when an earlier one happened since then too, as the guest keeps failing
+// its health checks.
+func (s *SQLStore) CountRestartFailures(vmid int, since time.Time) (int, error) {
+	query := `SELECT
+	            COALESCE(SUM(CASE WHEN status = 'failed' OR verification = 'failed_to_come_back' THEN 1 ELSE 0 END), 0),
+	            COALESCE(SUM(CASE WHEN trigger_type = 'health' AND status = 'success'
+	                              AND COALESCE(verification, '') <> 'failed_to_come_back' THEN 1 ELSE 0 END), 0)
+	          FROM restart_logs
+	          WHERE vmid = ? AND action = 'restart' AND started_at >= ?`
+
+	var failures, healthRestarts int
+	if err := s.db.QueryRow(query, vmid, since).Scan(&failures, &healthRestarts); err != nil {
+		return 0, err
+	}
+	if healthRestarts > 1 {
+		failures += healthRestarts - 1
+	}
+	return failures, nil
+}
+
+// lastRestartCond matches the logs GetLastRestartTime reads the last restart of
+// a guest from
+const lastRestartCond = `action = 'restart' AND status = 'success' AND completed_at IS NOT NULL`
+
+// FindPrunableLogs returns up to limit finished logs, oldest first, that the
+// retention policy allows to delete. Pending logs and each guest's last
+// successful restart, which the restart interval is measured from, are never
+// returned.
+func (s *SQLStore) FindPrunableLogs(policy models.LogRetention, limit int) ([]models.RestartLog, error) {
+	var conds []string
+	var args []interface{}
+
+	statuses := slices.Sorted(maps.Keys(policy.StatusBefore))
+	for _, status := range statuses {
+		if cutoff := policy.StatusBefore[status]; !cutoff.IsZero() {
+			conds = append(conds, "(status = ? AND started_at < ?)")
+			args = append(args, status, cutoff)
+		}
+	}
+	if !policy.Before.IsZero() {
+		cond := "started_at < ?"
+		args = append(args, policy.Before)
+		if len(statuses) > 0 {
+			// Statuses with their own cutoff are handled above
+			cond = "(started_at < ? AND status NOT IN (" + placeholders(len(statuses)) + "))"
+			for _, status := range statuses {
+				args = append(args, status)
+			}
+		}
+		conds = append(conds, cond)
+	}
+	if policy.KeepPerVMID > 0 {
+		conds = append(conds, "rn > ?")
+		args = append(args, policy.KeepPerVMID)
+	}
+	if len(conds) == 0 {
+		return nil, nil
+	}
+
+	// rn numbers each guest's logs from newest to oldest, and last_rn its
+	// successful restarts by completion
+	query := `SELECT ` + restartLogColumns + ` FROM (
+	              SELECT restart_logs.*,
+	                     ROW_NUMBER() OVER (PARTITION BY vmid ORDER BY started_at DESC, id DESC) AS rn,
+	                     ROW_NUMBER() OVER (PARTITION BY vmid, (` + lastRestartCond + `) ORDER BY completed_at DESC, id DESC) AS last_rn
+	              FROM restart_logs
+	          ) ranked
+	          WHERE status != 'pending' AND NOT (` + lastRestartCond + ` AND last_rn = 1)
+	            AND (` + strings.Join(conds, " OR ") + `)
+	          ORDER BY id ASC LIMIT ?`
+	args = append(args, limit)
+
+	return s.queryRestartLogs(query, args...)
+}
+
+// placeholders returns n comma-separated ? placeholders for an IN list
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// DeleteRestartLogs removes the given logs and returns how many were deleted
+func (s *SQLStore) DeleteRestartLogs(ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := `DELETE FROM restart_logs WHERE id IN (` + placeholders(len(ids)) + `)`
+
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetLogTableStats reports how large the restart_logs table has grown
+func (s *SQLStore) GetLogTableStats() (*models.LogTableStats, error) {
+	stats := models.LogTableStats{ByStatus: make(map[string]int64)}
+
+	err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(LENGTH(COALESCE(output, '')) + LENGTH(COALESCE(task_log, ''))), 0)
+	                      FROM restart_logs`).Scan(&stats.Rows, &stats.PayloadBytes)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var logs []models.RestartLog
+	rows, err := s.db.Query(`SELECT status, COUNT(*) FROM restart_logs GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var log models.RestartLog
-		var errorMsg sql.NullString
-		var output sql.NullString
-		var completedAt sql.NullTime
-		var duration sql.NullInt64
-
-		err := rows.Scan(&log.ID, &log.VMID, &log.ResourceName, &log.Node,
-			&log.Action, &log.TriggerType, &log.TriggeredBy, &log.Status,
-			&errorMsg, &output, &log.StartedAt, &completedAt, &duration)
-		if err != nil {
+		var status string
+		var count int64
+		if err := rows.Scan(&status, &count); err != nil {
 			return nil, err
 		}
+		stats.ByStatus[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		if errorMsg.Valid {
-			log.ErrorMessage = errorMsg.String
-		}
-		if output.Valid {
-			log.Output = output.String
-		}
-		if completedAt.Valid {
-			t := completedAt.Time
-			log.CompletedAt = &t
+	// Select the rows rather than MIN/MAX so SQLite keeps the column's time type
+	for _, q := range []struct {
+		order string
+		dest  **time.Time
+	}{{"ASC", &stats.Oldest}, {"DESC", &stats.Newest}} {
+		var t sql.NullTime
+		err := s.db.QueryRow(`SELECT started_at FROM restart_logs ORDER BY started_at ` + q.order + ` LIMIT 1`).Scan(&t)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
 		}
-		if duration.Valid {
-			log.DurationSeconds = duration.Int64
+		if t.Valid {
+			*q.dest = &t.Time
 		}
-
-		logs = append(logs, log)
 	}
 
-	return logs, nil
+	return &stats, nil
 }
 
-// GetSystemStatus retrieves aggregated system status
-func GetSystemStatus() (*models.SystemStatus, error) {
+// GetSystemStatus retrieves aggregated system status, counting only the
+// whitelist entries and restart logs within every one of scopes
+func (s *SQLStore) GetSystemStatus(scopes []models.LogScope) (*models.SystemStatus, error) {
 	var status models.SystemStatus
 
+	var scope string
+	var args []interface{}
+	for i := range scopes {
+		clause, scopeArgs := logScopeClause(&scopes[i])
+		scope += " AND " + clause
+		args = append(args, scopeArgs...)
+	}
+
 	// Get whitelisted count
-	err := DB.QueryRow(`SELECT COUNT(*) FROM whitelist WHERE enabled = 1`).
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM whitelist WHERE enabled = TRUE`+scope, args...).
 		Scan(&status.WhitelistedCount)
 	if err != nil {
 		return nil, err
 	}
 
 	// Get total and failed restarts
-	err = DB.QueryRow(`SELECT 
+	err = s.db.QueryRow(`SELECT 
 	                     COUNT(*),
 	                     COUNT(CASE WHEN status = 'failed' THEN 1 END)
-	                     FROM restart_logs`).
+	                     FROM restart_logs WHERE 1=1`+scope, args...).
 		Scan(&status.TotalRestarts, &status.FailedRestarts)
 	if err != nil {
 		return nil, err
 	}
 
-	// Calculate next restart time (6 hours from last auto restart)
+	// Calculate next restart time (default interval after the last auto restart)
+	interval := time.Duration(DefaultRestartInterval()) * time.Hour
 	var lastAutoRestartStr sql.NullString
-	err = DB.QueryRow(`SELECT MAX(started_at) FROM restart_logs 
-	                    WHERE trigger_type = 'auto'`).Scan(&lastAutoRestartStr)
+	err = s.db.QueryRow(`SELECT MAX(started_at) FROM restart_logs 
+	                    WHERE trigger_type = 'auto'`+scope, args...).Scan(&lastAutoRestartStr)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -279,15 +941,15 @@ func GetSystemStatus() (*models.SystemStatus, error) {
 			lastRestart, err = time.Parse(time.RFC3339, lastAutoRestartStr.String)
 			if err != nil {
 				// If parsing fails, use current time
-				status.NextRestartTime = time.Now().Add(6 * time.Hour)
+				status.NextRestartTime = time.Now().Add(interval)
 			} else {
-				status.NextRestartTime = lastRestart.Add(6 * time.Hour)
+				status.NextRestartTime = lastRestart.Add(interval)
 			}
 		} else {
-			status.NextRestartTime = lastRestart.Add(6 * time.Hour)
+			status.NextRestartTime = lastRestart.Add(interval)
 		}
 	} else {
-		status.NextRestartTime = time.Now().Add(6 * time.Hour)
+		status.NextRestartTime = time.Now().Add(interval)
 	}
 
 	return &status, nil
@@ -296,22 +958,22 @@ func GetSystemStatus() (*models.SystemStatus, error) {
 // Container Service functions
 
 // CreateContainerService records a service installation on a container
-func CreateContainerService(vmid int, node, serviceName, serviceType, installCommands string) error {
+func (s *SQLStore) CreateContainerService(vmid int, node, serviceName, serviceType, installCommands string) error {
 	query := `INSERT INTO container_services (vmid, node, service_name, service_type, install_commands)
 	          VALUES (?, ?, ?, ?, ?)`
 
-	_, err := DB.Exec(query, vmid, node, serviceName, serviceType, installCommands)
+	_, err := s.db.Exec(query, vmid, node, serviceName, serviceType, installCommands)
 	return err
 }
 
 // GetServicesByVMID retrieves all services installed on a container
-func GetServicesByVMID(vmid int, node string) ([]models.ContainerService, error) {
+func (s *SQLStore) GetServicesByVMID(vmid int, node string) ([]models.ContainerService, error) {
 	query := `SELECT id, vmid, node, service_name, service_type, install_commands, installed_at
 	          FROM container_services
 	          WHERE vmid = ? AND node = ?
 	          ORDER BY installed_at DESC`
 
-	rows, err := DB.Query(query, vmid, node)
+	rows, err := s.db.Query(query, vmid, node)
 	if err != nil {
 		return nil, err
 	}
@@ -339,20 +1001,20 @@ func GetServicesByVMID(vmid int, node string) ([]models.ContainerService, error)
 }
 
 // DeleteServicesByVMID removes all service records for a container
-func DeleteServicesByVMID(vmid int, node string) error {
+func (s *SQLStore) DeleteServicesByVMID(vmid int, node string) error {
 	query := `DELETE FROM container_services WHERE vmid = ? AND node = ?`
-	_, err := DB.Exec(query, vmid, node)
+	_, err := s.db.Exec(query, vmid, node)
 	return err
 }
 
 // GetLastRestartTime retrieves the timestamp of the last successful restart for a VMID
-func GetLastRestartTime(vmid int) (time.Time, error) {
+func (s *SQLStore) GetLastRestartTime(vmid int) (time.Time, error) {
 	query := `SELECT completed_at FROM restart_logs 
-	          WHERE vmid = ? AND action = 'restart' AND status = 'success' 
+	          WHERE vmid = ? AND ` + lastRestartCond + `
 	          ORDER BY completed_at DESC LIMIT 1`
 
 	var lastRestart sql.NullTime
-	err := DB.QueryRow(query, vmid).Scan(&lastRestart)
+	err := s.db.QueryRow(query, vmid).Scan(&lastRestart)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return time.Time{}, nil // Never restarted
@@ -365,3 +1027,371 @@ func GetLastRestartTime(vmid int) (time.Time, error) {
 	}
 	return time.Time{}, nil
 }
+
+// User functions
+
+const userColumns = `id, username, password_hash, role, provider, enabled, created_at, updated_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (models.User, error) {
+	var u models.User
+	err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.Provider, &u.Enabled, &u.CreatedAt, &u.UpdatedAt)
+	return u, err
+}
+
+// GetAllUsers retrieves all user accounts ordered by username
+func (s *SQLStore) GetAllUsers() ([]models.User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetUserByID retrieves a user account, nil if it does not exist
+func (s *SQLStore) GetUserByID(id int64) (*models.User, error) {
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetUserByUsername retrieves a user account, nil if it does not exist
+func (s *SQLStore) GetUserByUsername(username string) (*models.User, error) {
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CreateUser adds an enabled user account and returns its ID
+func (s *SQLStore) CreateUser(username, passwordHash, role, provider string) (int64, error) {
+	query := `INSERT INTO users (username, password_hash, role, provider) VALUES (?, ?, ?, ?)`
+	return s.insert(query, username, passwordHash, role, provider)
+}
+
+// UpdateUser saves a user's password hash, role and enabled flag
+func (s *SQLStore) UpdateUser(user *models.User) error {
+	query := `UPDATE users SET password_hash = ?, role = ?, enabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err := s.db.Exec(query, user.PasswordHash, user.Role, user.Enabled, user.ID)
+	return err
+}
+
+// DeleteUser removes a user account, its grants, API tokens and sessions
+func (s *SQLStore) DeleteUser(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM user_grants WHERE user_id = ?`), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM api_tokens WHERE user_id = ?`), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM sessions WHERE user_id = ?`), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.db.Rebind(`DELETE FROM users WHERE id = ?`), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CountUsers returns the number of user accounts
+func (s *SQLStore) CountUsers() (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+// GetUserGrants retrieves the grants of a user account
+func (s *SQLStore) GetUserGrants(userID int64) ([]models.UserGrant, error) {
+	query := `SELECT id, user_id, scope, value, created_at FROM user_grants WHERE user_id = ? ORDER BY scope ASC, value ASC`
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []models.UserGrant
+	for rows.Next() {
+		var g models.UserGrant
+		if err := rows.Scan(&g.ID, &g.UserID, &g.Scope, &g.Value, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// CreateUserGrant adds a grant to a user account and returns its ID
+func (s *SQLStore) CreateUserGrant(userID int64, scope, value string) (int64, error) {
+	return s.insert(`INSERT INTO user_grants (user_id, scope, value) VALUES (?, ?, ?)`, userID, scope, value)
+}
+
+// DeleteUserGrant removes a grant
+func (s *SQLStore) DeleteUserGrant(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM user_grants WHERE id = ?`, id)
+	return err
+}
+
+// API token functions
+
+// apiTokenColumns is the column list matching scanAPIToken; it joins the
+// token's owner
+const apiTokenColumns = `t.id, t.user_id, u.username, t.name, t.prefix, t.token_hash, t.role, t.scopes,
+	t.expires_at, t.last_used_at, t.created_at`
+
+const apiTokenFrom = ` FROM api_tokens t JOIN users u ON u.id = t.user_id`
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (models.APIToken, error) {
+	var t models.APIToken
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.Username, &t.Name, &t.Prefix, &t.TokenHash, &t.Role, &scopes,
+		&expiresAt, &lastUsedAt, &t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return t, nil
+}
+
+// GetAPITokens retrieves the tokens of a user, or of every user for 0
+func (s *SQLStore) GetAPITokens(userID int64) ([]models.APIToken, error) {
+	query := `SELECT ` + apiTokenColumns + apiTokenFrom
+	args := []interface{}{}
+	if userID != 0 {
+		query += ` WHERE t.user_id = ?`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY u.username ASC, t.name ASC`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []models.APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// GetAPITokenByID retrieves a token, nil if it does not exist
+func (s *SQLStore) GetAPITokenByID(id int64) (*models.APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`SELECT `+apiTokenColumns+apiTokenFrom+` WHERE t.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetAPITokenByHash retrieves the token with the given secret hash, nil if
+// there is none
+func (s *SQLStore) GetAPITokenByHash(tokenHash string) (*models.APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`SELECT `+apiTokenColumns+apiTokenFrom+` WHERE t.token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateAPIToken stores a new token and returns its ID
+func (s *SQLStore) CreateAPIToken(token *models.APIToken) (int64, error) {
+	query := `INSERT INTO api_tokens (user_id, name, prefix, token_hash, role, scopes, expires_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?)`
+	return s.insert(query, token.UserID, token.Name, token.Prefix, token.TokenHash, token.Role,
+		strings.Join(token.Scopes, " "), token.ExpiresAt)
+}
+
+// TouchAPIToken records when a token was last used
+func (s *SQLStore) TouchAPIToken(id int64, usedAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, usedAt, id)
+	return err
+}
+
+// DeleteAPIToken revokes a token
+func (s *SQLStore) DeleteAPIToken(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	return err
+}
+
+// Session functions
+
+// GetSessionByHash retrieves the session with the given secret hash, nil if
+// there is none
+func (s *SQLStore) GetSessionByHash(tokenHash string) (*models.Session, error) {
+	var sess models.Session
+	query := `SELECT id, user_id, token_hash, expires_at, created_at FROM sessions WHERE token_hash = ?`
+	err := s.db.QueryRow(query, tokenHash).Scan(&sess.ID, &sess.UserID, &sess.TokenHash, &sess.ExpiresAt, &sess.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// CreateSession stores a new session and returns its ID
+func (s *SQLStore) CreateSession(session *models.Session) (int64, error) {
+	query := `INSERT INTO sessions (user_id, token_hash, expires_at) VALUES (?, ?, ?)`
+	return s.insert(query, session.UserID, session.TokenHash, session.ExpiresAt)
+}
+
+// DeleteSession ends a session
+func (s *SQLStore) DeleteSession(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+// DeleteExpiredSessions removes sessions that expired before the given time
+// and returns how many were removed
+func (s *SQLStore) DeleteExpiredSessions(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Terminal session functions
+
+// terminalSessionColumns is the column list matching scanTerminalSession
+const terminalSessionColumns = `id, user_id, username, vmid, node, type, recording, started_at, ended_at,
+	input_bytes, output_bytes`
+
+func scanTerminalSession(row interface{ Scan(...interface{}) error }) (models.TerminalSession, error) {
+	var ts models.TerminalSession
+	var endedAt sql.NullTime
+	err := row.Scan(&ts.ID, &ts.UserID, &ts.Username, &ts.VMID, &ts.Node, &ts.Type, &ts.Recording, &ts.StartedAt,
+		&endedAt, &ts.InputBytes, &ts.OutputBytes)
+	if endedAt.Valid {
+		ts.EndedAt = &endedAt.Time
+	}
+	return ts, err
+}
+
+// CreateTerminalSession records the start of a terminal session and returns
+// its ID
+func (s *SQLStore) CreateTerminalSession(session *models.TerminalSession) (int64, error) {
+	query := `INSERT INTO terminal_sessions (user_id, username, vmid, node, type, recording, started_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?)`
+	return s.insert(query, session.UserID, session.Username, session.VMID, session.Node, session.Type,
+		session.Recording, session.StartedAt)
+}
+
+// FinishTerminalSession records the end of a session and its byte counts
+func (s *SQLStore) FinishTerminalSession(session *models.TerminalSession) error {
+	query := `UPDATE terminal_sessions SET ended_at = ?, input_bytes = ?, output_bytes = ? WHERE id = ?`
+	_, err := s.db.Exec(query, session.EndedAt, session.InputBytes, session.OutputBytes, session.ID)
+	return err
+}
+
+// GetTerminalSessions retrieves terminal sessions matching filter, newest first
+func (s *SQLStore) GetTerminalSessions(filter models.TerminalSessionFilter) ([]models.TerminalSession, error) {
+	query := `SELECT ` + terminalSessionColumns + ` FROM terminal_sessions WHERE 1=1`
+	args := []interface{}{}
+
+	if filter.Username != "" {
+		query += " AND username = ?"
+		args = append(args, filter.Username)
+	}
+	if filter.VMID != 0 {
+		query += " AND vmid = ?"
+		args = append(args, filter.VMID)
+	}
+	if filter.Node != "" {
+		query += " AND node = ?"
+		args = append(args, filter.Node)
+	}
+	if filter.StartDate != nil {
+		query += " AND started_at >= ?"
+		args = append(args, filter.StartDate)
+	}
+	if filter.EndDate != nil {
+		query += " AND started_at <= ?"
+		args = append(args, filter.EndDate)
+	}
+	for i := range filter.Scopes {
+		clause, scopeArgs := logScopeClause(&filter.Scopes[i])
+		query += " AND " + clause
+		args = append(args, scopeArgs...)
+	}
+
+	query += " ORDER BY started_at DESC, id DESC"
+
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", filter.Offset)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.TerminalSession
+	for rows.Next() {
+		ts, err := scanTerminalSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, ts)
+	}
+	return sessions, rows.Err()
+}
+
+// GetTerminalSessionByID retrieves a terminal session, nil if it does not exist
+func (s *SQLStore) GetTerminalSessionByID(id int64) (*models.TerminalSession, error) {
+	ts, err := scanTerminalSession(s.db.QueryRow(`SELECT `+terminalSessionColumns+` FROM terminal_sessions WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ts, nil
+}
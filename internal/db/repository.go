@@ -0,0 +1,127 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// WhitelistRepository stores whitelist entries and their quarantine state
+type WhitelistRepository interface {
+	GetAllWhitelist() ([]models.Whitelist, error)
+	GetEnabledWhitelist() ([]models.Whitelist, error)
+	GetWhitelistByID(id int64) (*models.Whitelist, error)
+	GetWhitelistByVMID(vmid int) (*models.Whitelist, error)
+	GetWhitelistByGroup(groupID int64) ([]models.Whitelist, error)
+	CreateWhitelist(req *models.CreateWhitelistRequest) error
+	UpdateWhitelist(id int64, req *models.UpdateWhitelistRequest) error
+	DeleteFromWhitelist(id int64) error
+	DeleteWhitelistByVMID(vmid int, node string) error
+	SetQuarantine(id int64, level int, until time.Time, reason string) error
+	ClearQuarantine(id int64) error
+	// SyncWhitelist applies a manifest's changes and records the manifest
+	SyncWhitelist(sync *models.WhitelistSync) error
+	// GetLastAppliedManifest returns nil when no manifest was applied yet
+	GetLastAppliedManifest() (*models.AppliedManifest, error)
+}
+
+// RestartGroupRepository stores restart groups
+type RestartGroupRepository interface {
+	GetAllRestartGroups() ([]models.RestartGroup, error)
+	GetRestartGroupByID(id int64) (*models.RestartGroup, error)
+	CreateRestartGroup(name, description string, waitHealthy, stopOnFailure bool) (int64, error)
+	UpdateRestartGroup(id int64, name, description string, waitHealthy, stopOnFailure bool) error
+	DeleteRestartGroup(id int64) error
+}
+
+// UserRepository stores the accounts that can sign in to the API
+type UserRepository interface {
+	GetAllUsers() ([]models.User, error)
+	GetUserByID(id int64) (*models.User, error)
+	GetUserByUsername(username string) (*models.User, error)
+	// CreateUser adds an account; provider is "local" for password accounts
+	CreateUser(username, passwordHash, role, provider string) (int64, error)
+	UpdateUser(user *models.User) error
+	// DeleteUser removes an account together with its grants, API tokens and
+	// sessions
+	DeleteUser(id int64) error
+	CountUsers() (int, error)
+	GetUserGrants(userID int64) ([]models.UserGrant, error)
+	CreateUserGrant(userID int64, scope, value string) (int64, error)
+	DeleteUserGrant(id int64) error
+}
+
+// APITokenRepository stores the bearer tokens used by automation
+type APITokenRepository interface {
+	// GetAPITokens lists the tokens of a user, or of every user for 0
+	GetAPITokens(userID int64) ([]models.APIToken, error)
+	GetAPITokenByID(id int64) (*models.APIToken, error)
+	GetAPITokenByHash(tokenHash string) (*models.APIToken, error)
+	CreateAPIToken(token *models.APIToken) (int64, error)
+	TouchAPIToken(id int64, usedAt time.Time) error
+	DeleteAPIToken(id int64) error
+}
+
+// SessionRepository stores browser sign-in sessions
+type SessionRepository interface {
+	GetSessionByHash(tokenHash string) (*models.Session, error)
+	CreateSession(session *models.Session) (int64, error)
+	DeleteSession(id int64) error
+	DeleteExpiredSessions(before time.Time) (int64, error)
+}
+
+// TerminalSessionRepository indexes the recordings of web terminal sessions
+type TerminalSessionRepository interface {
+	CreateTerminalSession(session *models.TerminalSession) (int64, error)
+	FinishTerminalSession(session *models.TerminalSession) error
+	GetTerminalSessions(filter models.TerminalSessionFilter) ([]models.TerminalSession, error)
+	GetTerminalSessionByID(id int64) (*models.TerminalSession, error)
+}
+
+// HealthCheckRepository stores watchdog health checks and their probe state
+type HealthCheckRepository interface {
+	GetHealthChecks(whitelistID int64) ([]models.HealthCheck, error)
+	GetActiveHealthChecks() ([]models.HealthCheck, error)
+	GetHealthCheckByID(id int64) (*models.HealthCheck, error)
+	CreateHealthCheck(req *models.HealthCheckRequest) (int64, error)
+	UpdateHealthCheck(id int64, req *models.HealthCheckRequest) error
+	UpdateHealthCheckState(hc *models.HealthCheck) error
+	DeleteHealthCheck(id int64) error
+}
+
+// RestartLogRepository stores the audit trail of restart, stop and start actions
+type RestartLogRepository interface {
+	CreateRestartLog(log *models.RestartLog) (int64, error)
+	UpdateRestartLog(log *models.RestartLog) error
+	GetLogs(filter models.LogsFilter) ([]models.RestartLog, error)
+	CountRestartFailures(vmid int, since time.Time) (int, error)
+	GetLastRestartTime(vmid int) (time.Time, error)
+	FindPrunableLogs(policy models.LogRetention, limit int) ([]models.RestartLog, error)
+	DeleteRestartLogs(ids []int64) (int64, error)
+	GetLogTableStats() (*models.LogTableStats, error)
+}
+
+// ContainerServiceRepository stores the services installed on deployed containers
+type ContainerServiceRepository interface {
+	CreateContainerService(vmid int, node, serviceName, serviceType, installCommands string) error
+	GetServicesByVMID(vmid int, node string) ([]models.ContainerService, error)
+	DeleteServicesByVMID(vmid int, node string) error
+}
+
+// Store is the complete storage backend used by the API and the scheduler
+type Store interface {
+	WhitelistRepository
+	RestartGroupRepository
+	HealthCheckRepository
+	RestartLogRepository
+	ContainerServiceRepository
+	UserRepository
+	APITokenRepository
+	SessionRepository
+	TerminalSessionRepository
+
+	GetSystemStatus(scopes []models.LogScope) (*models.SystemStatus, error)
+	// Backup writes a consistent snapshot of the database to a new file
+	Backup(path string) error
+	Close() error
+}
@@ -0,0 +1,551 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// TestSQLiteStore runs the store checks against an in-memory SQLite database
+func TestSQLiteStore(t *testing.T) {
+	conn := openTestDB(t)
+	if err := RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	testStore(t, NewStore(conn))
+}
+
+// TestPostgresStore runs the store checks against the PostgreSQL database in
+// TEST_POSTGRES_DSN. The database is wiped before and after the test.
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN not set")
+	}
+
+	conn, err := Open(dsn)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer conn.Close()
+	if conn.Dialect != Postgres {
+		t.Fatalf("TEST_POSTGRES_DSN must be a postgres:// URL")
+	}
+
+	reset := func() {
+		if _, err := MigrateDown(conn, LatestVersion()); err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+	}
+	reset()
+	defer reset()
+
+	// Instances starting together take turns migrating
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = RunMigrations(conn)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatalf("concurrent RunMigrations: %v", err)
+	}
+	if _, err := MigrateDown(conn, 2); err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	if err := RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations after down: %v", err)
+	}
+
+	// Only one session at a time holds the scheduler lock
+	release, ok, err := conn.TryAdvisoryLock(SchedulerLockKey)
+	if err != nil || !ok {
+		t.Fatalf("TryAdvisoryLock: %v, %v", ok, err)
+	}
+	if _, ok, err := conn.TryAdvisoryLock(SchedulerLockKey); err != nil || ok {
+		t.Errorf("second TryAdvisoryLock = %v, %v; want the lock taken", ok, err)
+	}
+	release()
+	release, ok, err = conn.TryAdvisoryLock(SchedulerLockKey)
+	if err != nil || !ok {
+		t.Fatalf("TryAdvisoryLock after release: %v, %v", ok, err)
+	}
+	release()
+
+	testStore(t, NewStore(conn))
+}
+
+func testStore(t *testing.T, s *SQLStore) {
+	t.Helper()
+
+	// Whitelist
+	err := s.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", CreatedBy: "test"})
+	if err != nil {
+		t.Fatalf("CreateWhitelist: %v", err)
+	}
+	wl, err := s.GetWhitelistByVMID(101)
+	if err != nil || wl == nil {
+		t.Fatalf("GetWhitelistByVMID: %v", err)
+	}
+	if !wl.Enabled || wl.RestartIntervalHours != 6 || wl.RestartMode != "schedule" {
+		t.Errorf("unexpected defaults %+v", wl)
+	}
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.SetQuarantine(wl.ID, 2, until, "crash loop"); err != nil {
+		t.Fatalf("SetQuarantine: %v", err)
+	}
+	wl, _ = s.GetWhitelistByID(wl.ID)
+	if !wl.Quarantined || wl.QuarantineLevel != 2 || wl.QuarantinedUntil == nil || !wl.QuarantinedUntil.Equal(until) {
+		t.Errorf("quarantine not stored: %+v", wl)
+	}
+	if err := s.ClearQuarantine(wl.ID); err != nil {
+		t.Fatalf("ClearQuarantine: %v", err)
+	}
+	wl, _ = s.GetWhitelistByID(wl.ID)
+	if wl.Quarantined || wl.FailuresResetAt == nil {
+		t.Errorf("quarantine not cleared: %+v", wl)
+	}
+
+	// Restart groups
+	groupID, err := s.CreateRestartGroup("web", "frontends", true, false)
+	if err != nil || groupID == 0 {
+		t.Fatalf("CreateRestartGroup: id %d, %v", groupID, err)
+	}
+	if _, err := s.CreateRestartGroup("web", "", true, true); !IsUniqueViolation(err) {
+		t.Errorf("expected a unique violation for a duplicate group name, got %v", err)
+	}
+	order := 1
+	err = s.UpdateWhitelist(wl.ID, &models.UpdateWhitelistRequest{Enabled: true, GroupID: &groupID, GroupOrder: &order})
+	if err != nil {
+		t.Fatalf("UpdateWhitelist: %v", err)
+	}
+	group, err := s.GetRestartGroupByID(groupID)
+	if err != nil || group == nil || len(group.Members) != 1 || group.StopOnFailure {
+		t.Fatalf("GetRestartGroupByID: %+v, %v", group, err)
+	}
+	if err := s.DeleteRestartGroup(groupID); err != nil {
+		t.Fatalf("DeleteRestartGroup: %v", err)
+	}
+	if wl, _ = s.GetWhitelistByID(wl.ID); wl.GroupID != 0 {
+		t.Errorf("member not ungrouped: %+v", wl)
+	}
+
+	// Health checks
+	checkID, err := s.CreateHealthCheck(&models.HealthCheckRequest{
+		WhitelistID: wl.ID, Type: "memory", Threshold: 92.5, IntervalSeconds: 60, TimeoutSeconds: 10, FailureThreshold: 3,
+	})
+	if err != nil || checkID == 0 {
+		t.Fatalf("CreateHealthCheck: id %d, %v", checkID, err)
+	}
+	checks, err := s.GetActiveHealthChecks()
+	if err != nil || len(checks) != 1 || checks[0].VMID != 101 || checks[0].Threshold != 92.5 {
+		t.Fatalf("GetActiveHealthChecks: %+v, %v", checks, err)
+	}
+	checked := time.Now().Truncate(time.Second)
+	checks[0].ConsecutiveFailures, checks[0].LastStatus, checks[0].LastCheckedAt = 2, "failing", &checked
+	if err := s.UpdateHealthCheckState(&checks[0]); err != nil {
+		t.Fatalf("UpdateHealthCheckState: %v", err)
+	}
+	hc, err := s.GetHealthCheckByID(checkID)
+	if err != nil || hc.ConsecutiveFailures != 2 || hc.LastCheckedAt == nil || hc.LastTriggeredAt != nil {
+		t.Errorf("health check state not stored: %+v, %v", hc, err)
+	}
+
+	// Restart logs
+	started := time.Now().Add(-time.Minute)
+	logID, err := s.CreateRestartLog(&models.RestartLog{
+		VMID: 101, ResourceName: "db", Node: "pve1", Action: "restart", TriggerType: "auto",
+		TriggeredBy: "scheduler", Status: "pending", StartedAt: started,
+	})
+	if err != nil || logID == 0 {
+		t.Fatalf("CreateRestartLog: id %d, %v", logID, err)
+	}
+	completed := time.Now()
+	err = s.UpdateRestartLog(&models.RestartLog{ID: logID, Status: "failed", ErrorMessage: "timeout", CompletedAt: &completed, DurationSeconds: 60})
+	if err != nil {
+		t.Fatalf("UpdateRestartLog: %v", err)
+	}
+	logs, err := s.GetLogs(models.LogsFilter{ResourceName: "d", Limit: 10})
+	if err != nil || len(logs) != 1 || logs[0].ErrorMessage != "timeout" || logs[0].CompletedAt == nil {
+		t.Fatalf("GetLogs: %+v, %v", logs, err)
+	}
+	for _, tt := range []struct {
+		scope models.LogScope
+		want  int
+	}{
+		{models.LogScope{Nodes: []string{"pve1"}}, 1},
+		{models.LogScope{Nodes: []string{"pve2"}, VMIDRanges: [][2]int{{100, 101}}}, 1},
+		{models.LogScope{VMIDs: []int{102, 103}}, 0},
+		{models.LogScope{}, 0},
+	} {
+		if logs, err := s.GetLogs(models.LogsFilter{Scopes: []models.LogScope{tt.scope}}); err != nil || len(logs) != tt.want {
+			t.Errorf("GetLogs in scope %+v: %d logs, %v", tt.scope, len(logs), err)
+		}
+	}
+	if n, err := s.CountRestartFailures(101, started.Add(-time.Second)); err != nil || n != 1 {
+		t.Errorf("CountRestartFailures = %d, %v", n, err)
+	}
+	if last, err := s.GetLastRestartTime(101); err != nil || !last.IsZero() {
+		t.Errorf("failed restart counted as last restart: %v, %v", last, err)
+	}
+	status, err := s.GetSystemStatus(nil)
+	if err != nil || status.WhitelistedCount != 1 || status.TotalRestarts != 1 || status.FailedRestarts != 1 {
+		t.Errorf("GetSystemStatus: %+v, %v", status, err)
+	}
+
+	// Pruning with a max age shorter than the restart interval keeps the last
+	// successful restart, so the guest is not restarted again at once
+	var restarts []int64
+	for _, age := range []time.Duration{12 * time.Hour, 6 * time.Hour} {
+		done := time.Now().Add(-age)
+		id, err := s.CreateRestartLog(&models.RestartLog{
+			VMID: 150, ResourceName: "web", Node: "pve1", Action: "restart", TriggerType: "auto",
+			TriggeredBy: "scheduler", Status: "pending", StartedAt: done.Add(-time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("CreateRestartLog: %v", err)
+		}
+		if err := s.UpdateRestartLog(&models.RestartLog{ID: id, Status: "success", CompletedAt: &done, DurationSeconds: 60}); err != nil {
+			t.Fatalf("UpdateRestartLog: %v", err)
+		}
+		restarts = append(restarts, id)
+	}
+	for _, policy := range []models.LogRetention{
+		{Before: time.Now().Add(-time.Hour)},
+		{StatusBefore: map[string]time.Time{"success": time.Now().Add(-time.Hour)}},
+		{KeepPerVMID: 1, Before: time.Now().Add(-time.Hour)},
+	} {
+		prunable, err := s.FindPrunableLogs(policy, 10)
+		if err != nil || len(prunable) != 1 || prunable[0].ID != restarts[0] {
+			t.Errorf("FindPrunableLogs(%+v) = %+v, %v; expected only the older restart", policy, prunable, err)
+		}
+	}
+	if _, err := s.DeleteRestartLogs(restarts[:1]); err != nil {
+		t.Fatalf("DeleteRestartLogs: %v", err)
+	}
+	if prunable, err := s.FindPrunableLogs(models.LogRetention{Before: time.Now()}, 10); err != nil || len(prunable) != 1 || prunable[0].ID != logID {
+		t.Errorf("last successful restart returned for pruning: %+v, %v", prunable, err)
+	}
+	if last, err := s.GetLastRestartTime(150); err != nil || last.IsZero() {
+		t.Errorf("last restart lost after pruning: %v, %v", last, err)
+	}
+	s.DeleteRestartLogs(restarts[1:])
+
+	// Container services
+	if err := s.CreateContainerService(101, "pve1", "geth", "blockchain", "apt install geth"); err != nil {
+		t.Fatalf("CreateContainerService: %v", err)
+	}
+	services, err := s.GetServicesByVMID(101, "pve1")
+	if err != nil || len(services) != 1 || services[0].InstallCommands != "apt install geth" {
+		t.Fatalf("GetServicesByVMID: %+v, %v", services, err)
+	}
+	if err := s.DeleteServicesByVMID(101, "pve1"); err != nil {
+		t.Fatalf("DeleteServicesByVMID: %v", err)
+	}
+
+	// Deleting a whitelist entry takes its health checks with it
+	if err := s.DeleteFromWhitelist(wl.ID); err != nil {
+		t.Fatalf("DeleteFromWhitelist: %v", err)
+	}
+	if checks, _ := s.GetHealthChecks(0); len(checks) != 0 {
+		t.Errorf("health checks left behind: %+v", checks)
+	}
+	s.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 104, ResourceName: "deleted", Node: "pve1", CreatedBy: "test"})
+	deleted, _ := s.GetWhitelistByVMID(104)
+	if _, err := s.CreateHealthCheck(&models.HealthCheckRequest{WhitelistID: deleted.ID, Type: "memory", Threshold: 90}); err != nil {
+		t.Fatalf("CreateHealthCheck: %v", err)
+	}
+	s.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 104, ResourceName: "other", Node: "pve2", CreatedBy: "test"})
+	if err := s.DeleteWhitelistByVMID(104, "pve1"); err != nil {
+		t.Fatalf("DeleteWhitelistByVMID: %v", err)
+	}
+	if other, _ := s.GetAllWhitelist(); len(other) != 1 || other[0].Node != "pve2" {
+		t.Errorf("expected only the entry on pve2 left, got %+v", other)
+	}
+	s.DeleteWhitelistByVMID(104, "pve2")
+	var orphans int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM health_checks`).Scan(&orphans); err != nil || orphans != 0 {
+		t.Errorf("expected no health checks left behind by VMID, got %d, %v", orphans, err)
+	}
+
+	// Manifest sync
+	if m, err := s.GetLastAppliedManifest(); err != nil || m != nil {
+		t.Fatalf("GetLastAppliedManifest before any apply: %+v, %v", m, err)
+	}
+	s.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 102, ResourceName: "old", Node: "pve1", CreatedBy: "test"})
+	s.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 103, ResourceName: "gone", Node: "pve1", CreatedBy: "test"})
+	keep, _ := s.GetWhitelistByVMID(102)
+	gone, _ := s.GetWhitelistByVMID(103)
+	err = s.SyncWhitelist(&models.WhitelistSync{
+		Create:    []models.Whitelist{{VMID: 104, ResourceName: "new", Node: "pve2", CreatedBy: "manifest"}},
+		Update:    []models.Whitelist{{ID: keep.ID, ResourceName: "app", Node: "pve2", Enabled: true, RestartIntervalHours: 12}},
+		Delete:    []int64{gone.ID},
+		Manifest:  "whitelist: []",
+		Checksum:  "abc",
+		AppliedBy: "ci",
+	})
+	if err != nil {
+		t.Fatalf("SyncWhitelist: %v", err)
+	}
+	all, _ := s.GetAllWhitelist()
+	if len(all) != 2 || all[0].VMID != 102 || all[0].Node != "pve2" || all[0].ResourceName != "app" ||
+		all[0].RestartIntervalHours != 12 || all[1].VMID != 104 || all[1].Enabled || all[1].RestartIntervalHours != 6 {
+		t.Errorf("unexpected whitelist after sync: %+v", all)
+	}
+	m, err := s.GetLastAppliedManifest()
+	if err != nil || m == nil || m.Checksum != "abc" || m.AppliedBy != "ci" || m.Content != "whitelist: []" {
+		t.Errorf("GetLastAppliedManifest: %+v, %v", m, err)
+	}
+
+	// Users
+	if n, err := s.CountUsers(); err != nil || n != 0 {
+		t.Fatalf("CountUsers: %d, %v", n, err)
+	}
+	userID, err := s.CreateUser("alice", "hash1", "viewer", "local")
+	if err != nil || userID == 0 {
+		t.Fatalf("CreateUser: id %d, %v", userID, err)
+	}
+	if _, err := s.CreateUser("alice", "hash2", "admin", "local"); !IsUniqueViolation(err) {
+		t.Errorf("expected a unique violation for a duplicate username, got %v", err)
+	}
+	user, err := s.GetUserByUsername("alice")
+	if err != nil || user == nil || user.ID != userID || !user.Enabled || user.PasswordHash != "hash1" || user.Provider != "local" {
+		t.Fatalf("GetUserByUsername: %+v, %v", user, err)
+	}
+	user.PasswordHash, user.Role, user.Enabled = "hash3", "operator", false
+	if err := s.UpdateUser(user); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if user, _ = s.GetUserByID(userID); user.PasswordHash != "hash3" || user.Role != "operator" || user.Enabled {
+		t.Errorf("user not updated: %+v", user)
+	}
+	grantID, err := s.CreateUserGrant(userID, "node", "pve1")
+	if err != nil || grantID == 0 {
+		t.Fatalf("CreateUserGrant: id %d, %v", grantID, err)
+	}
+	if _, err := s.CreateUserGrant(userID, "node", "pve1"); !IsUniqueViolation(err) {
+		t.Errorf("expected a unique violation for a duplicate grant, got %v", err)
+	}
+	s.CreateUserGrant(userID, "vmid", "100-199")
+	grants, err := s.GetUserGrants(userID)
+	if err != nil || len(grants) != 2 || grants[0].Scope != "node" || grants[1].Value != "100-199" {
+		t.Fatalf("GetUserGrants: %+v, %v", grants, err)
+	}
+	if err := s.DeleteUserGrant(grantID); err != nil {
+		t.Fatalf("DeleteUserGrant: %v", err)
+	}
+	if grants, _ = s.GetUserGrants(userID); len(grants) != 1 {
+		t.Errorf("expected 1 grant after delete, got %+v", grants)
+	}
+
+	// API tokens
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	tokenID, err := s.CreateAPIToken(&models.APIToken{
+		UserID: userID, Name: "ci", Prefix: "par_abcd", TokenHash: "h1", Role: "viewer",
+		Scopes: []string{"node:pve1", "vmid:100-199"}, ExpiresAt: &expires,
+	})
+	if err != nil || tokenID == 0 {
+		t.Fatalf("CreateAPIToken: id %d, %v", tokenID, err)
+	}
+	if _, err := s.CreateAPIToken(&models.APIToken{UserID: userID, Name: "ci", Prefix: "par_efgh", TokenHash: "h2", Role: "viewer"}); !IsUniqueViolation(err) {
+		t.Errorf("expected a unique violation for a duplicate token name, got %v", err)
+	}
+	token, err := s.GetAPITokenByHash("h1")
+	if err != nil || token == nil || token.ID != tokenID || token.Username != "alice" || len(token.Scopes) != 2 ||
+		token.ExpiresAt == nil || !token.ExpiresAt.Equal(expires) || token.LastUsedAt != nil {
+		t.Fatalf("GetAPITokenByHash: %+v, %v", token, err)
+	}
+	if err := s.TouchAPIToken(tokenID, time.Now()); err != nil {
+		t.Fatalf("TouchAPIToken: %v", err)
+	}
+	if token, _ = s.GetAPITokenByID(tokenID); token.LastUsedAt == nil {
+		t.Errorf("last use not recorded: %+v", token)
+	}
+	if tokens, err := s.GetAPITokens(0); err != nil || len(tokens) != 1 {
+		t.Errorf("GetAPITokens: %+v, %v", tokens, err)
+	}
+	if token, err := s.GetAPITokenByHash("missing"); err != nil || token != nil {
+		t.Errorf("expected no token for an unknown hash, got %+v, %v", token, err)
+	}
+	s.CreateAPIToken(&models.APIToken{UserID: userID, Name: "deploy", Prefix: "par_ijkl", TokenHash: "h3", Role: "viewer"})
+	if err := s.DeleteAPIToken(tokenID); err != nil {
+		t.Fatalf("DeleteAPIToken: %v", err)
+	}
+	if tokens, _ := s.GetAPITokens(userID); len(tokens) != 1 || tokens[0].Name != "deploy" {
+		t.Errorf("expected only the deploy token after delete, got %+v", tokens)
+	}
+
+	// Sessions
+	sessionID, err := s.CreateSession(&models.Session{UserID: userID, TokenHash: "s1", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil || sessionID == 0 {
+		t.Fatalf("CreateSession: id %d, %v", sessionID, err)
+	}
+	s.CreateSession(&models.Session{UserID: userID, TokenHash: "s2", ExpiresAt: time.Now().Add(-time.Hour)})
+	s.CreateSession(&models.Session{UserID: userID, TokenHash: "s3", ExpiresAt: time.Now().Add(time.Hour)})
+	if sess, err := s.GetSessionByHash("s1"); err != nil || sess == nil || sess.UserID != userID || sess.ExpiresAt.Before(time.Now()) {
+		t.Fatalf("GetSessionByHash: %+v, %v", sess, err)
+	}
+	if n, err := s.DeleteExpiredSessions(time.Now()); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredSessions: %d, %v", n, err)
+	}
+	if err := s.DeleteSession(sessionID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if sess, err := s.GetSessionByHash("s1"); err != nil || sess != nil {
+		t.Errorf("expected no session after delete, got %+v, %v", sess, err)
+	}
+
+	// Terminal sessions
+	opened := time.Now().Add(-time.Hour).Truncate(time.Second)
+	first := &models.TerminalSession{UserID: userID, Username: "alice", VMID: 101, Node: "pve1", Type: "lxc",
+		Recording: "101-a.cast", StartedAt: opened}
+	if first.ID, err = s.CreateTerminalSession(first); err != nil || first.ID == 0 {
+		t.Fatalf("CreateTerminalSession: id %d, %v", first.ID, err)
+	}
+	s.CreateTerminalSession(&models.TerminalSession{UserID: userID, Username: "alice", VMID: 102, Node: "pve2",
+		Type: "qemu", Recording: "102-b.cast", StartedAt: opened.Add(time.Minute)})
+	ended := opened.Add(5 * time.Minute)
+	first.EndedAt, first.InputBytes, first.OutputBytes = &ended, 12, 3400
+	if err := s.FinishTerminalSession(first); err != nil {
+		t.Fatalf("FinishTerminalSession: %v", err)
+	}
+	if ts, err := s.GetTerminalSessionByID(first.ID); err != nil || ts == nil || ts.Username != "alice" ||
+		ts.Recording != "101-a.cast" || ts.EndedAt == nil || !ts.EndedAt.Equal(ended) || ts.OutputBytes != 3400 {
+		t.Fatalf("GetTerminalSessionByID: %+v, %v", ts, err)
+	}
+	if all, err := s.GetTerminalSessions(models.TerminalSessionFilter{}); err != nil || len(all) != 2 ||
+		all[0].VMID != 102 || all[0].EndedAt != nil {
+		t.Errorf("expected both sessions, newest first, got %+v, %v", all, err)
+	}
+	if scoped, _ := s.GetTerminalSessions(models.TerminalSessionFilter{
+		Scopes: []models.LogScope{{Nodes: []string{"pve1"}}},
+	}); len(scoped) != 1 || scoped[0].ID != first.ID {
+		t.Errorf("expected the pve1 session, got %+v", scoped)
+	}
+	if byVMID, _ := s.GetTerminalSessions(models.TerminalSessionFilter{VMID: 102, Username: "alice"}); len(byVMID) != 1 {
+		t.Errorf("expected the session on 102, got %+v", byVMID)
+	}
+
+	if err := s.DeleteUser(userID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if user, err := s.GetUserByUsername("alice"); err != nil || user != nil {
+		t.Errorf("expected no user after delete, got %+v, %v", user, err)
+	}
+	if grants, _ = s.GetUserGrants(userID); len(grants) != 0 {
+		t.Errorf("grants left behind: %+v", grants)
+	}
+	if token, _ := s.GetAPITokenByHash("h3"); token != nil {
+		t.Errorf("token left behind: %+v", token)
+	}
+	if sess, _ := s.GetSessionByHash("s3"); sess != nil {
+		t.Errorf("session left behind: %+v", sess)
+	}
+	if ts, _ := s.GetTerminalSessionByID(first.ID); ts == nil {
+		t.Error("expected terminal sessions to outlive their user")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{`SELECT COUNT(*) FROM whitelist`, `SELECT COUNT(*) FROM whitelist`},
+		{`SELECT id FROM whitelist WHERE vmid = ? AND node = ?`, `SELECT id FROM whitelist WHERE vmid = $1 AND node = $2`},
+		{"UPDATE whitelist SET a = ?, b = ?, c = ?, d = ?, e = ?,\n\tf = ?, g = ?, h = ?, i = ?, j = ? WHERE id = ?",
+			"UPDATE whitelist SET a = $1, b = $2, c = $3, d = $4, e = $5,\n\tf = $6, g = $7, h = $8, i = $9, j = $10 WHERE id = $11"},
+	}
+
+	sqlite := &Conn{Dialect: SQLite}
+	pg := &Conn{Dialect: Postgres}
+	for _, tt := range tests {
+		if got := sqlite.Rebind(tt.query); got != tt.query {
+			t.Errorf("SQLite query changed: %s", got)
+		}
+		if got := pg.Rebind(tt.query); got != tt.want {
+			t.Errorf("Rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestDialectFor(t *testing.T) {
+	tests := map[string]Dialect{
+		"./proxmox.db":                     SQLite,
+		":memory:":                         SQLite,
+		"postgres://app:secret@db/proxmox": Postgres,
+		"postgresql://app@db:5432/proxmox?sslmode=disable": Postgres,
+	}
+	for dsn, want := range tests {
+		if got := DialectFor(dsn); got != want {
+			t.Errorf("DialectFor(%q) = %s, want %s", dsn, got, want)
+		}
+	}
+
+	if got := RedactDSN("postgres://app:secret@db/proxmox"); strings.Contains(got, "secret") {
+		t.Errorf("password not redacted: %s", got)
+	}
+}
+
+// TestPostgresDDL checks that every migration is translated for PostgreSQL
+// and that no SQLite-only syntax survives
+func TestPostgresDDL(t *testing.T) {
+	script := `
+		CREATE TABLE example (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			enabled BOOLEAN DEFAULT 1,
+			quarantined BOOLEAN NOT NULL DEFAULT 0,
+			wait_healthy BOOLEAN NOT NULL DEFAULT 1,
+			threshold REAL NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`
+	want := `
+		CREATE TABLE example (
+			id BIGSERIAL PRIMARY KEY,
+			enabled BOOLEAN DEFAULT TRUE,
+			quarantined BOOLEAN NOT NULL DEFAULT FALSE,
+			wait_healthy BOOLEAN NOT NULL DEFAULT TRUE,
+			threshold DOUBLE PRECISION NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`
+	if got := ddl(Postgres, script); got != want {
+		t.Errorf("unexpected PostgreSQL DDL:\n%s", got)
+	}
+	if got := ddl(SQLite, script); got != script {
+		t.Errorf("SQLite DDL changed:\n%s", got)
+	}
+
+	sqliteOnly := map[string]*regexp.Regexp{
+		"AUTOINCREMENT":            regexp.MustCompile(`AUTOINCREMENT`),
+		"DATETIME":                 regexp.MustCompile(`\bDATETIME\b`),
+		"REAL":                     regexp.MustCompile(`\bREAL\b`),
+		"integer boolean defaults": regexp.MustCompile(`\bBOOLEAN( NOT NULL)? DEFAULT [01]\b`),
+		"rowid primary keys":       regexp.MustCompile(`\bid INTEGER PRIMARY KEY\b`),
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has version %d", i+1, m.Version)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %d is missing its up or down script", m.Version)
+		}
+		for _, script := range []string{m.Up, m.Down} {
+			out := ddl(Postgres, script)
+			for name, re := range sqliteOnly {
+				if re.MatchString(out) {
+					t.Errorf("migration %d still contains %s for PostgreSQL: %s", m.Version, name, re.FindString(out))
+				}
+			}
+		}
+	}
+}
@@ -4,47 +4,101 @@ import "time"
 
 // Resource represents a Proxmox VM or Container (real-time data from Proxmox API)
 type Resource struct {
-	VMID        int     `json:"vmid"`
-	Name        string  `json:"name"`
-	Type        string  `json:"type"` // "qemu" or "lxc"
-	Node        string  `json:"node"`
-	Status      string  `json:"status"`
-	Uptime      int64   `json:"uptime"`
-	CPUUsage    float64 `json:"cpu_usage"`
-	MemoryUsed  int64   `json:"memory_used"`
-	MemoryTotal int64   `json:"memory_total"`
-	DiskUsed    int64   `json:"disk_used"`
-	DiskTotal   int64   `json:"disk_total"`
+	VMID        int      `json:"vmid"`
+	Name        string   `json:"name"`
+	Type        string   `json:"type"` // "qemu" or "lxc"
+	Node        string   `json:"node"`
+	Status      string   `json:"status"`
+	Uptime      int64    `json:"uptime"`
+	CPUUsage    float64  `json:"cpu_usage"`
+	MemoryUsed  int64    `json:"memory_used"`
+	MemoryTotal int64    `json:"memory_total"`
+	DiskUsed    int64    `json:"disk_used"`
+	DiskTotal   int64    `json:"disk_total"`
+	Pool        string   `json:"pool,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
 // Whitelist represents a VM/Container configured for auto-restart
 type Whitelist struct {
-	ID                   int64     `json:"id"`
-	VMID                 int       `json:"vmid"`
-	ResourceName         string    `json:"resource_name"`
-	Node                 string    `json:"node"`
-	Enabled              bool      `json:"enabled"`
-	RestartIntervalHours int       `json:"restart_interval_hours"`
-	CreatedAt            time.Time `json:"created_at"`
-	CreatedBy            string    `json:"created_by"`
-	Notes                string    `json:"notes"`
+	ID                   int64      `json:"id"`
+	VMID                 int        `json:"vmid"`
+	ResourceName         string     `json:"resource_name"`
+	Node                 string     `json:"node"`
+	Enabled              bool       `json:"enabled"`
+	RestartIntervalHours int        `json:"restart_interval_hours"`
+	CronExpression       string     `json:"cron_expression,omitempty"`   // overrides restart_interval_hours when set
+	WindowStart          string     `json:"window_start,omitempty"`      // HH:MM, start of allowed restart window
+	WindowEnd            string     `json:"window_end,omitempty"`        // HH:MM, end of allowed restart window
+	Timezone             string     `json:"timezone,omitempty"`          // IANA name used for cron and window, default UTC
+	GroupID              int64      `json:"group_id,omitempty"`          // restart group, 0 when not grouped
+	GroupOrder           int        `json:"group_order,omitempty"`       // position in the group's rolling restart
+	RestartMode          string     `json:"restart_mode"`                // schedule (default) or watchdog
+	Quarantined          bool       `json:"quarantined"`                 // crash loop detected, restarts are backed off
+	QuarantineLevel      int        `json:"quarantine_level,omitempty"`  // consecutive quarantines, doubles the back-off
+	QuarantinedUntil     *time.Time `json:"quarantined_until,omitempty"` // no automatic restarts before this time
+	QuarantineReason     string     `json:"quarantine_reason,omitempty"`
+	FailuresResetAt      *time.Time `json:"-"` // failures before this time no longer count toward a crash loop
+	CreatedAt            time.Time  `json:"created_at"`
+	CreatedBy            string     `json:"created_by"`
+	Notes                string     `json:"notes"`
+}
+
+// RestartGroup is a set of whitelist entries restarted as a rolling sequence
+type RestartGroup struct {
+	ID            int64       `json:"id"`
+	Name          string      `json:"name"`
+	Description   string      `json:"description"`
+	WaitHealthy   bool        `json:"wait_healthy"`    // next member only starts once the previous one is verified
+	StopOnFailure bool        `json:"stop_on_failure"` // skip remaining members when one fails
+	CreatedAt     time.Time   `json:"created_at"`
+	Members       []Whitelist `json:"members,omitempty"`
+}
+
+// HealthCheck is a watchdog probe attached to a whitelist entry
+type HealthCheck struct {
+	ID                  int64      `json:"id"`
+	WhitelistID         int64      `json:"whitelist_id"`
+	VMID                int        `json:"vmid"`
+	ResourceName        string     `json:"resource_name"`
+	Node                string     `json:"node"`
+	Type                string     `json:"type"`                // http, tcp, exec, memory, cpu
+	Target              string     `json:"target,omitempty"`    // URL, host:port or command
+	Threshold           float64    `json:"threshold,omitempty"` // percent for memory and cpu checks
+	IntervalSeconds     int        `json:"interval_seconds"`
+	TimeoutSeconds      int        `json:"timeout_seconds"`
+	FailureThreshold    int        `json:"failure_threshold"` // consecutive failures before restarting
+	CooldownMinutes     int        `json:"cooldown_minutes"`  // minimum time between watchdog restarts
+	Enabled             bool       `json:"enabled"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastStatus          string     `json:"last_status,omitempty"` // ok or failing
+	LastResult          string     `json:"last_result,omitempty"`
+	LastCheckedAt       *time.Time `json:"last_checked_at,omitempty"`
+	LastTriggeredAt     *time.Time `json:"last_triggered_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
 }
 
 // RestartLog represents a restart operation audit log
 type RestartLog struct {
-	ID              int64      `json:"id"`
-	VMID            int        `json:"vmid"`
-	ResourceName    string     `json:"resource_name"`
-	Node            string     `json:"node"`
-	Action          string     `json:"action"`       // restart, stop, start
-	TriggerType     string     `json:"trigger_type"` // auto, manual
-	TriggeredBy     string     `json:"triggered_by"`
-	Status          string     `json:"status"` // success, failed, pending
-	ErrorMessage    string     `json:"error_message,omitempty"`
-	Output          string     `json:"output,omitempty"`
-	StartedAt       time.Time  `json:"started_at"`
-	CompletedAt     *time.Time `json:"completed_at,omitempty"`
-	DurationSeconds int64      `json:"duration_seconds,omitempty"`
+	ID                 int64      `json:"id"`
+	VMID               int        `json:"vmid"`
+	ResourceName       string     `json:"resource_name"`
+	Node               string     `json:"node"`
+	Action             string     `json:"action"`       // restart, stop, start
+	TriggerType        string     `json:"trigger_type"` // auto, manual, health
+	TriggeredBy        string     `json:"triggered_by"`
+	Status             string     `json:"status"` // success, failed, pending
+	ErrorMessage       string     `json:"error_message,omitempty"`
+	Output             string     `json:"output,omitempty"`
+	UPID               string     `json:"upid,omitempty"`        // Proxmox task ID
+	ExitStatus         string     `json:"exit_status,omitempty"` // task exit status, "OK" on success
+	TaskLog            string     `json:"task_log,omitempty"`
+	Verification       string     `json:"verification,omitempty"` // verified, unverified, failed_to_come_back, pending
+	VerificationDetail string     `json:"verification_detail,omitempty"`
+	ProbeResult        string     `json:"probe_result,omitempty"` // failed health check that triggered a watchdog restart
+	StartedAt          time.Time  `json:"started_at"`
+	CompletedAt        *time.Time `json:"completed_at,omitempty"`
+	DurationSeconds    int64      `json:"duration_seconds,omitempty"`
 }
 
 // CreateWhitelistRequest is the request body for adding a VM/Container to whitelist
@@ -52,21 +106,187 @@ type CreateWhitelistRequest struct {
 	VMID                 int    `json:"vmid"`
 	ResourceName         string `json:"resource_name"`
 	Node                 string `json:"node"`
-	CreatedBy            string `json:"created_by"`
+	CreatedBy            string `json:"-"` // set to the authenticated user
 	Notes                string `json:"notes"`
 	RestartIntervalHours int    `json:"restart_interval_hours"`
+	CronExpression       string `json:"cron_expression"`
+	WindowStart          string `json:"window_start"`
+	WindowEnd            string `json:"window_end"`
+	Timezone             string `json:"timezone"`
+	GroupID              int64  `json:"group_id"`
+	GroupOrder           int    `json:"group_order"`
+	RestartMode          string `json:"restart_mode"`
 }
 
-// UpdateWhitelistRequest is the request body for updating a whitelist entry
+// UpdateWhitelistRequest is the request body for updating a whitelist entry.
+// Omitted schedule, group and mode fields are left unchanged.
 type UpdateWhitelistRequest struct {
-	Enabled              bool   `json:"enabled"`
-	Notes                string `json:"notes"`
-	RestartIntervalHours int    `json:"restart_interval_hours"`
+	Enabled              bool    `json:"enabled"`
+	Notes                string  `json:"notes"`
+	RestartIntervalHours int     `json:"restart_interval_hours"`
+	CronExpression       *string `json:"cron_expression"`
+	WindowStart          *string `json:"window_start"`
+	WindowEnd            *string `json:"window_end"`
+	Timezone             *string `json:"timezone"`
+	GroupID              *int64  `json:"group_id"`
+	GroupOrder           *int    `json:"group_order"`
+	RestartMode          *string `json:"restart_mode"`
+}
+
+// WhitelistSync is a set of whitelist changes applied in one transaction,
+// together with the manifest they came from. Created and updated entries
+// carry every setting; quarantine state is left alone.
+type WhitelistSync struct {
+	Create []Whitelist
+	Update []Whitelist // matched by ID
+	Delete []int64
+
+	Manifest  string // manifest content, kept for drift reports
+	Checksum  string // sha256 of Manifest
+	AppliedBy string
+}
+
+// AppliedManifest is a whitelist manifest that was applied
+type AppliedManifest struct {
+	ID        int64     `json:"id"`
+	Content   string    `json:"-"`
+	Checksum  string    `json:"checksum"`
+	AppliedBy string    `json:"applied_by"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// RestartGroupRequest is the request body for creating or updating a restart group
+type RestartGroupRequest struct {
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	WaitHealthy   *bool  `json:"wait_healthy"`    // default true
+	StopOnFailure *bool  `json:"stop_on_failure"` // default true
+}
+
+// HealthCheckRequest is the request body for creating or updating a health check
+type HealthCheckRequest struct {
+	WhitelistID      int64   `json:"whitelist_id"`
+	Type             string  `json:"type"`
+	Target           string  `json:"target"`
+	Threshold        float64 `json:"threshold"`
+	IntervalSeconds  int     `json:"interval_seconds"`  // default 60
+	TimeoutSeconds   int     `json:"timeout_seconds"`   // default 10
+	FailureThreshold int     `json:"failure_threshold"` // default 3
+	CooldownMinutes  int     `json:"cooldown_minutes"`  // default 30
+	Enabled          *bool   `json:"enabled"`           // default true
+}
+
+// User is an account that can sign in to the API
+type User struct {
+	ID           int64       `json:"id"`
+	Username     string      `json:"username"`
+	PasswordHash string      `json:"-"`
+	Role         string      `json:"role"`     // viewer, operator or admin
+	Provider     string      `json:"provider"` // local for password accounts, or the identity provider
+	Enabled      bool        `json:"enabled"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UpdatedAt    time.Time   `json:"updated_at"`
+	Grants       []UserGrant `json:"grants,omitempty"`
+}
+
+// UserGrant limits an account to some guests. An account with grants can
+// only see and act on guests matching at least one of them.
+type UserGrant struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Scope     string    `json:"scope"` // node, vmid, pool or tag
+	Value     string    `json:"value"` // node name, VMID or VMID range like 100-199, pool or tag
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Session is a browser sign-in through an identity provider, sent as a
+// cookie. Only a hash of the secret is stored.
+type Session struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	TokenHash string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
-// ResourceActionRequest is the request body for resource actions
-type ResourceActionRequest struct {
-	TriggeredBy string `json:"triggered_by"`
+// TerminalSession is a web terminal opened on a guest. What was typed and
+// shown is recorded in an asciicast file.
+type TerminalSession struct {
+	ID          int64      `json:"id"`
+	UserID      int64      `json:"user_id"`
+	Username    string     `json:"username"`
+	VMID        int        `json:"vmid"`
+	Node        string     `json:"node"`
+	Type        string     `json:"type"`
+	Recording   string     `json:"recording"` // file name in the recording directory
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at"` // nil while open, or if the service stopped first
+	InputBytes  int64      `json:"input_bytes"`
+	OutputBytes int64      `json:"output_bytes"`
+}
+
+// TerminalSessionFilter selects terminal sessions, newest first
+type TerminalSessionFilter struct {
+	Username  string
+	VMID      int
+	Node      string
+	StartDate *time.Time
+	EndDate   *time.Time
+	Scopes    []LogScope // sessions must match every scope; none means every guest
+	Limit     int
+	Offset    int
+}
+
+// APIToken is a bearer token that acts for its owner, limited to a role and
+// optionally to guest scopes. Only a hash of the secret is stored.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Username   string     `json:"username"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // start of the secret, to recognise it
+	TokenHash  string     `json:"-"`
+	Role       string     `json:"role"`
+	Scopes     []string   `json:"scopes"` // like node:pve1 or pool:team-a; empty means the owner's guests
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateAPITokenRequest is the request body for creating an API token
+type CreateAPITokenRequest struct {
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`       // default the owner's role
+	Scopes    []string   `json:"scopes"`     // like vmid:100-199
+	ExpiresAt *time.Time `json:"expires_at"` // omit for a token that does not expire
+}
+
+// CreateTerminalTicketRequest is the request body for a terminal ticket
+type CreateTerminalTicketRequest struct {
+	VMID int    `json:"vmid"`
+	Node string `json:"node"`
+	Type string `json:"type"` // "lxc" or "qemu", default qemu
+}
+
+// UserGrantRequest is the request body for adding a grant to a user
+type UserGrantRequest struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+}
+
+// CreateUserRequest is the request body for creating a user
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"` // default viewer
+}
+
+// UpdateUserRequest is the request body for updating a user. Omitted fields
+// are left unchanged.
+type UpdateUserRequest struct {
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	Enabled  *bool  `json:"enabled"`
 }
 
 // SystemStatus represents the overall system status
@@ -77,6 +297,8 @@ type SystemStatus struct {
 	NextRestartTime  time.Time `json:"next_restart_time"`
 	TotalRestarts    int64     `json:"total_restarts"`
 	FailedRestarts   int64     `json:"failed_restarts"`
+	QueuedRestarts   int       `json:"queued_restarts"`
+	RunningRestarts  int       `json:"running_restarts"`
 }
 
 // LogsFilter represents filtering options for logs
@@ -89,10 +311,38 @@ type LogsFilter struct {
 	Status       string
 	StartDate    *time.Time
 	EndDate      *time.Time
+	Scopes       []LogScope // logs must match every scope; none means every guest
 	Limit        int
 	Offset       int
 }
 
+// LogScope restricts logs to guests on one of Nodes, in one of VMIDRanges
+// (inclusive) or listed in VMIDs
+type LogScope struct {
+	Nodes      []string
+	VMIDRanges [][2]int
+	VMIDs      []int
+}
+
+// LogRetention selects finished restart logs that may be pruned. A log
+// matches when it started before its status's cutoff in StatusBefore, or
+// before Before if its status has none, or when it is not among the newest
+// KeepPerVMID logs of its guest. Zero values disable a rule.
+type LogRetention struct {
+	Before       time.Time
+	StatusBefore map[string]time.Time
+	KeepPerVMID  int
+}
+
+// LogTableStats describes the size of the restart_logs table
+type LogTableStats struct {
+	Rows         int64            `json:"rows"`
+	PayloadBytes int64            `json:"payload_bytes"` // output and task_log text
+	ByStatus     map[string]int64 `json:"by_status"`
+	Oldest       *time.Time       `json:"oldest,omitempty"`
+	Newest       *time.Time       `json:"newest,omitempty"`
+}
+
 // ContainerService represents a service installed on a container
 type ContainerService struct {
 	ID              int64     `json:"id"`
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alert is posted as JSON to the configured webhook
+type Alert struct {
+	Event        string    `json:"event"` // e.g. "crash_loop"
+	VMID         int       `json:"vmid"`
+	ResourceName string    `json:"resource_name"`
+	Node         string    `json:"node"`
+	Message      string    `json:"message"`
+	Time         time.Time `json:"time"`
+}
+
+var (
+	mu         sync.RWMutex
+	webhookURL string
+	client     = &http.Client{Timeout: 10 * time.Second}
+)
+
+// SetWebhookURL sets where alerts are posted; an empty URL only logs them
+func SetWebhookURL(url string) {
+	mu.Lock()
+	defer mu.Unlock()
+	webhookURL = url
+}
+
+// Send logs an alert and posts it to the webhook, if one is configured
+func Send(alert Alert) error {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+	log.Printf("ALERT: [%s] %d (%s): %s", alert.Event, alert.VMID, alert.ResourceName, alert.Message)
+
+	mu.RLock()
+	url := webhookURL
+	mu.RUnlock()
+	if url == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send alert: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to send alert: webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendPostsAlert(t *testing.T) {
+	var got Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	SetWebhookURL(srv.URL)
+	t.Cleanup(func() { SetWebhookURL("") })
+
+	if err := Send(Alert{Event: "crash_loop", VMID: 101, Message: "3 failures"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got.Event != "crash_loop" || got.VMID != 101 || got.Time.IsZero() {
+		t.Errorf("unexpected alert %+v", got)
+	}
+}
+
+func TestSendWebhookError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	SetWebhookURL(srv.URL)
+	t.Cleanup(func() { SetWebhookURL("") })
+
+	if err := Send(Alert{Event: "crash_loop"}); err == nil {
+		t.Error("expected an error for a failing webhook")
+	}
+}
+
+func TestSendWithoutWebhook(t *testing.T) {
+	SetWebhookURL("")
+	if err := Send(Alert{Event: "crash_loop"}); err != nil {
+		t.Errorf("Send without webhook: %v", err)
+	}
+}
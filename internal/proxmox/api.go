@@ -0,0 +1,257 @@
+package proxmox
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// APIBackend talks to the Proxmox VE HTTPS API (/api2/json) using an API token.
+// It lets the service run on a management host instead of a PVE node.
+type APIBackend struct {
+	baseURL     string
+	tokenID     string // user@realm!tokenname
+	tokenSecret string
+	client      *http.Client
+
+	// taskTimeout bounds how long clone/destroy tasks may run
+	taskTimeout time.Duration
+}
+
+// NewAPIBackend creates a backend for the given PVE host, e.g. https://pve.example.com:8006
+func NewAPIBackend(baseURL, tokenID, tokenSecret string, insecureSkipVerify bool) *APIBackend {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecureSkipVerify {
+		// Proxmox ships with a self-signed certificate by default
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &APIBackend{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		tokenID:     tokenID,
+		tokenSecret: tokenSecret,
+		client:      &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		taskTimeout: 10 * time.Minute,
+	}
+}
+
+// Name returns the backend identifier
+func (b *APIBackend) Name() string {
+	return "api"
+}
+
+// IsAvailable checks that the API is reachable and the token is accepted
+func (b *APIBackend) IsAvailable() bool {
+	var version map[string]interface{}
+	return b.do(http.MethodGet, "/version", nil, &version) == nil
+}
+
+// do performs an API request and decodes the "data" envelope into out
+func (b *APIBackend) do(method, path string, params url.Values, out interface{}) error {
+	endpoint := b.baseURL + "/api2/json" + path
+
+	var body io.Reader
+	if params != nil {
+		if method == http.MethodGet || method == http.MethodDelete {
+			endpoint += "?" + params.Encode()
+		} else {
+			body = strings.NewReader(params.Encode())
+		}
+	}
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s=%s", b.tokenID, b.tokenSecret))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// PVE puts the error reason in the status line and details in the body
+		return fmt.Errorf("%s %s: %s, output: %s", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	envelope := struct {
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(respBody, &envelope); err != nil {
+		return fmt.Errorf("failed to parse JSON response: %w", err)
+	}
+	if err := json.Unmarshal(envelope.Data, out); err != nil {
+		return fmt.Errorf("failed to parse JSON response: %w", err)
+	}
+
+	return nil
+}
+
+// GetAllResources fetches all VMs and Containers from Proxmox
+func (b *APIBackend) GetAllResources() ([]models.Resource, error) {
+	var proxmoxResources []ProxmoxResource
+	params := url.Values{"type": {"vm"}}
+	if err := b.do(http.MethodGet, "/cluster/resources", params, &proxmoxResources); err != nil {
+		return nil, err
+	}
+
+	return toResources(proxmoxResources), nil
+}
+
+// RestartResource restarts a VM or Container and returns the task UPID
+func (b *APIBackend) RestartResource(node string, vmid int, resourceType string) (string, error) {
+	upid, err := b.statusAction(node, vmid, resourceType, "reboot")
+	if err != nil {
+		return upid, fmt.Errorf("failed to restart resource: %w", err)
+	}
+	return upid, nil
+}
+
+// StopResource stops a VM or Container and returns the task UPID
+func (b *APIBackend) StopResource(node string, vmid int, resourceType string) (string, error) {
+	upid, err := b.statusAction(node, vmid, resourceType, "stop")
+	if err != nil {
+		return upid, fmt.Errorf("failed to stop resource: %w", err)
+	}
+	return upid, nil
+}
+
+// StartResource starts a VM or Container and returns the task UPID
+func (b *APIBackend) StartResource(node string, vmid int, resourceType string) (string, error) {
+	upid, err := b.statusAction(node, vmid, resourceType, "start")
+	if err != nil {
+		// Match the shell backend: starting a running guest is not an error
+		if strings.Contains(err.Error(), "already running") {
+			return "", nil
+		}
+		return upid, fmt.Errorf("failed to start resource: %w", err)
+	}
+	return upid, nil
+}
+
+func (b *APIBackend) statusAction(node string, vmid int, resourceType, action string) (string, error) {
+	path, err := resourcePath(node, vmid, resourceType, "status/"+action)
+	if err != nil {
+		return "", err
+	}
+
+	var upid string
+	if err := b.do(http.MethodPost, path, url.Values{}, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// CloneContainer clones a container to a new VMID and waits for the clone task
+func (b *APIBackend) CloneContainer(sourceVMID, newVMID int, targetNode, hostname string) error {
+	// The clone endpoint lives on the node that owns the source container
+	sourceNode, err := b.findNode(sourceVMID)
+	if err != nil {
+		return fmt.Errorf("failed to clone container: %w", err)
+	}
+
+	params := url.Values{
+		"newid":  {strconv.Itoa(newVMID)},
+		"target": {targetNode},
+	}
+	if hostname != "" {
+		params.Set("hostname", hostname)
+	}
+
+	var upid string
+	path := fmt.Sprintf("/nodes/%s/lxc/%d/clone", sourceNode, sourceVMID)
+	if err := b.do(http.MethodPost, path, params, &upid); err != nil {
+		return fmt.Errorf("failed to clone container: %w", err)
+	}
+
+	if err := finishTask(b, upid, b.taskTimeout); err != nil {
+		return fmt.Errorf("failed to clone container: %w", err)
+	}
+	return nil
+}
+
+// DeleteContainer destroys a container and waits for the destroy task
+func (b *APIBackend) DeleteContainer(vmid int, node string) error {
+	var upid string
+	path := fmt.Sprintf("/nodes/%s/lxc/%d", node, vmid)
+	if err := b.do(http.MethodDelete, path, url.Values{"purge": {"1"}}, &upid); err != nil {
+		return fmt.Errorf("failed to delete container: %w", err)
+	}
+
+	if err := finishTask(b, upid, b.taskTimeout); err != nil {
+		return fmt.Errorf("failed to delete container: %w", err)
+	}
+	return nil
+}
+
+// ExecuteInContainer is not available: the PVE API has no equivalent of pct exec
+func (b *APIBackend) ExecuteInContainer(vmid int, command string, timeout time.Duration) error {
+	return fmt.Errorf("failed to execute command in container %d: %w", vmid, ErrNotSupported)
+}
+
+// AgentPing pings the QEMU guest agent
+func (b *APIBackend) AgentPing(node string, vmid int) error {
+	path := fmt.Sprintf("/nodes/%s/qemu/%d/agent/ping", node, vmid)
+	if err := b.do(http.MethodPost, path, url.Values{}, nil); err != nil {
+		return fmt.Errorf("guest agent ping failed: %w", err)
+	}
+	return nil
+}
+
+// findNode returns the node currently hosting a guest
+func (b *APIBackend) findNode(vmid int) (string, error) {
+	resources, err := b.GetAllResources()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range resources {
+		if r.VMID == vmid {
+			return r.Node, nil
+		}
+	}
+	return "", fmt.Errorf("resource %d not found", vmid)
+}
+
+// GetTaskStatus reads a task's status
+func (b *APIBackend) GetTaskStatus(node, upid string) (*TaskStatus, error) {
+	var status TaskStatus
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid))
+	if err := b.do(http.MethodGet, path, nil, &status); err != nil {
+		return nil, err
+	}
+	status.UPID = upid
+	return &status, nil
+}
+
+// GetTaskLog reads a task's log
+func (b *APIBackend) GetTaskLog(node, upid string) (string, error) {
+	var lines []taskLogLine
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/log", node, url.PathEscape(upid))
+	params := url.Values{"limit": {strconv.Itoa(taskLogLimit)}}
+	if err := b.do(http.MethodGet, path, params, &lines); err != nil {
+		return "", err
+	}
+	return joinTaskLog(lines), nil
+}
@@ -0,0 +1,117 @@
+package proxmox
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAPIBackend(t *testing.T, handler http.HandlerFunc) *APIBackend {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	previous := TaskPollInterval
+	TaskPollInterval = time.Millisecond
+	t.Cleanup(func() { TaskPollInterval = previous })
+	return NewAPIBackend(srv.URL, "svc@pve!auto", "secret", false)
+}
+
+func TestAPIBackendGetAllResources(t *testing.T) {
+	b := newTestAPIBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "PVEAPIToken=svc@pve!auto=secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if r.URL.Path != "/api2/json/cluster/resources" || r.URL.Query().Get("type") != "vm" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		fmt.Fprint(w, `{"data":[{"vmid":101,"name":"db","type":"lxc","node":"pve1","status":"running","uptime":42,"maxmem":1024,"pool":"team-a","tags":"db;prod"}]}`)
+	})
+
+	resources, err := b.GetAllResources()
+	if err != nil {
+		t.Fatalf("GetAllResources: %v", err)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("expected 1 resource, got %d", len(resources))
+	}
+	if r := resources[0]; r.VMID != 101 || r.Node != "pve1" || r.Uptime != 42 || r.MemoryTotal != 1024 {
+		t.Errorf("unexpected resource %+v", r)
+	}
+	if r := resources[0]; r.Pool != "team-a" || len(r.Tags) != 2 || r.Tags[0] != "db" || r.Tags[1] != "prod" {
+		t.Errorf("unexpected pool %q or tags %q", r.Pool, r.Tags)
+	}
+}
+
+func TestAPIBackendRestartReturnsUPID(t *testing.T) {
+	const upid = "UPID:pve1:0000AAAA:00000000:65000000:qmreboot:200:svc@pve!auto:"
+	b := newTestAPIBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api2/json/nodes/pve1/qemu/200/status/reboot" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		fmt.Fprintf(w, `{"data":%q}`, upid)
+	})
+
+	got, err := b.RestartResource("pve1", 200, "qemu")
+	if err != nil {
+		t.Fatalf("RestartResource: %v", err)
+	}
+	if got != upid {
+		t.Errorf("got %q, want %q", got, upid)
+	}
+
+	if _, err := b.RestartResource("pve1", 200, "openvz"); err == nil {
+		t.Error("expected error for unknown resource type")
+	}
+}
+
+func TestAPIBackendErrorStatus(t *testing.T) {
+	b := newTestAPIBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"data":null}`, http.StatusForbidden)
+	})
+
+	_, err := b.StopResource("pve1", 100, "lxc")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected 403 error, got %v", err)
+	}
+	if b.IsAvailable() {
+		t.Error("backend should not be available when the token is rejected")
+	}
+}
+
+func TestAPIBackendCloneWaitsForTask(t *testing.T) {
+	polls := 0
+	b := newTestAPIBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api2/json/cluster/resources":
+			fmt.Fprint(w, `{"data":[{"vmid":100,"type":"lxc","node":"pve1","status":"stopped"}]}`)
+		case r.URL.Path == "/api2/json/nodes/pve1/lxc/100/clone":
+			r.ParseForm()
+			if r.Form.Get("newid") != "101" || r.Form.Get("target") != "pve2" || r.Form.Get("hostname") != "n1" {
+				t.Errorf("unexpected clone form %v", r.Form)
+			}
+			fmt.Fprint(w, `{"data":"UPID:pve1:1:0:0:vzclone:100:svc@pve!auto:"}`)
+		case strings.HasPrefix(r.URL.Path, "/api2/json/nodes/pve1/tasks/") && strings.HasSuffix(r.URL.Path, "/log"):
+			fmt.Fprint(w, `{"data":[{"n":1,"t":"TASK OK"}]}`)
+		case strings.HasPrefix(r.URL.Path, "/api2/json/nodes/pve1/tasks/"):
+			polls++
+			if polls < 3 {
+				fmt.Fprint(w, `{"data":{"status":"running"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	})
+
+	if err := b.CloneContainer(100, 101, "pve2", "n1"); err != nil {
+		t.Fatalf("CloneContainer: %v", err)
+	}
+	if polls != 3 {
+		t.Errorf("expected 3 task polls, got %d", polls)
+	}
+}
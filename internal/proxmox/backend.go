@@ -0,0 +1,247 @@
+package proxmox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// ErrNotSupported is returned when a backend cannot perform an operation
+var ErrNotSupported = errors.New("operation not supported by this Proxmox backend")
+
+// Backend is the set of Proxmox operations used by the service
+type Backend interface {
+	// Name returns a short identifier for logs and health output
+	Name() string
+	// IsAvailable reports whether the backend can currently reach Proxmox
+	IsAvailable() bool
+
+	GetAllResources() ([]models.Resource, error)
+	RestartResource(node string, vmid int, resourceType string) (string, error)
+	StopResource(node string, vmid int, resourceType string) (string, error)
+	StartResource(node string, vmid int, resourceType string) (string, error)
+	CloneContainer(sourceVMID, newVMID int, targetNode, hostname string) error
+	DeleteContainer(vmid int, node string) error
+	// ExecuteInContainer runs command inside a container, killing it after
+	// timeout; 0 means no limit
+	ExecuteInContainer(vmid int, command string, timeout time.Duration) error
+	// AgentPing checks that the QEMU guest agent inside a VM responds
+	AgentPing(node string, vmid int) error
+
+	// GetTaskStatus returns the current state of a task started on node
+	GetTaskStatus(node, upid string) (*TaskStatus, error)
+	// GetTaskLog returns the task's log output, one line per entry
+	GetTaskLog(node, upid string) (string, error)
+}
+
+var (
+	_ Backend = (*ShellBackend)(nil)
+	_ Backend = (*APIBackend)(nil)
+	_ Backend = (*FakeBackend)(nil)
+)
+
+var backend Backend = NewShellBackend()
+
+// SetBackend replaces the backend used by the package-level functions
+func SetBackend(b Backend) {
+	backend = b
+}
+
+// GetBackend returns the backend used by the package-level functions
+func GetBackend() Backend {
+	return backend
+}
+
+// BackendConfig selects and configures a backend
+type BackendConfig struct {
+	// Type is "shell" (local pvesh/pct, the default) or "api"
+	Type        string
+	APIURL      string
+	TokenID     string
+	TokenSecret string
+	// Insecure skips TLS verification of the API's certificate
+	Insecure bool
+}
+
+// NewBackend builds the backend described by cfg
+func NewBackend(cfg BackendConfig) (Backend, error) {
+	switch kind := strings.ToLower(cfg.Type); kind {
+	case "", "shell":
+		return NewShellBackend(), nil
+	case "api":
+		if cfg.APIURL == "" || cfg.TokenID == "" || cfg.TokenSecret == "" {
+			return nil, fmt.Errorf("an API URL, token ID and token secret are required for the api backend")
+		}
+		return NewAPIBackend(cfg.APIURL, cfg.TokenID, cfg.TokenSecret, cfg.Insecure), nil
+	default:
+		return nil, fmt.Errorf("unknown backend type: %s", kind)
+	}
+}
+
+// IsProxmoxInstalled checks if the configured backend can reach Proxmox
+func IsProxmoxInstalled() bool {
+	return backend.IsAvailable()
+}
+
+// GetAllResources fetches all VMs and Containers from Proxmox
+func GetAllResources() ([]models.Resource, error) {
+	return backend.GetAllResources()
+}
+
+// GetResource fetches a specific VM or Container by VMID and node
+func GetResource(node string, vmid int) (*models.Resource, error) {
+	// Get all resources and filter
+	resources, err := GetAllResources()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range resources {
+		if r.VMID == vmid && r.Node == node {
+			return &r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("resource %d not found on node %s", vmid, node)
+}
+
+// RestartResource restarts a VM or Container
+func RestartResource(node string, vmid int, resourceType string) (string, error) {
+	return backend.RestartResource(node, vmid, resourceType)
+}
+
+// StopResource stops a VM or Container
+func StopResource(node string, vmid int, resourceType string) (string, error) {
+	return backend.StopResource(node, vmid, resourceType)
+}
+
+// StartResource starts a VM or Container
+func StartResource(node string, vmid int, resourceType string) (string, error) {
+	return backend.StartResource(node, vmid, resourceType)
+}
+
+// CloneContainer clones a container to a new VMID
+func CloneContainer(sourceVMID, newVMID int, targetNode, hostname string) error {
+	return backend.CloneContainer(sourceVMID, newVMID, targetNode, hostname)
+}
+
+// stopTimeout bounds how long DeleteContainer waits for a container to stop
+var stopTimeout = 5 * time.Minute
+
+// DeleteContainer stops a container if it is running, then deletes it
+func DeleteContainer(vmid int, node string) error {
+	resource, err := GetResource(node, vmid)
+	if err == nil && resource.Status == "running" {
+		output, err := StopResource(node, vmid, resource.Type)
+		if err != nil {
+			return fmt.Errorf("failed to stop container before deleting it: %w", err)
+		}
+		if upid := ExtractUPID(output); upid != "" {
+			if err := finishTask(backend, upid, stopTimeout); err != nil {
+				return fmt.Errorf("failed to stop container before deleting it: %w", err)
+			}
+		}
+	}
+
+	return backend.DeleteContainer(vmid, node)
+}
+
+// ExecuteInContainer executes a command inside a container, giving up
+// after timeout; 0 means no limit
+func ExecuteInContainer(vmid int, command string, timeout time.Duration) error {
+	return backend.ExecuteInContainer(vmid, command, timeout)
+}
+
+// ProbeGuest checks that the OS inside a guest is alive: a guest-agent ping
+// for VMs and a no-op command via pct exec for containers
+func ProbeGuest(node string, vmid int, resourceType string) error {
+	if resourceType == "qemu" {
+		return backend.AgentPing(node, vmid)
+	}
+	return backend.ExecuteInContainer(vmid, "true", 0)
+}
+
+// DeployBlockchainNode orchestrates the full deployment: clone → start → exec commands
+func DeployBlockchainNode(sourceVMID, newVMID int, targetNode, hostname string, commands []string) error {
+	// Step 1: Clone the container
+	if err := CloneContainer(sourceVMID, newVMID, targetNode, hostname); err != nil {
+		return fmt.Errorf("clone failed: %w", err)
+	}
+
+	// Step 2: Start the container
+	if _, err := StartResource(targetNode, newVMID, "lxc"); err != nil {
+		return fmt.Errorf("start failed: %w", err)
+	}
+
+	// Step 3: Execute base setup commands (always run these first)
+	baseSetupCommands := []string{
+		"apt-get update && apt-get install -y locales",
+		"locale-gen en_US.UTF-8",
+		"update-locale LANG=en_US.UTF-8",
+		"apt-get update && apt-get install -y curl wget",
+	}
+
+	for i, cmd := range baseSetupCommands {
+		if err := ExecuteInContainer(newVMID, cmd, 0); err != nil {
+			return fmt.Errorf("base setup command %d failed: %w", i+1, err)
+		}
+	}
+
+	// Step 4: Execute user-provided commands
+	for i, cmd := range commands {
+		if err := ExecuteInContainer(newVMID, cmd, 0); err != nil {
+			return fmt.Errorf("command %d failed: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// resourcePath builds the API path for a guest action, e.g. /nodes/pve/lxc/100/status/reboot
+func resourcePath(node string, vmid int, resourceType, suffix string) (string, error) {
+	if resourceType != "lxc" && resourceType != "qemu" {
+		return "", fmt.Errorf("unknown resource type: %s", resourceType)
+	}
+	return fmt.Sprintf("/nodes/%s/%s/%d/%s", node, resourceType, vmid, suffix), nil
+}
+
+// toResources converts cluster resources into the service's resource model
+func toResources(proxmoxResources []ProxmoxResource) []models.Resource {
+	resources := make([]models.Resource, 0, len(proxmoxResources))
+	for _, pr := range proxmoxResources {
+		vmidInt, err := pr.VMID.Int64()
+		if err != nil {
+			continue // Skip invalid VMID
+		}
+
+		resource := models.Resource{
+			VMID:        int(vmidInt),
+			Name:        pr.Name,
+			Type:        pr.Type,
+			Node:        pr.Node,
+			Status:      pr.Status,
+			Uptime:      pr.Uptime,
+			CPUUsage:    pr.CPU,
+			MemoryUsed:  pr.Mem,
+			MemoryTotal: pr.MaxMem,
+			DiskUsed:    pr.Disk,
+			DiskTotal:   pr.MaxDisk,
+			Pool:        pr.Pool,
+			Tags:        splitTags(pr.Tags),
+		}
+		resources = append(resources, resource)
+	}
+
+	return resources
+}
+
+// splitTags splits a guest's tag list. Proxmox separates tags with
+// semicolons but also accepts commas and spaces.
+func splitTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+}
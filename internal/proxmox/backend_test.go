@@ -0,0 +1,125 @@
+package proxmox
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+func useFakeBackend(t *testing.T) *FakeBackend {
+	t.Helper()
+	fake := NewFakeBackend("pve1", "pve2")
+	fake.AddGuest(models.Resource{VMID: 100, Name: "template", Type: "lxc", Node: "pve1", Status: "stopped"})
+	fake.AddGuest(models.Resource{VMID: 200, Name: "web", Type: "qemu", Node: "pve1", Status: "running", Uptime: 3600})
+
+	previous := GetBackend()
+	SetBackend(fake)
+	t.Cleanup(func() { SetBackend(previous) })
+	return fake
+}
+
+func TestGetResource(t *testing.T) {
+	useFakeBackend(t)
+
+	r, err := GetResource("pve1", 200)
+	if err != nil {
+		t.Fatalf("GetResource: %v", err)
+	}
+	if r.Name != "web" || r.Type != "qemu" {
+		t.Errorf("got %+v, want web/qemu", r)
+	}
+
+	if _, err := GetResource("pve2", 200); err == nil {
+		t.Error("expected error for guest on wrong node")
+	}
+}
+
+func TestDeployBlockchainNode(t *testing.T) {
+	fake := useFakeBackend(t)
+
+	commands := []string{"curl -sL https://example.com/growblockchain | bash"}
+	if err := DeployBlockchainNode(100, 101, "pve2", "node-1", commands); err != nil {
+		t.Fatalf("DeployBlockchainNode: %v", err)
+	}
+
+	g, ok := fake.Guest(101)
+	if !ok {
+		t.Fatal("expected cloned guest 101")
+	}
+	if g.Node != "pve2" || g.Name != "node-1" || g.Status != "running" {
+		t.Errorf("unexpected clone state: %+v", g)
+	}
+
+	executed := fake.Executed(101)
+	if len(executed) != 5 {
+		t.Fatalf("expected 4 base commands plus 1 user command, got %d", len(executed))
+	}
+	if executed[4] != commands[0] {
+		t.Errorf("last command = %q, want %q", executed[4], commands[0])
+	}
+}
+
+func TestDeployBlockchainNodeCommandFailure(t *testing.T) {
+	fake := useFakeBackend(t)
+	fake.InjectFailure(OpExecuteInContainer, 101, errors.New("exit status 1"))
+
+	err := DeployBlockchainNode(100, 101, "pve1", "", []string{"true"})
+	if err == nil {
+		t.Fatal("expected deploy to fail")
+	}
+	if fake.CallCount(OpExecuteInContainer) != 1 {
+		t.Errorf("deploy should stop at the first failing command, got %d exec calls", fake.CallCount(OpExecuteInContainer))
+	}
+}
+
+func TestDeleteContainerStopsRunningGuest(t *testing.T) {
+	fake := useFakeBackend(t)
+	fake.AddGuest(models.Resource{VMID: 150, Name: "old", Type: "lxc", Node: "pve1", Status: "running"})
+
+	if err := DeleteContainer(150, "pve1"); err != nil {
+		t.Fatalf("DeleteContainer: %v", err)
+	}
+	if _, ok := fake.Guest(150); ok {
+		t.Error("guest 150 should be gone")
+	}
+	if fake.CallCount(OpStopResource) != 1 {
+		t.Errorf("expected running container to be stopped before destroy")
+	}
+}
+
+func TestDeleteContainerStopFailure(t *testing.T) {
+	fake := useFakeBackend(t)
+	TaskPollInterval = time.Millisecond
+	fake.AddGuest(models.Resource{VMID: 150, Name: "old", Type: "lxc", Node: "pve1", Status: "running"})
+	fake.InjectTaskFailure(150, "command 'pct shutdown' failed: got timeout")
+
+	err := DeleteContainer(150, "pve1")
+	if err == nil || !strings.Contains(err.Error(), "got timeout") {
+		t.Fatalf("expected the failed stop task to be reported, got %v", err)
+	}
+	if fake.CallCount(OpDeleteContainer) != 0 {
+		t.Error("container should not be deleted after its stop task failed")
+	}
+}
+
+func TestFakeRestartRequiresRunningGuest(t *testing.T) {
+	fake := useFakeBackend(t)
+
+	if _, err := RestartResource("pve1", 100, "lxc"); err == nil {
+		t.Error("expected restart of stopped container to fail")
+	}
+
+	upid, err := RestartResource("pve1", 200, "qemu")
+	if err != nil {
+		t.Fatalf("RestartResource: %v", err)
+	}
+	if upid == "" {
+		t.Error("expected a task UPID")
+	}
+	if g, _ := fake.Guest(200); g.Uptime != 0 {
+		t.Errorf("uptime should reset after reboot, got %d", g.Uptime)
+	}
+}
@@ -0,0 +1,467 @@
+package proxmox
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// Operation names used by FakeBackend for call recording and failure injection
+const (
+	OpGetAllResources    = "GetAllResources"
+	OpRestartResource    = "RestartResource"
+	OpStopResource       = "StopResource"
+	OpStartResource      = "StartResource"
+	OpCloneContainer     = "CloneContainer"
+	OpDeleteContainer    = "DeleteContainer"
+	OpExecuteInContainer = "ExecuteInContainer"
+	OpGetTaskStatus      = "GetTaskStatus"
+	OpAgentPing          = "AgentPing"
+)
+
+// FakeCall records a single call made against a FakeBackend
+type FakeCall struct {
+	Op   string
+	Node string
+	VMID int
+}
+
+// fakeTask is a task started by a FakeBackend action
+type fakeTask struct {
+	exitStatus string
+	log        string
+	pollsLeft  int
+}
+
+// FakeBackend simulates a Proxmox cluster in memory. It is meant for tests
+// of the scheduler and HTTP handlers that must run without pvesh/pct.
+type FakeBackend struct {
+	mu        sync.Mutex
+	available bool
+	nodes     map[string]bool
+	guests    map[int]*models.Resource
+	failures  map[string]map[int]error // op -> vmid (0 = any) -> error
+	executed  map[int][]string
+	calls     []FakeCall
+	nextPID   int
+
+	tasks        map[string]*fakeTask
+	taskPolls    int
+	taskFailures map[int]string // vmid -> exit status for new tasks
+
+	rebootStatus map[int]string        // vmid -> status a guest ends up in after reboot
+	execTimes    map[int]time.Duration // vmid -> how long commands run
+}
+
+// NewFakeBackend creates a fake cluster with the given node names
+func NewFakeBackend(nodes ...string) *FakeBackend {
+	f := &FakeBackend{
+		available: true,
+		nodes:     make(map[string]bool),
+		guests:    make(map[int]*models.Resource),
+		failures:  make(map[string]map[int]error),
+		executed:  make(map[int][]string),
+		nextPID:   1000,
+
+		tasks:        make(map[string]*fakeTask),
+		taskFailures: make(map[int]string),
+		rebootStatus: make(map[int]string),
+		execTimes:    make(map[int]time.Duration),
+	}
+	for _, node := range nodes {
+		f.nodes[node] = true
+	}
+	return f
+}
+
+// Name returns the backend identifier
+func (f *FakeBackend) Name() string {
+	return "fake"
+}
+
+// IsAvailable reports the availability set with SetAvailable (true by default)
+func (f *FakeBackend) IsAvailable() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.available
+}
+
+// SetAvailable controls what IsAvailable returns
+func (f *FakeBackend) SetAvailable(available bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.available = available
+}
+
+// AddNode adds a node to the fake cluster
+func (f *FakeBackend) AddNode(node string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[node] = true
+}
+
+// AddGuest adds a VM or container; its node is created if missing
+func (f *FakeBackend) AddGuest(r models.Resource) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[r.Node] = true
+	guest := r
+	f.guests[r.VMID] = &guest
+}
+
+// Guest returns a copy of a guest's current state
+func (f *FakeBackend) Guest(vmid int) (models.Resource, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	g, ok := f.guests[vmid]
+	if !ok {
+		return models.Resource{}, false
+	}
+	return *g, true
+}
+
+// SetStatus changes a guest's status, e.g. to simulate a crash
+func (f *FakeBackend) SetStatus(vmid int, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if g, ok := f.guests[vmid]; ok {
+		g.Status = status
+	}
+}
+
+// InjectFailure makes op fail with err for vmid (0 matches every guest)
+// until ClearFailures is called
+func (f *FakeBackend) InjectFailure(op string, vmid int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures[op] == nil {
+		f.failures[op] = make(map[int]error)
+	}
+	f.failures[op][vmid] = err
+}
+
+// InjectTaskFailure makes tasks started for vmid finish with exitStatus
+// instead of OK until ClearFailures is called
+func (f *FakeBackend) InjectTaskFailure(vmid int, exitStatus string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.taskFailures[vmid] = exitStatus
+}
+
+// SetTaskPolls makes new tasks report "running" for the given number of
+// status polls before they stop
+func (f *FakeBackend) SetTaskPolls(polls int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.taskPolls = polls
+}
+
+// SetRebootStatus makes a guest end up in status after a successful reboot
+// task, e.g. "stopped" to simulate a guest that fails to come back
+func (f *FakeBackend) SetRebootStatus(vmid int, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rebootStatus[vmid] = status
+}
+
+// SetExecTime makes commands in a container run for d, so they time out
+// when run with a shorter timeout
+func (f *FakeBackend) SetExecTime(vmid int, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.execTimes[vmid] = d
+}
+
+// ClearFailures removes all injected failures
+func (f *FakeBackend) ClearFailures() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = make(map[string]map[int]error)
+	f.taskFailures = make(map[int]string)
+}
+
+// Calls returns every call made so far, in order
+func (f *FakeBackend) Calls() []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeCall(nil), f.calls...)
+}
+
+// CallCount returns how many times op was called
+func (f *FakeBackend) CallCount(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, c := range f.calls {
+		if c.Op == op {
+			count++
+		}
+	}
+	return count
+}
+
+// Executed returns the commands run inside a container, in order
+func (f *FakeBackend) Executed(vmid int) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.executed[vmid]...)
+}
+
+// record logs the call and returns an injected failure, if any. Callers hold f.mu.
+func (f *FakeBackend) record(op, node string, vmid int) error {
+	f.calls = append(f.calls, FakeCall{Op: op, Node: node, VMID: vmid})
+	if errs, ok := f.failures[op]; ok {
+		if err, ok := errs[vmid]; ok {
+			return err
+		}
+		if err, ok := errs[0]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup finds a guest on a node and checks its type. Callers hold f.mu.
+func (f *FakeBackend) lookup(node string, vmid int, resourceType string) (*models.Resource, error) {
+	if resourceType != "lxc" && resourceType != "qemu" {
+		return nil, fmt.Errorf("unknown resource type: %s", resourceType)
+	}
+	g, ok := f.guests[vmid]
+	if !ok || g.Node != node || g.Type != resourceType {
+		return nil, fmt.Errorf("%s %d does not exist on node %s", resourceType, vmid, node)
+	}
+	return g, nil
+}
+
+// newTask starts a task and returns its ID in the format Proxmox uses. Callers hold f.mu.
+func (f *FakeBackend) newTask(node, taskType string, vmid int) string {
+	f.nextPID++
+	upid := fmt.Sprintf("UPID:%s:%08X:%08X:%08X:%s:%d:root@pam:",
+		node, f.nextPID, 0, time.Now().Unix(), taskType, vmid)
+
+	task := &fakeTask{exitStatus: "OK", pollsLeft: f.taskPolls}
+	if exitStatus, ok := f.taskFailures[vmid]; ok {
+		task.exitStatus = exitStatus
+	}
+	task.log = fmt.Sprintf("%s %d\nTASK %s", taskType, vmid, task.exitStatus)
+	if task.exitStatus != "OK" {
+		task.log = fmt.Sprintf("%s %d\nTASK ERROR: %s", taskType, vmid, task.exitStatus)
+	}
+	f.tasks[upid] = task
+	return upid
+}
+
+// GetAllResources returns every guest, ordered by VMID
+func (f *FakeBackend) GetAllResources() ([]models.Resource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpGetAllResources, "", 0); err != nil {
+		return nil, err
+	}
+
+	resources := make([]models.Resource, 0, len(f.guests))
+	for _, g := range f.guests {
+		resources = append(resources, *g)
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].VMID < resources[j].VMID })
+	return resources, nil
+}
+
+// RestartResource reboots a running guest, resetting its uptime
+func (f *FakeBackend) RestartResource(node string, vmid int, resourceType string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpRestartResource, node, vmid); err != nil {
+		return "", fmt.Errorf("failed to restart resource: %w", err)
+	}
+
+	g, err := f.lookup(node, vmid, resourceType)
+	if err != nil {
+		return "", fmt.Errorf("failed to restart resource: %w", err)
+	}
+	if g.Status != "running" {
+		return "", fmt.Errorf("failed to restart resource: %s %d is not running", resourceType, vmid)
+	}
+
+	g.Uptime = 0
+	if status, ok := f.rebootStatus[vmid]; ok {
+		g.Status = status
+	}
+	return f.newTask(node, taskPrefix(resourceType)+"reboot", vmid), nil
+}
+
+// StopResource stops a guest
+func (f *FakeBackend) StopResource(node string, vmid int, resourceType string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpStopResource, node, vmid); err != nil {
+		return "", fmt.Errorf("failed to stop resource: %w", err)
+	}
+
+	g, err := f.lookup(node, vmid, resourceType)
+	if err != nil {
+		return "", fmt.Errorf("failed to stop resource: %w", err)
+	}
+
+	g.Status = "stopped"
+	g.Uptime = 0
+	return f.newTask(node, taskPrefix(resourceType)+"stop", vmid), nil
+}
+
+// StartResource starts a guest; starting a running guest is not an error
+func (f *FakeBackend) StartResource(node string, vmid int, resourceType string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpStartResource, node, vmid); err != nil {
+		return "", fmt.Errorf("failed to start resource: %w", err)
+	}
+
+	g, err := f.lookup(node, vmid, resourceType)
+	if err != nil {
+		return "", fmt.Errorf("failed to start resource: %w", err)
+	}
+	if g.Status == "running" {
+		return fmt.Sprintf("%s %d already running", resourceType, vmid), nil
+	}
+
+	g.Status = "running"
+	g.Uptime = 0
+	return f.newTask(node, taskPrefix(resourceType)+"start", vmid), nil
+}
+
+// CloneContainer copies a container to a new VMID on the target node
+func (f *FakeBackend) CloneContainer(sourceVMID, newVMID int, targetNode, hostname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpCloneContainer, targetNode, newVMID); err != nil {
+		return fmt.Errorf("failed to clone container: %w", err)
+	}
+
+	src, ok := f.guests[sourceVMID]
+	if !ok || src.Type != "lxc" {
+		return fmt.Errorf("failed to clone container: container %d does not exist", sourceVMID)
+	}
+	if _, exists := f.guests[newVMID]; exists {
+		return fmt.Errorf("failed to clone container: VMID %d already exists", newVMID)
+	}
+	if !f.nodes[targetNode] {
+		return fmt.Errorf("failed to clone container: no such node %s", targetNode)
+	}
+
+	clone := *src
+	clone.VMID = newVMID
+	clone.Node = targetNode
+	clone.Status = "stopped"
+	clone.Uptime = 0
+	clone.CPUUsage = 0
+	clone.MemoryUsed = 0
+	if hostname != "" {
+		clone.Name = hostname
+	}
+	f.guests[newVMID] = &clone
+	return nil
+}
+
+// DeleteContainer destroys a stopped container
+func (f *FakeBackend) DeleteContainer(vmid int, node string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpDeleteContainer, node, vmid); err != nil {
+		return fmt.Errorf("failed to delete container: %w", err)
+	}
+
+	g, err := f.lookup(node, vmid, "lxc")
+	if err != nil {
+		return fmt.Errorf("failed to delete container: %w", err)
+	}
+	if g.Status == "running" {
+		return fmt.Errorf("failed to delete container: container %d is running", vmid)
+	}
+
+	delete(f.guests, vmid)
+	delete(f.executed, vmid)
+	return nil
+}
+
+// ExecuteInContainer records a command run inside a running container
+func (f *FakeBackend) ExecuteInContainer(vmid int, command string, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpExecuteInContainer, "", vmid); err != nil {
+		return fmt.Errorf("failed to execute command in container: %w", err)
+	}
+
+	g, ok := f.guests[vmid]
+	if !ok || g.Type != "lxc" {
+		return fmt.Errorf("failed to execute command in container: container %d does not exist", vmid)
+	}
+	if g.Status != "running" {
+		return fmt.Errorf("failed to execute command in container: container %d is not running", vmid)
+	}
+
+	f.executed[vmid] = append(f.executed[vmid], command)
+	if timeout > 0 && f.execTimes[vmid] > timeout {
+		return fmt.Errorf("failed to execute command in container: timed out after %s", timeout)
+	}
+	return nil
+}
+
+// AgentPing succeeds for running VMs
+func (f *FakeBackend) AgentPing(node string, vmid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpAgentPing, node, vmid); err != nil {
+		return fmt.Errorf("guest agent ping failed: %w", err)
+	}
+
+	g, err := f.lookup(node, vmid, "qemu")
+	if err != nil {
+		return fmt.Errorf("guest agent ping failed: %w", err)
+	}
+	if g.Status != "running" {
+		return fmt.Errorf("guest agent ping failed: VM %d is not running", vmid)
+	}
+	return nil
+}
+
+// GetTaskStatus reports a task as running until its polls are used up
+func (f *FakeBackend) GetTaskStatus(node, upid string) (*TaskStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(OpGetTaskStatus, node, 0); err != nil {
+		return nil, err
+	}
+
+	task, ok := f.tasks[upid]
+	if !ok {
+		return nil, fmt.Errorf("no such task: %s", upid)
+	}
+	if task.pollsLeft > 0 {
+		task.pollsLeft--
+		return &TaskStatus{UPID: upid, Status: "running"}, nil
+	}
+	return &TaskStatus{UPID: upid, Status: "stopped", ExitStatus: task.exitStatus}, nil
+}
+
+// GetTaskLog returns the log of a task
+func (f *FakeBackend) GetTaskLog(node, upid string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	task, ok := f.tasks[upid]
+	if !ok {
+		return "", fmt.Errorf("no such task: %s", upid)
+	}
+	return task.log, nil
+}
+
+// taskPrefix returns the task type prefix Proxmox uses for a guest type
+func taskPrefix(resourceType string) string {
+	if resourceType == "lxc" {
+		return "vz"
+	}
+	return "qm"
+}
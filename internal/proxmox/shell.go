@@ -1,16 +1,33 @@
 package proxmox
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rakib/proxmox-auto-restart/internal/models"
 )
 
-// IsProxmoxInstalled checks if pvesh command is available
-func IsProxmoxInstalled() bool {
+// ShellBackend talks to Proxmox through the pvesh and pct binaries.
+// It only works when the service runs as root on a PVE node.
+type ShellBackend struct{}
+
+// NewShellBackend creates a backend that shells out to pvesh/pct
+func NewShellBackend() *ShellBackend {
+	return &ShellBackend{}
+}
+
+// Name returns the backend identifier
+func (b *ShellBackend) Name() string {
+	return "shell"
+}
+
+// IsAvailable checks if pvesh command is available
+func (b *ShellBackend) IsAvailable() bool {
 	cmd := exec.Command("which", "pvesh")
 	err := cmd.Run()
 	return err == nil
@@ -30,10 +47,12 @@ type ProxmoxResource struct {
 	MaxMem  int64       `json:"maxmem"`
 	Disk    int64       `json:"disk"`
 	MaxDisk int64       `json:"maxdisk"`
+	Pool    string      `json:"pool"`
+	Tags    string      `json:"tags"` // separated by semicolons
 }
 
 // GetAllResources fetches all VMs and Containers from Proxmox
-func GetAllResources() ([]models.Resource, error) {
+func (b *ShellBackend) GetAllResources() ([]models.Resource, error) {
 	cmd := exec.Command("pvesh", "get", "/cluster/resources", "--type", "vm", "--output-format", "json")
 	output, err := cmd.Output()
 	if err != nil {
@@ -45,59 +64,14 @@ func GetAllResources() ([]models.Resource, error) {
 		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
 	}
 
-	resources := make([]models.Resource, 0, len(proxmoxResources))
-	for _, pr := range proxmoxResources {
-		vmidInt, err := pr.VMID.Int64()
-		if err != nil {
-			continue // Skip invalid VMID
-		}
-
-		resource := models.Resource{
-			VMID:        int(vmidInt),
-			Name:        pr.Name,
-			Type:        pr.Type,
-			Node:        pr.Node,
-			Status:      pr.Status,
-			Uptime:      pr.Uptime,
-			CPUUsage:    pr.CPU,
-			MemoryUsed:  pr.Mem,
-			MemoryTotal: pr.MaxMem,
-			DiskUsed:    pr.Disk,
-			DiskTotal:   pr.MaxDisk,
-		}
-		resources = append(resources, resource)
-	}
-
-	return resources, nil
-}
-
-// GetResource fetches a specific VM or Container by VMID and node
-func GetResource(node string, vmid int) (*models.Resource, error) {
-	// Get all resources and filter
-	resources, err := GetAllResources()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, r := range resources {
-		if r.VMID == vmid && r.Node == node {
-			return &r, nil
-		}
-	}
-
-	return nil, fmt.Errorf("resource %d not found on node %s", vmid, node)
+	return toResources(proxmoxResources), nil
 }
 
 // RestartResource restarts a VM or Container
-func RestartResource(node string, vmid int, resourceType string) (string, error) {
-	var cmdPath string
-
-	if resourceType == "lxc" {
-		cmdPath = fmt.Sprintf("/nodes/%s/lxc/%d/status/reboot", node, vmid)
-	} else if resourceType == "qemu" {
-		cmdPath = fmt.Sprintf("/nodes/%s/qemu/%d/status/reboot", node, vmid)
-	} else {
-		return "", fmt.Errorf("unknown resource type: %s", resourceType)
+func (b *ShellBackend) RestartResource(node string, vmid int, resourceType string) (string, error) {
+	cmdPath, err := resourcePath(node, vmid, resourceType, "status/reboot")
+	if err != nil {
+		return "", err
 	}
 
 	cmd := exec.Command("pvesh", "create", cmdPath)
@@ -111,15 +85,10 @@ func RestartResource(node string, vmid int, resourceType string) (string, error)
 }
 
 // StopResource stops a VM or Container
-func StopResource(node string, vmid int, resourceType string) (string, error) {
-	var cmdPath string
-
-	if resourceType == "lxc" {
-		cmdPath = fmt.Sprintf("/nodes/%s/lxc/%d/status/stop", node, vmid)
-	} else if resourceType == "qemu" {
-		cmdPath = fmt.Sprintf("/nodes/%s/qemu/%d/status/stop", node, vmid)
-	} else {
-		return "", fmt.Errorf("unknown resource type: %s", resourceType)
+func (b *ShellBackend) StopResource(node string, vmid int, resourceType string) (string, error) {
+	cmdPath, err := resourcePath(node, vmid, resourceType, "status/stop")
+	if err != nil {
+		return "", err
 	}
 
 	cmd := exec.Command("pvesh", "create", cmdPath)
@@ -133,15 +102,10 @@ func StopResource(node string, vmid int, resourceType string) (string, error) {
 }
 
 // StartResource starts a VM or Container
-func StartResource(node string, vmid int, resourceType string) (string, error) {
-	var cmdPath string
-
-	if resourceType == "lxc" {
-		cmdPath = fmt.Sprintf("/nodes/%s/lxc/%d/status/start", node, vmid)
-	} else if resourceType == "qemu" {
-		cmdPath = fmt.Sprintf("/nodes/%s/qemu/%d/status/start", node, vmid)
-	} else {
-		return "", fmt.Errorf("unknown resource type: %s", resourceType)
+func (b *ShellBackend) StartResource(node string, vmid int, resourceType string) (string, error) {
+	cmdPath, err := resourcePath(node, vmid, resourceType, "status/start")
+	if err != nil {
+		return "", err
 	}
 
 	cmd := exec.Command("pvesh", "create", cmdPath)
@@ -160,7 +124,7 @@ func StartResource(node string, vmid int, resourceType string) (string, error) {
 
 // CloneContainer clones a container to a new VMID
 // Usage: pct clone <source> <new> --target <node>
-func CloneContainer(sourceVMID, newVMID int, targetNode, hostname string) error {
+func (b *ShellBackend) CloneContainer(sourceVMID, newVMID int, targetNode, hostname string) error {
 	args := []string{"clone", fmt.Sprintf("%d", sourceVMID), fmt.Sprintf("%d", newVMID), "--target", targetNode}
 
 	if hostname != "" {
@@ -178,13 +142,7 @@ func CloneContainer(sourceVMID, newVMID int, targetNode, hostname string) error
 
 // DeleteContainer deletes a container
 // Usage: pct destroy <vmid> --purge
-func DeleteContainer(vmid int, node string) error {
-	// Stop container first if running
-	resource, err := GetResource(node, vmid)
-	if err == nil && resource.Status == "running" {
-		_, _ = StopResource(node, vmid, resource.Type)
-	}
-
+func (b *ShellBackend) DeleteContainer(vmid int, node string) error {
 	cmd := exec.Command("pct", "destroy", fmt.Sprintf("%d", vmid), "--purge")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -196,9 +154,20 @@ func DeleteContainer(vmid int, node string) error {
 
 // ExecuteInContainer executes a command inside a container
 // Usage: pct exec <vmid> -- <command>
-func ExecuteInContainer(vmid int, command string) error {
-	cmd := exec.Command("pct", "exec", fmt.Sprintf("%d", vmid), "--", "bash", "-c", command)
+func (b *ShellBackend) ExecuteInContainer(vmid int, command string, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "pct", "exec", fmt.Sprintf("%d", vmid), "--", "bash", "-c", command)
+	// Processes left behind in the container must not hold the output open
+	cmd.WaitDelay = time.Second
 	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("failed to execute command in container: timed out after %s", timeout)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to execute command in container: %w, output: %s", err, string(output))
 	}
@@ -206,38 +175,52 @@ func ExecuteInContainer(vmid int, command string) error {
 	return nil
 }
 
-// DeployBlockchainNode orchestrates the full deployment: clone → start → exec commands
-func DeployBlockchainNode(sourceVMID, newVMID int, targetNode, hostname string, commands []string) error {
-	// Step 1: Clone the container
-	if err := CloneContainer(sourceVMID, newVMID, targetNode, hostname); err != nil {
-		return fmt.Errorf("clone failed: %w", err)
+// AgentPing pings the QEMU guest agent
+// Usage: pvesh create /nodes/<node>/qemu/<vmid>/agent/ping
+func (b *ShellBackend) AgentPing(node string, vmid int) error {
+	cmdPath := fmt.Sprintf("/nodes/%s/qemu/%d/agent/ping", node, vmid)
+	cmd := exec.Command("pvesh", "create", cmdPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("guest agent ping failed: %w, output: %s", err, string(output))
 	}
 
-	// Step 2: Start the container
-	if _, err := StartResource(targetNode, newVMID, "lxc"); err != nil {
-		return fmt.Errorf("start failed: %w", err)
+	return nil
+}
+
+// GetTaskStatus reads a task's status
+// Usage: pvesh get /nodes/<node>/tasks/<upid>/status
+func (b *ShellBackend) GetTaskStatus(node, upid string) (*TaskStatus, error) {
+	cmdPath := fmt.Sprintf("/nodes/%s/tasks/%s/status", node, upid)
+	cmd := exec.Command("pvesh", "get", cmdPath, "--output-format", "json")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute pvesh command: %w", err)
 	}
 
-	// Step 3: Execute base setup commands (always run these first)
-	baseSetupCommands := []string{
-		"apt-get update && apt-get install -y locales",
-		"locale-gen en_US.UTF-8",
-		"update-locale LANG=en_US.UTF-8",
-		"apt-get update && apt-get install -y curl wget",
+	var status TaskStatus
+	if err := json.Unmarshal(output, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
 	}
+	status.UPID = upid
 
-	for i, cmd := range baseSetupCommands {
-		if err := ExecuteInContainer(newVMID, cmd); err != nil {
-			return fmt.Errorf("base setup command %d failed: %w", i+1, err)
-		}
+	return &status, nil
+}
+
+// GetTaskLog reads a task's log
+// Usage: pvesh get /nodes/<node>/tasks/<upid>/log
+func (b *ShellBackend) GetTaskLog(node, upid string) (string, error) {
+	cmdPath := fmt.Sprintf("/nodes/%s/tasks/%s/log", node, upid)
+	cmd := exec.Command("pvesh", "get", cmdPath, "--limit", strconv.Itoa(taskLogLimit), "--output-format", "json")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to execute pvesh command: %w", err)
 	}
 
-	// Step 4: Execute user-provided commands
-	for i, cmd := range commands {
-		if err := ExecuteInContainer(newVMID, cmd); err != nil {
-			return fmt.Errorf("command %d failed: %w", i+1, err)
-		}
+	var lines []taskLogLine
+	if err := json.Unmarshal(output, &lines); err != nil {
+		return "", fmt.Errorf("failed to parse JSON response: %w", err)
 	}
 
-	return nil
+	return joinTaskLog(lines), nil
 }
@@ -0,0 +1,134 @@
+package proxmox
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TaskPollInterval controls how often WaitForTask polls a running task
+var TaskPollInterval = 2 * time.Second
+
+// UPID is a parsed Proxmox task identifier, e.g.
+// UPID:pve1:0000A1B2:0012C3D4:65F0A1B2:qmreboot:101:root@pam:
+type UPID struct {
+	Raw       string
+	Node      string
+	PID       string
+	PStart    string
+	StartTime time.Time
+	Type      string
+	ID        string
+	User      string
+}
+
+// TaskStatus is the final (or current) state of a Proxmox task
+type TaskStatus struct {
+	UPID       string `json:"upid"`
+	Status     string `json:"status"`     // running, stopped
+	ExitStatus string `json:"exitstatus"` // OK or an error message once stopped
+	Log        string `json:"log,omitempty"`
+}
+
+// Succeeded reports whether the task finished with exit status OK
+func (s *TaskStatus) Succeeded() bool {
+	return s.Status == "stopped" && s.ExitStatus == "OK"
+}
+
+// taskLogLimit is the maximum number of task log lines fetched
+const taskLogLimit = 500
+
+// taskLogLine is one entry of /nodes/{node}/tasks/{upid}/log
+type taskLogLine struct {
+	N int    `json:"n"`
+	T string `json:"t"`
+}
+
+var upidPattern = regexp.MustCompile(`UPID:[^\s"]+`)
+
+// ParseUPID splits a task ID into its fields
+func ParseUPID(s string) (*UPID, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	// UPID + 7 fields + trailing empty field
+	if len(parts) < 8 || parts[0] != "UPID" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid UPID: %q", s)
+	}
+
+	upid := &UPID{
+		Raw:    strings.TrimSpace(s),
+		Node:   parts[1],
+		PID:    parts[2],
+		PStart: parts[3],
+		Type:   parts[5],
+		ID:     parts[6],
+		User:   parts[7],
+	}
+
+	var startTime int64
+	if _, err := fmt.Sscanf(parts[4], "%X", &startTime); err != nil {
+		return nil, fmt.Errorf("invalid UPID start time %q: %w", parts[4], err)
+	}
+	upid.StartTime = time.Unix(startTime, 0)
+
+	return upid, nil
+}
+
+// ExtractUPID finds the task ID in command or API output, or returns ""
+func ExtractUPID(output string) string {
+	return upidPattern.FindString(output)
+}
+
+// WaitForTask polls a task until it stops or timeout elapses and returns
+// its final status together with the task log
+func WaitForTask(upid string, timeout time.Duration) (*TaskStatus, error) {
+	return waitForTask(backend, upid, timeout)
+}
+
+// waitForTask is WaitForTask on a given backend
+func waitForTask(b Backend, upid string, timeout time.Duration) (*TaskStatus, error) {
+	parsed, err := ParseUPID(upid)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := b.GetTaskStatus(parsed.Node, parsed.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get task status: %w", err)
+		}
+
+		if status.Status == "stopped" {
+			if taskLog, err := b.GetTaskLog(parsed.Node, parsed.Raw); err == nil {
+				status.Log = taskLog
+			}
+			return status, nil
+		}
+
+		if time.Now().After(deadline) {
+			return status, fmt.Errorf("task %s did not finish within %s", parsed.Raw, timeout)
+		}
+		time.Sleep(TaskPollInterval)
+	}
+}
+
+// finishTask waits for a task on a given backend and fails unless it exited OK
+func finishTask(b Backend, upid string, timeout time.Duration) error {
+	status, err := waitForTask(b, upid, timeout)
+	if err != nil {
+		return err
+	}
+	if !status.Succeeded() {
+		return fmt.Errorf("task %s failed: %s", upid, status.ExitStatus)
+	}
+	return nil
+}
+
+func joinTaskLog(lines []taskLogLine) string {
+	text := make([]string, 0, len(lines))
+	for _, l := range lines {
+		text = append(text, l.T)
+	}
+	return strings.Join(text, "\n")
+}
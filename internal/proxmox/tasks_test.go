@@ -0,0 +1,81 @@
+package proxmox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+func TestParseUPID(t *testing.T) {
+	upid, err := ParseUPID("UPID:pve1:0000A1B2:0012C3D4:65F0A1B2:qmreboot:101:root@pam:")
+	if err != nil {
+		t.Fatalf("ParseUPID: %v", err)
+	}
+	if upid.Node != "pve1" || upid.Type != "qmreboot" || upid.ID != "101" || upid.User != "root@pam" {
+		t.Errorf("unexpected fields %+v", upid)
+	}
+	if upid.StartTime.Unix() != 0x65F0A1B2 {
+		t.Errorf("unexpected start time %v", upid.StartTime)
+	}
+
+	for _, bad := range []string{"", "UPID:pve1:1", "TASK:pve1:1:2:3:qmstart:1:root@pam:", "UPID:pve1:1:2:zz:qmstart:1:root@pam:"} {
+		if _, err := ParseUPID(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestExtractUPID(t *testing.T) {
+	out := "Requesting reboot...\nUPID:pve1:0000A1B2:0012C3D4:65F0A1B2:vzreboot:103:root@pam:\n"
+	if got := ExtractUPID(out); got != "UPID:pve1:0000A1B2:0012C3D4:65F0A1B2:vzreboot:103:root@pam:" {
+		t.Errorf("ExtractUPID = %q", got)
+	}
+	if got := ExtractUPID("CT 103 already running"); got != "" {
+		t.Errorf("expected no UPID, got %q", got)
+	}
+}
+
+func TestWaitForTask(t *testing.T) {
+	fake := useFakeBackend(t)
+	TaskPollInterval = time.Millisecond
+	fake.SetTaskPolls(3)
+
+	upid, err := RestartResource("pve1", 200, "qemu")
+	if err != nil {
+		t.Fatalf("RestartResource: %v", err)
+	}
+
+	status, err := WaitForTask(upid, time.Second)
+	if err != nil {
+		t.Fatalf("WaitForTask: %v", err)
+	}
+	if !status.Succeeded() || status.Log == "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if got := fake.CallCount(OpGetTaskStatus); got != 4 {
+		t.Errorf("expected 4 status polls, got %d", got)
+	}
+}
+
+func TestWaitForTaskFailureAndTimeout(t *testing.T) {
+	fake := useFakeBackend(t)
+	TaskPollInterval = time.Millisecond
+	fake.AddGuest(models.Resource{VMID: 300, Name: "stuck", Type: "lxc", Node: "pve2", Status: "running"})
+	fake.InjectTaskFailure(200, "command 'qm reboot' failed: got timeout")
+
+	upid, _ := RestartResource("pve1", 200, "qemu")
+	status, err := WaitForTask(upid, time.Second)
+	if err != nil {
+		t.Fatalf("WaitForTask: %v", err)
+	}
+	if status.Succeeded() || status.ExitStatus != "command 'qm reboot' failed: got timeout" {
+		t.Errorf("expected failed task, got %+v", status)
+	}
+
+	fake.SetTaskPolls(1000)
+	upid, _ = StopResource("pve2", 300, "lxc")
+	if _, err := WaitForTask(upid, 5*time.Millisecond); err == nil {
+		t.Error("expected timeout error")
+	}
+}
@@ -0,0 +1,158 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// BackupConfig controls where database backups go and how many are kept
+type BackupConfig struct {
+	Dir string
+	// Keep is how many backups to retain; older ones are deleted. 0 keeps all.
+	Keep int
+}
+
+// BackupInfo describes one backup file
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const backupPrefix = "proxmox-"
+
+var (
+	backupConfig = BackupConfig{Dir: "./backups", Keep: 7}
+
+	// backupMu serializes backups and rotation
+	backupMu sync.Mutex
+)
+
+// SetBackupConfig replaces the backup settings
+func SetBackupConfig(cfg BackupConfig) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	backupConfig = cfg
+}
+
+// StartBackups takes a rotating backup every interval
+func (s *Scheduler) StartBackups(interval time.Duration) error {
+	s.backupCron = cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+
+	_, err := s.backupCron.AddFunc(fmt.Sprintf("@every %s", interval), func() {
+		if _, err := s.CreateBackup(); err != nil {
+			log.Printf("ERROR: Scheduled database backup failed: %v", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	s.backupCron.Start()
+	log.Printf("Database backups started (interval: %s, dir: %s, keep: %d)", interval, backupConfig.Dir, backupConfig.Keep)
+	return nil
+}
+
+// StopBackups stops scheduled backups
+func (s *Scheduler) StopBackups() {
+	if s.backupCron != nil {
+		s.backupCron.Stop()
+		s.backupCron = nil
+		log.Println("Database backups stopped")
+	}
+}
+
+// CreateBackup snapshots the database into the backup directory and
+// deletes backups beyond the configured count
+func (s *Scheduler) CreateBackup() (*BackupInfo, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	cfg := backupConfig
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	now := time.Now().UTC()
+	name := backupPrefix + now.Format("20060102T150405.000Z") + ".db"
+	path := filepath.Join(cfg.Dir, name)
+	if err := s.store.Backup(path); err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup: %w", err)
+	}
+	log.Printf("Database backed up to %s (%d bytes)", path, fi.Size())
+
+	if err := rotateBackups(cfg); err != nil {
+		log.Printf("ERROR: Failed to rotate backups: %v", err)
+	}
+	return &BackupInfo{Name: name, Path: path, SizeBytes: fi.Size(), CreatedAt: now}, nil
+}
+
+// ListBackups returns the backups in the backup directory, newest first
+func ListBackups() ([]BackupInfo, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	return listBackups(backupConfig.Dir)
+}
+
+func listBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var backups []BackupInfo
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, ".db") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{
+			Name:      name,
+			Path:      filepath.Join(dir, name),
+			SizeBytes: info.Size(),
+			CreatedAt: info.ModTime().UTC(),
+		})
+	}
+
+	// Names embed the UTC time, so they sort chronologically
+	slices.SortFunc(backups, func(a, b BackupInfo) int { return strings.Compare(b.Name, a.Name) })
+	return backups, nil
+}
+
+func rotateBackups(cfg BackupConfig) error {
+	if cfg.Keep <= 0 {
+		return nil
+	}
+	backups, err := listBackups(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups[min(cfg.Keep, len(backups)):] {
+		if err := os.Remove(b.Path); err != nil {
+			return err
+		}
+		log.Printf("Removed old backup %s", b.Path)
+	}
+	return nil
+}
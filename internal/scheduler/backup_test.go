@@ -0,0 +1,40 @@
+package scheduler
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+)
+
+func TestCreateBackupRotates(t *testing.T) {
+	s, _ := setupTest(t)
+	dir := t.TempDir()
+	SetBackupConfig(BackupConfig{Dir: dir, Keep: 2})
+	t.Cleanup(func() { SetBackupConfig(BackupConfig{Dir: "./backups", Keep: 7}) })
+
+	var created []*BackupInfo
+	for i := 0; i < 3; i++ {
+		b, err := s.CreateBackup()
+		if err != nil {
+			t.Fatalf("CreateBackup: %v", err)
+		}
+		created = append(created, b)
+		time.Sleep(2 * time.Millisecond) // distinct file names
+	}
+
+	backups, err := ListBackups()
+	if err != nil {
+		t.Fatalf("ListBackups: %v", err)
+	}
+	if len(backups) != 2 || backups[0].Name != created[2].Name || backups[1].Name != created[1].Name {
+		t.Fatalf("expected the two newest backups, got %+v", backups)
+	}
+	if _, err := os.Stat(created[0].Path); !os.IsNotExist(err) {
+		t.Errorf("oldest backup should be rotated out")
+	}
+	if version, err := db.ValidateBackup(backups[0].Path); err != nil || version != db.LatestVersion() {
+		t.Errorf("backup not restorable: version %d, %v", version, err)
+	}
+}
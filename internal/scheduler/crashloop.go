@@ -0,0 +1,153 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/notify"
+)
+
+// CrashLoopConfig controls when a whitelist entry is quarantined for failing
+// over and over
+type CrashLoopConfig struct {
+	// MaxFailures within Window quarantine the entry; 0 disables detection
+	MaxFailures int
+	// Window is how far back failures are counted
+	Window time.Duration
+	// Backoff is the first quarantine's length; each further one doubles it
+	Backoff time.Duration
+	// MaxBackoff caps the quarantine length
+	MaxBackoff time.Duration
+}
+
+var (
+	crashLoopMu     sync.RWMutex
+	crashLoopConfig = CrashLoopConfig{
+		MaxFailures: 3,
+		Window:      6 * time.Hour,
+		Backoff:     time.Hour,
+		MaxBackoff:  24 * time.Hour,
+	}
+)
+
+// SetCrashLoopConfig replaces the crash-loop detection settings
+func SetCrashLoopConfig(cfg CrashLoopConfig) {
+	crashLoopMu.Lock()
+	defer crashLoopMu.Unlock()
+	crashLoopConfig = cfg
+}
+
+func getCrashLoopConfig() CrashLoopConfig {
+	crashLoopMu.RLock()
+	defer crashLoopMu.RUnlock()
+	return crashLoopConfig
+}
+
+// inBackoff reports whether automatic restarts of an entry are on hold
+func inBackoff(wl models.Whitelist, now time.Time) bool {
+	return wl.Quarantined && wl.QuarantinedUntil != nil && now.Before(*wl.QuarantinedUntil)
+}
+
+// backoffFor returns the quarantine length for the given level (1 = first)
+func backoffFor(level int) time.Duration {
+	cfg := getCrashLoopConfig()
+	limit := cfg.MaxBackoff
+	d := cfg.Backoff
+	for i := 1; i < level && (limit <= 0 || d < limit); i++ {
+		d *= 2
+	}
+	if limit > 0 && d > limit {
+		return limit
+	}
+	return d
+}
+
+// UnquarantineWhitelist lifts an entry's quarantine and forgets its past failures
+func (s *Scheduler) UnquarantineWhitelist(id int64, by string) error {
+	if err := s.store.ClearQuarantine(id); err != nil {
+		return fmt.Errorf("failed to clear quarantine: %w", err)
+	}
+	log.Printf("Whitelist entry %d unquarantined by %s", id, by)
+	return nil
+}
+
+// checkCrashLoop looks at a finished restart and quarantines the guest's
+// whitelist entry once it keeps failing. A restart of a quarantined entry
+// is its probation: success lifts the quarantine, another failure extends
+// it with a doubled back-off.
+func (s *Scheduler) checkCrashLoop(logEntry *models.RestartLog) {
+	cfg := getCrashLoopConfig()
+	if cfg.MaxFailures <= 0 {
+		return
+	}
+
+	wl, err := s.store.GetWhitelistByVMID(logEntry.VMID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get whitelist entry for %d: %v", logEntry.VMID, err)
+		return
+	}
+	if wl == nil {
+		return
+	}
+
+	cameBack := logEntry.Status == "success" && logEntry.Verification != VerificationFailedToComeBack
+
+	if wl.Quarantined {
+		if cameBack {
+			if err := s.store.ClearQuarantine(wl.ID); err != nil {
+				log.Printf("ERROR: Failed to clear quarantine of %d: %v", wl.VMID, err)
+				return
+			}
+			log.Printf("Resource %d (%s) recovered, quarantine lifted", wl.VMID, wl.ResourceName)
+			return
+		}
+		s.quarantine(wl, wl.QuarantineLevel+1, "failed again after quarantine")
+		return
+	}
+
+	// A watchdog restart that came back is only a failure when the guest keeps
+	// failing its health checks, which CountRestartFailures works out
+	if cameBack && logEntry.TriggerType != "health" {
+		return
+	}
+
+	since := time.Now().Add(-cfg.Window)
+	if wl.FailuresResetAt != nil && wl.FailuresResetAt.After(since) {
+		since = *wl.FailuresResetAt
+	}
+	failures, err := s.store.CountRestartFailures(wl.VMID, since)
+	if err != nil {
+		log.Printf("ERROR: Failed to count restart failures for %d: %v", wl.VMID, err)
+		return
+	}
+	if failures < cfg.MaxFailures {
+		return
+	}
+
+	s.quarantine(wl, 1, fmt.Sprintf("%d failed restarts within %s", failures, cfg.Window))
+}
+
+// quarantine backs off an entry's automatic restarts and raises an alert
+func (s *Scheduler) quarantine(wl *models.Whitelist, level int, reason string) {
+	backoff := backoffFor(level)
+	until := time.Now().Add(backoff)
+
+	if err := s.store.SetQuarantine(wl.ID, level, until, reason); err != nil {
+		log.Printf("ERROR: Failed to quarantine %d: %v", wl.VMID, err)
+		return
+	}
+
+	err := notify.Send(notify.Alert{
+		Event:        "crash_loop",
+		VMID:         wl.VMID,
+		ResourceName: wl.ResourceName,
+		Node:         wl.Node,
+		Message:      fmt.Sprintf("quarantined for %s (level %d): %s", backoff, level, reason),
+	})
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
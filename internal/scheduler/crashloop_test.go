@@ -0,0 +1,192 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/notify"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+func whitelistEntry(t *testing.T, s *Scheduler, vmid int) *models.Whitelist {
+	t.Helper()
+	wl, err := s.store.GetWhitelistByVMID(vmid)
+	if err != nil || wl == nil {
+		t.Fatalf("GetWhitelistByVMID: %v", err)
+	}
+	return wl
+}
+
+// endBackoff moves a quarantine's end into the past so the next run is its probation
+func endBackoff(t *testing.T, vmid int) {
+	t.Helper()
+	_, err := testDB.Exec(`UPDATE whitelist SET quarantined_until = ? WHERE vmid = ?`, time.Now().Add(-time.Minute), vmid)
+	if err != nil {
+		t.Fatalf("end backoff: %v", err)
+	}
+}
+
+func TestCrashLoopQuarantine(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	fake.InjectFailure(proxmox.OpRestartResource, 101, errors.New("CT is locked (snapshot)"))
+
+	var mu sync.Mutex
+	var alerts []notify.Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a notify.Alert
+		json.NewDecoder(r.Body).Decode(&a)
+		mu.Lock()
+		alerts = append(alerts, a)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	notify.SetWebhookURL(srv.URL)
+	t.Cleanup(func() { notify.SetWebhookURL("") })
+
+	for i := 0; i < 2; i++ {
+		runScheduledRestarts(s)
+	}
+	if whitelistEntry(t, s, 101).Quarantined {
+		t.Fatal("quarantined before reaching the failure limit")
+	}
+
+	runScheduledRestarts(s)
+	wl := whitelistEntry(t, s, 101)
+	if !wl.Quarantined || wl.QuarantineLevel != 1 || wl.QuarantinedUntil == nil {
+		t.Fatalf("expected quarantine after 3 failures, got %+v", wl)
+	}
+	if d := time.Until(*wl.QuarantinedUntil); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected a 1h back-off, got %s", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(alerts) != 1 || alerts[0].Event != "crash_loop" || alerts[0].VMID != 101 {
+		t.Errorf("expected one crash_loop alert, got %+v", alerts)
+	}
+
+	runScheduledRestarts(s)
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 3 {
+		t.Errorf("quarantined entry should not be restarted, got %d restarts", got)
+	}
+}
+
+func TestCrashLoopProbation(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	fake.InjectFailure(proxmox.OpRestartResource, 101, errors.New("CT is locked (snapshot)"))
+	for i := 0; i < 3; i++ {
+		runScheduledRestarts(s)
+	}
+
+	// Failing again after the back-off doubles it
+	endBackoff(t, 101)
+	runScheduledRestarts(s)
+	wl := whitelistEntry(t, s, 101)
+	if !wl.Quarantined || wl.QuarantineLevel != 2 {
+		t.Fatalf("expected level 2 quarantine, got %+v", wl)
+	}
+	if d := time.Until(*wl.QuarantinedUntil); d < 119*time.Minute {
+		t.Errorf("expected a 2h back-off, got %s", d)
+	}
+
+	// A successful restart after the back-off lifts the quarantine
+	fake.ClearFailures()
+	endBackoff(t, 101)
+	runScheduledRestarts(s)
+	if wl := whitelistEntry(t, s, 101); wl.Quarantined || wl.QuarantineLevel != 0 {
+		t.Errorf("expected quarantine to be lifted, got %+v", wl)
+	}
+}
+
+// healthRestart records a watchdog restart of vmid and runs the crash-loop check on it
+func healthRestart(t *testing.T, s *Scheduler, vmid int, verification string) {
+	t.Helper()
+	entry := &models.RestartLog{
+		VMID: vmid, ResourceName: "guest", Node: "pve1", Action: "restart", TriggerType: "health",
+		TriggeredBy: "watchdog", Status: "success", StartedAt: time.Now(), Verification: verification,
+	}
+	id, err := s.store.CreateRestartLog(entry)
+	if err != nil {
+		t.Fatalf("CreateRestartLog: %v", err)
+	}
+	entry.ID = id
+	if err := s.store.UpdateRestartLog(entry); err != nil {
+		t.Fatalf("UpdateRestartLog: %v", err)
+	}
+	s.checkCrashLoop(entry)
+}
+
+func TestCrashLoopHealthRestarts(t *testing.T) {
+	s, _ := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+
+	// The first watchdog restart in the window fixed the guest
+	healthRestart(t, s, 101, VerificationVerified)
+	if whitelistEntry(t, s, 101).Quarantined {
+		t.Fatal("a verified health restart counted as a failure")
+	}
+
+	// The guest keeps failing its health checks
+	for i := 0; i < 3; i++ {
+		healthRestart(t, s, 101, VerificationVerified)
+	}
+	wl := whitelistEntry(t, s, 101)
+	if !wl.Quarantined || wl.QuarantineLevel != 1 {
+		t.Fatalf("expected quarantine after repeated health restarts, got %+v", wl)
+	}
+
+	// A verified health restart after the back-off is a recovery
+	endBackoff(t, 101)
+	healthRestart(t, s, 101, VerificationVerified)
+	if wl := whitelistEntry(t, s, 101); wl.Quarantined {
+		t.Errorf("expected a verified health restart to lift the quarantine, got %+v", wl)
+	}
+}
+
+func TestCrashLoopHealthRestartNotBack(t *testing.T) {
+	s, _ := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	for i := 0; i < 3; i++ {
+		healthRestart(t, s, 101, VerificationFailedToComeBack)
+	}
+	if wl := whitelistEntry(t, s, 101); !wl.Quarantined {
+		t.Errorf("expected quarantine after health restarts that did not come back, got %+v", wl)
+	}
+}
+
+func TestUnquarantineForgetsFailures(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	fake.InjectFailure(proxmox.OpRestartResource, 101, errors.New("CT is locked (snapshot)"))
+	for i := 0; i < 3; i++ {
+		runScheduledRestarts(s)
+	}
+
+	wl := whitelistEntry(t, s, 101)
+	if err := s.UnquarantineWhitelist(wl.ID, "tester"); err != nil {
+		t.Fatalf("UnquarantineWhitelist: %v", err)
+	}
+
+	runScheduledRestarts(s)
+	if wl := whitelistEntry(t, s, 101); wl.Quarantined {
+		t.Errorf("one failure after unquarantine should not quarantine again, got %+v", wl)
+	}
+}
+
+func TestBackoffFor(t *testing.T) {
+	SetCrashLoopConfig(CrashLoopConfig{Backoff: time.Hour, MaxBackoff: 4 * time.Hour})
+
+	want := []time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour, 4 * time.Hour}
+	for i, w := range want {
+		if got := backoffFor(i + 1); got != w {
+			t.Errorf("backoffFor(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+var (
+	// ErrGroupNotFound is returned when a restart group does not exist
+	ErrGroupNotFound = errors.New("restart group not found")
+	// ErrGroupBusy is returned when a group is already queued or restarting
+	ErrGroupBusy = errors.New("restart group is already queued or restarting")
+)
+
+// groupMember is a whitelist entry in a restart group, resolved against Proxmox
+type groupMember struct {
+	whitelist    models.Whitelist
+	resourceType string
+	// schedule holds the member's maintenance window, which must be open
+	// when its turn comes; nil for manual restarts
+	schedule *entrySchedule
+}
+
+// enqueueGroup loads a group's settings and queues a rolling restart of its members
+func (s *Scheduler) enqueueGroup(groupID int64, members []groupMember, reason, triggerType, triggeredBy string) error {
+	group, err := s.store.GetRestartGroupByID(groupID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get restart group %d: %v", groupID, err)
+		return fmt.Errorf("failed to get restart group: %w", err)
+	}
+	if group == nil {
+		log.Printf("WARNING: Restart group %d no longer exists, skipping", groupID)
+		return ErrGroupNotFound
+	}
+
+	queued := s.queue.enqueue(restartJob{
+		triggerType: triggerType,
+		triggeredBy: triggeredBy,
+		group:       group,
+		members:     members,
+	})
+	if !queued {
+		log.Printf("Restart group %s is already queued or restarting", group.Name)
+		return ErrGroupBusy
+	}
+
+	log.Printf("Restart group %s (%d members) %s, queued for rolling restart", group.Name, len(members), reason)
+	return nil
+}
+
+// ManualRestartGroup queues a rolling restart of all enabled members of a group
+func (s *Scheduler) ManualRestartGroup(groupID int64, triggeredBy string) error {
+	group, err := s.store.GetRestartGroupByID(groupID)
+	if err != nil {
+		return fmt.Errorf("failed to get restart group: %w", err)
+	}
+	if group == nil {
+		return ErrGroupNotFound
+	}
+
+	resources, err := proxmox.GetAllResources()
+	if err != nil {
+		return fmt.Errorf("failed to get resources: %w", err)
+	}
+	typeMap := make(map[int]string)
+	for _, r := range resources {
+		typeMap[r.VMID] = r.Type
+	}
+
+	var members []groupMember
+	for _, wl := range group.Members {
+		if !wl.Enabled {
+			continue
+		}
+		resourceType, exists := typeMap[wl.VMID]
+		if !exists {
+			log.Printf("WARNING: Resource %d (%s) not found in Proxmox, leaving it out of group %s",
+				wl.VMID, wl.ResourceName, group.Name)
+			continue
+		}
+		members = append(members, groupMember{whitelist: wl, resourceType: resourceType})
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("restart group %s has no enabled members", group.Name)
+	}
+
+	log.Printf("Manual rolling restart requested for group %s by %s", group.Name, triggeredBy)
+	return s.enqueueGroup(groupID, members, "requested by "+triggeredBy, "manual", triggeredBy)
+}
+
+// restartGroup restarts group members one after another in group_order.
+// Members whose maintenance window has closed by their turn are skipped.
+// With wait_healthy a member must pass post-restart verification before the
+// next one starts, even when verification is otherwise disabled; with
+// stop_on_failure the remaining members are skipped once a member fails.
+func (s *Scheduler) restartGroup(group *models.RestartGroup, members []groupMember, triggerType, triggeredBy string) {
+	log.Printf("Starting rolling restart of group %s (%d members)", group.Name, len(members))
+
+	for i, m := range members {
+		wl := m.whitelist
+		if m.schedule != nil && !m.schedule.inWindow(time.Now()) {
+			log.Printf("WARNING: Maintenance window of group %s member %d (%s) closed before its turn, skipping it",
+				group.Name, wl.VMID, wl.ResourceName)
+			s.skipMembers(members[i:i+1], triggerType, triggeredBy,
+				fmt.Sprintf("skipped: maintenance window closed before group %s reached it", group.Name))
+			continue
+		}
+
+		entry := s.restartResource(wl.VMID, wl.ResourceName, wl.Node, m.resourceType, triggerType, triggeredBy, "")
+		if group.WaitHealthy && entry != nil && entry.Status == "success" && entry.Verification == "" {
+			// Verification is disabled, but the next member must not start
+			// before this one is back
+			s.verify(groupVerifyConfig(), entry, m.resourceType, entry.StartedAt)
+		}
+
+		healthy, detail := memberHealthy(entry, group.WaitHealthy)
+		if healthy {
+			continue
+		}
+
+		log.Printf("WARNING: Group %s member %d (%s) %s", group.Name, wl.VMID, wl.ResourceName, detail)
+		if group.StopOnFailure {
+			s.skipMembers(members[i+1:], triggerType, triggeredBy,
+				fmt.Sprintf("skipped: group %s stopped after %d (%s) %s", group.Name, wl.VMID, wl.ResourceName, detail))
+			log.Printf("Rolling restart of group %s aborted", group.Name)
+			return
+		}
+	}
+
+	log.Printf("Rolling restart of group %s completed", group.Name)
+}
+
+// memberHealthy decides whether a group may move on to its next member
+func memberHealthy(entry *models.RestartLog, waitHealthy bool) (bool, string) {
+	if entry == nil {
+		return false, "could not be restarted"
+	}
+	if entry.Status != "success" {
+		return false, fmt.Sprintf("failed to restart: %s", entry.ErrorMessage)
+	}
+	if waitHealthy && entry.Verification != VerificationVerified {
+		return false, fmt.Sprintf("was not healthy after restart (%s)", entry.Verification)
+	}
+	return true, ""
+}
+
+// skipMembers records a skipped restart for each remaining member so the
+// aborted sequence shows up in the logs
+func (s *Scheduler) skipMembers(members []groupMember, triggerType, triggeredBy, reason string) {
+	for _, m := range members {
+		now := time.Now()
+		logEntry := &models.RestartLog{
+			VMID:         m.whitelist.VMID,
+			ResourceName: m.whitelist.ResourceName,
+			Node:         m.whitelist.Node,
+			Action:       "restart",
+			TriggerType:  triggerType,
+			TriggeredBy:  triggeredBy,
+			Status:       "skipped",
+			ErrorMessage: reason,
+			StartedAt:    now,
+			CompletedAt:  &now,
+		}
+		logID, err := s.store.CreateRestartLog(logEntry)
+		if err != nil {
+			log.Printf("ERROR: Failed to create restart log for %d: %v", m.whitelist.VMID, err)
+			continue
+		}
+		logEntry.ID = logID
+		if err := s.store.UpdateRestartLog(logEntry); err != nil {
+			log.Printf("ERROR: Failed to update restart log: %v", err)
+		}
+	}
+}
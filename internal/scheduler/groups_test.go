@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+// addGroup creates a restart group and puts the given VMIDs in it, in order
+func addGroup(t *testing.T, s *Scheduler, name string, waitHealthy, stopOnFailure bool, vmids ...int) int64 {
+	t.Helper()
+	groupID, err := s.store.CreateRestartGroup(name, "", waitHealthy, stopOnFailure)
+	if err != nil {
+		t.Fatalf("CreateRestartGroup: %v", err)
+	}
+
+	entries, err := s.store.GetAllWhitelist()
+	if err != nil {
+		t.Fatalf("GetAllWhitelist: %v", err)
+	}
+	for i, vmid := range vmids {
+		for _, wl := range entries {
+			if wl.VMID != vmid {
+				continue
+			}
+			order := i + 1
+			err := s.store.UpdateWhitelist(wl.ID, &models.UpdateWhitelistRequest{
+				Enabled: true, RestartIntervalHours: wl.RestartIntervalHours,
+				GroupID: &groupID, GroupOrder: &order,
+			})
+			if err != nil {
+				t.Fatalf("UpdateWhitelist: %v", err)
+			}
+		}
+	}
+	return groupID
+}
+
+// restartOrder returns the VMIDs of restart calls in the order they happened
+func restartOrder(fake *proxmox.FakeBackend) []int {
+	var order []int
+	for _, call := range fake.Calls() {
+		if call.Op == proxmox.OpRestartResource {
+			order = append(order, call.VMID)
+		}
+	}
+	return order
+}
+
+func TestGroupRollingRestartOrder(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addGroup(t, s, "stack", true, true, 102, 101)
+
+	runScheduledRestarts(s)
+
+	order := restartOrder(fake)
+	if len(order) != 2 || order[0] != 102 || order[1] != 101 {
+		t.Fatalf("expected restarts in group order [102 101], got %v", order)
+	}
+	for _, vmid := range []int{101, 102} {
+		logs := logsFor(t, s, vmid)
+		if len(logs) != 1 || logs[0].Verification != VerificationVerified {
+			t.Errorf("expected one verified restart of %d, got %+v", vmid, logs)
+		}
+	}
+}
+
+func TestGroupStopsOnFailure(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addGroup(t, s, "stack", true, true, 101, 102)
+	fake.InjectFailure(proxmox.OpRestartResource, 101, errors.New("CT is locked (backup)"))
+
+	runScheduledRestarts(s)
+
+	if order := restartOrder(fake); len(order) != 1 || order[0] != 101 {
+		t.Fatalf("expected only the first member to be restarted, got %v", order)
+	}
+	logs := logsFor(t, s, 102)
+	if len(logs) != 1 || logs[0].Status != "skipped" {
+		t.Fatalf("expected a skipped log for the second member, got %+v", logs)
+	}
+}
+
+func TestGroupWaitsUntilHealthy(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addGroup(t, s, "stack", true, true, 101, 102)
+	fake.SetRebootStatus(101, "stopped")
+
+	runScheduledRestarts(s)
+
+	if logs := logsFor(t, s, 101); logs[0].Verification != VerificationFailedToComeBack {
+		t.Fatalf("expected first member to fail verification, got %+v", logs[0])
+	}
+	if logs := logsFor(t, s, 102); len(logs) != 1 || logs[0].Status != "skipped" {
+		t.Errorf("second member should not restart while the first is unhealthy, got %+v", logs)
+	}
+}
+
+func TestGroupVerifiesWhenVerificationDisabled(t *testing.T) {
+	s, _ := setupTest(t)
+	SetVerifyConfig(VerifyConfig{PollInterval: time.Millisecond})
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addGroup(t, s, "stack", true, true, 101, 102)
+
+	runScheduledRestarts(s)
+
+	for _, vmid := range []int{101, 102} {
+		if logs := logsFor(t, s, vmid); len(logs) != 1 || logs[0].Verification != VerificationVerified {
+			t.Errorf("wait_healthy should verify %d anyway, got %+v", vmid, logs)
+		}
+	}
+}
+
+func TestGroupSkipsMembersOutsideWindow(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addGroup(t, s, "stack", true, true, 101, 102)
+
+	// 101 is due, but 102's window opens in two hours
+	start := time.Now().UTC().Add(2 * time.Hour)
+	_, err := testDB.Exec(`UPDATE whitelist SET window_start = ?, window_end = ?, timezone = 'UTC' WHERE vmid = 102`,
+		start.Format(windowLayout), start.Add(time.Hour).Format(windowLayout))
+	if err != nil {
+		t.Fatalf("set window: %v", err)
+	}
+
+	runScheduledRestarts(s)
+
+	if order := restartOrder(fake); len(order) != 1 || order[0] != 101 {
+		t.Fatalf("expected only the member inside its window to restart, got %v", order)
+	}
+}
+
+func TestGroupContinuesWithoutWaitHealthy(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addGroup(t, s, "stack", false, true, 101, 102)
+	fake.SetRebootStatus(101, "stopped")
+
+	runScheduledRestarts(s)
+
+	if order := restartOrder(fake); len(order) != 2 {
+		t.Fatalf("expected both members restarted, got %v", order)
+	}
+}
+
+func TestGroupDueWhenAnyMemberDue(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addGroup(t, s, "stack", true, true, 101, 102)
+
+	runScheduledRestarts(s)
+	runScheduledRestarts(s)
+
+	// Both members were just restarted, so the second check finds nothing due
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 2 {
+		t.Errorf("expected 2 restarts, got %d", got)
+	}
+}
+
+func TestManualRestartGroup(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	groupID := addGroup(t, s, "stack", true, true, 101)
+
+	if err := s.ManualRestartGroup(groupID+1, "tester"); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("expected ErrGroupNotFound, got %v", err)
+	}
+	if err := s.ManualRestartGroup(groupID, "tester"); err != nil {
+		t.Fatalf("ManualRestartGroup: %v", err)
+	}
+	s.queue.waitIdle()
+
+	logs := logsFor(t, s, 101)
+	if len(logs) != 1 || logs[0].TriggerType != "manual" || logs[0].TriggeredBy != "tester" {
+		t.Errorf("expected a manual restart by tester, got %+v", logs)
+	}
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 1 {
+		t.Errorf("expected 1 restart, got %d", got)
+	}
+}
@@ -0,0 +1,331 @@
+package scheduler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Whitelist change actions in a plan
+const (
+	ChangeAdd    = "add"
+	ChangeUpdate = "update"
+	ChangeRemove = "remove"
+)
+
+// ErrInvalidManifest wraps every problem found in a manifest
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// ErrEmptyManifest is returned when applying a manifest would remove every
+// whitelist entry without allowEmpty
+var ErrEmptyManifest = errors.New("manifest removes every whitelist entry; apply with allow_empty to confirm")
+
+// WhitelistManifest declares the complete desired whitelist. Entries are
+// matched to the table by VMID; table entries missing from the manifest are
+// removed. The whitelist key is required; an empty list empties the table.
+type WhitelistManifest struct {
+	Whitelist []ManifestEntry `yaml:"whitelist" json:"whitelist"`
+}
+
+// ManifestEntry is one guest in a whitelist manifest. Keys match the
+// whitelist API, except that restart groups are referenced by name.
+type ManifestEntry struct {
+	VMID                 int    `yaml:"vmid" json:"vmid"`
+	ResourceName         string `yaml:"resource_name" json:"resource_name"`
+	Node                 string `yaml:"node" json:"node"`
+	Enabled              *bool  `yaml:"enabled" json:"enabled"` // default true
+	RestartIntervalHours int    `yaml:"restart_interval_hours" json:"restart_interval_hours"`
+	CronExpression       string `yaml:"cron_expression" json:"cron_expression"`
+	WindowStart          string `yaml:"window_start" json:"window_start"`
+	WindowEnd            string `yaml:"window_end" json:"window_end"`
+	Timezone             string `yaml:"timezone" json:"timezone"`
+	Group                string `yaml:"group" json:"group"`
+	GroupOrder           int    `yaml:"group_order" json:"group_order"`
+	RestartMode          string `yaml:"restart_mode" json:"restart_mode"`
+	Notes                string `yaml:"notes" json:"notes"`
+}
+
+// FieldChange is one setting that differs between the table and the manifest
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// WhitelistChange is one entry a manifest adds, updates or removes
+type WhitelistChange struct {
+	Action       string        `json:"action"`
+	VMID         int           `json:"vmid"`
+	ResourceName string        `json:"resource_name"`
+	Node         string        `json:"node"`
+	Fields       []FieldChange `json:"fields,omitempty"`
+}
+
+// WhitelistPlan lists the changes that reconcile the whitelist table with a
+// manifest
+type WhitelistPlan struct {
+	Checksum  string            `json:"checksum"`
+	Add       int               `json:"add"`
+	Update    int               `json:"update"`
+	Remove    int               `json:"remove"`
+	Unchanged int               `json:"unchanged"`
+	Changes   []WhitelistChange `json:"changes"`
+
+	sync models.WhitelistSync
+}
+
+// InSync reports whether the table already matches the manifest
+func (p *WhitelistPlan) InSync() bool {
+	return len(p.Changes) == 0
+}
+
+// WhitelistDrift compares the table with the last applied manifest
+type WhitelistDrift struct {
+	Manifest *models.AppliedManifest `json:"manifest"`
+	InSync   bool                    `json:"in_sync"`
+	Plan     *WhitelistPlan          `json:"plan,omitempty"`
+}
+
+// ParseWhitelistManifest decodes and validates a YAML (or JSON) manifest
+func ParseWhitelistManifest(data []byte) (*WhitelistManifest, error) {
+	var m WhitelistManifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if m.Whitelist == nil {
+		return nil, errors.New("whitelist is required (use whitelist: [] to remove every entry)")
+	}
+
+	var errs []error
+	seen := make(map[int]bool)
+	for i, e := range m.Whitelist {
+		prefix := fmt.Sprintf("whitelist[%d]", i)
+		if e.VMID <= 0 {
+			errs = append(errs, fmt.Errorf("%s: vmid is required", prefix))
+			continue
+		}
+		prefix = fmt.Sprintf("whitelist[%d] (vmid %d)", i, e.VMID)
+		if seen[e.VMID] {
+			errs = append(errs, fmt.Errorf("%s: listed more than once", prefix))
+		}
+		seen[e.VMID] = true
+		if e.ResourceName == "" || e.Node == "" {
+			errs = append(errs, fmt.Errorf("%s: resource_name and node are required", prefix))
+		}
+		if e.RestartIntervalHours < 0 {
+			errs = append(errs, fmt.Errorf("%s: restart_interval_hours must not be negative", prefix))
+		}
+		if err := ValidateSchedule(e.CronExpression, e.WindowStart, e.WindowEnd, e.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+		if err := ValidateRestartMode(e.RestartMode); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// PlanWhitelist parses a manifest and works out how the whitelist table must
+// change to match it
+func (s *Scheduler) PlanWhitelist(content []byte) (*WhitelistPlan, error) {
+	manifest, err := ParseWhitelistManifest(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+
+	current, err := s.store.GetAllWhitelist()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get whitelist: %w", err)
+	}
+	groups, err := s.store.GetAllRestartGroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get restart groups: %w", err)
+	}
+	groupIDs := make(map[string]int64)
+	groupNames := make(map[int64]string)
+	for _, g := range groups {
+		groupIDs[g.Name] = g.ID
+		groupNames[g.ID] = g.Name
+	}
+
+	sum := sha256.Sum256(content)
+	plan := &WhitelistPlan{Checksum: hex.EncodeToString(sum[:]), Changes: []WhitelistChange{}}
+	plan.sync.Manifest = string(content)
+	plan.sync.Checksum = plan.Checksum
+
+	// Several rows may share a VMID on different nodes; only the first is kept
+	existing := make(map[int]models.Whitelist)
+	var duplicates []models.Whitelist
+	for _, wl := range current {
+		if _, dup := existing[wl.VMID]; dup {
+			duplicates = append(duplicates, wl)
+			continue
+		}
+		existing[wl.VMID] = wl
+	}
+
+	var errs []error
+	for _, e := range manifest.Whitelist {
+		desired, err := e.desired(groupIDs)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		wl, ok := existing[e.VMID]
+		if !ok {
+			plan.Add++
+			plan.Changes = append(plan.Changes, WhitelistChange{
+				Action: ChangeAdd, VMID: desired.VMID, ResourceName: desired.ResourceName, Node: desired.Node,
+			})
+			plan.sync.Create = append(plan.sync.Create, desired)
+			continue
+		}
+		delete(existing, e.VMID)
+
+		fields := diffWhitelist(wl, desired, groupNames)
+		if len(fields) == 0 {
+			plan.Unchanged++
+			continue
+		}
+		desired.ID = wl.ID
+		plan.Update++
+		plan.Changes = append(plan.Changes, WhitelistChange{
+			Action: ChangeUpdate, VMID: wl.VMID, ResourceName: desired.ResourceName, Node: desired.Node, Fields: fields,
+		})
+		plan.sync.Update = append(plan.sync.Update, desired)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+
+	for _, vmid := range slices.Sorted(maps.Keys(existing)) {
+		duplicates = append(duplicates, existing[vmid])
+	}
+	for _, wl := range duplicates {
+		plan.Remove++
+		plan.Changes = append(plan.Changes, WhitelistChange{
+			Action: ChangeRemove, VMID: wl.VMID, ResourceName: wl.ResourceName, Node: wl.Node,
+		})
+		plan.sync.Delete = append(plan.sync.Delete, wl.ID)
+	}
+	return plan, nil
+}
+
+// ApplyWhitelistManifest reconciles the whitelist table with a manifest and
+// records the manifest for drift reports. With dryRun nothing is changed and
+// only the plan is returned. A manifest that removes every entry is only
+// applied with allowEmpty.
+func (s *Scheduler) ApplyWhitelistManifest(content []byte, appliedBy string, dryRun, allowEmpty bool) (*WhitelistPlan, error) {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+
+	plan, err := s.PlanWhitelist(content)
+	if err != nil || dryRun {
+		return plan, err
+	}
+	if plan.Remove > 0 && plan.Add+plan.Update+plan.Unchanged == 0 && !allowEmpty {
+		return nil, ErrEmptyManifest
+	}
+
+	plan.sync.AppliedBy = appliedBy
+	for i := range plan.sync.Create {
+		plan.sync.Create[i].CreatedBy = appliedBy
+	}
+	if err := s.store.SyncWhitelist(&plan.sync); err != nil {
+		return nil, fmt.Errorf("failed to apply manifest: %w", err)
+	}
+
+	log.Printf("Whitelist manifest %.12s applied by %s: %d added, %d updated, %d removed, %d unchanged",
+		plan.Checksum, appliedBy, plan.Add, plan.Update, plan.Remove, plan.Unchanged)
+	return plan, nil
+}
+
+// GetWhitelistDrift compares the whitelist table with the last applied
+// manifest. It returns nil if no manifest was applied yet.
+func (s *Scheduler) GetWhitelistDrift() (*WhitelistDrift, error) {
+	applied, err := s.store.GetLastAppliedManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied manifest: %w", err)
+	}
+	if applied == nil {
+		return nil, nil
+	}
+
+	plan, err := s.PlanWhitelist([]byte(applied.Content))
+	if err != nil {
+		return nil, err
+	}
+	return &WhitelistDrift{Manifest: applied, InSync: plan.InSync(), Plan: plan}, nil
+}
+
+// desired returns the whitelist entry a manifest entry stands for, with the
+// same defaults the API applies
+func (e ManifestEntry) desired(groupIDs map[string]int64) (models.Whitelist, error) {
+	wl := models.Whitelist{
+		VMID:                 e.VMID,
+		ResourceName:         e.ResourceName,
+		Node:                 e.Node,
+		Enabled:              e.Enabled == nil || *e.Enabled,
+		RestartIntervalHours: e.RestartIntervalHours,
+		CronExpression:       e.CronExpression,
+		WindowStart:          e.WindowStart,
+		WindowEnd:            e.WindowEnd,
+		Timezone:             e.Timezone,
+		GroupOrder:           e.GroupOrder,
+		RestartMode:          e.RestartMode,
+		Notes:                e.Notes,
+	}
+	if wl.RestartIntervalHours < 1 {
+		wl.RestartIntervalHours = db.DefaultRestartInterval()
+	}
+	if wl.RestartMode == "" {
+		wl.RestartMode = RestartModeSchedule
+	}
+	if e.Group != "" {
+		id, ok := groupIDs[e.Group]
+		if !ok {
+			return wl, fmt.Errorf("vmid %d: restart group %q not found", e.VMID, e.Group)
+		}
+		wl.GroupID = id
+	}
+	return wl, nil
+}
+
+// diffWhitelist lists the manifest-managed settings that differ
+func diffWhitelist(current, desired models.Whitelist, groupNames map[int64]string) []FieldChange {
+	var fields []FieldChange
+	add := func(field string, from, to interface{}) {
+		if from != to {
+			fields = append(fields, FieldChange{Field: field, From: from, To: to})
+		}
+	}
+	add("resource_name", current.ResourceName, desired.ResourceName)
+	add("node", current.Node, desired.Node)
+	add("enabled", current.Enabled, desired.Enabled)
+	add("restart_interval_hours", current.RestartIntervalHours, desired.RestartIntervalHours)
+	add("cron_expression", current.CronExpression, desired.CronExpression)
+	add("window_start", current.WindowStart, desired.WindowStart)
+	add("window_end", current.WindowEnd, desired.WindowEnd)
+	add("timezone", current.Timezone, desired.Timezone)
+	add("group", groupNames[current.GroupID], groupNames[desired.GroupID])
+	add("group_order", current.GroupOrder, desired.GroupOrder)
+	add("restart_mode", current.RestartMode, desired.RestartMode)
+	add("notes", current.Notes, desired.Notes)
+	return fields
+}
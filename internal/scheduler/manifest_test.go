@@ -0,0 +1,179 @@
+package scheduler
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+const testManifest = `
+whitelist:
+  - vmid: 101
+    resource_name: db
+    node: pve1
+    restart_interval_hours: 12
+    group: backend
+  - vmid: 102
+    resource_name: app
+    node: pve2
+    enabled: false
+    cron_expression: "30 3 * * *"
+    window_start: "02:00"
+    window_end: "05:00"
+`
+
+func TestApplyWhitelistManifest(t *testing.T) {
+	s, _ := setupTest(t)
+	if _, err := s.store.CreateRestartGroup("backend", "", true, true); err != nil {
+		t.Fatalf("CreateRestartGroup: %v", err)
+	}
+	// 101 exists with other settings, 103 is not in the manifest
+	s.store.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", CreatedBy: "ui"})
+	s.store.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 103, ResourceName: "old", Node: "pve1", CreatedBy: "ui"})
+
+	plan, err := s.ApplyWhitelistManifest([]byte(testManifest), "ci", true, false)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if plan.Add != 1 || plan.Update != 1 || plan.Remove != 1 || plan.Unchanged != 0 {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	update := plan.Changes[0]
+	if update.Action != ChangeUpdate || update.VMID != 101 || len(update.Fields) != 2 ||
+		update.Fields[0].Field != "restart_interval_hours" || update.Fields[1].Field != "group" {
+		t.Errorf("unexpected update %+v", update)
+	}
+	if all, _ := s.store.GetAllWhitelist(); len(all) != 2 || all[1].VMID != 103 {
+		t.Fatalf("dry run changed the whitelist: %+v", all)
+	}
+
+	if _, err := s.ApplyWhitelistManifest([]byte(testManifest), "ci", false, false); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	all, _ := s.store.GetAllWhitelist()
+	if len(all) != 2 || all[0].RestartIntervalHours != 12 || all[0].GroupID == 0 {
+		t.Fatalf("unexpected whitelist after apply: %+v", all)
+	}
+	if app := all[1]; app.VMID != 102 || app.Enabled || app.CronExpression != "30 3 * * *" || app.CreatedBy != "ci" {
+		t.Errorf("unexpected added entry %+v", app)
+	}
+
+	// Applying again changes nothing
+	plan, err = s.ApplyWhitelistManifest([]byte(testManifest), "ci", true, false)
+	if err != nil || !plan.InSync() || plan.Unchanged != 2 {
+		t.Errorf("expected no changes on reapply, got %+v, %v", plan, err)
+	}
+}
+
+func TestWhitelistDrift(t *testing.T) {
+	s, _ := setupTest(t)
+	s.store.CreateRestartGroup("backend", "", true, true)
+
+	if drift, err := s.GetWhitelistDrift(); err != nil || drift != nil {
+		t.Fatalf("expected no drift report before an apply, got %+v, %v", drift, err)
+	}
+	if _, err := s.ApplyWhitelistManifest([]byte(testManifest), "ci", false, false); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	drift, err := s.GetWhitelistDrift()
+	if err != nil || !drift.InSync || drift.Manifest.AppliedBy != "ci" {
+		t.Fatalf("expected no drift right after applying, got %+v, %v", drift, err)
+	}
+
+	// Someone edits and adds entries outside the manifest
+	wl, _ := s.store.GetWhitelistByVMID(101)
+	s.store.UpdateWhitelist(wl.ID, &models.UpdateWhitelistRequest{Enabled: false, RestartIntervalHours: 12, GroupID: &wl.GroupID})
+	s.store.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 104, ResourceName: "extra", Node: "pve1", CreatedBy: "ui"})
+
+	drift, err = s.GetWhitelistDrift()
+	if err != nil {
+		t.Fatalf("GetWhitelistDrift: %v", err)
+	}
+	if drift.InSync || drift.Plan.Update != 1 || drift.Plan.Remove != 1 {
+		t.Fatalf("unexpected drift %+v", drift.Plan)
+	}
+	if f := drift.Plan.Changes[0].Fields; len(f) != 1 || f[0].Field != "enabled" || f[0].From != false || f[0].To != true {
+		t.Errorf("unexpected drifted fields %+v", f)
+	}
+}
+
+func TestPlanWhitelistRejectsInvalidManifest(t *testing.T) {
+	s, _ := setupTest(t)
+
+	manifest := `
+whitelist:
+  - vmid: 101
+    resource_name: db
+    node: pve1
+    group: missing
+  - vmid: 101
+    resource_name: db
+    node: pve1
+  - vmid: 102
+    node: pve2
+    cron_expression: "every day"
+`
+	_, err := s.PlanWhitelist([]byte(manifest))
+	if !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("expected ErrInvalidManifest, got %v", err)
+	}
+	for _, want := range []string{"listed more than once", "resource_name and node are required", "invalid cron expression"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q should mention %q", err, want)
+		}
+	}
+
+	if _, err := s.PlanWhitelist([]byte("whitelist:\n  - vmid: 101\n    resource_name: db\n    node: pve1\n    group: missing\n")); err == nil ||
+		!strings.Contains(err.Error(), `restart group "missing" not found`) {
+		t.Errorf("expected an unknown group error, got %v", err)
+	}
+	if _, err := s.PlanWhitelist([]byte("whitelist:\n  - vmid: 101\n    name: db\n")); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("unknown keys should be rejected, got %v", err)
+	}
+}
+
+func TestApplyEmptyManifest(t *testing.T) {
+	s, _ := setupTest(t)
+	s.store.CreateWhitelist(&models.CreateWhitelistRequest{VMID: 101, ResourceName: "db", Node: "pve1", CreatedBy: "ui"})
+
+	// A manifest without the whitelist key is a mistake, not an empty list
+	for _, manifest := range []string{"", "{}", "whitelist:\n", "# nothing here\n"} {
+		if _, err := s.ApplyWhitelistManifest([]byte(manifest), "ci", false, true); !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("manifest %q: expected ErrInvalidManifest, got %v", manifest, err)
+		}
+	}
+
+	if _, err := s.ApplyWhitelistManifest([]byte("whitelist: []\n"), "ci", false, false); !errors.Is(err, ErrEmptyManifest) {
+		t.Errorf("expected ErrEmptyManifest without allow_empty, got %v", err)
+	}
+	if plan, err := s.ApplyWhitelistManifest([]byte(`{"whitelist": []}`), "ci", true, false); err != nil || plan.Remove != 1 {
+		t.Errorf("dry run: %+v, %v", plan, err)
+	}
+	if all, _ := s.store.GetAllWhitelist(); len(all) != 1 {
+		t.Fatalf("whitelist changed without allow_empty: %+v", all)
+	}
+
+	if _, err := s.ApplyWhitelistManifest([]byte("whitelist: []\n"), "ci", false, true); err != nil {
+		t.Fatalf("apply with allow_empty: %v", err)
+	}
+	if all, _ := s.store.GetAllWhitelist(); len(all) != 0 {
+		t.Errorf("expected an empty whitelist, got %+v", all)
+	}
+}
+
+func TestExampleManifestParses(t *testing.T) {
+	data, err := os.ReadFile("../../whitelist.example.yaml")
+	if err != nil {
+		t.Fatalf("read example: %v", err)
+	}
+	m, err := ParseWhitelistManifest(data)
+	if err != nil {
+		t.Fatalf("whitelist.example.yaml is invalid: %v", err)
+	}
+	if len(m.Whitelist) != 3 || *m.Whitelist[2].Enabled {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+}
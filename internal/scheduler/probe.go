@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+// Health check types
+const (
+	ProbeHTTP   = "http"   // GET target, healthy on a status below 400
+	ProbeTCP    = "tcp"    // connect to target host:port
+	ProbeExec   = "exec"   // run target with pct exec, healthy on exit code 0
+	ProbeMemory = "memory" // unhealthy when memory use is above threshold percent
+	ProbeCPU    = "cpu"    // unhealthy when CPU use is above threshold percent
+)
+
+// Health check defaults applied by ValidateHealthCheck
+const (
+	defaultProbeInterval    = 60
+	defaultProbeTimeout     = 10
+	defaultFailureThreshold = 3
+	defaultProbeCooldown    = 30
+)
+
+// ValidateHealthCheck fills in defaults and checks that the probe type and
+// its target or threshold make sense
+func ValidateHealthCheck(req *models.HealthCheckRequest) error {
+	switch req.Type {
+	case ProbeHTTP, ProbeTCP, ProbeExec:
+		if req.Target == "" {
+			return fmt.Errorf("target is required for %s checks", req.Type)
+		}
+	case ProbeMemory, ProbeCPU:
+		if req.Threshold <= 0 || req.Threshold > 100 {
+			return fmt.Errorf("threshold must be a percentage between 0 and 100")
+		}
+	default:
+		return fmt.Errorf("type must be one of http, tcp, exec, memory, cpu")
+	}
+
+	if req.Type == ProbeTCP {
+		if _, _, err := net.SplitHostPort(req.Target); err != nil {
+			return fmt.Errorf("target must be host:port: %w", err)
+		}
+	}
+
+	if req.IntervalSeconds <= 0 {
+		req.IntervalSeconds = defaultProbeInterval
+	}
+	if req.TimeoutSeconds <= 0 {
+		req.TimeoutSeconds = defaultProbeTimeout
+	}
+	if req.FailureThreshold <= 0 {
+		req.FailureThreshold = defaultFailureThreshold
+	}
+	if req.CooldownMinutes <= 0 {
+		req.CooldownMinutes = defaultProbeCooldown
+	}
+	return nil
+}
+
+// runProbe runs a health check against a guest and reports whether it is
+// healthy along with a short description of the result
+func runProbe(hc models.HealthCheck, resource models.Resource) (bool, string) {
+	timeout := time.Duration(hc.TimeoutSeconds) * time.Second
+
+	switch hc.Type {
+	case ProbeHTTP:
+		client := &http.Client{Timeout: timeout}
+		start := time.Now()
+		resp, err := client.Get(hc.Target)
+		if err != nil {
+			return false, fmt.Sprintf("GET %s failed: %v", hc.Target, err)
+		}
+		resp.Body.Close()
+		result := fmt.Sprintf("GET %s returned %d in %dms", hc.Target, resp.StatusCode, time.Since(start).Milliseconds())
+		return resp.StatusCode < 400, result
+
+	case ProbeTCP:
+		conn, err := net.DialTimeout("tcp", hc.Target, timeout)
+		if err != nil {
+			return false, fmt.Sprintf("connect to %s failed: %v", hc.Target, err)
+		}
+		conn.Close()
+		return true, fmt.Sprintf("connected to %s", hc.Target)
+
+	case ProbeExec:
+		if err := proxmox.ExecuteInContainer(hc.VMID, hc.Target, timeout); err != nil {
+			return false, fmt.Sprintf("%q failed: %v", hc.Target, err)
+		}
+		return true, fmt.Sprintf("%q exited 0", hc.Target)
+
+	case ProbeMemory:
+		if resource.MemoryTotal <= 0 {
+			return true, "memory usage unknown"
+		}
+		percent := float64(resource.MemoryUsed) / float64(resource.MemoryTotal) * 100
+		return percent <= hc.Threshold, fmt.Sprintf("memory at %.1f%% (threshold %.1f%%)", percent, hc.Threshold)
+
+	case ProbeCPU:
+		// Proxmox reports CPU usage as a fraction of the guest's cores
+		percent := resource.CPUUsage * 100
+		return percent <= hc.Threshold, fmt.Sprintf("cpu at %.1f%% (threshold %.1f%%)", percent, hc.Threshold)
+	}
+
+	return false, fmt.Sprintf("unknown check type %q", hc.Type)
+}
@@ -0,0 +1,255 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// QueueConfig limits how scheduled restarts are dispatched
+type QueueConfig struct {
+	// MaxConcurrent caps restarts running at the same time; 0 means no limit
+	MaxConcurrent int
+	// MaxPerNode caps concurrent restarts on a single node; 0 means no limit
+	MaxPerNode int
+	// Stagger is the minimum delay between starting two restarts
+	Stagger time.Duration
+	// Jitter adds a random delay of up to this much on top of Stagger
+	Jitter time.Duration
+}
+
+// DefaultQueueConfig restarts one guest per node, two at a time cluster-wide,
+// spaced 30-60 seconds apart
+var DefaultQueueConfig = QueueConfig{
+	MaxConcurrent: 2,
+	MaxPerNode:    1,
+	Stagger:       30 * time.Second,
+	Jitter:        30 * time.Second,
+}
+
+// QueueStats is a snapshot of the restart queue
+type QueueStats struct {
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+}
+
+// restartJob is a scheduled restart waiting in the queue. A job either
+// restarts a single guest or, when group is set, a whole restart group as a
+// rolling sequence.
+type restartJob struct {
+	vmid         int
+	resourceName string
+	node         string
+	resourceType string
+	triggerType  string
+	triggeredBy  string
+	probeResult  string // failed health check behind a watchdog restart
+	// schedule holds the maintenance window of a scheduled restart, which
+	// must still be open when the job starts; nil for restarts that may
+	// start any time
+	schedule *entrySchedule
+
+	group   *models.RestartGroup
+	members []groupMember
+}
+
+// nodes returns the nodes a job restarts guests on
+func (j restartJob) nodes() []string {
+	if j.group == nil {
+		return []string{j.node}
+	}
+	var nodes []string
+	for _, m := range j.members {
+		if !slices.Contains(nodes, m.whitelist.Node) {
+			nodes = append(nodes, m.whitelist.Node)
+		}
+	}
+	return nodes
+}
+
+// key identifies a job for duplicate detection
+func (j restartJob) key() string {
+	if j.group != nil {
+		return fmt.Sprintf("group:%d", j.group.ID)
+	}
+	return fmt.Sprintf("vmid:%d", j.vmid)
+}
+
+// restartQueue runs scheduled restarts in FIFO order while respecting the
+// global and per-node concurrency limits and the stagger between starts
+type restartQueue struct {
+	run         func(restartJob)
+	mu          sync.Mutex
+	cond        *sync.Cond
+	cfg         QueueConfig
+	pending     []restartJob
+	active      map[string]bool // job keys queued or running, to avoid duplicates
+	running     int
+	perNode     map[string]int
+	nextStartAt time.Time
+	started     bool
+}
+
+// newRestartQueue returns a queue that starts each job with run
+func newRestartQueue(cfg QueueConfig, run func(restartJob)) *restartQueue {
+	q := &restartQueue{
+		run:     run,
+		cfg:     cfg,
+		active:  make(map[string]bool),
+		perNode: make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// SetQueueConfig changes the restart queue limits; running restarts are not affected
+func (s *Scheduler) SetQueueConfig(cfg QueueConfig) {
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+	s.queue.cfg = cfg
+	s.queue.cond.Broadcast()
+}
+
+// GetQueueStats returns how many scheduled restarts are queued and running
+func (s *Scheduler) GetQueueStats() QueueStats {
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+	return QueueStats{Queued: len(s.queue.pending), Running: s.queue.running}
+}
+
+// enqueue adds a restart unless the same VMID or group is already queued or
+// running. It returns false for duplicates.
+func (q *restartQueue) enqueue(job restartJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active[job.key()] {
+		return false
+	}
+	q.active[job.key()] = true
+	q.pending = append(q.pending, job)
+
+	if !q.started {
+		q.started = true
+		go q.dispatch()
+	}
+	q.cond.Broadcast()
+	return true
+}
+
+// dispatch starts queued restarts as limits allow. It runs for the life of the process.
+func (q *restartQueue) dispatch() {
+	for {
+		job := q.next()
+		go func() {
+			defer q.finish(job)
+			q.run(job)
+		}()
+	}
+}
+
+// next blocks until a queued job may start and marks it running
+func (q *restartQueue) next() restartJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		q.dropClosed(time.Now())
+		idx := q.runnable()
+		if idx >= 0 {
+			wait := time.Until(q.nextStartAt)
+			if wait <= 0 {
+				job := q.pending[idx]
+				q.pending = append(q.pending[:idx], q.pending[idx+1:]...)
+				q.running++
+				for _, node := range job.nodes() {
+					q.perNode[node]++
+				}
+				q.nextStartAt = time.Now().Add(q.delay())
+				return job
+			}
+			// Wake up once the stagger has elapsed
+			time.AfterFunc(wait, q.cond.Broadcast)
+		}
+		q.cond.Wait()
+	}
+}
+
+// dropClosed removes the queued jobs whose maintenance window has closed
+// while they waited. Callers hold q.mu.
+func (q *restartQueue) dropClosed(now time.Time) {
+	kept := q.pending[:0]
+	for _, job := range q.pending {
+		if job.schedule != nil && !job.schedule.inWindow(now) {
+			log.Printf("WARNING: Maintenance window of resource %d (%s) closed while it was queued, dropping its restart",
+				job.vmid, job.resourceName)
+			delete(q.active, job.key())
+			continue
+		}
+		kept = append(kept, job)
+	}
+	if len(kept) < len(q.pending) {
+		q.pending = kept
+		q.cond.Broadcast()
+	}
+}
+
+// runnable returns the index of the first pending job that fits the limits,
+// or -1. Callers hold q.mu.
+func (q *restartQueue) runnable() int {
+	if q.cfg.MaxConcurrent > 0 && q.running >= q.cfg.MaxConcurrent {
+		return -1
+	}
+	for i, job := range q.pending {
+		// A group holds a slot on every node it has members on while it runs
+		if q.cfg.MaxPerNode > 0 && slices.ContainsFunc(job.nodes(), func(node string) bool {
+			return q.perNode[node] >= q.cfg.MaxPerNode
+		}) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// delay returns the stagger plus a random jitter. Callers hold q.mu.
+func (q *restartQueue) delay() time.Duration {
+	d := q.cfg.Stagger
+	if q.cfg.Jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(q.cfg.Jitter)))
+	}
+	return d
+}
+
+func (q *restartQueue) finish(job restartJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running--
+	for _, node := range job.nodes() {
+		q.perNode[node]--
+		if q.perNode[node] == 0 {
+			delete(q.perNode, node)
+		}
+	}
+	delete(q.active, job.key())
+	q.cond.Broadcast()
+
+	if len(q.pending) > 0 {
+		log.Printf("Restart queue: %d running, %d waiting", q.running, len(q.pending))
+	}
+}
+
+// waitIdle blocks until nothing is queued or running
+func (q *restartQueue) waitIdle() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 || q.running > 0 {
+		q.cond.Wait()
+	}
+}
@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+func TestQueuePerNodeLimit(t *testing.T) {
+	s, fake := setupTest(t)
+	s.SetQueueConfig(QueueConfig{MaxConcurrent: 2, MaxPerNode: 1})
+	fake.SetTaskPolls(10)
+
+	for vmid := 201; vmid <= 204; vmid++ {
+		name := fmt.Sprintf("ct-%d", vmid)
+		fake.AddGuest(models.Resource{VMID: vmid, Name: name, Type: "lxc", Node: "pve1", Status: "running"})
+		addWhitelist(t, s, vmid, name, "pve1")
+	}
+
+	runScheduledRestarts(s)
+
+	var logs []models.RestartLog
+	for vmid := 201; vmid <= 204; vmid++ {
+		l := logsFor(t, s, vmid)
+		if len(l) != 1 || l[0].Status != "success" {
+			t.Fatalf("expected one successful restart for %d, got %+v", vmid, l)
+		}
+		logs = append(logs, l[0])
+	}
+
+	// Restarts on the same node must not overlap
+	for i := range logs {
+		for j := range logs {
+			if i == j {
+				continue
+			}
+			a, b := logs[i], logs[j]
+			if a.StartedAt.Before(b.StartedAt) && a.CompletedAt.After(b.StartedAt) {
+				t.Errorf("restarts of %d and %d overlapped on the same node", a.VMID, b.VMID)
+			}
+		}
+	}
+}
+
+func TestQueueStagger(t *testing.T) {
+	s, _ := setupTest(t)
+	s.SetQueueConfig(QueueConfig{Stagger: 30 * time.Millisecond})
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+
+	runScheduledRestarts(s)
+
+	first, second := logsFor(t, s, 101)[0].StartedAt, logsFor(t, s, 102)[0].StartedAt
+	gap := second.Sub(first)
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap < 30*time.Millisecond {
+		t.Errorf("restarts started %s apart, want at least 30ms", gap)
+	}
+}
+
+func TestQueueDeduplicates(t *testing.T) {
+	q := newRestartQueue(QueueConfig{}, nil)
+	job := restartJob{vmid: 101, node: "pve1"}
+
+	// Do not start the dispatcher; only the bookkeeping is under test
+	q.started = true
+	if !q.enqueue(job) {
+		t.Fatal("first enqueue should succeed")
+	}
+	if q.enqueue(job) {
+		t.Error("duplicate VMID should not be queued twice")
+	}
+	if len(q.pending) != 1 {
+		t.Errorf("expected 1 pending job, got %d", len(q.pending))
+	}
+}
+
+func TestQueueLimitsGroupsPerNode(t *testing.T) {
+	q := newRestartQueue(QueueConfig{MaxPerNode: 1}, nil)
+	q.started = true
+
+	group := restartJob{
+		group: &models.RestartGroup{ID: 1, Name: "stack"},
+		members: []groupMember{
+			{whitelist: models.Whitelist{VMID: 103, Node: "pve2"}},
+			{whitelist: models.Whitelist{VMID: 104, Node: "pve1"}},
+		},
+	}
+	q.enqueue(restartJob{vmid: 101, node: "pve1"})
+	q.enqueue(group)
+	q.enqueue(restartJob{vmid: 102, node: "pve2"})
+
+	// The group waits for pve1, and then holds pve2 until it finishes
+	if job := q.next(); job.vmid != 101 {
+		t.Fatalf("expected job 101 to start, got %+v", job)
+	}
+	if job := q.next(); job.vmid != 102 {
+		t.Fatalf("expected job 102 to start while the group waits for pve1, got %+v", job)
+	}
+	q.finish(restartJob{vmid: 101, node: "pve1"})
+	q.finish(restartJob{vmid: 102, node: "pve2"})
+	if job := q.next(); job.group == nil {
+		t.Fatalf("expected the group to start, got %+v", job)
+	}
+	if q.perNode["pve1"] != 1 || q.perNode["pve2"] != 1 {
+		t.Errorf("group should count against both nodes, got %v", q.perNode)
+	}
+}
+
+func TestQueueDropsClosedWindows(t *testing.T) {
+	q := newRestartQueue(QueueConfig{}, nil)
+	q.started = true
+
+	// A window that opens in two hours has closed for a job queued earlier
+	now := time.Now().UTC()
+	closed, err := parseSchedule(models.Whitelist{
+		WindowStart: now.Add(2 * time.Hour).Format(windowLayout),
+		WindowEnd:   now.Add(3 * time.Hour).Format(windowLayout),
+	})
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+	open, _ := parseSchedule(models.Whitelist{})
+
+	q.enqueue(restartJob{vmid: 101, node: "pve1", schedule: closed})
+	q.enqueue(restartJob{vmid: 102, node: "pve1", schedule: open})
+	q.enqueue(restartJob{vmid: 103, node: "pve1"})
+
+	for _, want := range []int{102, 103} {
+		if job := q.next(); job.vmid != want {
+			t.Errorf("expected job %d to start, got %d", want, job.vmid)
+		}
+	}
+	if len(q.pending) != 0 || q.active["vmid:101"] {
+		t.Errorf("job outside its window still queued: %+v, %v", q.pending, q.active)
+	}
+}
@@ -3,6 +3,9 @@ package scheduler
 import (
 	"fmt"
 	"log"
+	"maps"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/rakib/proxmox-auto-restart/internal/db"
@@ -11,42 +14,80 @@ import (
 	"github.com/robfig/cron/v3"
 )
 
-var restartCron *cron.Cron
+// Scheduler restarts whitelisted guests on schedule and when their health
+// checks fail, and prunes and backs up the database it works on
+type Scheduler struct {
+	// store holds whitelist entries, restart logs and health checks
+	store db.Store
+	queue *restartQueue
+
+	restartCron  *cron.Cron
+	watchdogCron *cron.Cron
+	pruneCron    *cron.Cron
+	backupCron   *cron.Cron
+
+	// pruneMu serializes pruning runs and guards pruneStats
+	pruneMu    sync.Mutex
+	pruneStats PruneStats
+
+	// manifestMu serializes manifest applies
+	manifestMu sync.Mutex
+}
+
+// New returns a scheduler that reads and writes through store
+func New(store db.Store) *Scheduler {
+	s := &Scheduler{store: store}
+	s.queue = newRestartQueue(DefaultQueueConfig, s.runJob)
+	return s
+}
+
+// taskTimeout bounds how long an action waits for its Proxmox task to finish
+var taskTimeout = 10 * time.Minute
 
 // StartRestartScheduler starts the auto-restart scheduler for whitelisted VMs/Containers
-func StartRestartScheduler(interval string) error {
-	restartCron = cron.New()
+func (s *Scheduler) StartRestartScheduler(interval string) error {
+	s.restartCron = cron.New()
 
 	// Run every hour to check for due restarts
 	if interval == "" {
 		interval = "@every 1h"
 	}
 
-	_, err := restartCron.AddFunc(interval, restartWhitelistedResources)
+	id, err := s.restartCron.AddFunc(interval, s.restartWhitelistedResources)
 	if err != nil {
 		return err
 	}
 
-	restartCron.Start()
+	s.restartCron.Start()
 	log.Printf("Auto-restart scheduler started (interval: %s, next run: %s)",
-		interval, time.Now().Add(1*time.Hour).Format(time.RFC3339))
+		interval, s.restartCron.Entry(id).Schedule.Next(time.Now()).Format(time.RFC3339))
 	return nil
 }
 
 // StopRestartScheduler stops the auto-restart scheduler
-func StopRestartScheduler() {
-	if restartCron != nil {
-		restartCron.Stop()
+func (s *Scheduler) StopRestartScheduler() {
+	if s.restartCron != nil {
+		s.restartCron.Stop()
+		s.restartCron = nil
 		log.Println("Auto-restart scheduler stopped")
 	}
 }
 
+// runJob runs a restart taken from the queue
+func (s *Scheduler) runJob(job restartJob) {
+	if job.group != nil {
+		s.restartGroup(job.group, job.members, job.triggerType, job.triggeredBy)
+		return
+	}
+	s.restartResource(job.vmid, job.resourceName, job.node, job.resourceType, job.triggerType, job.triggeredBy, job.probeResult)
+}
+
 // restartWhitelistedResources restarts all enabled whitelisted VMs/Containers
-func restartWhitelistedResources() {
+func (s *Scheduler) restartWhitelistedResources() {
 	log.Println("Starting auto-restart check for whitelisted resources...")
 
 	// Get enabled whitelist entries
-	whitelisted, err := db.GetEnabledWhitelist()
+	whitelisted, err := s.store.GetEnabledWhitelist()
 	if err != nil {
 		log.Printf("ERROR: Failed to get whitelist: %v", err)
 		return
@@ -72,53 +113,98 @@ func restartWhitelistedResources() {
 		typeMap[r.VMID] = r.Type
 	}
 
+	// Grouped entries are restarted together as a rolling sequence
+	groups := make(map[int64][]groupMember)
+	dueGroups := make(map[int64]string)
+
 	for _, wl := range whitelisted {
+		if wl.RestartMode == RestartModeWatchdog {
+			// Only restarted when a health check fails, see watchdog.go
+			continue
+		}
+
+		if inBackoff(wl, time.Now()) {
+			log.Printf("Resource %d (%s) is quarantined until %s (%s), skipping",
+				wl.VMID, wl.ResourceName, wl.QuarantinedUntil.Format(time.RFC3339), wl.QuarantineReason)
+			continue
+		}
+
 		resourceType, exists := typeMap[wl.VMID]
 		if !exists {
 			log.Printf("WARNING: Resource %d (%s) not found in Proxmox, skipping", wl.VMID, wl.ResourceName)
 			continue
 		}
 
+		schedule, err := parseSchedule(wl)
+		if err != nil {
+			log.Printf("ERROR: Invalid schedule for %d (%s): %v", wl.VMID, wl.ResourceName, err)
+			continue
+		}
+
 		// Check if it's time to restart
-		lastRestart, err := db.GetLastRestartTime(wl.VMID)
+		lastRestart, err := s.store.GetLastRestartTime(wl.VMID)
 		if err != nil {
 			log.Printf("ERROR: Failed to get last restart time for %d: %v", wl.VMID, err)
 			continue
 		}
 
-		// Default interval is 6 hours if not set (though DB default is 6)
-		intervalHours := wl.RestartIntervalHours
-		if intervalHours < 1 {
-			intervalHours = 6
+		shouldRestart, reason := isDue(wl, schedule, lastRestart, time.Now())
+
+		if wl.GroupID != 0 {
+			if !schedule.inWindow(time.Now()) {
+				log.Printf("Resource %d (%s) is outside its maintenance window, leaving it out of group %d",
+					wl.VMID, wl.ResourceName, wl.GroupID)
+				continue
+			}
+			groups[wl.GroupID] = append(groups[wl.GroupID], groupMember{whitelist: wl, resourceType: resourceType, schedule: schedule})
+			if shouldRestart {
+				if _, seen := dueGroups[wl.GroupID]; !seen {
+					dueGroups[wl.GroupID] = fmt.Sprintf("member %d (%s) %s", wl.VMID, wl.ResourceName, reason)
+				}
+			}
+			continue
 		}
 
-		// If never restarted, or time since last restart >= interval
-		shouldRestart := false
-		if lastRestart.IsZero() {
-			shouldRestart = true
-			log.Printf("Resource %d (%s) has never been auto-restarted, triggering now", wl.VMID, wl.ResourceName)
-		} else {
-			hoursSince := time.Since(lastRestart).Hours()
-			if hoursSince >= float64(intervalHours) {
-				shouldRestart = true
-				log.Printf("Resource %d (%s) last restarted %.1f hours ago (interval: %dh), triggering now",
-					wl.VMID, wl.ResourceName, hoursSince, intervalHours)
+		if shouldRestart {
+			queued := s.queue.enqueue(restartJob{
+				vmid:         wl.VMID,
+				resourceName: wl.ResourceName,
+				node:         wl.Node,
+				resourceType: resourceType,
+				triggerType:  "auto",
+				triggeredBy:  "system",
+				schedule:     schedule,
+			})
+			if queued {
+				log.Printf("Resource %d (%s) %s, queued for restart", wl.VMID, wl.ResourceName, reason)
 			} else {
-				log.Printf("Resource %d (%s) not due for restart (last: %.1f hours ago, interval: %dh)",
-					wl.VMID, wl.ResourceName, hoursSince, intervalHours)
+				log.Printf("Resource %d (%s) is already queued or restarting", wl.VMID, wl.ResourceName)
 			}
+		} else {
+			log.Printf("Resource %d (%s) not due for restart (%s)", wl.VMID, wl.ResourceName, reason)
 		}
+	}
 
-		if shouldRestart {
-			restartResource(wl.VMID, wl.ResourceName, wl.Node, resourceType, "auto", "system")
+	for _, groupID := range slices.Sorted(maps.Keys(groups)) {
+		members := groups[groupID]
+		slices.SortStableFunc(members, func(a, b groupMember) int {
+			return a.whitelist.GroupOrder - b.whitelist.GroupOrder
+		})
+		reason, due := dueGroups[groupID]
+		if !due {
+			log.Printf("Restart group %d not due for restart", groupID)
+			continue
 		}
+		s.enqueueGroup(groupID, members, reason, "auto", "system")
 	}
 
 	log.Println("Auto-restart check completed")
 }
 
-// restartResource restarts a specific VM/Container and logs the operation
-func restartResource(vmid int, resourceName, node, resourceType, triggerType, triggeredBy string) {
+// restartResource restarts a specific VM/Container and logs the operation.
+// probeResult records the failed health check behind a watchdog restart.
+// It returns the final log entry, or nil if the log could not be created.
+func (s *Scheduler) restartResource(vmid int, resourceName, node, resourceType, triggerType, triggeredBy, probeResult string) *models.RestartLog {
 	// Create log entry
 	logEntry := &models.RestartLog{
 		VMID:         vmid,
@@ -128,13 +214,14 @@ func restartResource(vmid int, resourceName, node, resourceType, triggerType, tr
 		TriggerType:  triggerType,
 		TriggeredBy:  triggeredBy,
 		Status:       "pending",
+		ProbeResult:  probeResult,
 		StartedAt:    time.Now(),
 	}
 
-	logID, err := db.CreateRestartLog(logEntry)
+	logID, err := s.store.CreateRestartLog(logEntry)
 	if err != nil {
 		log.Printf("ERROR: Failed to create restart log for %d: %v", vmid, err)
-		return
+		return nil
 	}
 
 	logEntry.ID = logID
@@ -142,6 +229,9 @@ func restartResource(vmid int, resourceName, node, resourceType, triggerType, tr
 	// Execute restart
 	startTime := time.Now()
 	output, err := proxmox.RestartResource(node, vmid, resourceType)
+	if err == nil {
+		err = awaitTask(logEntry, output)
+	}
 	duration := time.Since(startTime).Seconds()
 
 	// Update log entry
@@ -159,13 +249,46 @@ func restartResource(vmid int, resourceName, node, resourceType, triggerType, tr
 		log.Printf("Successfully restarted resource %d (%s) in %.2fs", vmid, resourceName, duration)
 	}
 
-	if err := db.UpdateRestartLog(logEntry); err != nil {
+	if err := s.store.UpdateRestartLog(logEntry); err != nil {
 		log.Printf("ERROR: Failed to update restart log: %v", err)
 	}
+
+	// Confirm the guest actually came back
+	if logEntry.Status == "success" {
+		s.verifyAfterRestart(logEntry, resourceType, startTime)
+	}
+
+	s.checkCrashLoop(logEntry)
+	return logEntry
+}
+
+// awaitTask waits for the Proxmox task started by an action and records its
+// UPID, exit status and task log on the log entry. The action only counts as
+// successful once the task has stopped with exit status OK.
+func awaitTask(logEntry *models.RestartLog, output string) error {
+	upid := proxmox.ExtractUPID(output)
+	if upid == "" {
+		// Nothing to wait for, e.g. starting a guest that is already running
+		return nil
+	}
+	logEntry.UPID = upid
+
+	status, err := proxmox.WaitForTask(upid, taskTimeout)
+	if status != nil {
+		logEntry.ExitStatus = status.ExitStatus
+		logEntry.TaskLog = status.Log
+	}
+	if err != nil {
+		return err
+	}
+	if !status.Succeeded() {
+		return fmt.Errorf("task %s failed: %s", upid, status.ExitStatus)
+	}
+	return nil
 }
 
 // ManualRestartResource handles manual restart requests
-func ManualRestartResource(vmid int, node, triggeredBy string) error {
+func (s *Scheduler) ManualRestartResource(vmid int, node, triggeredBy string) error {
 	// Get resource type from Proxmox
 	resource, err := proxmox.GetResource(node, vmid)
 	if err != nil {
@@ -178,12 +301,12 @@ func ManualRestartResource(vmid int, node, triggeredBy string) error {
 	log.Printf("Manual restart requested for %s (VMID: %d, Type: %s) by %s",
 		resource.Name, vmid, resource.Type, triggeredBy)
 
-	go restartResource(vmid, resource.Name, node, resource.Type, "manual", triggeredBy)
+	go s.restartResource(vmid, resource.Name, node, resource.Type, "manual", triggeredBy, "")
 	return nil
 }
 
 // stopResource stops a specific VM/Container and logs the operation
-func stopResource(vmid int, resourceName, node, resourceType, triggerType, triggeredBy string) {
+func (s *Scheduler) stopResource(vmid int, resourceName, node, resourceType, triggerType, triggeredBy string) {
 	// Create log entry
 	logEntry := &models.RestartLog{
 		VMID:         vmid,
@@ -196,7 +319,7 @@ func stopResource(vmid int, resourceName, node, resourceType, triggerType, trigg
 		StartedAt:    time.Now(),
 	}
 
-	logID, err := db.CreateRestartLog(logEntry)
+	logID, err := s.store.CreateRestartLog(logEntry)
 	if err != nil {
 		log.Printf("ERROR: Failed to create stop log for %d: %v", vmid, err)
 		return
@@ -207,6 +330,9 @@ func stopResource(vmid int, resourceName, node, resourceType, triggerType, trigg
 	// Execute stop
 	startTime := time.Now()
 	output, err := proxmox.StopResource(node, vmid, resourceType)
+	if err == nil {
+		err = awaitTask(logEntry, output)
+	}
 	duration := time.Since(startTime).Seconds()
 
 	// Update log entry
@@ -224,13 +350,13 @@ func stopResource(vmid int, resourceName, node, resourceType, triggerType, trigg
 		log.Printf("Successfully stopped resource %d (%s) in %.2fs", vmid, resourceName, duration)
 	}
 
-	if err := db.UpdateRestartLog(logEntry); err != nil {
+	if err := s.store.UpdateRestartLog(logEntry); err != nil {
 		log.Printf("ERROR: Failed to update stop log: %v", err)
 	}
 }
 
 // ManualStopResource handles manual stop requests
-func ManualStopResource(vmid int, node, triggeredBy string) error {
+func (s *Scheduler) ManualStopResource(vmid int, node, triggeredBy string) error {
 	// Get resource type from Proxmox
 	resource, err := proxmox.GetResource(node, vmid)
 	if err != nil {
@@ -243,12 +369,12 @@ func ManualStopResource(vmid int, node, triggeredBy string) error {
 	log.Printf("Manual stop requested for %s (VMID: %d, Type: %s) by %s",
 		resource.Name, vmid, resource.Type, triggeredBy)
 
-	go stopResource(vmid, resource.Name, node, resource.Type, "manual", triggeredBy)
+	go s.stopResource(vmid, resource.Name, node, resource.Type, "manual", triggeredBy)
 	return nil
 }
 
 // startResource starts a specific VM/Container and logs the operation
-func startResource(vmid int, resourceName, node, resourceType, triggerType, triggeredBy string) {
+func (s *Scheduler) startResource(vmid int, resourceName, node, resourceType, triggerType, triggeredBy string) {
 	// Create log entry
 	logEntry := &models.RestartLog{
 		VMID:         vmid,
@@ -261,7 +387,7 @@ func startResource(vmid int, resourceName, node, resourceType, triggerType, trig
 		StartedAt:    time.Now(),
 	}
 
-	logID, err := db.CreateRestartLog(logEntry)
+	logID, err := s.store.CreateRestartLog(logEntry)
 	if err != nil {
 		log.Printf("ERROR: Failed to create start log for %d: %v", vmid, err)
 		return
@@ -272,6 +398,9 @@ func startResource(vmid int, resourceName, node, resourceType, triggerType, trig
 	// Execute start
 	startTime := time.Now()
 	output, err := proxmox.StartResource(node, vmid, resourceType)
+	if err == nil {
+		err = awaitTask(logEntry, output)
+	}
 	duration := time.Since(startTime).Seconds()
 
 	// Update log entry
@@ -289,13 +418,13 @@ func startResource(vmid int, resourceName, node, resourceType, triggerType, trig
 		log.Printf("Successfully started resource %d (%s) in %.2fs", vmid, resourceName, duration)
 	}
 
-	if err := db.UpdateRestartLog(logEntry); err != nil {
+	if err := s.store.UpdateRestartLog(logEntry); err != nil {
 		log.Printf("ERROR: Failed to update start log: %v", err)
 	}
 }
 
 // ManualStartResource handles manual start requests
-func ManualStartResource(vmid int, node, triggeredBy string) error {
+func (s *Scheduler) ManualStartResource(vmid int, node, triggeredBy string) error {
 	// Get resource type from Proxmox
 	resource, err := proxmox.GetResource(node, vmid)
 	if err != nil {
@@ -308,6 +437,6 @@ func ManualStartResource(vmid int, node, triggeredBy string) error {
 	log.Printf("Manual start requested for %s (VMID: %d, Type: %s) by %s",
 		resource.Name, vmid, resource.Type, triggeredBy)
 
-	go startResource(vmid, resource.Name, node, resource.Type, "manual", triggeredBy)
+	go s.startResource(vmid, resource.Name, node, resource.Type, "manual", triggeredBy)
 	return nil
 }
@@ -0,0 +1,206 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+// testDB is the raw database behind the store, for tests that tweak state directly
+var testDB *db.Conn
+
+// setupTest returns a scheduler on an in-memory database and a fake cluster
+func setupTest(t *testing.T) (*Scheduler, *proxmox.FakeBackend) {
+	t.Helper()
+
+	conn, err := db.Open(":memory:")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.RunMigrations(conn); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	testDB = conn
+	s := New(db.NewStore(conn))
+
+	fake := proxmox.NewFakeBackend("pve1", "pve2")
+	fake.AddGuest(models.Resource{VMID: 101, Name: "db", Type: "lxc", Node: "pve1", Status: "running", Uptime: 7200})
+	fake.AddGuest(models.Resource{VMID: 102, Name: "app", Type: "qemu", Node: "pve2", Status: "running", Uptime: 7200})
+
+	previous := proxmox.GetBackend()
+	proxmox.SetBackend(fake)
+	proxmox.TaskPollInterval = time.Millisecond
+	SetVerifyConfig(VerifyConfig{Timeout: 50 * time.Millisecond, PollInterval: time.Millisecond})
+	s.SetQueueConfig(QueueConfig{})
+	SetCrashLoopConfig(CrashLoopConfig{MaxFailures: 3, Window: time.Hour, Backoff: time.Hour, MaxBackoff: 4 * time.Hour})
+	t.Cleanup(func() { proxmox.SetBackend(previous) })
+	return s, fake
+}
+
+// runScheduledRestarts runs one scheduler check and waits for the queued restarts
+func runScheduledRestarts(s *Scheduler) {
+	s.restartWhitelistedResources()
+	s.queue.waitIdle()
+}
+
+func addWhitelist(t *testing.T, s *Scheduler, vmid int, name, node string) {
+	t.Helper()
+	err := s.store.CreateWhitelist(&models.CreateWhitelistRequest{
+		VMID: vmid, ResourceName: name, Node: node, CreatedBy: "test", RestartIntervalHours: 6,
+	})
+	if err != nil {
+		t.Fatalf("CreateWhitelist: %v", err)
+	}
+}
+
+func logsFor(t *testing.T, s *Scheduler, vmid int) []models.RestartLog {
+	t.Helper()
+	logs, err := s.store.GetLogs(models.LogsFilter{VMID: vmid})
+	if err != nil {
+		t.Fatalf("GetLogs: %v", err)
+	}
+	return logs
+}
+
+// waitForLog polls until a log for vmid and action leaves the pending state
+func waitForLog(t *testing.T, s *Scheduler, vmid int, action string) models.RestartLog {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		logs, err := s.store.GetLogs(models.LogsFilter{VMID: vmid, Action: action})
+		if err != nil {
+			t.Fatalf("GetLogs: %v", err)
+		}
+		if len(logs) > 0 && logs[0].Status != "pending" {
+			return logs[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s log of %d", action, vmid)
+	return models.RestartLog{}
+}
+
+func TestRestartWhitelistedResources(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	addWhitelist(t, s, 999, "gone", "pve1")
+
+	runScheduledRestarts(s)
+
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 2 {
+		t.Fatalf("expected 2 restarts, got %d", got)
+	}
+	for _, vmid := range []int{101, 102} {
+		logs := logsFor(t, s, vmid)
+		if len(logs) != 1 {
+			t.Fatalf("expected 1 log for %d, got %d", vmid, len(logs))
+		}
+		if logs[0].Status != "success" || logs[0].TriggerType != "auto" || logs[0].TriggeredBy != "system" {
+			t.Errorf("unexpected log for %d: %+v", vmid, logs[0])
+		}
+	}
+	if logs := logsFor(t, s, 999); len(logs) != 0 {
+		t.Errorf("missing resource should not be restarted")
+	}
+}
+
+func TestRestartWhitelistedResourcesNotDue(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+
+	runScheduledRestarts(s)
+	runScheduledRestarts(s)
+
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 1 {
+		t.Errorf("second run should skip a resource restarted moments ago, got %d restarts", got)
+	}
+}
+
+func TestRestartFailureIsLogged(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	fake.InjectFailure(proxmox.OpRestartResource, 101, errors.New("lock timeout"))
+
+	runScheduledRestarts(s)
+
+	logs := logsFor(t, s, 101)
+	if len(logs) != 1 || logs[0].Status != "failed" {
+		t.Fatalf("expected one failed log, got %+v", logs)
+	}
+	if logs[0].ErrorMessage == "" {
+		t.Error("failed log should carry the error message")
+	}
+
+	// Failed restarts do not count as the last restart, so the next run retries
+	fake.ClearFailures()
+	runScheduledRestarts(s)
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 2 {
+		t.Errorf("expected retry after failure, got %d restarts", got)
+	}
+}
+
+func TestRestartWaitsForTask(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	fake.SetTaskPolls(5)
+
+	runScheduledRestarts(s)
+
+	logs := logsFor(t, s, 101)
+	if len(logs) != 1 || logs[0].Status != "success" {
+		t.Fatalf("expected one successful log, got %+v", logs)
+	}
+	if logs[0].UPID == "" || logs[0].ExitStatus != "OK" || logs[0].TaskLog == "" {
+		t.Errorf("task details not recorded: %+v", logs[0])
+	}
+	if got := fake.CallCount(proxmox.OpGetTaskStatus); got != 6 {
+		t.Errorf("expected 6 task status polls, got %d", got)
+	}
+}
+
+func TestRestartTaskFailure(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 102, "app", "pve2")
+	fake.InjectTaskFailure(102, "VM quit/powerdown failed")
+
+	runScheduledRestarts(s)
+
+	logs := logsFor(t, s, 102)
+	if len(logs) != 1 || logs[0].Status != "failed" {
+		t.Fatalf("a failed task must not be logged as success: %+v", logs)
+	}
+	if logs[0].ExitStatus != "VM quit/powerdown failed" {
+		t.Errorf("exit status not recorded: %+v", logs[0])
+	}
+}
+
+func TestManualActions(t *testing.T) {
+	s, fake := setupTest(t)
+
+	if err := s.ManualStopResource(101, "pve1", "alice"); err != nil {
+		t.Fatalf("ManualStopResource: %v", err)
+	}
+	if l := waitForLog(t, s, 101, "stop"); l.Status != "success" || l.TriggeredBy != "alice" {
+		t.Errorf("unexpected stop log %+v", l)
+	}
+	if g, _ := fake.Guest(101); g.Status != "stopped" {
+		t.Errorf("guest should be stopped, got %s", g.Status)
+	}
+
+	if err := s.ManualStartResource(101, "pve1", "alice"); err != nil {
+		t.Fatalf("ManualStartResource: %v", err)
+	}
+	if l := waitForLog(t, s, 101, "start"); l.Status != "success" {
+		t.Errorf("unexpected start log %+v", l)
+	}
+
+	if err := s.ManualRestartResource(101, "pve2", "alice"); err == nil {
+		t.Error("expected error for resource on the wrong node")
+	}
+}
@@ -0,0 +1,223 @@
+package scheduler
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/robfig/cron/v3"
+)
+
+// pruneBatchSize is how many logs are archived and deleted at a time
+const pruneBatchSize = 500
+
+// RetentionConfig controls which restart logs the pruner deletes
+type RetentionConfig struct {
+	// MaxAge deletes logs older than this; 0 keeps them
+	MaxAge time.Duration
+	// StatusMaxAge replaces MaxAge for logs with the given status; 0 keeps them
+	StatusMaxAge map[string]time.Duration
+	// MaxPerVMID keeps only the newest logs of each guest; 0 keeps all
+	MaxPerVMID int
+	// ArchiveDir receives gzipped JSONL copies of logs before they are
+	// deleted; empty deletes without archiving
+	ArchiveDir string
+}
+
+// PruneResult describes one pruning run
+type PruneResult struct {
+	StartedAt    time.Time `json:"started_at"`
+	Duration     string    `json:"duration"`
+	Deleted      int64     `json:"deleted"`
+	ArchiveFiles []string  `json:"archive_files,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// PruneStats summarizes pruning since the service started
+type PruneStats struct {
+	Runs         int          `json:"runs"`
+	TotalDeleted int64        `json:"total_deleted"`
+	LastRun      *PruneResult `json:"last_run,omitempty"`
+}
+
+var (
+	retentionConfig RetentionConfig
+	retentionMu     sync.Mutex
+)
+
+// SetRetentionConfig replaces the log retention settings
+func SetRetentionConfig(cfg RetentionConfig) {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	retentionConfig = cfg
+}
+
+// GetRetentionConfig returns the log retention settings
+func GetRetentionConfig() RetentionConfig {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	return retentionConfig
+}
+
+// GetPruneStats returns what the pruner has done so far
+func (s *Scheduler) GetPruneStats() PruneStats {
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+	return s.pruneStats
+}
+
+// Enabled reports whether any retention rule is set
+func (c RetentionConfig) Enabled() bool {
+	return c.MaxAge > 0 || c.MaxPerVMID > 0 || len(c.StatusMaxAge) > 0
+}
+
+// StartLogPruner prunes restart logs every interval
+func (s *Scheduler) StartLogPruner(interval time.Duration) error {
+	s.pruneCron = cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+
+	_, err := s.pruneCron.AddFunc(fmt.Sprintf("@every %s", interval), func() {
+		if _, err := s.PruneLogs(); err != nil {
+			log.Printf("ERROR: Failed to prune restart logs: %v", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	s.pruneCron.Start()
+	log.Printf("Restart log pruner started (interval: %s)", interval)
+	return nil
+}
+
+// StopLogPruner stops the restart log pruner
+func (s *Scheduler) StopLogPruner() {
+	if s.pruneCron != nil {
+		s.pruneCron.Stop()
+		s.pruneCron = nil
+		log.Println("Restart log pruner stopped")
+	}
+}
+
+// PruneLogs deletes the restart logs the retention settings no longer keep,
+// archiving each batch first when an archive directory is set
+func (s *Scheduler) PruneLogs() (PruneResult, error) {
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+
+	cfg := GetRetentionConfig()
+	result := PruneResult{StartedAt: time.Now()}
+	err := s.prune(cfg, &result)
+	result.Duration = time.Since(result.StartedAt).Round(time.Millisecond).String()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	s.pruneStats.Runs++
+	s.pruneStats.TotalDeleted += result.Deleted
+	s.pruneStats.LastRun = &result
+
+	if result.Deleted > 0 {
+		log.Printf("Pruned %d restart logs (%d archive files)", result.Deleted, len(result.ArchiveFiles))
+	}
+	return result, err
+}
+
+func (s *Scheduler) prune(cfg RetentionConfig, result *PruneResult) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	now := result.StartedAt
+	policy := models.LogRetention{KeepPerVMID: cfg.MaxPerVMID}
+	if cfg.MaxAge > 0 {
+		policy.Before = now.Add(-cfg.MaxAge)
+	}
+	if len(cfg.StatusMaxAge) > 0 {
+		policy.StatusBefore = make(map[string]time.Time)
+		for status, age := range cfg.StatusMaxAge {
+			var cutoff time.Time // zero keeps the status forever
+			if age > 0 {
+				cutoff = now.Add(-age)
+			}
+			policy.StatusBefore[status] = cutoff
+		}
+	}
+
+	for {
+		logs, err := s.store.FindPrunableLogs(policy, pruneBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to find logs to prune: %w", err)
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+
+		if cfg.ArchiveDir != "" {
+			path, err := archiveLogs(cfg.ArchiveDir, logs)
+			if err != nil {
+				return err
+			}
+			result.ArchiveFiles = append(result.ArchiveFiles, path)
+		}
+
+		ids := make([]int64, len(logs))
+		for i, l := range logs {
+			ids[i] = l.ID
+		}
+		deleted, err := s.store.DeleteRestartLogs(ids)
+		if err != nil {
+			return fmt.Errorf("failed to delete restart logs: %w", err)
+		}
+		result.Deleted += deleted
+		if deleted == 0 {
+			return nil
+		}
+	}
+}
+
+// archiveLogs writes logs to a new gzipped JSONL file in dir and returns its
+// path. The file is complete on disk before the logs are deleted.
+func archiveLogs(dir string, logs []models.RestartLog) (string, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	name := fmt.Sprintf("restart_logs-%s-%d.jsonl.gz", time.Now().UTC().Format("20060102T150405Z"), logs[0].ID)
+	path := filepath.Join(dir, name)
+
+	tmp, err := os.CreateTemp(dir, ".restart_logs-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	for _, l := range logs {
+		if err := enc.Encode(l); err != nil {
+			tmp.Close()
+			return "", fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to sync archive: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to close archive: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to move archive into place: %w", err)
+	}
+	return path, nil
+}
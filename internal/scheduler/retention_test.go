@@ -0,0 +1,143 @@
+package scheduler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+)
+
+// addLog records a finished restart of vmid that started age ago
+func addLog(t *testing.T, s *Scheduler, vmid int, status string, age time.Duration) int64 {
+	t.Helper()
+	id, err := s.store.CreateRestartLog(&models.RestartLog{
+		VMID: vmid, ResourceName: "guest", Node: "pve1", Action: "restart", TriggerType: "auto",
+		TriggeredBy: "scheduler", Status: status, StartedAt: time.Now().Add(-age),
+	})
+	if err != nil {
+		t.Fatalf("CreateRestartLog: %v", err)
+	}
+	return id
+}
+
+// remainingLogs returns the IDs of the logs left for vmid, newest first
+func remainingLogs(t *testing.T, s *Scheduler, vmid int) []int64 {
+	t.Helper()
+	var ids []int64
+	for _, l := range logsFor(t, s, vmid) {
+		ids = append(ids, l.ID)
+	}
+	return ids
+}
+
+func TestPruneByAge(t *testing.T) {
+	s, _ := setupTest(t)
+	SetRetentionConfig(RetentionConfig{MaxAge: 24 * time.Hour})
+	t.Cleanup(func() { SetRetentionConfig(RetentionConfig{}) })
+
+	addLog(t, s, 101, "success", 48*time.Hour)
+	pending := addLog(t, s, 101, "pending", 48*time.Hour)
+	recent := addLog(t, s, 101, "failed", time.Hour)
+
+	result, err := s.PruneLogs()
+	if err != nil {
+		t.Fatalf("PruneLogs: %v", err)
+	}
+	if result.Deleted != 1 {
+		t.Errorf("expected 1 deleted log, got %d", result.Deleted)
+	}
+	if got := remainingLogs(t, s, 101); len(got) != 2 || got[0] != recent || got[1] != pending {
+		t.Errorf("expected the recent and pending logs to remain, got %v", got)
+	}
+	if stats := s.GetPruneStats(); stats.Runs == 0 || stats.LastRun == nil || stats.LastRun.Deleted != 1 {
+		t.Errorf("unexpected prune stats %+v", stats)
+	}
+}
+
+func TestPruneByStatus(t *testing.T) {
+	s, _ := setupTest(t)
+	SetRetentionConfig(RetentionConfig{
+		MaxAge:       24 * time.Hour,
+		StatusMaxAge: map[string]time.Duration{"failed": 0, "skipped": time.Hour},
+	})
+	t.Cleanup(func() { SetRetentionConfig(RetentionConfig{}) })
+
+	failed := addLog(t, s, 101, "failed", 48*time.Hour)
+	addLog(t, s, 101, "success", 48*time.Hour)
+	addLog(t, s, 101, "skipped", 2*time.Hour)
+	success := addLog(t, s, 101, "success", 2*time.Hour)
+
+	if _, err := s.PruneLogs(); err != nil {
+		t.Fatalf("PruneLogs: %v", err)
+	}
+	if got := remainingLogs(t, s, 101); len(got) != 2 || got[0] != success || got[1] != failed {
+		t.Errorf("expected the old failure and recent success to remain, got %v", got)
+	}
+}
+
+func TestPruneKeepsNewestPerVMID(t *testing.T) {
+	s, _ := setupTest(t)
+	SetRetentionConfig(RetentionConfig{MaxPerVMID: 2})
+	t.Cleanup(func() { SetRetentionConfig(RetentionConfig{}) })
+
+	for i := 5; i > 0; i-- {
+		addLog(t, s, 101, "success", time.Duration(i)*time.Hour)
+	}
+	other := addLog(t, s, 102, "success", 10*time.Hour)
+
+	if _, err := s.PruneLogs(); err != nil {
+		t.Fatalf("PruneLogs: %v", err)
+	}
+	if got := remainingLogs(t, s, 101); len(got) != 2 {
+		t.Errorf("expected 2 logs left for 101, got %v", got)
+	}
+	if got := remainingLogs(t, s, 102); len(got) != 1 || got[0] != other {
+		t.Errorf("logs of another guest should be kept, got %v", got)
+	}
+}
+
+func TestPruneArchivesBeforeDeleting(t *testing.T) {
+	s, _ := setupTest(t)
+	dir := t.TempDir()
+	SetRetentionConfig(RetentionConfig{MaxAge: time.Hour, ArchiveDir: dir})
+	t.Cleanup(func() { SetRetentionConfig(RetentionConfig{}) })
+
+	id := addLog(t, s, 101, "success", 2*time.Hour)
+
+	result, err := s.PruneLogs()
+	if err != nil {
+		t.Fatalf("PruneLogs: %v", err)
+	}
+	if len(result.ArchiveFiles) != 1 {
+		t.Fatalf("expected one archive file, got %v", result.ArchiveFiles)
+	}
+
+	f, err := os.Open(result.ArchiveFiles[0])
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	var archived []models.RestartLog
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var l models.RestartLog
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			t.Fatalf("decode archived log: %v", err)
+		}
+		archived = append(archived, l)
+	}
+	if len(archived) != 1 || archived[0].ID != id || archived[0].VMID != 101 {
+		t.Errorf("unexpected archive contents %+v", archived)
+	}
+	if got := remainingLogs(t, s, 101); len(got) != 0 {
+		t.Errorf("archived log should be deleted, got %v", got)
+	}
+}
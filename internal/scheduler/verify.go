@@ -0,0 +1,147 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+// Verification results recorded on restart logs
+const (
+	VerificationPending          = "pending"
+	VerificationVerified         = "verified"
+	VerificationUnverified       = "unverified"
+	VerificationFailedToComeBack = "failed_to_come_back"
+)
+
+// uptimeSlack tolerates clock skew between this host and the PVE node when
+// deciding whether a guest's uptime has reset
+const uptimeSlack = 5 * time.Second
+
+// VerifyConfig controls the verification phase that runs after a restart
+type VerifyConfig struct {
+	// Timeout is how long to wait for the guest to come back; 0 disables verification
+	Timeout time.Duration
+	// PollInterval is the delay between status checks
+	PollInterval time.Duration
+	// Probe also requires a guest-agent ping (VMs) or pct exec (containers) to succeed
+	Probe bool
+}
+
+// defaultVerifyTimeout is how long verification waits unless configured
+const defaultVerifyTimeout = 5 * time.Minute
+
+var (
+	verifyMu     sync.RWMutex
+	verifyConfig = VerifyConfig{
+		Timeout:      defaultVerifyTimeout,
+		PollInterval: 5 * time.Second,
+	}
+)
+
+// SetVerifyConfig replaces the post-restart verification settings;
+// verifications already running keep the settings they started with
+func SetVerifyConfig(cfg VerifyConfig) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 5 * time.Second
+	}
+	verifyMu.Lock()
+	defer verifyMu.Unlock()
+	verifyConfig = cfg
+}
+
+func getVerifyConfig() VerifyConfig {
+	verifyMu.RLock()
+	defer verifyMu.RUnlock()
+	return verifyConfig
+}
+
+// groupVerifyConfig returns the verification settings for members of
+// wait_healthy groups, which are verified even when verification is disabled
+func groupVerifyConfig() VerifyConfig {
+	cfg := getVerifyConfig()
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultVerifyTimeout
+	}
+	return cfg
+}
+
+// verifyAfterRestart checks that a restarted guest came back, unless
+// verification is disabled
+func (s *Scheduler) verifyAfterRestart(logEntry *models.RestartLog, resourceType string, rebootedAt time.Time) {
+	cfg := getVerifyConfig()
+	if cfg.Timeout <= 0 {
+		return
+	}
+	s.verify(cfg, logEntry, resourceType, rebootedAt)
+}
+
+// verify records that verification is running, checks that the guest came
+// back, and stores the outcome on the log entry
+func (s *Scheduler) verify(cfg VerifyConfig, logEntry *models.RestartLog, resourceType string, rebootedAt time.Time) {
+	logEntry.Verification = VerificationPending
+	if err := s.store.UpdateRestartLog(logEntry); err != nil {
+		log.Printf("ERROR: Failed to update restart log: %v", err)
+	}
+
+	state, detail := verifyRestart(cfg, logEntry.Node, logEntry.VMID, resourceType, rebootedAt)
+	logEntry.Verification = state
+	logEntry.VerificationDetail = detail
+
+	if state == VerificationVerified {
+		log.Printf("Verified resource %d (%s) is back and running", logEntry.VMID, logEntry.ResourceName)
+	} else {
+		log.Printf("WARNING: Resource %d (%s) restart %s: %s", logEntry.VMID, logEntry.ResourceName, state, detail)
+	}
+
+	if err := s.store.UpdateRestartLog(logEntry); err != nil {
+		log.Printf("ERROR: Failed to update restart log: %v", err)
+	}
+}
+
+// verifyRestart polls a guest until it is running with a reset uptime (and,
+// if configured, answers a probe) or the timeout expires
+func verifyRestart(cfg VerifyConfig, node string, vmid int, resourceType string, rebootedAt time.Time) (string, string) {
+	deadline := time.Now().Add(cfg.Timeout)
+	cameBack := false
+	detail := ""
+
+	for {
+		resource, err := proxmox.GetResource(node, vmid)
+		switch {
+		case err != nil:
+			detail = err.Error()
+		case resource.Status != "running":
+			detail = fmt.Sprintf("status is %s", resource.Status)
+		case time.Duration(resource.Uptime)*time.Second > time.Since(rebootedAt)+uptimeSlack:
+			cameBack = true
+			detail = fmt.Sprintf("running but uptime %ds did not reset", resource.Uptime)
+		case !cfg.Probe:
+			return VerificationVerified, fmt.Sprintf("running, uptime %ds", resource.Uptime)
+		default:
+			cameBack = true
+			err := proxmox.ProbeGuest(node, vmid, resourceType)
+			if err == nil {
+				return VerificationVerified, fmt.Sprintf("running, uptime %ds, guest probe succeeded", resource.Uptime)
+			}
+			detail = fmt.Sprintf("running but guest probe failed: %v", err)
+			if errors.Is(err, proxmox.ErrNotSupported) {
+				// Retrying cannot help; the backend has no way to probe this guest
+				return VerificationUnverified, detail
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if cameBack {
+				return VerificationUnverified, detail
+			}
+			return VerificationFailedToComeBack, detail
+		}
+		time.Sleep(cfg.PollInterval)
+	}
+}
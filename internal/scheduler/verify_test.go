@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+func TestRestartVerified(t *testing.T) {
+	s, _ := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+
+	runScheduledRestarts(s)
+
+	logs := logsFor(t, s, 101)
+	if len(logs) != 1 || logs[0].Verification != VerificationVerified {
+		t.Fatalf("expected verified restart, got %+v", logs)
+	}
+}
+
+func TestRestartFailedToComeBack(t *testing.T) {
+	s, fake := setupTest(t)
+	addWhitelist(t, s, 101, "db", "pve1")
+	fake.SetRebootStatus(101, "stopped")
+
+	runScheduledRestarts(s)
+
+	logs := logsFor(t, s, 101)
+	if len(logs) != 1 {
+		t.Fatalf("expected one log, got %d", len(logs))
+	}
+	if logs[0].Status != "success" || logs[0].Verification != VerificationFailedToComeBack {
+		t.Errorf("expected successful task that failed to come back, got %+v", logs[0])
+	}
+	if logs[0].VerificationDetail != "status is stopped" {
+		t.Errorf("unexpected detail %q", logs[0].VerificationDetail)
+	}
+}
+
+func TestRestartProbe(t *testing.T) {
+	s, fake := setupTest(t)
+	SetVerifyConfig(VerifyConfig{Timeout: 20 * time.Millisecond, PollInterval: time.Millisecond, Probe: true})
+	addWhitelist(t, s, 101, "db", "pve1")
+	addWhitelist(t, s, 102, "app", "pve2")
+	fake.InjectFailure(proxmox.OpAgentPing, 102, errors.New("QEMU guest agent is not running"))
+
+	runScheduledRestarts(s)
+
+	if logs := logsFor(t, s, 101); logs[0].Verification != VerificationVerified {
+		t.Errorf("container probe should pass via pct exec, got %+v", logs[0])
+	}
+	if cmds := fake.Executed(101); len(cmds) == 0 {
+		t.Error("expected a probe command inside the container")
+	}
+
+	logs := logsFor(t, s, 102)
+	if logs[0].Verification != VerificationUnverified {
+		t.Errorf("failed agent ping should leave the restart unverified, got %+v", logs[0])
+	}
+}
+
+func TestVerificationDisabled(t *testing.T) {
+	s, _ := setupTest(t)
+	SetVerifyConfig(VerifyConfig{})
+	addWhitelist(t, s, 101, "db", "pve1")
+
+	runScheduledRestarts(s)
+
+	if logs := logsFor(t, s, 101); logs[0].Verification != "" {
+		t.Errorf("verification should be skipped, got %q", logs[0].Verification)
+	}
+}
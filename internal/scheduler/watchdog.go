@@ -0,0 +1,180 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+	"github.com/robfig/cron/v3"
+)
+
+// Whitelist restart modes
+const (
+	RestartModeSchedule = "schedule" // restarted by interval or cron expression
+	RestartModeWatchdog = "watchdog" // restarted only when a health check fails
+)
+
+// Health check states
+const (
+	probeOK      = "ok"
+	probeFailing = "failing"
+)
+
+// ValidateRestartMode checks a whitelist entry's restart mode; empty means schedule
+func ValidateRestartMode(mode string) error {
+	switch mode {
+	case "", RestartModeSchedule, RestartModeWatchdog:
+		return nil
+	}
+	return fmt.Errorf("restart_mode must be %s or %s", RestartModeSchedule, RestartModeWatchdog)
+}
+
+// StartWatchdog runs due health checks every interval
+func (s *Scheduler) StartWatchdog(interval time.Duration) error {
+	// A slow round of probes must not overlap with the next one
+	s.watchdogCron = cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+
+	_, err := s.watchdogCron.AddFunc(fmt.Sprintf("@every %s", interval), s.runHealthChecks)
+	if err != nil {
+		return err
+	}
+
+	s.watchdogCron.Start()
+	log.Printf("Health check watchdog started (interval: %s)", interval)
+	return nil
+}
+
+// StopWatchdog stops the health check watchdog
+func (s *Scheduler) StopWatchdog() {
+	if s.watchdogCron != nil {
+		s.watchdogCron.Stop()
+		s.watchdogCron = nil
+		log.Println("Health check watchdog stopped")
+	}
+}
+
+// runHealthChecks probes every health check whose interval has elapsed and
+// queues a restart for guests that failed too many times in a row
+func (s *Scheduler) runHealthChecks() {
+	checks, err := s.store.GetActiveHealthChecks()
+	if err != nil {
+		log.Printf("ERROR: Failed to get health checks: %v", err)
+		return
+	}
+	if len(checks) == 0 {
+		return
+	}
+
+	resources, err := proxmox.GetAllResources()
+	if err != nil {
+		log.Printf("ERROR: Failed to fetch resources from Proxmox: %v", err)
+		return
+	}
+	resourceMap := make(map[int]models.Resource)
+	for _, r := range resources {
+		resourceMap[r.VMID] = r
+	}
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, hc := range checks {
+		if hc.LastCheckedAt != nil && now.Sub(*hc.LastCheckedAt) < time.Duration(hc.IntervalSeconds)*time.Second {
+			continue
+		}
+
+		resource, exists := resourceMap[hc.VMID]
+		if !exists {
+			log.Printf("WARNING: Resource %d (%s) not found in Proxmox, skipping health check", hc.VMID, hc.ResourceName)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.checkHealth(hc, resource)
+		}()
+	}
+	wg.Wait()
+}
+
+// checkHealth runs one probe, updates its failure count and triggers a
+// restart once the failure threshold is reached outside the cooldown
+func (s *Scheduler) checkHealth(hc models.HealthCheck, resource models.Resource) {
+	now := time.Now()
+	hc.LastCheckedAt = &now
+
+	if resource.Status != "running" {
+		// A stopped guest was most likely stopped on purpose; leave it alone
+		hc.LastResult = fmt.Sprintf("guest is %s, not probed", resource.Status)
+		s.saveHealthCheck(&hc)
+		return
+	}
+
+	healthy, result := runProbe(hc, resource)
+	hc.LastResult = result
+	if healthy {
+		hc.LastStatus = probeOK
+		hc.ConsecutiveFailures = 0
+		s.saveHealthCheck(&hc)
+		return
+	}
+
+	hc.LastStatus = probeFailing
+	hc.ConsecutiveFailures++
+	log.Printf("WARNING: Health check %d (%s) for %d (%s) failed %d/%d: %s",
+		hc.ID, hc.Type, hc.VMID, hc.ResourceName, hc.ConsecutiveFailures, hc.FailureThreshold, result)
+
+	if hc.ConsecutiveFailures < hc.FailureThreshold {
+		s.saveHealthCheck(&hc)
+		return
+	}
+
+	cooldown := time.Duration(hc.CooldownMinutes) * time.Minute
+	if hc.LastTriggeredAt != nil && now.Sub(*hc.LastTriggeredAt) < cooldown {
+		log.Printf("Resource %d (%s) is unhealthy but was restarted by the watchdog %s ago (cooldown: %s)",
+			hc.VMID, hc.ResourceName, now.Sub(*hc.LastTriggeredAt).Round(time.Second), cooldown)
+		s.saveHealthCheck(&hc)
+		return
+	}
+
+	wl, err := s.store.GetWhitelistByID(hc.WhitelistID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get whitelist entry %d: %v", hc.WhitelistID, err)
+		s.saveHealthCheck(&hc)
+		return
+	}
+	if wl != nil && inBackoff(*wl, now) {
+		log.Printf("Resource %d (%s) is unhealthy but quarantined until %s, not restarting",
+			hc.VMID, hc.ResourceName, wl.QuarantinedUntil.Format(time.RFC3339))
+		s.saveHealthCheck(&hc)
+		return
+	}
+
+	probeResult := fmt.Sprintf("%s check failed %d times: %s", hc.Type, hc.ConsecutiveFailures, result)
+	queued := s.queue.enqueue(restartJob{
+		vmid:         hc.VMID,
+		resourceName: hc.ResourceName,
+		node:         resource.Node,
+		resourceType: resource.Type,
+		triggerType:  "health",
+		triggeredBy:  "watchdog",
+		probeResult:  probeResult,
+	})
+	if queued {
+		log.Printf("Resource %d (%s) %s, queued for restart", hc.VMID, hc.ResourceName, probeResult)
+		hc.LastTriggeredAt = &now
+		hc.ConsecutiveFailures = 0
+	} else {
+		log.Printf("Resource %d (%s) is already queued or restarting", hc.VMID, hc.ResourceName)
+	}
+	s.saveHealthCheck(&hc)
+}
+
+func (s *Scheduler) saveHealthCheck(hc *models.HealthCheck) {
+	if err := s.store.UpdateHealthCheckState(hc); err != nil {
+		log.Printf("ERROR: Failed to update health check %d: %v", hc.ID, err)
+	}
+}
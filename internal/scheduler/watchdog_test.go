@@ -0,0 +1,214 @@
+package scheduler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+// addWatchdogEntry whitelists a guest in watchdog mode and attaches a health check
+func addWatchdogEntry(t *testing.T, s *Scheduler, vmid int, name, node string, check models.HealthCheckRequest) int64 {
+	t.Helper()
+	err := s.store.CreateWhitelist(&models.CreateWhitelistRequest{
+		VMID: vmid, ResourceName: name, Node: node, CreatedBy: "test", RestartMode: RestartModeWatchdog,
+	})
+	if err != nil {
+		t.Fatalf("CreateWhitelist: %v", err)
+	}
+	entries, err := s.store.GetAllWhitelist()
+	if err != nil {
+		t.Fatalf("GetAllWhitelist: %v", err)
+	}
+	for _, wl := range entries {
+		if wl.VMID == vmid {
+			check.WhitelistID = wl.ID
+		}
+	}
+
+	if err := ValidateHealthCheck(&check); err != nil {
+		t.Fatalf("ValidateHealthCheck: %v", err)
+	}
+	id, err := s.store.CreateHealthCheck(&check)
+	if err != nil {
+		t.Fatalf("CreateHealthCheck: %v", err)
+	}
+	return id
+}
+
+// runWatchdog runs one round of health checks, ignoring their intervals, and
+// waits for any restarts they queued
+func runWatchdog(t *testing.T, s *Scheduler) {
+	t.Helper()
+	if _, err := testDB.Exec(`UPDATE health_checks SET last_checked_at = NULL`); err != nil {
+		t.Fatalf("reset last_checked_at: %v", err)
+	}
+	s.runHealthChecks()
+	s.queue.waitIdle()
+}
+
+func healthCheck(t *testing.T, s *Scheduler, id int64) *models.HealthCheck {
+	t.Helper()
+	hc, err := s.store.GetHealthCheckByID(id)
+	if err != nil || hc == nil {
+		t.Fatalf("GetHealthCheckByID: %v", err)
+	}
+	return hc
+}
+
+func TestWatchdogRestartsAfterThreshold(t *testing.T) {
+	s, fake := setupTest(t)
+	fake.AddGuest(models.Resource{VMID: 103, Name: "cache", Type: "lxc", Node: "pve1", Status: "running",
+		MemoryUsed: 98, MemoryTotal: 100})
+	id := addWatchdogEntry(t, s, 103, "cache", "pve1", models.HealthCheckRequest{
+		Type: ProbeMemory, Threshold: 95, FailureThreshold: 2,
+	})
+
+	runWatchdog(t, s)
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 0 {
+		t.Fatalf("restarted after one failure, want threshold of 2")
+	}
+	if hc := healthCheck(t, s, id); hc.ConsecutiveFailures != 1 || hc.LastStatus != probeFailing {
+		t.Errorf("unexpected check state %+v", hc)
+	}
+
+	runWatchdog(t, s)
+	logs := logsFor(t, s, 103)
+	if len(logs) != 1 {
+		t.Fatalf("expected one restart, got %d", len(logs))
+	}
+	if logs[0].TriggerType != "health" || logs[0].TriggeredBy != "watchdog" {
+		t.Errorf("unexpected trigger %q by %q", logs[0].TriggerType, logs[0].TriggeredBy)
+	}
+	if !strings.Contains(logs[0].ProbeResult, "memory at 98.0%") {
+		t.Errorf("probe result not recorded: %q", logs[0].ProbeResult)
+	}
+	if hc := healthCheck(t, s, id); hc.ConsecutiveFailures != 0 || hc.LastTriggeredAt == nil {
+		t.Errorf("check should reset after triggering, got %+v", hc)
+	}
+}
+
+func TestWatchdogCooldown(t *testing.T) {
+	s, fake := setupTest(t)
+	fake.AddGuest(models.Resource{VMID: 103, Name: "cache", Type: "lxc", Node: "pve1", Status: "running",
+		MemoryUsed: 98, MemoryTotal: 100})
+	addWatchdogEntry(t, s, 103, "cache", "pve1", models.HealthCheckRequest{
+		Type: ProbeMemory, Threshold: 95, FailureThreshold: 1, CooldownMinutes: 30,
+	})
+
+	for i := 0; i < 3; i++ {
+		runWatchdog(t, s)
+	}
+
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 1 {
+		t.Errorf("expected 1 restart within the cooldown, got %d", got)
+	}
+}
+
+func TestWatchdogHTTPProbe(t *testing.T) {
+	s, _ := setupTest(t)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	id := addWatchdogEntry(t, s, 101, "db", "pve1", models.HealthCheckRequest{Type: ProbeHTTP, Target: srv.URL})
+
+	runWatchdog(t, s)
+	if hc := healthCheck(t, s, id); hc.LastStatus != probeOK || !strings.Contains(hc.LastResult, "returned 200") {
+		t.Errorf("expected healthy check, got %+v", hc)
+	}
+
+	status = http.StatusServiceUnavailable
+	runWatchdog(t, s)
+	if hc := healthCheck(t, s, id); hc.LastStatus != probeFailing || hc.ConsecutiveFailures != 1 {
+		t.Errorf("expected failing check, got %+v", hc)
+	}
+}
+
+func TestWatchdogExecProbe(t *testing.T) {
+	s, fake := setupTest(t)
+	addWatchdogEntry(t, s, 101, "db", "pve1", models.HealthCheckRequest{
+		Type: ProbeExec, Target: "systemctl is-active postgresql", FailureThreshold: 1,
+	})
+	fake.InjectFailure(proxmox.OpExecuteInContainer, 101, errors.New("exit code 3"))
+
+	runWatchdog(t, s)
+
+	logs := logsFor(t, s, 101)
+	if len(logs) != 1 || !strings.Contains(logs[0].ProbeResult, "exit code 3") {
+		t.Fatalf("expected a watchdog restart with the exec result, got %+v", logs)
+	}
+}
+
+func TestWatchdogExecProbeTimeout(t *testing.T) {
+	s, fake := setupTest(t)
+	addWatchdogEntry(t, s, 101, "db", "pve1", models.HealthCheckRequest{
+		Type: ProbeExec, Target: "sleep infinity", TimeoutSeconds: 5, FailureThreshold: 1,
+	})
+	fake.SetExecTime(101, time.Minute)
+
+	runWatchdog(t, s)
+
+	logs := logsFor(t, s, 101)
+	if len(logs) != 1 || !strings.Contains(logs[0].ProbeResult, "timed out after 5s") {
+		t.Fatalf("expected a watchdog restart after the exec timed out, got %+v", logs)
+	}
+}
+
+func TestWatchdogSkipsStoppedGuests(t *testing.T) {
+	s, fake := setupTest(t)
+	id := addWatchdogEntry(t, s, 101, "db", "pve1", models.HealthCheckRequest{Type: ProbeTCP, Target: "127.0.0.1:1", FailureThreshold: 1})
+	fake.SetStatus(101, "stopped")
+
+	runWatchdog(t, s)
+
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 0 {
+		t.Errorf("stopped guest should not be restarted, got %d restarts", got)
+	}
+	if hc := healthCheck(t, s, id); hc.ConsecutiveFailures != 0 {
+		t.Errorf("stopped guest should not count as a failure, got %+v", hc)
+	}
+}
+
+func TestWatchdogModeSkipsSchedule(t *testing.T) {
+	s, fake := setupTest(t)
+	addWatchdogEntry(t, s, 101, "db", "pve1", models.HealthCheckRequest{Type: ProbeMemory, Threshold: 95})
+
+	runScheduledRestarts(s)
+
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 0 {
+		t.Errorf("watchdog-mode entry should not be restarted on schedule, got %d restarts", got)
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	tests := []struct {
+		req   models.HealthCheckRequest
+		valid bool
+	}{
+		{models.HealthCheckRequest{Type: ProbeHTTP, Target: "http://10.0.0.5/health"}, true},
+		{models.HealthCheckRequest{Type: ProbeHTTP}, false},
+		{models.HealthCheckRequest{Type: ProbeTCP, Target: "10.0.0.5:5432"}, true},
+		{models.HealthCheckRequest{Type: ProbeTCP, Target: "10.0.0.5"}, false},
+		{models.HealthCheckRequest{Type: ProbeMemory, Threshold: 95}, true},
+		{models.HealthCheckRequest{Type: ProbeCPU, Threshold: 150}, false},
+		{models.HealthCheckRequest{Type: "ping"}, false},
+	}
+
+	for _, tt := range tests {
+		req := tt.req
+		err := ValidateHealthCheck(&req)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateHealthCheck(%+v) = %v, want valid=%v", tt.req, err, tt.valid)
+		}
+		if err == nil && (req.IntervalSeconds != defaultProbeInterval || req.FailureThreshold != defaultFailureThreshold) {
+			t.Errorf("defaults not applied: %+v", req)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // whitelist timezones must resolve on hosts without zoneinfo
+
+	"github.com/rakib/proxmox-auto-restart/internal/db"
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/robfig/cron/v3"
+)
+
+// windowLayout is the clock format for maintenance window bounds
+const windowLayout = "15:04"
+
+// entrySchedule holds the parsed cron expression, maintenance window and
+// timezone of a whitelist entry
+type entrySchedule struct {
+	cron        cron.Schedule // nil when the entry uses restart_interval_hours
+	location    *time.Location
+	hasWindow   bool
+	windowStart time.Duration // offset from local midnight
+	windowEnd   time.Duration
+}
+
+// ValidateSchedule checks a whitelist entry's cron expression, maintenance
+// window and timezone. Empty values are allowed and mean "not set".
+func ValidateSchedule(cronExpression, windowStart, windowEnd, timezone string) error {
+	_, err := parseSchedule(models.Whitelist{
+		CronExpression: cronExpression,
+		WindowStart:    windowStart,
+		WindowEnd:      windowEnd,
+		Timezone:       timezone,
+	})
+	return err
+}
+
+func parseSchedule(wl models.Whitelist) (*entrySchedule, error) {
+	s := &entrySchedule{location: time.UTC}
+
+	if wl.Timezone != "" {
+		loc, err := time.LoadLocation(wl.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", wl.Timezone, err)
+		}
+		s.location = loc
+	}
+
+	if wl.CronExpression != "" {
+		sched, err := cron.ParseStandard(wl.CronExpression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", wl.CronExpression, err)
+		}
+		s.cron = sched
+	}
+
+	if wl.WindowStart != "" || wl.WindowEnd != "" {
+		if wl.WindowStart == "" || wl.WindowEnd == "" {
+			return nil, fmt.Errorf("window_start and window_end must be set together")
+		}
+		start, err := parseClock(wl.WindowStart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window_start: %w", err)
+		}
+		end, err := parseClock(wl.WindowEnd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window_end: %w", err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("window_start and window_end must differ")
+		}
+		s.hasWindow = true
+		s.windowStart = start
+		s.windowEnd = end
+	}
+
+	return s, nil
+}
+
+// parseClock converts "HH:MM" to an offset from midnight
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse(windowLayout, value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inWindow reports whether now falls inside the maintenance window. Windows
+// whose end is before their start wrap past midnight (e.g. 23:00-02:00).
+func (s *entrySchedule) inWindow(now time.Time) bool {
+	if !s.hasWindow {
+		return true
+	}
+
+	local := now.In(s.location)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second
+
+	if s.windowStart < s.windowEnd {
+		return offset >= s.windowStart && offset < s.windowEnd
+	}
+	return offset >= s.windowStart || offset < s.windowEnd
+}
+
+// isDue decides whether an entry should be restarted now and explains why.
+// With a cron expression the entry is due once a scheduled time has passed
+// since the last restart (or since the entry was created); otherwise it is
+// due when restart_interval_hours have elapsed. Either way the restart only
+// happens inside the maintenance window.
+func isDue(wl models.Whitelist, s *entrySchedule, lastRestart, now time.Time) (bool, string) {
+	var due bool
+	var reason string
+
+	if s.cron != nil {
+		reference := lastRestart
+		if reference.IsZero() {
+			reference = wl.CreatedAt
+		}
+		next := s.cron.Next(reference.In(s.location))
+		due = !next.After(now)
+		if due {
+			reason = fmt.Sprintf("scheduled run at %s (cron: %s)", next.Format(time.RFC3339), wl.CronExpression)
+		} else {
+			reason = fmt.Sprintf("next scheduled run at %s (cron: %s)", next.Format(time.RFC3339), wl.CronExpression)
+		}
+	} else {
+		intervalHours := wl.RestartIntervalHours
+		if intervalHours < 1 {
+			intervalHours = db.DefaultRestartInterval()
+		}
+
+		if lastRestart.IsZero() {
+			due = true
+			reason = "never been auto-restarted"
+		} else {
+			hoursSince := now.Sub(lastRestart).Hours()
+			due = hoursSince >= float64(intervalHours)
+			reason = fmt.Sprintf("last restarted %.1f hours ago, interval: %dh", hoursSince, intervalHours)
+		}
+	}
+
+	if due && !s.inWindow(now) {
+		return false, fmt.Sprintf("%s, but outside maintenance window %s-%s %s",
+			reason, wl.WindowStart, wl.WindowEnd, s.location)
+	}
+	return due, reason
+}
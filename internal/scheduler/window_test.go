@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rakib/proxmox-auto-restart/internal/models"
+	"github.com/rakib/proxmox-auto-restart/internal/proxmox"
+)
+
+func mustSchedule(t *testing.T, wl models.Whitelist) *entrySchedule {
+	t.Helper()
+	s, err := parseSchedule(wl)
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+	return s
+}
+
+func TestValidateSchedule(t *testing.T) {
+	valid := [][4]string{
+		{"", "", "", ""},
+		{"0 3 * * *", "", "", ""},
+		{"@daily", "02:00", "05:00", "Europe/Berlin"},
+		{"", "23:00", "01:30", "UTC"},
+	}
+	for _, v := range valid {
+		if err := ValidateSchedule(v[0], v[1], v[2], v[3]); err != nil {
+			t.Errorf("ValidateSchedule(%q) = %v", v, err)
+		}
+	}
+
+	invalid := [][4]string{
+		{"every day", "", "", ""},
+		{"", "02:00", "", ""},
+		{"", "2am", "5am", ""},
+		{"", "02:00", "02:00", ""},
+		{"", "", "", "Mars/Olympus"},
+	}
+	for _, v := range invalid {
+		if err := ValidateSchedule(v[0], v[1], v[2], v[3]); err == nil {
+			t.Errorf("ValidateSchedule(%q) should fail", v)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+
+	s := mustSchedule(t, models.Whitelist{WindowStart: "02:00", WindowEnd: "05:00"})
+	for _, c := range []struct {
+		t    time.Time
+		want bool
+	}{{at(1, 59), false}, {at(2, 0), true}, {at(4, 59), true}, {at(5, 0), false}, {at(14, 0), false}} {
+		if got := s.inWindow(c.t); got != c.want {
+			t.Errorf("inWindow(%s) = %v, want %v", c.t.Format("15:04"), got, c.want)
+		}
+	}
+
+	wrap := mustSchedule(t, models.Whitelist{WindowStart: "23:00", WindowEnd: "01:00"})
+	if !wrap.inWindow(at(23, 30)) || !wrap.inWindow(at(0, 30)) || wrap.inWindow(at(1, 0)) {
+		t.Error("window past midnight evaluated incorrectly")
+	}
+
+	// 02:00-05:00 in New York is 06:00-09:00 UTC during daylight saving time
+	ny := mustSchedule(t, models.Whitelist{WindowStart: "02:00", WindowEnd: "05:00", Timezone: "America/New_York"})
+	if ny.inWindow(at(3, 0)) || !ny.inWindow(at(7, 0)) {
+		t.Error("window should be evaluated in the entry's timezone")
+	}
+}
+
+func TestIsDueCron(t *testing.T) {
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	wl := models.Whitelist{CronExpression: "0 3 * * *", CreatedAt: created}
+	s := mustSchedule(t, wl)
+
+	if due, _ := isDue(wl, s, time.Time{}, created.Add(10*time.Hour)); due {
+		t.Error("not due before the first scheduled run")
+	}
+	if due, _ := isDue(wl, s, time.Time{}, time.Date(2024, 6, 2, 3, 10, 0, 0, time.UTC)); !due {
+		t.Error("due once the scheduled run has passed")
+	}
+	lastRestart := time.Date(2024, 6, 2, 3, 1, 0, 0, time.UTC)
+	if due, _ := isDue(wl, s, lastRestart, time.Date(2024, 6, 2, 15, 0, 0, 0, time.UTC)); due {
+		t.Error("not due again until the next day")
+	}
+}
+
+func TestIsDueInterval(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	wl := models.Whitelist{RestartIntervalHours: 6, WindowStart: "02:00", WindowEnd: "05:00"}
+	s := mustSchedule(t, wl)
+
+	if due, reason := isDue(wl, s, time.Time{}, now); due {
+		t.Errorf("never-restarted entry must still wait for its window: %s", reason)
+	}
+	if due, _ := isDue(wl, s, time.Time{}, time.Date(2024, 6, 2, 2, 30, 0, 0, time.UTC)); !due {
+		t.Error("due inside the window")
+	}
+}
+
+func TestRestartSkippedOutsideWindow(t *testing.T) {
+	s, fake := setupTest(t)
+
+	// A one-hour window starting two hours from now never contains now
+	start := time.Now().UTC().Add(2 * time.Hour)
+	err := s.store.CreateWhitelist(&models.CreateWhitelistRequest{
+		VMID: 101, ResourceName: "db", Node: "pve1", CreatedBy: "test",
+		WindowStart: start.Format("15:04"), WindowEnd: start.Add(time.Hour).Format("15:04"), Timezone: "UTC",
+	})
+	if err != nil {
+		t.Fatalf("CreateWhitelist: %v", err)
+	}
+
+	runScheduledRestarts(s)
+
+	if got := fake.CallCount(proxmox.OpRestartResource); got != 0 {
+		t.Errorf("restart outside the maintenance window: %d calls", got)
+	}
+}